@@ -24,6 +24,12 @@ type ClientAuth interface {
 	Handshake(io.ReadWriteCloser) error
 }
 
+// A ClientAuthConnUpgrader is a ClientAuth which replaces the connection during its handshake (e.g. VeNCrypt moving it
+// to TLS), it is used instead of Handshake and the returned connection carries the rest of the session.
+type ClientAuthConnUpgrader interface {
+	HandshakeConn(net.Conn) (net.Conn, error)
+}
+
 type ClientConn struct {
 	conn io.ReadWriteCloser
 
@@ -399,7 +405,17 @@ FindAuth:
 		return err
 	}
 
-	if err = auth.Handshake(c.conn); err != nil {
+	if upgrader, ok := auth.(ClientAuthConnUpgrader); ok {
+		nc, ok := c.conn.(net.Conn)
+		if !ok {
+			return fmt.Errorf("security type %d needs a net.Conn", auth.SecurityType())
+		}
+		upgraded, err := upgrader.HandshakeConn(nc)
+		if err != nil {
+			return err
+		}
+		c.conn = upgraded
+	} else if err = auth.Handshake(c.conn); err != nil {
 		return err
 	}
 
@@ -489,6 +505,8 @@ func (c *ClientConn) mainLoop() {
 
 	defer func() {
 		logger.Warn("ClientConn.MainLoop: exiting!")
+		//the stream can't be resumed after an error, release the connection before letting the listeners know
+		c.conn.Close()
 		c.Listeners.Consume(&common.RfbSegment{
 			SegmentType: common.SegmentConnectionClosed,
 		})
@@ -517,6 +535,12 @@ func (c *ClientConn) mainLoop() {
 			break
 		}
 		logger.Debugf("ClientConn.MainLoop: read & parsed ServerMessage:%d, %s", parsedMsg.Type(), parsedMsg)
+
+		//let listeners that work on whole messages (rather than on the byte stream) see the parsed result
+		c.Listeners.Consume(&common.RfbSegment{
+			SegmentType: common.SegmentFullyParsedServerMessage,
+			Message:     parsedMsg,
+		})
 	}
 }
 
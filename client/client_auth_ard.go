@@ -0,0 +1,101 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// maxARDKeyLength limits the Diffie-Hellman key length a server can announce (macOS uses 128 bytes)
+const maxARDKeyLength = 1024
+
+// ARDAuth is Apple Remote Desktop authentication (security type 30) used by macOS Screen Sharing,
+// it logs in with a macOS user account. The credentials are AES encrypted with a key agreed by Diffie-Hellman.
+type ARDAuth struct {
+	Username string
+	Password string
+}
+
+func (*ARDAuth) SecurityType() uint8 {
+	return 30
+}
+
+func (auth *ARDAuth) Handshake(c io.ReadWriteCloser) error {
+	var header struct {
+		Generator uint16
+		KeyLength uint16
+	}
+	if err := binary.Read(c, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.KeyLength == 0 || header.KeyLength > maxARDKeyLength {
+		return errors.New("ARD: invalid key length")
+	}
+	prime := make([]byte, header.KeyLength)
+	serverPub := make([]byte, header.KeyLength)
+	if _, err := io.ReadFull(c, prime); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, serverPub); err != nil {
+		return err
+	}
+
+	pub, shared, err := dhExchange(new(big.Int).SetUint64(uint64(header.Generator)), new(big.Int).SetBytes(prime), new(big.Int).SetBytes(serverPub))
+	if err != nil {
+		return err
+	}
+	key := md5.Sum(padBytes(shared.Bytes(), int(header.KeyLength)))
+
+	// username & password take 64 bytes each (null terminated), the rest is random
+	credentials := make([]byte, 128)
+	if _, err := rand.Read(credentials); err != nil {
+		return err
+	}
+	n := copy(credentials[:63], auth.Username)
+	credentials[n] = 0
+	n = copy(credentials[64:127], auth.Password)
+	credentials[64+n] = 0
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(credentials); i += block.BlockSize() {
+		block.Encrypt(credentials[i:], credentials[i:])
+	}
+
+	if _, err := c.Write(credentials); err != nil {
+		return err
+	}
+	_, err = c.Write(padBytes(pub.Bytes(), int(header.KeyLength)))
+	return err
+}
+
+// dhExchange creates a Diffie-Hellman key pair for generator & prime, it returns the public key & the secret shared with serverPub
+func dhExchange(generator *big.Int, prime *big.Int, serverPub *big.Int) (*big.Int, *big.Int, error) {
+	if prime.Cmp(big.NewInt(2)) <= 0 {
+		return nil, nil, errors.New("invalid Diffie-Hellman prime")
+	}
+	priv, err := rand.Int(rand.Reader, new(big.Int).Sub(prime, big.NewInt(2)))
+	if err != nil {
+		return nil, nil, err
+	}
+	priv.Add(priv, big.NewInt(1))
+	pub := new(big.Int).Exp(generator, priv, prime)
+	shared := new(big.Int).Exp(serverPub, priv, prime)
+	return pub, shared, nil
+}
+
+// padBytes left pads a big endian number to length bytes
+func padBytes(b []byte, length int) []byte {
+	if len(b) >= length {
+		return b
+	}
+	padded := make([]byte, length)
+	copy(padded[length-len(b):], b)
+	return padded
+}
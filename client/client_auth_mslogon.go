@@ -0,0 +1,87 @@
+package client
+
+import (
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/big"
+)
+
+// MSLogonIIAuth is UltraVNC's MS-Logon II authentication (security type 113), it logs in with a windows account
+// (the username can be "DOMAIN\user"). The credentials are DES encrypted with a key agreed by Diffie-Hellman.
+type MSLogonIIAuth struct {
+	Username string
+	Password string
+}
+
+func (*MSLogonIIAuth) SecurityType() uint8 {
+	return 113
+}
+
+func (auth *MSLogonIIAuth) Handshake(c io.ReadWriteCloser) error {
+	var params struct {
+		Generator uint64
+		Modulus   uint64
+		ServerPub uint64
+	}
+	if err := binary.Read(c, binary.BigEndian, &params); err != nil {
+		return err
+	}
+
+	pub, shared, err := dhExchange(new(big.Int).SetUint64(params.Generator), new(big.Int).SetUint64(params.Modulus), new(big.Int).SetUint64(params.ServerPub))
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, shared.Uint64())
+
+	// null terminated strings in fixed size fields, the rest is random
+	username := make([]byte, 256)
+	password := make([]byte, 64)
+	if _, err := rand.Read(username); err != nil {
+		return err
+	}
+	if _, err := rand.Read(password); err != nil {
+		return err
+	}
+	username[copy(username[:255], auth.Username)] = 0
+	password[copy(password[:63], auth.Password)] = 0
+	if err := msLogonEncrypt(username, key); err != nil {
+		return err
+	}
+	if err := msLogonEncrypt(password, key); err != nil {
+		return err
+	}
+
+	if err := binary.Write(c, binary.BigEndian, pub.Uint64()); err != nil {
+		return err
+	}
+	if _, err := c.Write(username); err != nil {
+		return err
+	}
+	_, err = c.Write(password)
+	return err
+}
+
+// msLogonEncrypt encrypts b in place like UltraVNC's vncEncryptBytes2: DES in CBC mode,
+// the key (bit reversed, as in vnc authentication) is also the IV
+func msLogonEncrypt(b []byte, key []byte) error {
+	desKey := make([]byte, len(key))
+	for i := range key {
+		desKey[i] = (&PasswordAuth{}).reverseBits(key[i])
+	}
+	block, err := des.NewCipher(desKey)
+	if err != nil {
+		return err
+	}
+	prev := key
+	for i := 0; i < len(b); i += block.BlockSize() {
+		for j := 0; j < block.BlockSize(); j++ {
+			b[i+j] ^= prev[j]
+		}
+		block.Encrypt(b[i:], b[i:])
+		prev = b[i : i+block.BlockSize()]
+	}
+	return nil
+}
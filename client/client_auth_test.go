@@ -2,6 +2,12 @@ package client
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/des"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"math/big"
 	"net"
 	"testing"
 	"time"
@@ -167,3 +173,97 @@ func TestClientAuthPasswordReject_Impl(t *testing.T) {
 		t.Fatal("PasswordAuth didn't complete properly")
 	}
 }
+
+// cString returns the null terminated string at the start of b
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+func TestClientAuthARD(t *testing.T) {
+	// the 1024 bit MODP group (rfc 2409), as sent by macOS
+	prime, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 16)
+	const keyLength = 128
+	c, srv := tcpPair(t)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- (&ARDAuth{Username: "admin", Password: "secret"}).Handshake(c)
+	}()
+
+	serverPriv := big.NewInt(123456789)
+	serverPub := new(big.Int).Exp(big.NewInt(2), serverPriv, prime)
+	binary.Write(srv, binary.BigEndian, []uint16{2, keyLength})
+	srv.Write(padBytes(prime.Bytes(), keyLength))
+	srv.Write(padBytes(serverPub.Bytes(), keyLength))
+
+	credentials := make([]byte, 128)
+	clientPub := make([]byte, keyLength)
+	io.ReadFull(srv, credentials)
+	io.ReadFull(srv, clientPub)
+	if err := <-done; err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	shared := new(big.Int).Exp(new(big.Int).SetBytes(clientPub), serverPriv, prime)
+	key := md5.Sum(padBytes(shared.Bytes(), keyLength))
+	block, _ := aes.NewCipher(key[:])
+	for i := 0; i < len(credentials); i += block.BlockSize() {
+		block.Decrypt(credentials[i:], credentials[i:])
+	}
+	if user, pass := cString(credentials[:64]), cString(credentials[64:]); user != "admin" || pass != "secret" {
+		t.Errorf("unexpected credentials: %q %q", user, pass)
+	}
+}
+
+func TestClientAuthMSLogonII(t *testing.T) {
+	const generator, modulus = 5, 18446744073709551557 // the largest 64 bit prime
+	c, srv := tcpPair(t)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- (&MSLogonIIAuth{Username: `DOMAIN\user`, Password: "secret"}).Handshake(c)
+	}()
+
+	mod := new(big.Int).SetUint64(modulus)
+	serverPriv := big.NewInt(987654321)
+	serverPub := new(big.Int).Exp(big.NewInt(generator), serverPriv, mod)
+	binary.Write(srv, binary.BigEndian, []uint64{generator, modulus, serverPub.Uint64()})
+
+	var clientPub uint64
+	username := make([]byte, 256)
+	password := make([]byte, 64)
+	binary.Read(srv, binary.BigEndian, &clientPub)
+	io.ReadFull(srv, username)
+	io.ReadFull(srv, password)
+	if err := <-done; err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	shared := new(big.Int).Exp(new(big.Int).SetUint64(clientPub), serverPriv, mod)
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, shared.Uint64())
+	decrypt := func(b []byte) string {
+		desKey := make([]byte, 8)
+		for i := range key {
+			desKey[i] = (&PasswordAuth{}).reverseBits(key[i])
+		}
+		block, _ := des.NewCipher(desKey)
+		plain := make([]byte, len(b))
+		prev := key
+		for i := 0; i < len(b); i += 8 {
+			block.Decrypt(plain[i:], b[i:])
+			for j := 0; j < 8; j++ {
+				plain[i+j] ^= prev[j]
+			}
+			prev = b[i : i+8]
+		}
+		return cString(plain)
+	}
+	if user, pass := decrypt(username), decrypt(password); user != `DOMAIN\user` || pass != "secret" {
+		t.Errorf("unexpected credentials: %q %q", user, pass)
+	}
+}
@@ -0,0 +1,21 @@
+package client
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// ConnectRepeater asks the UltraVNC repeater c is connected to for the vnc server with the given id ("ID:1234",
+// or "host:port" for repeaters in mode I). the RFB handshake with the server follows on c (see ClientConn.Connect)
+func ConnectRepeater(c io.ReadWriter, id string) error {
+	greeting := make([]byte, len(common.RepeaterGreeting))
+	if _, err := io.ReadFull(c, greeting); err != nil {
+		return err
+	}
+	if string(greeting) != common.RepeaterGreeting {
+		return fmt.Errorf("not an UltraVNC repeater, got greeting %q", greeting)
+	}
+	return common.WriteRepeaterID(c, id)
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// VeNCryptSubType identifies the authentication scheme used inside VeNCrypt
+type VeNCryptSubType uint32
+
+const (
+	SecSubTypeVeNCrypt02Plain     = VeNCryptSubType(256)
+	SecSubTypeVeNCrypt02TLSNone   = VeNCryptSubType(257)
+	SecSubTypeVeNCrypt02TLSVNC    = VeNCryptSubType(258)
+	SecSubTypeVeNCrypt02TLSPlain  = VeNCryptSubType(259)
+	SecSubTypeVeNCrypt02X509None  = VeNCryptSubType(260)
+	SecSubTypeVeNCrypt02X509VNC   = VeNCryptSubType(261)
+	SecSubTypeVeNCrypt02X509Plain = VeNCryptSubType(262)
+)
+
+// the sub types used when VeNCryptAuth.SubTypes is empty, Plain (credentials sent without encryption) is left out
+// and so are the TLS* ones when VeNCryptAuth.TLSConfig has a CA or a client certificate
+var defaultVeNCryptSubTypes = []VeNCryptSubType{
+	SecSubTypeVeNCrypt02X509Plain,
+	SecSubTypeVeNCrypt02X509VNC,
+	SecSubTypeVeNCrypt02X509None,
+	SecSubTypeVeNCrypt02TLSPlain,
+	SecSubTypeVeNCrypt02TLSVNC,
+	SecSubTypeVeNCrypt02TLSNone,
+}
+
+func (st VeNCryptSubType) usesTLS() bool {
+	return st != SecSubTypeVeNCrypt02Plain
+}
+
+// usesPlain reports if the sub type authenticates with a username & password
+func (st VeNCryptSubType) usesPlain() bool {
+	return st == SecSubTypeVeNCrypt02Plain || st == SecSubTypeVeNCrypt02TLSPlain || st == SecSubTypeVeNCrypt02X509Plain
+}
+
+// usesX509 reports if the server's certificate is verified (the TLS* sub types are meant to be anonymous)
+func (st VeNCryptSubType) usesX509() bool {
+	return st >= SecSubTypeVeNCrypt02X509None
+}
+
+// VeNCryptAuth is the VeNCrypt security type (version 0.2), see https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#vencrypt
+// the TLS* & X509* sub types move the connection to TLS before authenticating, ClientConn keeps using the encrypted
+// connection for the rest of the session.
+// Go has no anonymous TLS cipher suites, so the TLS* sub types only work with servers which present a certificate,
+// it is not verified. The X509* sub types verify it using TLSConfig.
+// TLSPlain would send the username & password to whoever answers, it is only used with InsecurePlain.
+type VeNCryptAuth struct {
+	// accepted sub types in order of preference, the first one also offered by the server is used
+	// (defaults to all but Plain, and only the X509* ones when TLSConfig has RootCAs or Certificates)
+	SubTypes []VeNCryptSubType
+	// RootCAs verifies the server for the X509* sub types, Certificates are sent when the server asks for a client certificate.
+	// if ServerName is empty the server's address is used
+	TLSConfig *tls.Config
+	Username  string // for the *Plain sub types, which are skipped when it is empty (the *VNC ones use Password)
+	Password  string // for the *Plain & *VNC sub types
+	// allow TLSPlain, sending the credentials over TLS without verifying the server's certificate
+	InsecurePlain bool
+}
+
+func (*VeNCryptAuth) SecurityType() uint8 {
+	return 19
+}
+
+// Handshake can't replace the connection, so only the Plain sub type can be used through it
+func (auth *VeNCryptAuth) Handshake(c io.ReadWriteCloser) error {
+	_, err := auth.handshake(c, nil)
+	return err
+}
+
+// HandshakeConn runs the VeNCrypt handshake, returning the (TLS) connection the session continues on
+func (auth *VeNCryptAuth) HandshakeConn(c net.Conn) (net.Conn, error) {
+	conn, err := auth.handshake(c, c)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(net.Conn), nil
+}
+
+// handshake negotiates a sub type & authenticates, sub types using TLS are only picked when nc is given
+func (auth *VeNCryptAuth) handshake(c io.ReadWriteCloser, nc net.Conn) (io.ReadWriteCloser, error) {
+	var version [2]uint8
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version[0] != 0 || version[1] < 2 {
+		return nil, fmt.Errorf("VeNCrypt: unsupported version %d.%d", version[0], version[1])
+	}
+	if err := binary.Write(c, binary.BigEndian, []uint8{0, 2}); err != nil {
+		return nil, err
+	}
+	var status uint8
+	if err := binary.Read(c, binary.BigEndian, &status); err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		return nil, errors.New("VeNCrypt: the server rejected version 0.2")
+	}
+
+	var count uint8
+	if err := binary.Read(c, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	offered := make([]VeNCryptSubType, count)
+	if err := binary.Read(c, binary.BigEndian, offered); err != nil {
+		return nil, err
+	}
+	subType, err := auth.pickSubType(offered, nc != nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := binary.Write(c, binary.BigEndian, subType); err != nil {
+		return nil, err
+	}
+
+	if subType.usesTLS() {
+		var ack uint8
+		if err := binary.Read(c, binary.BigEndian, &ack); err != nil {
+			return nil, err
+		}
+		if ack != 1 {
+			return nil, fmt.Errorf("VeNCrypt: the server rejected sub type %d", subType)
+		}
+		tlsConn := tls.Client(nc, auth.tlsConfig(subType, nc))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("VeNCrypt: TLS handshake failed: %v", err)
+		}
+		c = tlsConn
+	}
+
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02X509VNC:
+		if err := (&PasswordAuth{Password: auth.Password}).Handshake(c); err != nil {
+			return nil, err
+		}
+	case SecSubTypeVeNCrypt02Plain, SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509Plain:
+		lengths := []uint32{uint32(len(auth.Username)), uint32(len(auth.Password))}
+		if err := binary.Write(c, binary.BigEndian, lengths); err != nil {
+			return nil, err
+		}
+		if _, err := c.Write([]byte(auth.Username + auth.Password)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (auth *VeNCryptAuth) pickSubType(offered []VeNCryptSubType, canUseTLS bool) (VeNCryptSubType, error) {
+	accepted := auth.SubTypes
+	if len(accepted) == 0 {
+		accepted = defaultVeNCryptSubTypes
+	}
+	// with a CA or a client certificate configured the server is expected to be verified
+	verify := auth.TLSConfig != nil && (auth.TLSConfig.RootCAs != nil || len(auth.TLSConfig.Certificates) > 0)
+	for _, st := range accepted {
+		if (st.usesTLS() && !canUseTLS) || (st.usesPlain() && auth.Username == "") {
+			continue
+		}
+		if st == SecSubTypeVeNCrypt02TLSPlain && !auth.InsecurePlain {
+			continue
+		}
+		if verify && len(auth.SubTypes) == 0 && st.usesTLS() && !st.usesX509() {
+			continue
+		}
+		for _, o := range offered {
+			if o == st {
+				return st, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("VeNCrypt: no suitable sub type, server supported: %v", offered)
+}
+
+func (auth *VeNCryptAuth) tlsConfig(subType VeNCryptSubType, nc net.Conn) *tls.Config {
+	var cfg *tls.Config
+	if auth.TLSConfig != nil {
+		cfg = auth.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if !subType.usesX509() {
+		cfg.InsecureSkipVerify = true
+	}
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(nc.RemoteAddr().String()); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg
+}
+
+// NewTLSConfig creates a TLS configuration for VeNCryptAuth, caFile (PEM) replaces the system's trusted roots
+// and certFile & keyFile are the client certificate, each of them can be left empty
+func NewTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/server"
+)
+
+// testCert creates a self signed certificate for the host name "vncserver", returning it & a pool trusting it
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vncserver"},
+		DNSNames:              []string{"vncserver"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	parsed, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// tcpPair returns both ends of a loopback tcp connection, unlike net.Pipe it buffers writes
+// which TLS needs (both sides can write at the same time during the handshake)
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	return c2, c1
+}
+
+// veNCryptHandshake runs auth against the server's VeNCrypt handler,
+// it returns both connections after the handshake & both results
+func veNCryptHandshake(t *testing.T, auth *VeNCryptAuth, srvAuth *server.ServerAuthVeNCrypt) (net.Conn, *server.ServerConn, error, error) {
+	c1, c2 := tcpPair(t)
+	sconn, err := server.NewServerConn(c1, &server.ServerConfig{ClientMessages: server.DefaultClientMessages})
+	if err != nil {
+		t.Fatalf("error creating server conn: %v", err)
+	}
+	srvResult := make(chan error, 1)
+	go func() {
+		err := srvAuth.Auth(sconn)
+		if err != nil {
+			c1.Close()
+		}
+		srvResult <- err
+	}()
+
+	conn, err := auth.HandshakeConn(c2)
+	if err != nil {
+		c2.Close()
+	}
+	return conn, sconn, err, <-srvResult
+}
+
+func TestVeNCryptAuth_Impl(t *testing.T) {
+	var raw interface{} = new(VeNCryptAuth)
+	if _, ok := raw.(ClientAuthConnUpgrader); !ok {
+		t.Fatal("VeNCryptAuth doesn't implement ClientAuthConnUpgrader")
+	}
+}
+
+func TestVeNCryptX509Plain(t *testing.T) {
+	cert, pool := testCert(t)
+	var gotUser, gotPass string
+	srvAuth := &server.ServerAuthVeNCrypt{
+		SubTypes:  []server.SecuritySubType{server.SecSubTypeVeNCrypt02Plain, server.SecSubTypeVeNCrypt02X509Plain},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Verify: func(username string, password string) error {
+			gotUser, gotPass = username, password
+			return nil
+		},
+	}
+	auth := &VeNCryptAuth{
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "vncserver"},
+		Username:  "user",
+		Password:  "secret",
+	}
+	conn, sconn, err, srvErr := veNCryptHandshake(t, auth, srvAuth)
+	if err != nil || srvErr != nil {
+		t.Fatalf("handshake failed: client=%v server=%v", err, srvErr)
+	}
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("the connection wasn't moved to TLS: %T", conn)
+	}
+	if gotUser != "user" || gotPass != "secret" {
+		t.Errorf("unexpected credentials: %q %q", gotUser, gotPass)
+	}
+
+	// the rest of the session goes over TLS
+	go binary.Write(sconn, binary.BigEndian, uint32(42))
+	var value uint32
+	if err := binary.Read(conn, binary.BigEndian, &value); err != nil || value != 42 {
+		t.Errorf("error reading after the handshake: %d %v", value, err)
+	}
+}
+
+func TestVeNCryptUntrustedServer(t *testing.T) {
+	cert, _ := testCert(t)
+	_, otherPool := testCert(t)
+	srvAuth := &server.ServerAuthVeNCrypt{
+		SubTypes:  []server.SecuritySubType{server.SecSubTypeVeNCrypt02X509None},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	auth := &VeNCryptAuth{TLSConfig: &tls.Config{RootCAs: otherPool, ServerName: "vncserver"}}
+	if _, _, err, _ := veNCryptHandshake(t, auth, srvAuth); err == nil {
+		t.Fatal("handshake succeeded with an untrusted server certificate")
+	}
+
+	// the TLS* sub types don't verify the certificate, so they aren't used by default when a CA is configured
+	srvAuth.SubTypes = []server.SecuritySubType{server.SecSubTypeVeNCrypt02TLSNone}
+	if _, _, err, _ := veNCryptHandshake(t, auth, srvAuth); err == nil {
+		t.Fatal("TLSNone was used with a CA configured")
+	}
+	if _, _, err, srvErr := veNCryptHandshake(t, &VeNCryptAuth{}, srvAuth); err != nil || srvErr != nil {
+		t.Fatalf("TLSNone handshake failed: client=%v server=%v", err, srvErr)
+	}
+}
+
+func TestVeNCryptTLSPlain(t *testing.T) {
+	offered := []VeNCryptSubType{SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02TLSVNC}
+	auth := &VeNCryptAuth{Username: "user", Password: "secret"}
+	if st, err := auth.pickSubType(offered, true); err != nil || st != SecSubTypeVeNCrypt02TLSVNC {
+		t.Fatalf("expected TLSVNC without InsecurePlain, got %d (%v)", st, err)
+	}
+	// listing it isn't enough to send the credentials unverified
+	auth.SubTypes = []VeNCryptSubType{SecSubTypeVeNCrypt02TLSPlain}
+	if _, err := auth.pickSubType(offered, true); err == nil {
+		t.Fatal("TLSPlain was picked without InsecurePlain")
+	}
+	auth.InsecurePlain = true
+	if st, err := auth.pickSubType(offered, true); err != nil || st != SecSubTypeVeNCrypt02TLSPlain {
+		t.Fatalf("expected TLSPlain with InsecurePlain, got %d (%v)", st, err)
+	}
+}
+
+func TestVeNCryptPlainWithoutUpgrade(t *testing.T) {
+	srvAuth := &server.ServerAuthVeNCrypt{
+		SubTypes: []server.SecuritySubType{server.SecSubTypeVeNCrypt02X509VNC, server.SecSubTypeVeNCrypt02Plain},
+		Verify:   server.StaticCredentials("user", "secret"),
+	}
+	auth := &VeNCryptAuth{
+		SubTypes: []VeNCryptSubType{SecSubTypeVeNCrypt02X509VNC, SecSubTypeVeNCrypt02Plain},
+		Username: "user",
+		Password: "secret",
+	}
+
+	c1, c2 := tcpPair(t)
+	sconn, err := server.NewServerConn(c1, &server.ServerConfig{ClientMessages: server.DefaultClientMessages})
+	if err != nil {
+		t.Fatalf("error creating server conn: %v", err)
+	}
+	srvResult := make(chan error, 1)
+	go func() { srvResult <- srvAuth.Auth(sconn) }()
+
+	// Handshake can't replace the connection, so it falls back to Plain
+	if err := auth.Handshake(c2); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if err := <-srvResult; err != nil {
+		t.Fatalf("server rejected the credentials: %v", err)
+	}
+}
+
+func TestVeNCryptSubTypeWithoutUsername(t *testing.T) {
+	offered := []VeNCryptSubType{SecSubTypeVeNCrypt02X509Plain, SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509VNC}
+	auth := &VeNCryptAuth{Password: "secret"}
+	if st, err := auth.pickSubType(offered, true); err != nil || st != SecSubTypeVeNCrypt02X509VNC {
+		t.Fatalf("expected X509VNC without a username, got %d (%v)", st, err)
+	}
+	auth.Username = "user"
+	if st, err := auth.pickSubType(offered, true); err != nil || st != SecSubTypeVeNCrypt02X509Plain {
+		t.Fatalf("expected X509Plain with a username, got %d (%v)", st, err)
+	}
+	if _, err := (&VeNCryptAuth{}).pickSubType(offered[:2], true); err == nil {
+		t.Fatalf("a Plain sub type was picked without a username")
+	}
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"encoding/binary"
+	"image/color"
+)
+
+// BytesPerPixel returns the size of a single pixel on the wire
+func (pf *PixelFormat) BytesPerPixel() int {
+	return int(pf.BPP) / 8
+}
+
+func (pf *PixelFormat) byteOrder() binary.ByteOrder {
+	if pf.BigEndian != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// ReadPixel reads a single pixel value (BytesPerPixel bytes) from buf
+func (pf *PixelFormat) ReadPixel(buf []byte) uint32 {
+	switch pf.BPP {
+	case 8:
+		return uint32(buf[0])
+	case 16:
+		return uint32(pf.byteOrder().Uint16(buf))
+	case 32:
+		return pf.byteOrder().Uint32(buf)
+	}
+	return 0
+}
+
+// WritePixel writes a single pixel value into buf (which must hold BytesPerPixel bytes)
+func (pf *PixelFormat) WritePixel(buf []byte, pixel uint32) {
+	switch pf.BPP {
+	case 8:
+		buf[0] = byte(pixel)
+	case 16:
+		pf.byteOrder().PutUint16(buf, uint16(pixel))
+	case 32:
+		pf.byteOrder().PutUint32(buf, pixel)
+	}
+}
+
+// scaleColor converts a color component between the 0..fromMax and 0..toMax ranges
+func scaleColor(value uint32, fromMax uint32, toMax uint32) uint32 {
+	if fromMax == 0 {
+		return 0
+	}
+	return (value*toMax + fromMax/2) / fromMax
+}
+
+// PixelToColor converts a true-color pixel value to a color, colormap pixels are looked up in colorMap (when given)
+func (pf *PixelFormat) PixelToColor(pixel uint32, colorMap *ColorMap) color.RGBA {
+	if pf.TrueColor == 0 {
+		if colorMap == nil || pixel > 255 {
+			return color.RGBA{A: 0xFF}
+		}
+		c := colorMap[pixel]
+		return color.RGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), 0xFF}
+	}
+	return color.RGBA{
+		R: uint8(scaleColor((pixel>>pf.RedShift)&uint32(pf.RedMax), uint32(pf.RedMax), 255)),
+		G: uint8(scaleColor((pixel>>pf.GreenShift)&uint32(pf.GreenMax), uint32(pf.GreenMax), 255)),
+		B: uint8(scaleColor((pixel>>pf.BlueShift)&uint32(pf.BlueMax), uint32(pf.BlueMax), 255)),
+		A: 0xFF,
+	}
+}
+
+// ColorToPixel converts a color to a true-color pixel value in this pixel format
+func (pf *PixelFormat) ColorToPixel(c color.RGBA) uint32 {
+	return scaleColor(uint32(c.R), 255, uint32(pf.RedMax))<<pf.RedShift |
+		scaleColor(uint32(c.G), 255, uint32(pf.GreenMax))<<pf.GreenShift |
+		scaleColor(uint32(c.B), 255, uint32(pf.BlueMax))<<pf.BlueShift
+}
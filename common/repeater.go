@@ -0,0 +1,37 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// the UltraVNC repeater handshake: a repeater greets viewers with RepeaterGreeting, then viewers & servers send the
+// ID of the connection they want to be paired with ("ID:1234", or "host:port" for repeaters in mode I) padded with zeros
+const (
+	RepeaterIDLength = 250
+	RepeaterGreeting = "RFB 000.000\n"
+)
+
+// ReadRepeaterID reads an ID sent to a repeater
+func ReadRepeaterID(r io.Reader) (string, error) {
+	id := make([]byte, RepeaterIDLength)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(id, 0); i >= 0 {
+		id = id[:i]
+	}
+	return string(id), nil
+}
+
+// WriteRepeaterID sends an ID to a repeater
+func WriteRepeaterID(w io.Writer, id string) error {
+	if len(id) >= RepeaterIDLength {
+		return errors.New("repeater id too long")
+	}
+	padded := make([]byte, RepeaterIDLength)
+	copy(padded, id)
+	_, err := w.Write(padded)
+	return err
+}
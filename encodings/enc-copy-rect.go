@@ -2,6 +2,7 @@ package encodings
 
 import (
 	"encoding/binary"
+	"image"
 	"io"
 	"github.com/amitbet/vncproxy/common"
 )
@@ -27,10 +28,42 @@ func (z *CopyRectEncoding) WriteTo(w io.Writer) (n int, err error) {
 	return 4, nil
 }
 
+// NewCopyRectEncoding creates a CopyRect encoder, the rectangle is copied from src on the viewer's screen
+func NewCopyRectEncoding(src image.Point) *CopyRectEncoding {
+	return &CopyRectEncoding{copyRectSrcX: uint16(src.X), copyRectSrcY: uint16(src.Y)}
+}
+
+// Encode writes the source position, the image isn't used
+func (z *CopyRectEncoding) Encode(s *EncoderState, w io.Writer, img image.Image, area image.Rectangle) error {
+	return binary.Write(w, binary.BigEndian, []uint16{z.copyRectSrcX, z.copyRectSrcY})
+}
+
+// SrcPosition returns the position of the source rectangle the pixels are copied from
+func (z *CopyRectEncoding) SrcPosition() (uint16, uint16) {
+	return z.copyRectSrcX, z.copyRectSrcY
+}
+
 func (z *CopyRectEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
-	z.copyRectSrcX, _ = r.ReadUint16()
-	z.copyRectSrcY, _ = r.ReadUint16()
-	return z, nil
+	srcX, err := r.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	srcY, err := r.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	//a new instance per rect, so the source position survives reading the rest of the message
+	return &CopyRectEncoding{copyRectSrcX: srcX, copyRectSrcY: srcY}, nil
+}
+
+// Decode copies the source rectangle, the source & destination may overlap
+func (z *CopyRectEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	area := rectArea(rect)
+	src := image.Rect(int(z.copyRectSrcX), int(z.copyRectSrcY), int(z.copyRectSrcX)+area.Dx(), int(z.copyRectSrcY)+area.Dy())
+	tmp := image.NewRGBA(src)
+	copyRGBA(tmp, fb.img, src, src.Min)
+	copyRGBA(fb.img, tmp, src, area.Min)
+	return nil
 }
 
 //////////
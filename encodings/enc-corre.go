@@ -42,19 +42,24 @@ func (z *CoRREEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangl
 	if err != nil {
 		return nil, err
 	}
-	z.numSubRects = numOfSubrectangles
+	enc := &CoRREEncoding{numSubRects: numOfSubrectangles}
 
 	//read whole-rect background color
-	z.backgroundColor, err = r.ReadBytes(bytesPerPixel)
+	enc.backgroundColor, err = r.ReadBytes(bytesPerPixel)
 	if err != nil {
 		return nil, err
 	}
 
-	//read all individual rects (color=BPP + x=16b + y=16b + w=16b + h=16b)
-	z.subRectData, err = r.ReadBytes(int(numOfSubrectangles) * (bytesPerPixel + 4))
+	//read all individual rects (color=BPP + x=8b + y=8b + w=8b + h=8b)
+	enc.subRectData, err = r.ReadBytes(int(numOfSubrectangles) * (bytesPerPixel + 4))
 	if err != nil {
 		return nil, err
 	}
 
-	return z, nil
+	return enc, nil
+}
+
+// Decode fills the background & draws the subrectangles
+func (z *CoRREEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	return decodeRRE(fb, rect, z.numSubRects, z.backgroundColor, z.subRectData, 1)
 }
@@ -1,6 +1,9 @@
 package encodings
 
 import (
+	"errors"
+	"image"
+	"image/color"
 	"io"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
@@ -28,9 +31,10 @@ func (z *HextileEncoding) WriteTo(w io.Writer) (n int, err error) {
 func (z *HextileEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
 	bytesPerPixel := int(pixelFmt.BPP) / 8
 
+	enc := &HextileEncoding{}
 	r.StartByteCollection()
 	defer func() {
-		z.bytes = r.EndByteCollection()
+		enc.bytes = r.EndByteCollection()
 	}()
 
 	for ty := rect.Y; ty < rect.Y+rect.Height; ty += 16 {
@@ -80,5 +84,148 @@ func (z *HextileEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectan
 		}
 	}
 
-	return z, nil
+	return enc, nil
+}
+
+var errHextileTooShort = errors.New("HextileEncoding.Decode: rect data too short")
+
+// Decode draws the 16x16 tiles, the background & foreground colors carry over from tile to tile
+func (z *HextileEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	bpp := fb.bytesPerPixel()
+	data := z.bytes
+	next := func(n int) ([]byte, error) {
+		if len(data) < n {
+			return nil, errHextileTooShort
+		}
+		b := data[:n]
+		data = data[n:]
+		return b, nil
+	}
+
+	var bg, fg color.RGBA
+	area := rectArea(rect)
+	for ty := area.Min.Y; ty < area.Max.Y; ty += 16 {
+		for tx := area.Min.X; tx < area.Max.X; tx += 16 {
+			tile := image.Rect(tx, ty, min(tx+16, area.Max.X), min(ty+16, area.Max.Y))
+			b, err := next(1)
+			if err != nil {
+				return err
+			}
+			subencoding := b[0]
+
+			if (subencoding & HextileRaw) != 0 {
+				pixels, err := next(tile.Dx() * tile.Dy() * bpp)
+				if err != nil {
+					return err
+				}
+				fb.drawPixels(tile, pixels, bpp)
+				continue
+			}
+			if (subencoding & HextileBackgroundSpecified) != 0 {
+				if b, err = next(bpp); err != nil {
+					return err
+				}
+				bg = fb.pixelColor(b)
+			}
+			fb.fill(tile, bg)
+			if (subencoding & HextileForegroundSpecified) != 0 {
+				if b, err = next(bpp); err != nil {
+					return err
+				}
+				fg = fb.pixelColor(b)
+			}
+			if (subencoding & HextileAnySubrects) == 0 {
+				continue
+			}
+
+			if b, err = next(1); err != nil {
+				return err
+			}
+			for i := 0; i < int(b[0]); i++ {
+				c := fg
+				if (subencoding & HextileSubrectsColoured) != 0 {
+					pixel, err := next(bpp)
+					if err != nil {
+						return err
+					}
+					c = fb.pixelColor(pixel)
+				}
+				pos, err := next(2)
+				if err != nil {
+					return err
+				}
+				x, y := int(pos[0]>>4), int(pos[0]&0x0F)
+				w, h := int(pos[1]>>4)+1, int(pos[1]&0x0F)+1
+				fb.fill(image.Rect(x, y, x+w, y+h).Add(tile.Min).Intersect(tile), c)
+			}
+		}
+	}
+	return nil
+}
+
+// Encode writes the 16x16 tiles of area: a solid tile is its background, a tile with 2 colors is foreground subrects,
+// more colors are colored subrects, unless sending the tile raw is shorter
+func (*HextileEncoding) Encode(s *EncoderState, w io.Writer, img image.Image, area image.Rectangle) error {
+	var bg, fg uint32
+	bgValid, fgValid := false, false
+	buf := []byte{}
+	for ty := area.Min.Y; ty < area.Max.Y; ty += 16 {
+		for tx := area.Min.X; tx < area.Max.X; tx += 16 {
+			tile := image.Rect(tx, ty, min(tx+16, area.Max.X), min(ty+16, area.Max.Y))
+			pixels := s.pixels(img, tile)
+			colors := palette(pixels, 3)
+
+			tileBg := mostCommonPixel(pixels)
+			subencoding := uint8(0)
+			tileData := []byte{}
+			if !bgValid || tileBg != bg {
+				subencoding |= HextileBackgroundSpecified
+				tileData = s.appendPixel(tileData, tileBg)
+			}
+			subRects := []subRect{}
+			if len(colors) > 1 {
+				subRects = findSubRects(pixels, tile.Dx(), tile.Dy(), tileBg)
+				subencoding |= HextileAnySubrects
+			}
+			if len(colors) == 2 {
+				tileFg := subRects[0].pixel
+				if !fgValid || tileFg != fg {
+					subencoding |= HextileForegroundSpecified
+					tileData = s.appendPixel(tileData, tileFg)
+				}
+				fg, fgValid = tileFg, true
+			} else if len(colors) > 2 {
+				subencoding |= HextileSubrectsColoured
+			}
+			if len(subRects) > 0 {
+				tileData = append(tileData, uint8(len(subRects)))
+			}
+			for _, sub := range subRects {
+				if subencoding&HextileSubrectsColoured != 0 {
+					tileData = s.appendPixel(tileData, sub.pixel)
+				}
+				tileData = append(tileData,
+					uint8(sub.area.Min.X<<4|sub.area.Min.Y),
+					uint8((sub.area.Dx()-1)<<4|(sub.area.Dy()-1)))
+			}
+
+			if len(subRects) > 255 || len(tileData) >= len(pixels)*s.pixelFormat.BytesPerPixel() {
+				// the colors of the next tile must be specified again after a raw tile
+				buf = append(buf, HextileRaw)
+				for _, pixel := range pixels {
+					buf = s.appendPixel(buf, pixel)
+				}
+				bgValid, fgValid = false, false
+				continue
+			}
+			buf = append(buf, subencoding)
+			buf = append(buf, tileData...)
+			bg, bgValid = tileBg, true
+			if subencoding&HextileSubrectsColoured != 0 {
+				fgValid = false
+			}
+		}
+	}
+	_, err := w.Write(buf)
+	return err
 }
@@ -2,6 +2,7 @@ package encodings
 
 import (
 	"bytes"
+	"image"
 	"io"
 	"github.com/amitbet/vncproxy/common"
 )
@@ -14,6 +15,11 @@ type RawEncoding struct {
 func (*RawEncoding) Type() int32 {
 	return 0
 }
+// Pixels returns the raw pixel data of the rectangle, in the connection's pixel format
+func (z *RawEncoding) Pixels() []byte {
+	return z.bytes
+}
+
 func (z *RawEncoding) WriteTo(w io.Writer) (n int, err error) {
 	return w.Write(z.bytes)
 }
@@ -23,13 +29,27 @@ func (*RawEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r
 
 	bytes := &bytes.Buffer{}
 	for y := uint16(0); y < rect.Height; y++ {
-		for x := uint16(0); x < rect.Width; x++ {
-			if bts, err := r.ReadBytes(bytesPerPixel); err != nil {
-				StoreBytes(bytes, bts)
-				return nil, err
-			}
+		bts, err := r.ReadBytes(int(rect.Width) * bytesPerPixel)
+		if err != nil {
+			return nil, err
 		}
+		StoreBytes(bytes, bts)
 	}
 
 	return &RawEncoding{bytes.Bytes()}, nil
 }
+
+// Encode writes the pixels of area in the viewer's pixel format
+func (*RawEncoding) Encode(s *EncoderState, w io.Writer, img image.Image, area image.Rectangle) error {
+	buf := make([]byte, 0, area.Dx()*area.Dy()*s.pixelFormat.BytesPerPixel())
+	for _, pixel := range s.pixels(img, area) {
+		buf = s.appendPixel(buf, pixel)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// Decode draws the rectangle's pixels into the framebuffer
+func (z *RawEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	return fb.drawPixels(rectArea(rect), z.bytes, fb.bytesPerPixel())
+}
@@ -2,6 +2,8 @@ package encodings
 
 import (
 	"encoding/binary"
+	"fmt"
+	"image"
 	"io"
 	"github.com/amitbet/vncproxy/common"
 )
@@ -42,18 +44,122 @@ func (z *RREEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle,
 	if err != nil {
 		return nil, err
 	}
-	z.numSubRects = numOfSubrectangles
+	enc := &RREEncoding{numSubRects: numOfSubrectangles}
 
 	//read whole-rect background color
-	z.backgroundColor, err = r.ReadBytes(bytesPerPixel)
+	enc.backgroundColor, err = r.ReadBytes(bytesPerPixel)
 	if err != nil {
 		return nil, err
 	}
 
 	//read all individual rects (color=bytesPerPixel + x=16b + y=16b + w=16b + h=16b)
-	z.subRectData, err = r.ReadBytes(int(numOfSubrectangles) * (bytesPerPixel + 8)) // x+y+w+h=8 bytes
+	enc.subRectData, err = r.ReadBytes(int(numOfSubrectangles) * (bytesPerPixel + 8)) // x+y+w+h=8 bytes
 	if err != nil {
 		return nil, err
 	}
-	return z, nil
+	return enc, nil
+}
+
+// Decode fills the background & draws the subrectangles
+func (z *RREEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	return decodeRRE(fb, rect, z.numSubRects, z.backgroundColor, z.subRectData, 2)
+}
+
+// Encode writes the most common color as the background, and the rest of area as subrectangles
+func (*RREEncoding) Encode(s *EncoderState, w io.Writer, img image.Image, area image.Rectangle) error {
+	pixels := s.pixels(img, area)
+	background := mostCommonPixel(pixels)
+	subRects := findSubRects(pixels, area.Dx(), area.Dy(), background)
+
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(subRects)))
+	buf = s.appendPixel(buf, background)
+	for _, sub := range subRects {
+		buf = s.appendPixel(buf, sub.pixel)
+		for _, v := range []int{sub.area.Min.X, sub.area.Min.Y, sub.area.Dx(), sub.area.Dy()} {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(v))
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// subRect is a single colored rectangle, relative to the rectangle it is part of
+type subRect struct {
+	area  image.Rectangle
+	pixel uint32
+}
+
+func mostCommonPixel(pixels []uint32) uint32 {
+	counts := make(map[uint32]int)
+	var common uint32
+	for _, pixel := range pixels {
+		counts[pixel]++
+		if counts[pixel] > counts[common] {
+			common = pixel
+		}
+	}
+	return common
+}
+
+// findSubRects covers the pixels (of a w x h area) which aren't background with single colored rectangles:
+// each one starts at the first uncovered pixel, grows right and then down as long as the color is the same
+func findSubRects(pixels []uint32, w int, h int, background uint32) []subRect {
+	covered := make([]bool, len(pixels))
+	subRects := []subRect{}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			pixel := pixels[y*w+x]
+			if pixel == background || covered[y*w+x] {
+				continue
+			}
+			right := x + 1
+			for right < w && pixels[y*w+right] == pixel && !covered[y*w+right] {
+				right++
+			}
+			bottom := y + 1
+			for ; bottom < h; bottom++ {
+				same := true
+				for i := x; i < right && same; i++ {
+					same = pixels[bottom*w+i] == pixel && !covered[bottom*w+i]
+				}
+				if !same {
+					break
+				}
+			}
+			for cy := y; cy < bottom; cy++ {
+				for cx := x; cx < right; cx++ {
+					covered[cy*w+cx] = true
+				}
+			}
+			subRects = append(subRects, subRect{area: image.Rect(x, y, right, bottom), pixel: pixel})
+		}
+	}
+	return subRects
+}
+
+// decodeRRE draws RRE & CoRRE rectangles, whose subrectangle positions are coordSize bytes each (2 for RRE, 1 for CoRRE)
+func decodeRRE(fb *Framebuffer, rect *common.Rectangle, numSubRects uint32, background []byte, subRectData []byte, coordSize int) error {
+	bpp := fb.bytesPerPixel()
+	subRectSize := bpp + 4*coordSize
+	if bpp == 0 || len(background) < bpp || len(subRectData) < int(numSubRects)*subRectSize {
+		return fmt.Errorf("decodeRRE: rect data too short for %d subrects", numSubRects)
+	}
+	coord := func(b []byte) int {
+		if coordSize == 1 {
+			return int(b[0])
+		}
+		return int(binary.BigEndian.Uint16(b))
+	}
+
+	area := rectArea(rect)
+	fb.fill(area, fb.pixelColor(background))
+	for i := 0; i < int(numSubRects); i++ {
+		sub := subRectData[i*subRectSize:]
+		pos := sub[bpp:]
+		x, y := coord(pos), coord(pos[coordSize:])
+		w, h := coord(pos[2*coordSize:]), coord(pos[3*coordSize:])
+		subArea := image.Rect(x, y, x+w, y+h).Add(area.Min).Intersect(area)
+		fb.fill(subArea, fb.pixelColor(sub))
+	}
+	return nil
 }
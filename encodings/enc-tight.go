@@ -3,6 +3,12 @@ package encodings
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
@@ -10,11 +16,20 @@ import (
 
 var TightMinToCompress int = 12
 
+// the size limits of a rectangle using basic compression
+const (
+	tightMaxRectWidth = 2048
+	tightMaxRectSize  = 65536
+)
+
+// tightJpegQuality maps the jpeg quality levels viewers ask for to the quality jpeg data is encoded with
+var tightJpegQuality = [10]int{15, 29, 41, 42, 62, 77, 79, 86, 92, 100}
+
 const (
 	TightExplicitFilter = 0x04
 	TightFill           = 0x08
 	TightJpeg           = 0x09
-	TightPNG            = 0x10
+	TightPNG            = 0x0A // only in TightPng encoding
 
 	TightFilterCopy     = 0x00
 	TightFilterPalette  = 0x01
@@ -53,9 +68,10 @@ func StoreBytes(bytes *bytes.Buffer, data []byte) {
 func (t *TightEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
 	bytesPixel := calcTightBytePerPixel(pixelFmt)
 
+	enc := &TightEncoding{}
 	r.StartByteCollection()
 	defer func() {
-		t.bytes = r.EndByteCollection()
+		enc.bytes = r.EndByteCollection()
 	}()
 
 	compctl, err := r.ReadUint8()
@@ -80,7 +96,7 @@ func (t *TightEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangl
 			return nil, err
 		}
 
-		return t, nil
+		return enc, nil
 	case TightJpeg:
 		if pixelFmt.BPP == 8 {
 			return nil, errors.New("Tight encoding: JPEG is not supported in 8 bpp mode")
@@ -97,20 +113,22 @@ func (t *TightEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangl
 			return nil, err
 		}
 
-		return t, nil
+		return enc, nil
 	default:
 
 		if compType > TightJpeg {
-			logger.Debug("Compression control byte is incorrect!")
+			return nil, fmt.Errorf("Tight encoding: bad compression control byte: %x", compctl)
 		}
 
-		handleTightFilters(compctl, pixelFmt, rect, r)
+		if err := handleTightFilters(compctl, pixelFmt, rect, r); err != nil {
+			return nil, err
+		}
 
-		return t, nil
+		return enc, nil
 	}
 }
 
-func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) {
+func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) error {
 
 	var FILTER_ID_MASK uint8 = 0x40
 
@@ -122,7 +140,7 @@ func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *c
 
 		if err != nil {
 			logger.Errorf("error in handling tight encoding, reading filterid: %v", err)
-			return
+			return err
 		}
 		logger.Debugf("handleTightFilters: read filter: %d\n", filterid)
 	}
@@ -139,7 +157,7 @@ func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *c
 		colorCount, err := r.ReadUint8()
 		if err != nil {
 			logger.Errorf("handleTightFilters: error in handling tight encoding, reading TightFilterPalette: %v", err)
-			return
+			return err
 		}
 
 		paletteSize := int(colorCount) + 1 // add one more
@@ -148,7 +166,7 @@ func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *c
 		_, err = r.ReadBytes(int(paletteSize) * bytesPixel)
 		if err != nil {
 			logger.Errorf("handleTightFilters: error in handling tight encoding, reading TightFilterPalette.paletteSize: %v", err)
-			return
+			return err
 		}
 
 		var dataLength int
@@ -160,7 +178,7 @@ func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *c
 		_, err = r.ReadTightData(dataLength)
 		if err != nil {
 			logger.Errorf("handleTightFilters: error in handling tight encoding, Reading Palette: %v", err)
-			return
+			return err
 		}
 
 	case TightFilterGradient: //GRADIENT_FILTER
@@ -169,7 +187,7 @@ func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *c
 		_, err := r.ReadTightData(lengthCurrentbpp)
 		if err != nil {
 			logger.Errorf("handleTightFilters: error in handling tight encoding, Reading GRADIENT_FILTER: %v", err)
-			return
+			return err
 		}
 
 	case TightFilterCopy: //BASIC_FILTER
@@ -179,13 +197,324 @@ func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *c
 		_, err := r.ReadTightData(lengthCurrentbpp)
 		if err != nil {
 			logger.Errorf("handleTightFilters: error in handling tight encoding, Reading BASIC_FILTER: %v", err)
-			return
+			return err
 		}
 
 	default:
 		logger.Errorf("handleTightFilters: Bad tight filter id: %d", filterid)
-		return
+		return fmt.Errorf("Tight encoding: bad filter id: %d", filterid)
+	}
+
+	return nil
+}
+
+// Encode writes area as a fill, a palette (up to 16 colors), jpeg data (if the viewer asked for a jpeg quality level)
+// or the pixels, compressing the basic compression data on the viewer's tight zlib streams.
+// the area can't be larger than tight's size limits (see SplitRect)
+func (t *TightEncoding) Encode(s *EncoderState, w io.Writer, img image.Image, area image.Rectangle) error {
+	pf := &s.pixelFormat
+	pixels := s.pixels(img, area)
+	colors := palette(pixels, 17)
+	switch {
+	case len(colors) == 1:
+		_, err := w.Write(appendTightPixel(s, []byte{TightFill << 4}, colors[0]))
+		return err
+	case len(colors) > 16 && s.jpegQuality >= 0 && pf.BPP != 8:
+		src := image.NewRGBA(image.Rect(0, 0, area.Dx(), area.Dy()))
+		for y := 0; y < area.Dy(); y++ {
+			for x := 0; x < area.Dx(); x++ {
+				src.SetRGBA(x, y, rgbaAt(img, area.Min.X+x, area.Min.Y+y))
+			}
+		}
+		imgData := &bytes.Buffer{}
+		if err := jpeg.Encode(imgData, src, &jpeg.Options{Quality: tightJpegQuality[s.jpegQuality]}); err != nil {
+			return err
+		}
+		buf := appendCompactLen([]byte{TightJpeg << 4}, imgData.Len())
+		_, err := w.Write(append(buf, imgData.Bytes()...))
+		return err
+	case len(colors) > 1 && len(colors) <= 16:
+		indexes := make(map[uint32]uint8)
+		filter := []byte{TightFilterPalette, uint8(len(colors) - 1)}
+		for i, c := range colors {
+			indexes[c] = uint8(i)
+			filter = appendTightPixel(s, filter, c)
+		}
+		// 2 colors are sent as a bitmap on stream 1, more as a byte per pixel on stream 2
+		width := area.Dx()
+		if len(colors) == 2 {
+			rowSize := (width + 7) / 8
+			bitmap := make([]byte, rowSize*area.Dy())
+			for i, pixel := range pixels {
+				bitmap[i/width*rowSize+i%width/8] |= indexes[pixel] << uint(7-i%width%8)
+			}
+			return writeTightBasic(s, w, 1, filter, bitmap)
+		}
+		data := make([]byte, len(pixels))
+		for i, pixel := range pixels {
+			data[i] = indexes[pixel]
+		}
+		return writeTightBasic(s, w, 2, filter, data)
+	}
+	data := []byte{}
+	for _, pixel := range pixels {
+		data = appendTightPixel(s, data, pixel)
+	}
+	return writeTightBasic(s, w, 0, nil, data)
+}
+
+// writeTightBasic writes a rectangle using basic compression: the compression control byte, the filter (none is the
+// copy filter) & the data, compressed on one of the tight zlib streams unless it is shorter than TightMinToCompress
+func writeTightBasic(s *EncoderState, w io.Writer, streamId int, filter []byte, data []byte) error {
+	compctl := uint8(streamId) << 4
+	if filter != nil {
+		compctl |= TightExplicitFilter << 4
+	}
+	var compressed []byte
+	if len(data) >= TightMinToCompress {
+		zw, reset := s.zlibWriter(zlibStreamTight+streamId, true)
+		if reset {
+			compctl |= 1 << uint(streamId)
+		}
+		compressed = zw.compress(data)
+	}
+	buf := append([]byte{compctl}, filter...)
+	if compressed != nil {
+		buf = appendCompactLen(buf, len(compressed))
+		data = compressed
+	}
+	buf = append(buf, data...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// appendCompactLen appends a length in 1 to 3 bytes, 7 bits in each byte with the msb set when another byte follows
+func appendCompactLen(buf []byte, length int) []byte {
+	b := byte(length & 0x7F)
+	if length > 0x7F {
+		buf = append(buf, b|0x80)
+		b = byte(length >> 7 & 0x7F)
+		if length > 0x3FFF {
+			buf = append(buf, b|0x80)
+			b = byte(length >> 14)
+		}
+	}
+	return append(buf, b)
+}
+
+// appendTightPixel appends a TPIXEL, 24 bit depth pixels are sent as 3 bytes: red, green & blue
+func appendTightPixel(s *EncoderState, buf []byte, pixel uint32) []byte {
+	if calcTightBytePerPixel(&s.pixelFormat) == 3 {
+		c := s.pixelFormat.PixelToColor(pixel, nil)
+		return append(buf, c.R, c.G, c.B)
+	}
+	return s.appendPixel(buf, pixel)
+}
+
+// Decode draws the rectangle, inflating its data from the connection's tight zlib streams
+func (t *TightEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	return decodeTight(fb, rect, t.bytes, false)
+}
+
+// decodeTight draws a Tight (or TightPng) rectangle: the compression control byte resets zlib streams and picks
+// fill, jpeg, png (TightPng only) or basic compression (Tight only) with one of the 4 zlib streams & a filter
+func decodeTight(fb *Framebuffer, rect *common.Rectangle, data []byte, tightPng bool) error {
+	r := common.NewRfbReadHelper(bytes.NewReader(data))
+	compctl, err := r.ReadUint8()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 4; i++ {
+		if compctl&(1<<uint(i)) != 0 {
+			fb.streams[zlibStreamTight+i] = nil
+		}
+	}
+
+	area := rectArea(rect)
+	compType := compctl >> 4 & 0x0F
+	switch {
+	case compType == TightFill:
+		pixel, err := r.ReadBytes(calcTightBytePerPixel(&fb.pixelFormat))
+		if err != nil {
+			return err
+		}
+		fb.fill(area, tightPixelColor(fb, pixel))
+		return nil
+	case compType == TightJpeg || (compType == TightPNG && tightPng):
+		len, err := r.ReadCompactLen()
+		if err != nil {
+			return err
+		}
+		imgData, err := r.ReadBytes(len)
+		if err != nil {
+			return err
+		}
+		var img image.Image
+		if compType == TightJpeg {
+			img, err = jpeg.Decode(bytes.NewReader(imgData))
+		} else {
+			img, err = png.Decode(bytes.NewReader(imgData))
+		}
+		if err != nil {
+			return fmt.Errorf("decodeTight: bad image data: %v", err)
+		}
+		draw.Draw(fb.img, area, img, img.Bounds().Min, draw.Src)
+		return nil
+	case compType <= 0x07 && !tightPng:
+		return decodeTightBasic(fb, area, compctl, r)
+	}
+	return fmt.Errorf("decodeTight: bad compression control byte: %x", compctl)
+}
+
+// decodeTightBasic draws a rectangle using basic compression: the filter (copy, palette or gradient) & its data,
+// which is zlib compressed on the stream picked by compctl unless it is shorter than TightMinToCompress
+func decodeTightBasic(fb *Framebuffer, area image.Rectangle, compctl uint8, r *common.RfbReadHelper) error {
+	streamId := int(compctl>>4) & 0x03
+	filterId := uint8(TightFilterCopy)
+	if (compctl>>4)&TightExplicitFilter != 0 {
+		var err error
+		if filterId, err = r.ReadUint8(); err != nil {
+			return err
+		}
 	}
 
-	return
+	bytesPixel := calcTightBytePerPixel(&fb.pixelFormat)
+	w, h := area.Dx(), area.Dy()
+	switch filterId {
+	case TightFilterCopy:
+		pixels, err := readTightData(fb, r, streamId, w*h*bytesPixel)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < w*h; i++ {
+			fb.img.SetRGBA(area.Min.X+i%w, area.Min.Y+i/w, tightPixelColor(fb, pixels[i*bytesPixel:]))
+		}
+	case TightFilterPalette:
+		colorCount, err := r.ReadUint8()
+		if err != nil {
+			return err
+		}
+		paletteSize := int(colorCount) + 1
+		paletteData, err := r.ReadBytes(paletteSize * bytesPixel)
+		if err != nil {
+			return err
+		}
+		palette := make([]color.RGBA, paletteSize)
+		for i := range palette {
+			palette[i] = tightPixelColor(fb, paletteData[i*bytesPixel:])
+		}
+
+		// 2 colors are sent as a bitmap (msb first, rows padded to a byte), more as a byte per pixel
+		rowSize := w
+		if paletteSize == 2 {
+			rowSize = (w + 7) / 8
+		}
+		indexes, err := readTightData(fb, r, streamId, h*rowSize)
+		if err != nil {
+			return err
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var index int
+				if paletteSize == 2 {
+					index = int(indexes[y*rowSize+x/8]>>(7-uint(x%8))) & 1
+				} else {
+					index = int(indexes[y*rowSize+x])
+				}
+				if index >= paletteSize {
+					return fmt.Errorf("decodeTightBasic: palette index %d out of %d colors", index, paletteSize)
+				}
+				fb.img.SetRGBA(area.Min.X+x, area.Min.Y+y, palette[index])
+			}
+		}
+	case TightFilterGradient:
+		data, err := readTightData(fb, r, streamId, w*h*bytesPixel)
+		if err != nil {
+			return err
+		}
+		decodeTightGradient(fb, area, data, bytesPixel)
+	default:
+		return fmt.Errorf("decodeTightBasic: bad filter id: %d", filterId)
+	}
+	return nil
+}
+
+// readTightData reads length bytes of filtered data, inflating them from the tight zlib stream if they were compressed
+func readTightData(fb *Framebuffer, r *common.RfbReadHelper, streamId int, length int) ([]byte, error) {
+	if length < TightMinToCompress {
+		return r.ReadBytes(length)
+	}
+	zlibDataLen, err := r.ReadCompactLen()
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := r.ReadBytes(zlibDataLen)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fb.zlibStream(zlibStreamTight+streamId).inflate(compressed, length)
+	if err != nil {
+		return nil, fmt.Errorf("readTightData: zlib stream %d: %v", streamId, err)
+	}
+	return data, nil
+}
+
+// decodeTightGradient reverses the gradient filter: each color component was sent as the difference from
+// its prediction left + above - above-left (clamped to the component's range), modulo the range
+func decodeTightGradient(fb *Framebuffer, area image.Rectangle, data []byte, bytesPixel int) {
+	pf := &fb.pixelFormat
+	maxes := [3]int{0xFF, 0xFF, 0xFF}
+	shifts := [3]uint8{pf.RedShift, pf.GreenShift, pf.BlueShift}
+	if bytesPixel != 3 {
+		maxes = [3]int{int(pf.RedMax), int(pf.GreenMax), int(pf.BlueMax)}
+	}
+	components := func(buf []byte) [3]int {
+		if bytesPixel == 3 {
+			return [3]int{int(buf[0]), int(buf[1]), int(buf[2])}
+		}
+		pixel := pf.ReadPixel(buf)
+		var c [3]int
+		for i := range c {
+			c[i] = int(pixel>>shifts[i]) & maxes[i]
+		}
+		return c
+	}
+
+	w := area.Dx()
+	prevRow := make([][3]int, w)
+	row := make([][3]int, w)
+	for y := 0; y < area.Dy(); y++ {
+		for x := 0; x < w; x++ {
+			diff := components(data[(y*w+x)*bytesPixel:])
+			for i := range diff {
+				var left, upperLeft int
+				if x > 0 {
+					left, upperLeft = row[x-1][i], prevRow[x-1][i]
+				}
+				prediction := max(0, min(maxes[i], left+prevRow[x][i]-upperLeft))
+				row[x][i] = (prediction + diff[i]) & maxes[i]
+			}
+
+			var c color.RGBA
+			if bytesPixel == 3 {
+				c = color.RGBA{uint8(row[x][0]), uint8(row[x][1]), uint8(row[x][2]), 0xFF}
+			} else {
+				var pixel uint32
+				for i := range shifts {
+					pixel |= uint32(row[x][i]) << shifts[i]
+				}
+				c = pf.PixelToColor(pixel, &fb.colorMap)
+			}
+			fb.img.SetRGBA(area.Min.X+x, area.Min.Y+y, c)
+		}
+		prevRow, row = row, prevRow
+	}
+}
+
+// tightPixelColor converts a TPIXEL to its color, 24 bit depth pixels are sent as 3 bytes: red, green & blue
+func tightPixelColor(fb *Framebuffer, buf []byte) color.RGBA {
+	if calcTightBytePerPixel(&fb.pixelFormat) == 3 {
+		return color.RGBA{buf[0], buf[1], buf[2], 0xFF}
+	}
+	return fb.pixelColor(buf)
 }
@@ -0,0 +1,359 @@
+package encodings
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// tightServer builds tight rectangles the way a server does, keeping its 4 zlib streams
+type tightServer struct {
+	pf      *common.PixelFormat
+	streams [4]*zlib.Writer
+	out     [4]*bytes.Buffer
+}
+
+func newTightServer(pf *common.PixelFormat) *tightServer {
+	return &tightServer{pf: pf}
+}
+
+func writeCompactLen(buf *bytes.Buffer, length int) {
+	b := byte(length & 0x7F)
+	if length > 0x7F {
+		buf.WriteByte(b | 0x80)
+		b = byte(length >> 7 & 0x7F)
+		if length > 0x3FFF {
+			buf.WriteByte(b | 0x80)
+			b = byte(length >> 14)
+		}
+	}
+	buf.WriteByte(b)
+}
+
+// tpixels encodes colors as TPIXELs: 3 bytes for 24 bit depth, otherwise in the pixel format
+func (s *tightServer) tpixels(colors ...color.RGBA) []byte {
+	if calcTightBytePerPixel(s.pf) != 3 {
+		return pixelBytes(s.pf, colors...)
+	}
+	buf := []byte{}
+	for _, c := range colors {
+		buf = append(buf, c.R, c.G, c.B)
+	}
+	return buf
+}
+
+// basicRect builds a basic compression rect: the filter & its data, compressed on stream unless it is short.
+// a reset starts the stream over, as servers do after changing its compression level
+func (s *tightServer) basicRect(stream int, reset bool, filter []byte, data []byte) []byte {
+	rect := &bytes.Buffer{}
+	compctl := byte(stream) << 4
+	if filter != nil {
+		compctl |= TightExplicitFilter << 4
+	}
+	if reset || s.streams[stream] == nil {
+		if s.streams[stream] != nil {
+			compctl |= 1 << uint(stream)
+		}
+		s.out[stream] = &bytes.Buffer{}
+		s.streams[stream] = zlib.NewWriter(s.out[stream])
+	}
+	rect.WriteByte(compctl)
+	rect.Write(filter)
+	if len(data) < TightMinToCompress {
+		rect.Write(data)
+		return rect.Bytes()
+	}
+	s.out[stream].Reset()
+	s.streams[stream].Write(data)
+	s.streams[stream].Flush()
+	writeCompactLen(rect, s.out[stream].Len())
+	rect.Write(s.out[stream].Bytes())
+	return rect.Bytes()
+}
+
+func imageRect(compType byte, imgData []byte) []byte {
+	rect := &bytes.Buffer{}
+	rect.WriteByte(compType << 4)
+	writeCompactLen(rect, len(imgData))
+	rect.Write(imgData)
+	return rect.Bytes()
+}
+
+func TestTightFillAndCopy(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := NewFramebuffer(8, 8, *pf)
+	srv := newTightServer(pf)
+
+	fill := append([]byte{TightFill << 4}, srv.tpixels(green)...)
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{Width: 8, Height: 8}, fill)
+	checkColors(t, fb, image.Rect(0, 0, 8, 8), green)
+
+	// two rects continuing the same stream, then a reset
+	reds := srv.tpixels(red, red, red, red, red, red, red, red)
+	blues := srv.tpixels(blue, blue, blue, blue, blue, blue, blue, blue)
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{X: 0, Y: 0, Width: 8, Height: 1}, srv.basicRect(2, false, nil, reds))
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{X: 0, Y: 1, Width: 8, Height: 1}, srv.basicRect(2, false, nil, blues))
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{X: 0, Y: 2, Width: 4, Height: 2}, srv.basicRect(2, true, []byte{TightFilterCopy}, reds))
+	// 2 pixels are too short to be compressed
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{X: 6, Y: 7, Width: 2, Height: 1}, srv.basicRect(1, false, nil, srv.tpixels(blue, blue)))
+
+	checkColors(t, fb, image.Rect(0, 0, 8, 1), red)
+	checkColors(t, fb, image.Rect(0, 1, 8, 2), blue)
+	checkColors(t, fb, image.Rect(0, 2, 4, 4), red)
+	checkColors(t, fb, image.Rect(4, 2, 8, 4), green)
+	checkColors(t, fb, image.Rect(6, 7, 8, 8), blue)
+}
+
+func TestTightPalette(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := NewFramebuffer(10, 4, *pf)
+	srv := newTightServer(pf)
+
+	// 2 colors: a bitmap, rows padded to a byte. the left 9 columns are blue, the last red
+	filter := append([]byte{TightFilterPalette, 1}, srv.tpixels(blue, red)...)
+	bitmap := []byte{0x00, 0x40, 0x00, 0x40}
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{Width: 10, Height: 2}, srv.basicRect(0, false, filter, bitmap))
+	checkColors(t, fb, image.Rect(0, 0, 9, 2), blue)
+	checkColors(t, fb, image.Rect(9, 0, 10, 2), red)
+
+	// 3 colors: a byte per pixel
+	filter = append([]byte{TightFilterPalette, 2}, srv.tpixels(red, green, blue)...)
+	indexes := []byte{
+		0, 0, 0, 0, 0, 1, 1, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	}
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{Y: 2, Width: 10, Height: 2}, srv.basicRect(0, false, filter, indexes))
+	checkColors(t, fb, image.Rect(0, 2, 5, 3), red)
+	checkColors(t, fb, image.Rect(5, 2, 10, 3), green)
+	checkColors(t, fb, image.Rect(0, 3, 10, 4), blue)
+
+	// an index outside the palette
+	filter = append([]byte{TightFilterPalette, 2}, srv.tpixels(red, green, blue)...)
+	indexes[0] = 3
+	rect := common.Rectangle{Width: 10, Height: 2}
+	enc, err := (&TightEncoding{}).Read(pf, &rect, common.NewRfbReadHelper(bytes.NewReader(srv.basicRect(0, false, filter, indexes))))
+	if err != nil {
+		t.Fatalf("error reading tight rect: %v", err)
+	}
+	rect.Enc = enc
+	if _, err := fb.ApplyRect(&rect); err == nil {
+		t.Fatalf("expected an error for a bad palette index")
+	}
+}
+
+func TestTightGradient(t *testing.T) {
+	rgb565 := &common.PixelFormat{BPP: 16, Depth: 16, TrueColor: 1, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+	for _, pf := range []*common.PixelFormat{common.NewPixelFormat(32), rgb565} {
+		srv := newTightServer(pf)
+		fb := NewFramebuffer(5, 3, *pf)
+
+		// a picture the pixel format can show exactly
+		expected := image.NewRGBA(image.Rect(0, 0, 5, 3))
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 5; x++ {
+				c := color.RGBA{uint8(x * 60), uint8(y * 100), uint8(255 - x*40 - y*20), 0xFF}
+				expected.SetRGBA(x, y, pf.PixelToColor(pf.ColorToPixel(c), nil))
+			}
+		}
+
+		// the server sends each component's difference from its prediction
+		maxes := [3]int{0xFF, 0xFF, 0xFF}
+		if calcTightBytePerPixel(pf) != 3 {
+			maxes = [3]int{int(pf.RedMax), int(pf.GreenMax), int(pf.BlueMax)}
+		}
+		component := func(x, y, i int) int {
+			if x < 0 || y < 0 {
+				return 0
+			}
+			c := expected.RGBAAt(x, y)
+			return (int([3]uint8{c.R, c.G, c.B}[i])*maxes[i] + 127) / 255
+		}
+		data := []byte{}
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 5; x++ {
+				var diff [3]int
+				for i := range diff {
+					prediction := max(0, min(maxes[i], component(x-1, y, i)+component(x, y-1, i)-component(x-1, y-1, i)))
+					diff[i] = (component(x, y, i) - prediction) & maxes[i]
+				}
+				if calcTightBytePerPixel(pf) == 3 {
+					data = append(data, byte(diff[0]), byte(diff[1]), byte(diff[2]))
+				} else {
+					pixel := make([]byte, pf.BytesPerPixel())
+					pf.WritePixel(pixel, uint32(diff[0])<<pf.RedShift|uint32(diff[1])<<pf.GreenShift|uint32(diff[2])<<pf.BlueShift)
+					data = append(data, pixel...)
+				}
+			}
+		}
+		applyRect(t, fb, &TightEncoding{}, common.Rectangle{Width: 5, Height: 3}, srv.basicRect(3, false, []byte{TightFilterGradient}, data))
+
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 5; x++ {
+				if c := fb.RGBA().RGBAAt(x, y); c != expected.RGBAAt(x, y) {
+					t.Fatalf("%d bpp: unexpected color at %d,%d: %v, expected %v", pf.BPP, x, y, c, expected.RGBAAt(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestTightJpegAndPng(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := NewFramebuffer(16, 16, *pf)
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{0x20, 0x80, 0xE0, 0xFF})
+	}
+	jpegData := &bytes.Buffer{}
+	if err := jpeg.Encode(jpegData, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("error encoding jpeg: %v", err)
+	}
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{X: 8, Y: 8, Width: 8, Height: 8}, imageRect(TightJpeg, jpegData.Bytes()))
+	diff := func(a, b uint8) int { return max(int(a), int(b)) - min(int(a), int(b)) }
+	if c := fb.RGBA().RGBAAt(12, 12); diff(c.R, 0x20) > 4 || diff(c.G, 0x80) > 4 || diff(c.B, 0xE0) > 4 {
+		t.Fatalf("unexpected jpeg color: %v", c)
+	}
+
+	img.SetRGBA(0, 0, red)
+	pngData := &bytes.Buffer{}
+	if err := png.Encode(pngData, img); err != nil {
+		t.Fatalf("error encoding png: %v", err)
+	}
+	applyRect(t, fb, &TightPngEncoding{}, common.Rectangle{Width: 8, Height: 8}, imageRect(TightPNG, pngData.Bytes()))
+	checkColors(t, fb, image.Rect(0, 0, 1, 1), red)
+	checkColors(t, fb, image.Rect(1, 0, 8, 8), color.RGBA{0x20, 0x80, 0xE0, 0xFF})
+
+	// png is only sent with TightPng, basic compression only with Tight
+	rect := common.Rectangle{Width: 8, Height: 8}
+	if _, err := (&TightEncoding{}).Read(pf, &rect, common.NewRfbReadHelper(bytes.NewReader(imageRect(TightPNG, pngData.Bytes())))); err == nil {
+		t.Fatalf("expected an error reading png in a tight rect")
+	}
+	if _, err := (&TightPngEncoding{}).Read(pf, &rect, common.NewRfbReadHelper(bytes.NewReader([]byte{0, 0}))); err == nil {
+		t.Fatalf("expected an error reading basic compression in a tightpng rect")
+	}
+}
+
+// tightZlibFixture is a server's stream of 2 FramebufferUpdates for a 32x16 screen (32 bpp, depth 24), compressed with
+// the C zlib (1.2.13) vnc servers link rather than by tightServer: each rect type has its own stream (full color 0,
+// mono 1, indexed 2, gradient 3), each rect ends with a sync flush & the streams continue across updates.
+// it has a fill, 2 color & 4 color palettes, a gradient, full color, data too short to compress, and streams 1 & 2
+// reset together by the first rect of the second update (which uses stream 2).
+// no capture of a live TightVNC / TigerVNC session was available, the bytes were built following TightVNC's encoder
+var tightZlibFixture = []byte{
+	0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x10, 0x00, 0x00, 0x00, 0x07,
+	0x80, 0x20, 0x40, 0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x04, 0x00, 0x00, 0x00, 0x07,
+	0x50, 0x01, 0x01, 0x00, 0x00, 0x80, 0xff, 0xff, 0xff, 0x16, 0x78, 0x9c, 0x9a, 0xe4, 0xa9, 0x32,
+	0x49, 0x65, 0x92, 0xa7, 0x0a, 0x90, 0xf2, 0x04, 0x52, 0x93, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff,
+	0x00, 0x00, 0x00, 0x04, 0x00, 0x20, 0x00, 0x04, 0x00, 0x00, 0x00, 0x07, 0x60, 0x01, 0x03, 0xff,
+	0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x00, 0x20, 0x78, 0x9c, 0x62, 0x60,
+	0x80, 0x00, 0x46, 0x28, 0x60, 0x82, 0x02, 0x66, 0x28, 0xc0, 0x25, 0x0e, 0xd5, 0xc6, 0x80, 0x4b,
+	0x1c, 0xa6, 0x0f, 0x97, 0x38, 0x4c, 0x1f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x08,
+	0x00, 0x10, 0x00, 0x08, 0x00, 0x00, 0x00, 0x07, 0x70, 0x02, 0x19, 0x78, 0x9c, 0x62, 0x48, 0x68,
+	0x10, 0x60, 0x60, 0x20, 0x1e, 0x31, 0xf0, 0x30, 0x90, 0x06, 0x46, 0xd5, 0xe3, 0x05, 0x00, 0x00,
+	0x00, 0x00, 0xff, 0xff, 0x00, 0x10, 0x00, 0x08, 0x00, 0x10, 0x00, 0x04, 0x00, 0x00, 0x00, 0x07,
+	0x00, 0xc8, 0x01, 0x78, 0x9c, 0x04, 0xc1, 0x21, 0x0b, 0xc2, 0x50, 0x10, 0x00, 0xe0, 0xa2, 0x60,
+	0xb2, 0x18, 0x34, 0x19, 0x6c, 0x82, 0x51, 0xac, 0x76, 0xbb, 0xff, 0xe1, 0xe2, 0xca, 0xb1, 0x36,
+	0xe4, 0x60, 0x60, 0x18, 0xdc, 0x60, 0x45, 0x97, 0x9c, 0xe9, 0xa1, 0x61, 0x86, 0x31, 0x04, 0x79,
+	0x62, 0x18, 0x63, 0xb0, 0xa0, 0xbe, 0xb4, 0x81, 0x41, 0x8b, 0x8a, 0x69, 0x68, 0x11, 0x51, 0xf0,
+	0xfb, 0x34, 0x18, 0xe9, 0x30, 0x36, 0xc0, 0x36, 0x61, 0x62, 0xc1, 0xcc, 0x01, 0xe1, 0xc2, 0xca,
+	0x83, 0xb5, 0x80, 0x9d, 0x0f, 0x49, 0x08, 0x07, 0x09, 0x59, 0x04, 0xe7, 0x14, 0xee, 0x0a, 0x8a,
+	0x1c, 0xde, 0x1a, 0xda, 0x3a, 0x4e, 0x0d, 0x9c, 0x9b, 0xb8, 0xb4, 0x30, 0x70, 0x50, 0xba, 0x18,
+	0x7b, 0xb8, 0x17, 0x98, 0xf9, 0x78, 0x09, 0xf1, 0x21, 0xf1, 0x15, 0xe1, 0x37, 0xc5, 0xb2, 0xc2,
+	0x6a, 0x8e, 0x75, 0x8d, 0x66, 0x3a, 0x2d, 0x0c, 0x0a, 0x4c, 0xda, 0x5a, 0x94, 0x38, 0xa4, 0x5c,
+	0x3a, 0x79, 0x74, 0x15, 0x54, 0xf8, 0xf4, 0x09, 0xa9, 0x24, 0xa9, 0x1a, 0x51, 0x23, 0xa5, 0x96,
+	0xa2, 0x4e, 0x4e, 0x3d, 0x8d, 0x57, 0x3a, 0x6f, 0x0c, 0x8e, 0x4d, 0x3e, 0x5a, 0x7c, 0x72, 0xf8,
+	0xe6, 0xf2, 0xd3, 0xe3, 0x9f, 0xe0, 0x8a, 0xcf, 0xb5, 0x90, 0x9b, 0x92, 0xdb, 0x11, 0x77, 0x53,
+	0xee, 0x2b, 0x1e, 0xe4, 0x3c, 0xfc, 0x03, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x04, 0x00,
+	0x10, 0x00, 0x0c, 0x00, 0x10, 0x00, 0x02, 0x00, 0x00, 0x00, 0x07, 0x50, 0x01, 0x01, 0x30, 0x30,
+	0x30, 0xff, 0x80, 0x00, 0x44, 0x44, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x04,
+	0x00, 0x00, 0x00, 0x07, 0x66, 0x01, 0x02, 0x10, 0x10, 0x10, 0x80, 0x20, 0x40, 0xe0, 0xc0, 0xa0,
+	0x0e, 0x78, 0x9c, 0x62, 0x60, 0x64, 0x62, 0x18, 0x48, 0x04, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00,
+	0x10, 0x00, 0x0e, 0x00, 0x10, 0x00, 0x02, 0x00, 0x00, 0x00, 0x07, 0x50, 0x01, 0x01, 0x30, 0x30,
+	0x30, 0xff, 0x80, 0x00, 0x44, 0x44, 0x44, 0x44, 0x00, 0x1d, 0x00, 0x0f, 0x00, 0x03, 0x00, 0x01,
+	0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x22, 0x33, 0x11, 0x22, 0x33, 0x22, 0x22, 0x33,
+}
+
+// tightFixtureScreen is the screen tightZlibFixture leaves, drawn from the same rects
+func tightFixtureScreen() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	draw := func(area image.Rectangle, f func(x, y int) color.RGBA) {
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				img.SetRGBA(x, y, f(x, y))
+			}
+		}
+	}
+	rgb := func(r, g, b int) color.RGBA { return color.RGBA{uint8(r), uint8(g), uint8(b), 0xFF} }
+	pal4 := []color.RGBA{red, green, blue, rgb(0xFF, 0xFF, 0)}
+	pal3 := []color.RGBA{rgb(0x10, 0x10, 0x10), rgb(0x80, 0x20, 0x40), rgb(0xE0, 0xC0, 0xA0)}
+	mono := func(x, y int) color.RGBA {
+		if x%4 == 1 || y == 13 {
+			return rgb(0xFF, 0x80, 0)
+		}
+		return rgb(0x30, 0x30, 0x30)
+	}
+
+	// first update
+	draw(img.Rect, func(x, y int) color.RGBA { return rgb(0x20, 0x40, 0x60) })
+	draw(image.Rect(0, 0, 32, 4), func(x, y int) color.RGBA {
+		if (x+y)%3 == 0 {
+			return rgb(0xFF, 0xFF, 0xFF)
+		}
+		return rgb(0, 0, 0x80)
+	})
+	draw(image.Rect(0, 4, 32, 8), func(x, y int) color.RGBA { return pal4[(x/8+y)%4] })
+	draw(image.Rect(0, 8, 16, 16), func(x, y int) color.RGBA { return rgb(x*16, y*12, 0x80) })
+	draw(image.Rect(16, 8, 32, 12), func(x, y int) color.RGBA { return rgb(x*7, y*13, x*y) })
+	// second update
+	draw(image.Rect(16, 12, 32, 14), mono)
+	draw(image.Rect(0, 0, 32, 4), func(x, y int) color.RGBA { return pal3[(x+2*y)%3] })
+	draw(image.Rect(16, 14, 32, 16), mono)
+	draw(image.Rect(29, 15, 32, 16), func(x, y int) color.RGBA { return rgb(0x11*(x-29), 0x22, 0x33) })
+	return img
+}
+
+func TestTightZlibFixture(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := NewFramebuffer(32, 16, *pf)
+	r := common.NewRfbReadHelper(bytes.NewReader(tightZlibFixture))
+	for update := 0; update < 2; update++ {
+		var header struct {
+			MsgType  uint8
+			_        uint8
+			NumRects uint16
+		}
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil || header.MsgType != 0 {
+			t.Fatalf("bad update header: %+v, %v", header, err)
+		}
+		for i := 0; i < int(header.NumRects); i++ {
+			var rh struct {
+				X, Y, Width, Height uint16
+				EncType             int32
+			}
+			if err := binary.Read(r, binary.BigEndian, &rh); err != nil || rh.EncType != int32(common.EncTight) {
+				t.Fatalf("bad rect header: %+v, %v", rh, err)
+			}
+			rect := common.Rectangle{X: rh.X, Y: rh.Y, Width: rh.Width, Height: rh.Height}
+			enc, err := (&TightEncoding{}).Read(pf, &rect, r)
+			if err != nil {
+				t.Fatalf("update %d, rect %d: error reading tight rect: %v", update, i, err)
+			}
+			rect.Enc = enc
+			if _, err := fb.ApplyRect(&rect); err != nil {
+				t.Fatalf("update %d, rect %d: error applying tight rect: %v", update, i, err)
+			}
+		}
+	}
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		t.Fatalf("the fixture wasn't fully read")
+	}
+	checkImage(t, fb, tightFixtureScreen(), image.Rect(0, 0, 32, 16), 0)
+}
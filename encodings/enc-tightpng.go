@@ -19,9 +19,10 @@ func (*TightPngEncoding) Type() int32 { return int32(common.EncTightPng) }
 
 func (t *TightPngEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
 	bytesPixel := calcTightBytePerPixel(pixelFmt)
+	enc := &TightPngEncoding{}
 	r.StartByteCollection()
 	defer func() {
-		t.bytes = r.EndByteCollection()
+		enc.bytes = r.EndByteCollection()
 	}()
 
 	//var subencoding uint8
@@ -37,18 +38,27 @@ func (t *TightPngEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Recta
 
 	logger.Debugf("afterSHL:%d", compType)
 	switch compType {
-	case TightPNG:
+	case TightPNG, TightJpeg:
 		len, err := r.ReadCompactLen()
+		if err != nil {
+			return nil, err
+		}
 		_, err = r.ReadBytes(len)
-
 		if err != nil {
-			return t, err
+			return nil, err
 		}
 
 	case TightFill:
-		r.ReadBytes(int(bytesPixel))
+		if _, err := r.ReadBytes(int(bytesPixel)); err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("unknown tight compression %d", compType)
 	}
-	return t, nil
+	return enc, nil
+}
+
+// Decode draws the rectangle (a fill, jpeg or png image)
+func (t *TightPngEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	return decodeTight(fb, rect, t.bytes, true)
 }
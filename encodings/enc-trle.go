@@ -0,0 +1,44 @@
+package encodings
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// TRLEEncoding is ZRLE's tile encoding without zlib: 16x16 tiles sent as they are
+type TRLEEncoding struct {
+	bytes []byte
+}
+
+func (*TRLEEncoding) Type() int32 { return int32(common.EncTRLE) }
+
+func (z *TRLEEncoding) WriteTo(w io.Writer) (n int, err error) {
+	return w.Write(z.bytes)
+}
+
+// Read goes over the tiles, which have no length prefix
+func (z *TRLEEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
+	enc := &TRLEEncoding{}
+	r.StartByteCollection()
+	defer func() {
+		enc.bytes = r.EndByteCollection()
+	}()
+
+	tiles := newRLETileReader(r, pixelFmt, nil, true)
+	if err := tiles.readRect(rectArea(rect), 16); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// Decode draws the rectangle's 16x16 tiles
+func (z *TRLEEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	tiles := newRLETileReader(bytes.NewReader(z.bytes), &fb.pixelFormat, fb, true)
+	if err := tiles.readRect(rectArea(rect), 16); err != nil {
+		return fmt.Errorf("TRLEEncoding.Decode: %v", err)
+	}
+	return nil
+}
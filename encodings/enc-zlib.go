@@ -3,6 +3,7 @@ package encodings
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"github.com/amitbet/vncproxy/common"
 )
@@ -33,6 +34,19 @@ func (z *ZLibEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle
 		return nil, err
 	}
 	StoreBytes(bytes, bts)
-	z.bytes = bytes.Bytes()
-	return z, nil
+	return &ZLibEncoding{bytes: bytes.Bytes()}, nil
+}
+
+// Decode inflates the rectangle's raw pixels from the connection's zlib stream
+func (z *ZLibEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	if len(z.bytes) < 4 {
+		return fmt.Errorf("ZLibEncoding.Decode: rect data too short: %d bytes", len(z.bytes))
+	}
+	area := rectArea(rect)
+	bpp := fb.bytesPerPixel()
+	pixels, err := fb.zlibStream(zlibStreamZlib).inflate(z.bytes[4:], area.Dx()*area.Dy()*bpp)
+	if err != nil {
+		return fmt.Errorf("ZLibEncoding.Decode: %v", err)
+	}
+	return fb.drawPixels(area, pixels, bpp)
 }
@@ -3,6 +3,9 @@ package encodings
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
 	"io"
 	"github.com/amitbet/vncproxy/common"
 )
@@ -33,6 +36,404 @@ func (z *ZRLEEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle
 		return nil, err
 	}
 	StoreBytes(bytes, bts)
-	z.bytes = bytes.Bytes()
-	return z, nil
+	return &ZRLEEncoding{bytes: bytes.Bytes()}, nil
+}
+
+// Decode inflates the rectangle's 64x64 tiles from the connection's zlib stream & draws them
+func (z *ZRLEEncoding) Decode(fb *Framebuffer, rect *common.Rectangle) error {
+	if len(z.bytes) < 4 {
+		return fmt.Errorf("ZRLEEncoding.Decode: rect data too short: %d bytes", len(z.bytes))
+	}
+	stream := fb.zlibStream(zlibStreamZRLE)
+	stream.Write(z.bytes[4:])
+	tiles := newRLETileReader(stream, &fb.pixelFormat, fb, false)
+	if err := tiles.readRect(rectArea(rect), 64); err != nil {
+		return fmt.Errorf("ZRLEEncoding.Decode: %v", err)
+	}
+	return nil
+}
+
+// Encode writes the 64x64 tiles of area, compressed on the viewer's ZRLE zlib stream
+func (z *ZRLEEncoding) Encode(s *EncoderState, w io.Writer, img image.Image, area image.Rectangle) error {
+	tiles := newRLETileWriter(s)
+	for ty := area.Min.Y; ty < area.Max.Y; ty += 64 {
+		for tx := area.Min.X; tx < area.Max.X; tx += 64 {
+			tiles.writeTile(img, image.Rect(tx, ty, min(tx+64, area.Max.X), min(ty+64, area.Max.Y)))
+		}
+	}
+	zw, _ := s.zlibWriter(zlibStreamZRLE, false)
+	data := zw.compress(tiles.buf)
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// rleTileWriter writes ZRLE tiles, each one with the subencoding which makes it the shortest
+type rleTileWriter struct {
+	s         *EncoderState
+	cpixelLen int
+	buf       []byte
+}
+
+// rleRun is a run of pixels of the same color
+type rleRun struct {
+	pixel  uint32
+	length int
+}
+
+func newRLETileWriter(s *EncoderState) *rleTileWriter {
+	return &rleTileWriter{s: s, cpixelLen: cpixelLength(&s.pixelFormat)}
+}
+
+// runLengthSize is the number of bytes a run length is written in
+func runLengthSize(length int) int {
+	return (length-1)/255 + 1
+}
+
+func (t *rleTileWriter) writeTile(img image.Image, tile image.Rectangle) {
+	pixels := t.s.pixels(img, tile)
+	colors := palette(pixels, 128)
+	if len(colors) == 1 {
+		t.buf = append(t.buf, 1)
+		t.writeCPixel(colors[0])
+		return
+	}
+
+	runs := []rleRun{}
+	for _, pixel := range pixels {
+		if len(runs) > 0 && runs[len(runs)-1].pixel == pixel {
+			runs[len(runs)-1].length++
+		} else {
+			runs = append(runs, rleRun{pixel: pixel, length: 1})
+		}
+	}
+	rawSize := len(pixels) * t.cpixelLen
+	plainRLESize := 0
+	paletteRLESize := len(colors) * t.cpixelLen
+	for _, run := range runs {
+		plainRLESize += t.cpixelLen + runLengthSize(run.length)
+		paletteRLESize++
+		if run.length > 1 {
+			paletteRLESize += runLengthSize(run.length)
+		}
+	}
+	packedSize, bits := rawSize+1, 4
+	if len(colors) <= 16 {
+		if len(colors) <= 2 {
+			bits = 1
+		} else if len(colors) <= 4 {
+			bits = 2
+		}
+		packedSize = len(colors)*t.cpixelLen + tile.Dy()*((tile.Dx()*bits+7)/8)
+	}
+	if len(colors) > 127 {
+		paletteRLESize = rawSize + 1
+	}
+
+	indexes := make(map[uint32]int)
+	for i, c := range colors {
+		indexes[c] = i
+	}
+	switch min(rawSize, plainRLESize, paletteRLESize, packedSize) {
+	case rawSize:
+		t.buf = append(t.buf, 0)
+		for _, pixel := range pixels {
+			t.writeCPixel(pixel)
+		}
+	case packedSize:
+		t.writePalette(uint8(len(colors)), colors)
+		w := tile.Dx()
+		for y := 0; y < tile.Dy(); y++ {
+			row := make([]byte, (w*bits+7)/8)
+			for x := 0; x < w; x++ {
+				shift := uint(8 - bits - (x*bits)%8)
+				row[x*bits/8] |= uint8(indexes[pixels[y*w+x]] << shift)
+			}
+			t.buf = append(t.buf, row...)
+		}
+	case plainRLESize:
+		t.buf = append(t.buf, 128)
+		for _, run := range runs {
+			t.writeCPixel(run.pixel)
+			t.writeRunLength(run.length)
+		}
+	default:
+		t.writePalette(uint8(128+len(colors)), colors)
+		for _, run := range runs {
+			if run.length == 1 {
+				t.buf = append(t.buf, uint8(indexes[run.pixel]))
+				continue
+			}
+			t.buf = append(t.buf, uint8(indexes[run.pixel])|0x80)
+			t.writeRunLength(run.length)
+		}
+	}
+}
+
+func (t *rleTileWriter) writePalette(subencoding uint8, colors []uint32) {
+	t.buf = append(t.buf, subencoding)
+	for _, c := range colors {
+		t.writeCPixel(c)
+	}
+}
+
+// writeCPixel writes a CPIXEL, dropping the byte a 3 byte CPIXEL doesn't use (see readCPixel)
+func (t *rleTileWriter) writeCPixel(pixel uint32) {
+	if t.cpixelLen != 3 {
+		t.buf = t.s.appendPixel(t.buf, pixel)
+		return
+	}
+	b := t.s.appendPixel(nil, pixel)
+	if cpixelFitsLow(&t.s.pixelFormat) == (t.s.pixelFormat.BigEndian == 0) {
+		t.buf = append(t.buf, b[:3]...)
+	} else {
+		t.buf = append(t.buf, b[1:]...)
+	}
+}
+
+// writeRunLength writes length-1 as bytes of 255 followed by a smaller one
+func (t *rleTileWriter) writeRunLength(length int) {
+	for length--; length >= 0xFF; length -= 0xFF {
+		t.buf = append(t.buf, 0xFF)
+	}
+	t.buf = append(t.buf, uint8(length))
+}
+
+// rleTileReader reads the tiles of ZRLE (64x64, inflated from the zlib stream) & TRLE (16x16) rectangles,
+// drawing them into fb when it is set, otherwise only reading over their data
+type rleTileReader struct {
+	r         io.Reader
+	pf        *common.PixelFormat
+	fb        *Framebuffer
+	trle      bool
+	cpixelLen int
+	palette   []color.RGBA // the last palette, TRLE's subencodings 127 & 129 reuse it
+	buf       []byte
+}
+
+func newRLETileReader(r io.Reader, pf *common.PixelFormat, fb *Framebuffer, trle bool) *rleTileReader {
+	return &rleTileReader{r: r, pf: pf, fb: fb, trle: trle, cpixelLen: cpixelLength(pf), buf: make([]byte, 4)}
+}
+
+// cpixelLength is the size of a CPIXEL: 3 bytes for 32 bit true-color pixels whose colors fit in 3 bytes, otherwise a pixel
+func cpixelLength(pf *common.PixelFormat) int {
+	if pf.TrueColor != 0 && pf.BPP == 32 && pf.Depth <= 24 && (cpixelFitsLow(pf) || cpixelFitsHigh(pf)) {
+		return 3
+	}
+	return pf.BytesPerPixel()
+}
+
+func cpixelFitsLow(pf *common.PixelFormat) bool {
+	all := uint32(pf.RedMax)<<pf.RedShift | uint32(pf.GreenMax)<<pf.GreenShift | uint32(pf.BlueMax)<<pf.BlueShift
+	return all < 1<<24
+}
+
+func cpixelFitsHigh(pf *common.PixelFormat) bool {
+	all := uint32(pf.RedMax)<<pf.RedShift | uint32(pf.GreenMax)<<pf.GreenShift | uint32(pf.BlueMax)<<pf.BlueShift
+	return all&0xFF == 0
+}
+
+func (t *rleTileReader) readBytes(n int) ([]byte, error) {
+	if cap(t.buf) < n {
+		t.buf = make([]byte, n)
+	}
+	buf := t.buf[:n]
+	if _, err := io.ReadFull(t.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (t *rleTileReader) readByte() (uint8, error) {
+	b, err := t.readBytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readCPixel reads a CPIXEL, a 3 byte one is the pixel without the byte its colors don't use
+func (t *rleTileReader) readCPixel() (color.RGBA, error) {
+	b, err := t.readBytes(t.cpixelLen)
+	if err != nil || t.fb == nil {
+		return color.RGBA{}, err
+	}
+	if t.cpixelLen != 3 {
+		return t.fb.pixelColor(b), nil
+	}
+	pixel := make([]byte, 4)
+	// the unused byte is the most significant one if the colors fit in the low 3 bytes
+	if cpixelFitsLow(t.pf) == (t.pf.BigEndian == 0) {
+		copy(pixel, b)
+	} else {
+		copy(pixel[1:], b)
+	}
+	return t.pf.PixelToColor(t.pf.ReadPixel(pixel), &t.fb.colorMap), nil
+}
+
+// readRunLength reads a run length: bytes of 255 are added until a smaller one, plus 1
+func (t *rleTileReader) readRunLength() (int, error) {
+	length := 1
+	for {
+		b, err := t.readByte()
+		if err != nil {
+			return 0, err
+		}
+		length += int(b)
+		if b != 0xFF {
+			return length, nil
+		}
+	}
+}
+
+func (t *rleTileReader) readPalette(size int) error {
+	t.palette = make([]color.RGBA, size)
+	for i := range t.palette {
+		c, err := t.readCPixel()
+		if err != nil {
+			return err
+		}
+		t.palette[i] = c
+	}
+	return nil
+}
+
+func (t *rleTileReader) set(tile image.Rectangle, i int, c color.RGBA) {
+	if t.fb != nil {
+		t.fb.img.SetRGBA(tile.Min.X+i%tile.Dx(), tile.Min.Y+i/tile.Dx(), c)
+	}
+}
+
+// readRect reads the rectangle's tiles, in rows from left to right
+func (t *rleTileReader) readRect(area image.Rectangle, tileSize int) error {
+	for ty := area.Min.Y; ty < area.Max.Y; ty += tileSize {
+		for tx := area.Min.X; tx < area.Max.X; tx += tileSize {
+			tile := image.Rect(tx, ty, min(tx+tileSize, area.Max.X), min(ty+tileSize, area.Max.Y))
+			if err := t.readTile(tile); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *rleTileReader) readTile(tile image.Rectangle) error {
+	subencoding, err := t.readByte()
+	if err != nil {
+		return err
+	}
+	pixelCount := tile.Dx() * tile.Dy()
+
+	switch {
+	case subencoding == 0:
+		// raw
+		for i := 0; i < pixelCount; i++ {
+			c, err := t.readCPixel()
+			if err != nil {
+				return err
+			}
+			t.set(tile, i, c)
+		}
+	case subencoding == 1:
+		// solid
+		c, err := t.readCPixel()
+		if err != nil {
+			return err
+		}
+		if t.fb != nil {
+			t.fb.fill(tile, c)
+		}
+	case subencoding <= 16 || (subencoding == 127 && t.trle):
+		// packed palette
+		if subencoding != 127 {
+			if err := t.readPalette(int(subencoding)); err != nil {
+				return err
+			}
+		}
+		return t.readPackedPalette(tile)
+	case subencoding == 128:
+		// plain rle
+		for i := 0; i < pixelCount; {
+			c, err := t.readCPixel()
+			if err != nil {
+				return err
+			}
+			length, err := t.readRunLength()
+			if err != nil {
+				return err
+			}
+			if i+length > pixelCount {
+				return fmt.Errorf("rle run of %d pixels overflows the tile %v", length, tile)
+			}
+			for ; length > 0; length-- {
+				t.set(tile, i, c)
+				i++
+			}
+		}
+	case subencoding >= 130 || (subencoding == 129 && t.trle):
+		// palette rle
+		if subencoding != 129 {
+			if err := t.readPalette(int(subencoding) - 128); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < pixelCount; {
+			index, err := t.readByte()
+			if err != nil {
+				return err
+			}
+			length := 1
+			if index&0x80 != 0 {
+				index &= 0x7F
+				if length, err = t.readRunLength(); err != nil {
+					return err
+				}
+			}
+			if int(index) >= len(t.palette) {
+				return fmt.Errorf("palette index %d out of %d colors", index, len(t.palette))
+			}
+			if i+length > pixelCount {
+				return fmt.Errorf("rle run of %d pixels overflows the tile %v", length, tile)
+			}
+			for ; length > 0; length-- {
+				t.set(tile, i, t.palette[index])
+				i++
+			}
+		}
+	default:
+		return fmt.Errorf("bad tile subencoding: %d", subencoding)
+	}
+	return nil
+}
+
+// readPackedPalette reads palette indexes packed to 1, 2 or 4 bits (for up to 2, 4 or 16 colors), msb first with rows padded to a byte
+func (t *rleTileReader) readPackedPalette(tile image.Rectangle) error {
+	if len(t.palette) == 0 {
+		return fmt.Errorf("packed palette tile without a palette")
+	}
+	bits := 4
+	if len(t.palette) <= 2 {
+		bits = 1
+	} else if len(t.palette) <= 4 {
+		bits = 2
+	}
+	w := tile.Dx()
+	rowSize := (w*bits + 7) / 8
+	for y := 0; y < tile.Dy(); y++ {
+		row, err := t.readBytes(rowSize)
+		if err != nil {
+			return err
+		}
+		for x := 0; x < w; x++ {
+			shift := uint(8 - bits - (x*bits)%8)
+			index := int(row[x*bits/8]>>shift) & (1<<uint(bits) - 1)
+			if index >= len(t.palette) {
+				return fmt.Errorf("palette index %d out of %d colors", index, len(t.palette))
+			}
+			t.set(tile, y*w+x, t.palette[index])
+		}
+	}
+	return nil
 }
@@ -0,0 +1,171 @@
+package encodings
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// cpixels encodes colors as CPIXELs, 32 bit pixels without their unused byte
+func cpixels(pf *common.PixelFormat, colors ...color.RGBA) []byte {
+	if cpixelLength(pf) != 3 {
+		return pixelBytes(pf, colors...)
+	}
+	buf := []byte{}
+	for _, c := range colors {
+		pixel := pixelBytes(pf, c)
+		if pf.BigEndian != 0 {
+			pixel = pixel[1:]
+		}
+		buf = append(buf, pixel[:3]...)
+	}
+	return buf
+}
+
+func TestZRLETiles(t *testing.T) {
+	bigEndian := *common.NewPixelFormat(32)
+	bigEndian.BigEndian = 1
+	rgb565 := &common.PixelFormat{BPP: 16, Depth: 16, TrueColor: 1, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+
+	for _, pf := range []*common.PixelFormat{common.NewPixelFormat(32), &bigEndian, rgb565} {
+		fb := NewFramebuffer(70, 20, *pf)
+
+		// a 70x20 rect: the first 64x20 tile is solid green, the second (6x20) raw.
+		// a second 4x2 rect tests the packed palettes & palette rle, on the same zlib stream
+		tiles := &bytes.Buffer{}
+		tiles.WriteByte(1)
+		tiles.Write(cpixels(pf, green))
+		tiles.WriteByte(0)
+		for i := 0; i < 6*20; i++ {
+			tiles.Write(cpixels(pf, [3]color.RGBA{red, green, blue}[i%3]))
+		}
+
+		second := &bytes.Buffer{}
+		// 2 colors, 1 bit per pixel: a row is 4 bits (0101), padded to a byte
+		second.WriteByte(2)
+		second.Write(cpixels(pf, red, blue))
+		second.Write([]byte{0x50, 0x50})
+
+		third := &bytes.Buffer{}
+		// palette rle with 3 colors: a run of 5 blue, a single red, a run of 2 green
+		third.WriteByte(128 + 3)
+		third.Write(cpixels(pf, red, green, blue))
+		third.Write([]byte{0x82, 4, 0, 0x81, 1})
+
+		compressed := &bytes.Buffer{}
+		zw := zlib.NewWriter(compressed)
+		rectData := func(tiles []byte) []byte {
+			compressed.Reset()
+			zw.Write(tiles)
+			zw.Flush()
+			data := &bytes.Buffer{}
+			binary.Write(data, binary.BigEndian, uint32(compressed.Len()))
+			data.Write(compressed.Bytes())
+			return data.Bytes()
+		}
+		applyRect(t, fb, &ZRLEEncoding{}, common.Rectangle{Width: 70, Height: 20}, rectData(tiles.Bytes()))
+		checkColors(t, fb, image.Rect(0, 0, 64, 20), green)
+		for i := 0; i < 6*20; i++ {
+			if c, expected := fb.RGBA().RGBAAt(64+i%6, i/6), [3]color.RGBA{red, green, blue}[i%3]; c != expected {
+				t.Fatalf("%d bpp: unexpected raw tile color at %d: %v, expected %v", pf.BPP, i, c, expected)
+			}
+		}
+
+		applyRect(t, fb, &ZRLEEncoding{}, common.Rectangle{X: 0, Y: 0, Width: 4, Height: 2}, rectData(second.Bytes()))
+		applyRect(t, fb, &ZRLEEncoding{}, common.Rectangle{X: 10, Y: 10, Width: 4, Height: 2}, rectData(third.Bytes()))
+		for y := 0; y < 2; y++ {
+			checkColors(t, fb, image.Rect(0, y, 1, y+1), red)
+			checkColors(t, fb, image.Rect(1, y, 2, y+1), blue)
+			checkColors(t, fb, image.Rect(2, y, 3, y+1), red)
+			checkColors(t, fb, image.Rect(3, y, 4, y+1), blue)
+		}
+		checkColors(t, fb, image.Rect(10, 10, 14, 11), blue)
+		checkColors(t, fb, image.Rect(10, 11, 11, 12), blue)
+		checkColors(t, fb, image.Rect(11, 11, 12, 12), red)
+		checkColors(t, fb, image.Rect(12, 11, 14, 12), green)
+	}
+}
+
+func TestTRLE(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := NewFramebuffer(32, 16, *pf)
+
+	tiles := &bytes.Buffer{}
+	// the first tile: plain rle, 100 red pixels & 156 blue ones
+	tiles.WriteByte(128)
+	tiles.Write(cpixels(pf, red))
+	tiles.WriteByte(99)
+	tiles.Write(cpixels(pf, blue))
+	tiles.WriteByte(155)
+	// the second tile: 5 colors packed to 4 bits
+	tiles.WriteByte(5)
+	tiles.Write(cpixels(pf, red, green, blue, red, green))
+	for i := 0; i < 16*16/2; i++ {
+		tiles.WriteByte(0x12)
+	}
+	// trailing bytes of the next message mustn't be read as part of the rect
+	tiles.Write([]byte{0xDE, 0xAD})
+
+	rect := common.Rectangle{Width: 32, Height: 16}
+	r := common.NewRfbReadHelper(tiles)
+	enc, err := (&TRLEEncoding{}).Read(pf, &rect, r)
+	if err != nil {
+		t.Fatalf("error reading trle rect: %v", err)
+	}
+	if tiles.Len() != 2 {
+		t.Fatalf("the trle reader left %d bytes, expected 2", tiles.Len())
+	}
+	rect.Enc = enc
+	if _, err := fb.ApplyRect(&rect); err != nil {
+		t.Fatalf("error applying trle rect: %v", err)
+	}
+	checkColors(t, fb, image.Rect(0, 0, 16, 6), red)
+	checkColors(t, fb, image.Rect(0, 6, 4, 7), red)
+	checkColors(t, fb, image.Rect(4, 6, 16, 7), blue)
+	checkColors(t, fb, image.Rect(0, 7, 16, 16), blue)
+	for x := 16; x < 32; x += 2 {
+		checkColors(t, fb, image.Rect(x, 0, x+1, 16), green)
+		checkColors(t, fb, image.Rect(x+1, 0, x+2, 16), blue)
+	}
+
+	// palettes are only reused within a rect
+	next := common.Rectangle{Width: 16, Height: 16}
+	if _, err := (&TRLEEncoding{}).Read(pf, &next, common.NewRfbReadHelper(bytes.NewReader([]byte{129, 0}))); err == nil {
+		t.Fatalf("expected an error reusing a palette in a new rect")
+	}
+	// a red tile packed with 2 colors, then a palette rle tile reusing them: a run of 254 reds & 2 single blues
+	rect2 := append(append([]byte{2}, cpixels(pf, blue, red)...), bytes.Repeat([]byte{0xFF, 0xFF}, 16)...)
+	rect2 = append(rect2, 129, 0x81, 253, 0, 0)
+	next = common.Rectangle{Width: 32, Height: 16}
+	enc, err = (&TRLEEncoding{}).Read(pf, &next, common.NewRfbReadHelper(bytes.NewReader(rect2)))
+	if err != nil {
+		t.Fatalf("error reading trle rect with a reused palette: %v", err)
+	}
+	next.Enc = enc
+	if _, err := fb.ApplyRect(&next); err != nil {
+		t.Fatalf("error applying trle rect with a reused palette: %v", err)
+	}
+	checkColors(t, fb, image.Rect(0, 0, 16, 16), red)
+	checkColors(t, fb, image.Rect(16, 0, 32, 15), red)
+	checkColors(t, fb, image.Rect(16, 15, 30, 16), red)
+	checkColors(t, fb, image.Rect(30, 15, 32, 16), blue)
+}
+
+func TestCPixelLength(t *testing.T) {
+	if l := cpixelLength(common.NewPixelFormat(32)); l != 3 {
+		t.Fatalf("unexpected cpixel length for 24 bit depth: %d", l)
+	}
+	full := &common.PixelFormat{BPP: 32, Depth: 32, TrueColor: 1, RedMax: 1023, GreenMax: 1023, BlueMax: 1023, RedShift: 20, GreenShift: 10}
+	if l := cpixelLength(full); l != 4 {
+		t.Fatalf("unexpected cpixel length for 30 bit colors: %d", l)
+	}
+	high := &common.PixelFormat{BPP: 32, Depth: 24, TrueColor: 1, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 24, GreenShift: 16, BlueShift: 8}
+	if l := cpixelLength(high); l != 3 {
+		t.Fatalf("unexpected cpixel length for colors in the high bytes: %d", l)
+	}
+}
@@ -0,0 +1,203 @@
+package encodings
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// DefaultCompressionLevel is the zlib level used for viewers which didn't ask for a compression level
+const DefaultCompressionLevel = 6
+
+// Encoder is implemented by the encodings which can encode a region of an image, to send it to a viewer
+type Encoder interface {
+	common.IEncoding
+	Encode(s *EncoderState, w io.Writer, img image.Image, area image.Rectangle) error
+}
+
+// EncoderState is what encoding rectangles for a viewer depends on: its pixel format, the encodings it asked for
+// (in its order of preference, with the compression level & jpeg quality pseudo encodings) and the zlib streams.
+// the viewer keeps its side of the zlib streams, so all the rectangles sent to a viewer must be encoded with the same
+// EncoderState, in the order they are sent. an EncoderState is not safe for concurrent use
+type EncoderState struct {
+	pixelFormat      common.PixelFormat
+	encodings        []common.EncodingType
+	compressionLevel int
+	jpegQuality      int // the jpeg quality level (0-9) the viewer asked for, -1 = no jpeg
+	streams          [zlibStreamCount]*zlibWriter
+}
+
+func NewEncoderState(pf common.PixelFormat) *EncoderState {
+	return &EncoderState{pixelFormat: pf, compressionLevel: DefaultCompressionLevel, jpegQuality: -1}
+}
+
+func (s *EncoderState) SetPixelFormat(pf common.PixelFormat) {
+	s.pixelFormat = pf
+}
+
+// SetEncodings records the encodings a viewer asked for in a SetEncodings message, the first compression level
+// & jpeg quality pseudo encodings in the list are used
+func (s *EncoderState) SetEncodings(encs []common.EncodingType) {
+	s.encodings = encs
+	s.compressionLevel = -1
+	s.jpegQuality = -1
+	for _, enc := range encs {
+		if enc >= common.EncCompressionLevel1 && enc <= common.EncCompressionLevel10 && s.compressionLevel < 0 {
+			s.compressionLevel = int(enc - common.EncCompressionLevel1)
+		}
+		if enc >= common.EncJPEGQualityLevelPseudo1 && enc <= common.EncJPEGQualityLevelPseudo10 && s.jpegQuality < 0 {
+			s.jpegQuality = int(enc - common.EncJPEGQualityLevelPseudo1)
+		}
+	}
+	if s.compressionLevel < 0 {
+		s.compressionLevel = DefaultCompressionLevel
+	}
+}
+
+// Supports reports if the viewer asked for an encoding (or pseudo encoding)
+func (s *EncoderState) Supports(encType common.EncodingType) bool {
+	for _, enc := range s.encodings {
+		if enc == encType {
+			return true
+		}
+	}
+	return false
+}
+
+// Encoder returns an encoder for the viewer's most preferred encoding which can be encoded, Raw if there is none
+func (s *EncoderState) Encoder() Encoder {
+	for _, enc := range s.encodings {
+		if e := NewEncoder(enc); e != nil {
+			return e
+		}
+	}
+	return &RawEncoding{}
+}
+
+// NewEncoder returns an encoder for an encoding type, nil if it can't be encoded.
+// CopyRect isn't returned since it needs its source (see NewCopyRectEncoding)
+func NewEncoder(encType common.EncodingType) Encoder {
+	switch encType {
+	case common.EncRaw:
+		return &RawEncoding{}
+	case common.EncRRE:
+		return &RREEncoding{}
+	case common.EncHextile:
+		return &HextileEncoding{}
+	case common.EncZRLE:
+		return &ZRLEEncoding{}
+	case common.EncTight:
+		return &TightEncoding{}
+	}
+	return nil
+}
+
+// SplitRect splits an area into the rectangles enc can send, only tight rectangles are limited in size
+func (s *EncoderState) SplitRect(enc Encoder, area image.Rectangle) []image.Rectangle {
+	if _, ok := enc.(*TightEncoding); !ok || area.Empty() {
+		return []image.Rectangle{area}
+	}
+	w := min(area.Dx(), tightMaxRectWidth)
+	h := max(1, min(area.Dy(), tightMaxRectSize/w))
+	rects := []image.Rectangle{}
+	for y := area.Min.Y; y < area.Max.Y; y += h {
+		for x := area.Min.X; x < area.Max.X; x += w {
+			rects = append(rects, image.Rect(x, y, min(x+w, area.Max.X), min(y+h, area.Max.Y)))
+		}
+	}
+	return rects
+}
+
+// WriteRect writes a rectangle of a FramebufferUpdate: its header & the area of img encoded with enc,
+// the area must be one of the rectangles SplitRect returns
+func (s *EncoderState) WriteRect(w io.Writer, enc Encoder, img image.Image, area image.Rectangle) error {
+	header := []uint16{uint16(area.Min.X), uint16(area.Min.Y), uint16(area.Dx()), uint16(area.Dy())}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, enc.Type()); err != nil {
+		return err
+	}
+	return enc.Encode(s, w, img, area)
+}
+
+// pixels returns the pixels of area (in rows) in the viewer's pixel format
+func (s *EncoderState) pixels(img image.Image, area image.Rectangle) []uint32 {
+	pixels := make([]uint32, 0, area.Dx()*area.Dy())
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			pixels = append(pixels, s.pixelFormat.ColorToPixel(rgbaAt(img, x, y)))
+		}
+	}
+	return pixels
+}
+
+// rgbaAt returns the color of an image's pixel, without converting colors for the framebuffer & RGBA images
+func rgbaAt(img image.Image, x, y int) color.RGBA {
+	switch img := img.(type) {
+	case *Framebuffer:
+		return img.img.RGBAAt(x, y)
+	case *image.RGBA:
+		return img.RGBAAt(x, y)
+	}
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+// appendPixel appends a pixel as it is sent on the wire
+func (s *EncoderState) appendPixel(buf []byte, pixel uint32) []byte {
+	var b [4]byte
+	bpp := s.pixelFormat.BytesPerPixel()
+	s.pixelFormat.WritePixel(b[:bpp], pixel)
+	return append(buf, b[:bpp]...)
+}
+
+// palette returns the distinct pixels in the order they appear, it stops counting after limit pixels
+func palette(pixels []uint32, limit int) []uint32 {
+	colors := []uint32{}
+	seen := make(map[uint32]bool)
+	for _, pixel := range pixels {
+		if !seen[pixel] {
+			if len(colors) == limit {
+				break
+			}
+			seen[pixel] = true
+			colors = append(colors, pixel)
+		}
+	}
+	return colors
+}
+
+// zlibWriter is the sending side of a zlib stream which spans all the rectangles sent to a viewer (see zlibStream)
+type zlibWriter struct {
+	out   bytes.Buffer
+	w     *zlib.Writer
+	level int
+}
+
+// compress compresses the data of a rectangle, flushing the stream so the viewer can inflate all of it.
+// the returned data is valid until the next call
+func (z *zlibWriter) compress(data []byte) []byte {
+	z.out.Reset()
+	z.w.Write(data)
+	z.w.Flush()
+	return z.out.Bytes()
+}
+
+// zlibWriter returns one of the viewer's zlib streams, a stream which can be reset is started over when the viewer asks
+// for another compression level, reset reports that the viewer must start its stream over too
+func (s *EncoderState) zlibWriter(id int, resettable bool) (zw *zlibWriter, reset bool) {
+	zw = s.streams[id]
+	if zw != nil && (zw.level == s.compressionLevel || !resettable) {
+		return zw, false
+	}
+	reset = zw != nil
+	zw = &zlibWriter{level: s.compressionLevel}
+	zw.w, _ = zlib.NewWriterLevel(&zw.out, s.compressionLevel)
+	s.streams[id] = zw
+	return zw, reset
+}
@@ -0,0 +1,167 @@
+package encodings
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// testImage has areas for each kind of tile: a solid background, 2 colors, a few colors & many colors
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := blue
+			switch {
+			case x < w/4 && y%5 == 0:
+				c = red
+			case x >= w/4 && x < w/2 && (x+y)%3 == 0:
+				c = [3]color.RGBA{red, green, blue}[(x*y)%3]
+			case x >= w/2 && y < h/2:
+				c = color.RGBA{uint8(x * 7), uint8(y * 13), uint8(x * y), 0xFF}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// encodeRects encodes areas of img for a viewer & applies them to fb, as the viewer would
+func encodeRects(t *testing.T, s *EncoderState, fb *Framebuffer, enc Encoder, img image.Image, areas ...image.Rectangle) {
+	for _, area := range areas {
+		buf := &bytes.Buffer{}
+		if err := enc.Encode(s, buf, img, area); err != nil {
+			t.Fatalf("error encoding %T rect: %v", enc, err)
+		}
+		rect := common.Rectangle{X: uint16(area.Min.X), Y: uint16(area.Min.Y), Width: uint16(area.Dx()), Height: uint16(area.Dy())}
+		applyRect(t, fb, enc, rect, buf.Bytes())
+	}
+}
+
+// checkImage compares fb to img, as the pixel format shows it. tolerance allows for lossy (jpeg) compression
+func checkImage(t *testing.T, fb *Framebuffer, img *image.RGBA, area image.Rectangle, tolerance int) {
+	pf := fb.PixelFormat()
+	diff := func(a, b uint8) int { return max(int(a), int(b)) - min(int(a), int(b)) }
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			c, expected := fb.RGBA().RGBAAt(x, y), pf.PixelToColor(pf.ColorToPixel(img.RGBAAt(x, y)), nil)
+			if diff(c.R, expected.R) > tolerance || diff(c.G, expected.G) > tolerance || diff(c.B, expected.B) > tolerance {
+				t.Fatalf("unexpected color at %d,%d: %v, expected %v", x, y, c, expected)
+			}
+		}
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	bigEndian := *common.NewPixelFormat(32)
+	bigEndian.BigEndian = 1
+	rgb565 := &common.PixelFormat{BPP: 16, Depth: 16, TrueColor: 1, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+	img := testImage(100, 70)
+
+	for _, pf := range []*common.PixelFormat{common.NewPixelFormat(32), &bigEndian, rgb565} {
+		for _, enc := range []Encoder{&RawEncoding{}, &RREEncoding{}, &HextileEncoding{}, &ZRLEEncoding{}, &TightEncoding{}} {
+			s := NewEncoderState(*pf)
+			fb := NewFramebuffer(100, 70, *pf)
+			// the whole image, then parts of it continuing the zlib streams
+			encodeRects(t, s, fb, enc, img, img.Rect, image.Rect(3, 5, 40, 9), image.Rect(60, 10, 61, 11), image.Rect(45, 30, 90, 70))
+			checkImage(t, fb, img, img.Rect, 0)
+		}
+	}
+}
+
+func TestEncoderFramebufferSource(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	src := NewFramebuffer(40, 20, *pf)
+	copyRGBA(src.RGBA(), testImage(40, 20), image.Rect(0, 0, 40, 20), image.Point{})
+
+	fb := NewFramebuffer(40, 20, *pf)
+	encodeRects(t, NewEncoderState(*pf), fb, &ZRLEEncoding{}, src, src.Bounds())
+	checkImage(t, fb, src.RGBA(), src.Bounds(), 0)
+
+	// copy the top left corner to the bottom right
+	encodeRects(t, NewEncoderState(*pf), fb, NewCopyRectEncoding(image.Pt(0, 0)), src, image.Rect(30, 10, 40, 20))
+	checkImage(t, fb, src.RGBA(), image.Rect(0, 0, 30, 10), 0)
+	for y := 10; y < 20; y++ {
+		for x := 30; x < 40; x++ {
+			if c, expected := fb.RGBA().RGBAAt(x, y), src.RGBA().RGBAAt(x-30, y-10); c != expected {
+				t.Fatalf("unexpected color at %d,%d: %v, expected %v", x, y, c, expected)
+			}
+		}
+	}
+}
+
+func TestTightEncoderSettings(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	img := testImage(100, 70)
+	// a smooth gradient, which jpeg keeps close to the original
+	for y := 0; y < 35; y++ {
+		for x := 50; x < 100; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 2), uint8(y * 4), 0x80, 0xFF})
+		}
+	}
+	s := NewEncoderState(*pf)
+	fb := NewFramebuffer(100, 70, *pf)
+
+	// jpeg for the many colored area, the other areas stay lossless
+	s.SetEncodings([]common.EncodingType{common.EncTight, common.EncJPEGQualityLevelPseudo10, common.EncCompressionLevel2})
+	if s.jpegQuality != 9 || s.compressionLevel != 1 {
+		t.Fatalf("unexpected jpeg quality & compression level: %d, %d", s.jpegQuality, s.compressionLevel)
+	}
+	encodeRects(t, s, fb, s.Encoder(), img, image.Rect(0, 0, 50, 70))
+	checkImage(t, fb, img, image.Rect(0, 0, 50, 70), 0)
+	buf := &bytes.Buffer{}
+	if err := s.Encoder().Encode(s, buf, img, image.Rect(50, 0, 100, 35)); err != nil {
+		t.Fatalf("error encoding tight rect: %v", err)
+	}
+	if compctl := buf.Bytes()[0]; compctl>>4 != TightJpeg {
+		t.Fatalf("expected jpeg compression, compression control: %x", compctl)
+	}
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{X: 50, Width: 50, Height: 35}, buf.Bytes())
+	checkImage(t, fb, img, image.Rect(50, 0, 100, 35), 8)
+
+	// another compression level starts the streams over, the viewer's streams are reset by the compression control byte
+	s.SetEncodings([]common.EncodingType{common.EncTight, common.EncCompressionLevel10})
+	buf.Reset()
+	if err := s.Encoder().Encode(s, buf, img, image.Rect(0, 0, 25, 10)); err != nil {
+		t.Fatalf("error encoding tight rect: %v", err)
+	}
+	if compctl := buf.Bytes()[0]; compctl&0x0F == 0 {
+		t.Fatalf("expected a stream reset after a compression level change, compression control: %x", compctl)
+	}
+	applyRect(t, fb, &TightEncoding{}, common.Rectangle{Width: 25, Height: 10}, buf.Bytes())
+	encodeRects(t, s, fb, s.Encoder(), img, image.Rect(50, 0, 100, 70))
+	checkImage(t, fb, img, img.Rect, 0)
+}
+
+func TestEncoderSelection(t *testing.T) {
+	s := NewEncoderState(*common.NewPixelFormat(32))
+	if _, ok := s.Encoder().(*RawEncoding); !ok {
+		t.Fatalf("expected raw before the viewer sets its encodings, got %T", s.Encoder())
+	}
+	s.SetEncodings([]common.EncodingType{common.EncCursorPseudo, common.EncTightPng, common.EncHextile, common.EncZRLE})
+	if _, ok := s.Encoder().(*HextileEncoding); !ok {
+		t.Fatalf("expected the first encoding which can be encoded, got %T", s.Encoder())
+	}
+	if !s.Supports(common.EncCursorPseudo) || s.Supports(common.EncDesktopSizePseudo) {
+		t.Fatalf("unexpected pseudo encoding support")
+	}
+
+	area := image.Rect(10, 0, 5000, 100)
+	if rects := s.SplitRect(&HextileEncoding{}, area); len(rects) != 1 || rects[0] != area {
+		t.Fatalf("unexpected hextile split: %v", rects)
+	}
+	rects := s.SplitRect(&TightEncoding{}, area)
+	covered := 0
+	for _, r := range rects {
+		if r.Dx() > tightMaxRectWidth || r.Dx()*r.Dy() > tightMaxRectSize || !r.In(area) {
+			t.Fatalf("bad tight rect: %v", r)
+		}
+		covered += r.Dx() * r.Dy()
+	}
+	if covered != area.Dx()*area.Dy() {
+		t.Fatalf("tight rects cover %d pixels of %d", covered, area.Dx()*area.Dy())
+	}
+}
@@ -0,0 +1,215 @@
+package encodings
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// the zlib streams of a connection, each encoding using zlib keeps its own stream(s) for the whole connection
+const (
+	zlibStreamZlib = iota
+	zlibStreamZRLE
+	zlibStreamTight // followed by the other 3 tight streams
+	zlibStreamCount = zlibStreamTight + 4
+)
+
+// Decoder is implemented by the encodings which can draw the rectangle they read into a Framebuffer
+type Decoder interface {
+	Decode(fb *Framebuffer, rect *common.Rectangle) error
+}
+
+// Framebuffer is a decoded copy of a vnc server's screen, the rectangles of FramebufferUpdate messages are drawn
+// into it (see ApplyRect) using the connection's pixel format & color map.
+// it keeps the connection's zlib streams, so all the rectangles of a connection must be applied to the same Framebuffer,
+// in the order they were read. a Framebuffer is not safe for concurrent use
+type Framebuffer struct {
+	img         *image.RGBA
+	pixelFormat common.PixelFormat
+	colorMap    common.ColorMap
+	streams     [zlibStreamCount]*zlibStream
+}
+
+func NewFramebuffer(width, height uint16, pf common.PixelFormat) *Framebuffer {
+	return &Framebuffer{
+		img:         image.NewRGBA(image.Rect(0, 0, int(width), int(height))),
+		pixelFormat: pf,
+	}
+}
+
+// RGBA returns the screen image, it is changed in place by ApplyRect (and replaced by Resize)
+func (fb *Framebuffer) RGBA() *image.RGBA {
+	return fb.img
+}
+
+func (fb *Framebuffer) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (fb *Framebuffer) Bounds() image.Rectangle {
+	return fb.img.Rect
+}
+
+func (fb *Framebuffer) At(x, y int) color.Color {
+	return fb.img.At(x, y)
+}
+
+func (fb *Framebuffer) PixelFormat() common.PixelFormat {
+	return fb.pixelFormat
+}
+
+// SetPixelFormat changes the format of the rectangles applied from now on (after a SetPixelFormat message)
+func (fb *Framebuffer) SetPixelFormat(pf common.PixelFormat) {
+	fb.pixelFormat = pf
+}
+
+func (fb *Framebuffer) SetColorMapEntries(first uint16, colors []common.Color) {
+	for i, c := range colors {
+		if int(first)+i < len(fb.colorMap) {
+			fb.colorMap[int(first)+i] = c
+		}
+	}
+}
+
+// Resize changes the screen size, keeping the part of the screen which is still inside it
+func (fb *Framebuffer) Resize(width, height uint16) {
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	copyRGBA(img, fb.img, fb.img.Rect, image.Point{})
+	fb.img = img
+}
+
+// ResetStreams drops the zlib streams' state, for a new connection to the server
+func (fb *Framebuffer) ResetStreams() {
+	for i := range fb.streams {
+		fb.streams[i] = nil
+	}
+}
+
+// ApplyRect draws a rectangle which was read from a FramebufferUpdate into the framebuffer, it returns the area that
+// was changed (the whole screen for a desktop size change, empty for the other pseudo encodings).
+// an error means the rectangle's encoding can't be decoded or its data is broken, later rectangles using the same zlib stream
+// can't be decoded either
+func (fb *Framebuffer) ApplyRect(rect *common.Rectangle) (image.Rectangle, error) {
+	if rect.Enc == nil {
+		return image.Rectangle{}, nil
+	}
+	encType := common.EncodingType(rect.Enc.Type())
+	if encType == common.EncDesktopSizePseudo {
+		fb.Resize(rect.Width, rect.Height)
+		return fb.img.Rect, nil
+	}
+
+	dec, ok := rect.Enc.(Decoder)
+	if !ok {
+		if strings.Contains(encType.String(), "Pseudo") {
+			return image.Rectangle{}, nil
+		}
+		return image.Rectangle{}, fmt.Errorf("Framebuffer.ApplyRect: can't decode encoding %s", encType)
+	}
+	if err := dec.Decode(fb, rect); err != nil {
+		return image.Rectangle{}, err
+	}
+	return rectArea(rect).Intersect(fb.img.Rect), nil
+}
+
+func rectArea(rect *common.Rectangle) image.Rectangle {
+	return image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+}
+
+// bytesPerPixel is the size of a pixel on the wire
+func (fb *Framebuffer) bytesPerPixel() int {
+	return fb.pixelFormat.BytesPerPixel()
+}
+
+// pixelColor converts a pixel on the wire to its color, using the color map if the pixel format isn't true-color
+func (fb *Framebuffer) pixelColor(buf []byte) color.RGBA {
+	return fb.pixelFormat.PixelToColor(fb.pixelFormat.ReadPixel(buf), &fb.colorMap)
+}
+
+func (fb *Framebuffer) fill(area image.Rectangle, c color.RGBA) {
+	area = area.Intersect(fb.img.Rect)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			fb.img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// drawPixels draws the pixels of area, in row order, from wire pixels of bpp bytes each
+func (fb *Framebuffer) drawPixels(area image.Rectangle, pixels []byte, bpp int) error {
+	if bpp == 0 || len(pixels) < area.Dx()*area.Dy()*bpp {
+		return fmt.Errorf("Framebuffer.drawPixels: %d bytes are too short for %v", len(pixels), area)
+	}
+	for y := 0; y < area.Dy(); y++ {
+		for x := 0; x < area.Dx(); x++ {
+			p := image.Point{area.Min.X + x, area.Min.Y + y}
+			if p.In(fb.img.Rect) {
+				fb.img.SetRGBA(p.X, p.Y, fb.pixelColor(pixels[(y*area.Dx()+x)*bpp:]))
+			}
+		}
+	}
+	return nil
+}
+
+// zlibStream returns one of the connection's zlib streams
+func (fb *Framebuffer) zlibStream(id int) *zlibStream {
+	if fb.streams[id] == nil {
+		fb.streams[id] = &zlibStream{}
+	}
+	return fb.streams[id]
+}
+
+// copyRGBA copies the srcRect part of src into dst at dstPoint, clipping to both images
+func copyRGBA(dst *image.RGBA, src *image.RGBA, srcRect image.Rectangle, dstPoint image.Point) {
+	srcRect = srcRect.Intersect(src.Rect)
+	for y := srcRect.Min.Y; y < srcRect.Max.Y; y++ {
+		for x := srcRect.Min.X; x < srcRect.Max.X; x++ {
+			p := image.Point{dstPoint.X + x - srcRect.Min.X, dstPoint.Y + y - srcRect.Min.Y}
+			if p.In(dst.Rect) {
+				dst.SetRGBA(p.X, p.Y, src.RGBAAt(x, y))
+			}
+		}
+	}
+}
+
+// zlibStream is a zlib stream which spans all the rectangles of a connection: the server flushes (but doesn't end) the stream
+// after each rectangle, so the compressed data of every rectangle is appended to the input, and inflated with the
+// dictionary the previous rectangles left
+type zlibStream struct {
+	input  bytes.Buffer
+	reader io.ReadCloser
+}
+
+// Write appends the compressed data of a rectangle
+func (s *zlibStream) Write(p []byte) (int, error) {
+	return s.input.Write(p)
+}
+
+// Read returns inflated data, it must not read past the data of the rectangles written so far.
+// the input is a bytes.Buffer (an io.ByteReader), so the inflater doesn't read ahead of the data it needs
+func (s *zlibStream) Read(p []byte) (int, error) {
+	if s.reader == nil {
+		r, err := zlib.NewReader(&s.input)
+		if err != nil {
+			return 0, err
+		}
+		s.reader = r
+	}
+	return s.reader.Read(p)
+}
+
+// inflate appends the compressed data of a rectangle, and returns length bytes of inflated data
+func (s *zlibStream) inflate(compressed []byte, length int) ([]byte, error) {
+	s.Write(compressed)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(s, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
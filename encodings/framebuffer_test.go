@@ -0,0 +1,145 @@
+package encodings
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+var (
+	red   = color.RGBA{0xFF, 0, 0, 0xFF}
+	green = color.RGBA{0, 0xFF, 0, 0xFF}
+	blue  = color.RGBA{0, 0, 0xFF, 0xFF}
+)
+
+// pixelBytes encodes colors in the pixel format, as a server sends them
+func pixelBytes(pf *common.PixelFormat, colors ...color.RGBA) []byte {
+	buf := make([]byte, len(colors)*pf.BytesPerPixel())
+	for i, c := range colors {
+		pf.WritePixel(buf[i*pf.BytesPerPixel():], pf.ColorToPixel(c))
+	}
+	return buf
+}
+
+// applyRect reads a rectangle's data with enc & draws it into fb
+func applyRect(t *testing.T, fb *Framebuffer, enc common.IEncoding, rect common.Rectangle, data []byte) {
+	pf := fb.PixelFormat()
+	var err error
+	rect.Enc, err = enc.Read(&pf, &rect, common.NewRfbReadHelper(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("error reading %T rect: %v", enc, err)
+	}
+	if _, err := fb.ApplyRect(&rect); err != nil {
+		t.Fatalf("error applying %T rect: %v", enc, err)
+	}
+}
+
+func checkColors(t *testing.T, fb *Framebuffer, area image.Rectangle, expected color.RGBA) {
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if c := fb.RGBA().RGBAAt(x, y); c != expected {
+				t.Fatalf("unexpected color at %d,%d: %v, expected %v", x, y, c, expected)
+			}
+		}
+	}
+}
+
+func TestFramebufferZlibStream(t *testing.T) {
+	// rgb565, big endian
+	pf := &common.PixelFormat{BPP: 16, Depth: 16, BigEndian: 1, TrueColor: 1, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+	fb := NewFramebuffer(4, 4, *pf)
+
+	// the server keeps a single zlib stream, flushed after each rect
+	compressed := &bytes.Buffer{}
+	zw := zlib.NewWriter(compressed)
+	rectData := func(pixels []byte) []byte {
+		compressed.Reset()
+		zw.Write(pixels)
+		zw.Flush()
+		data := &bytes.Buffer{}
+		binary.Write(data, binary.BigEndian, uint32(compressed.Len()))
+		data.Write(compressed.Bytes())
+		return data.Bytes()
+	}
+
+	applyRect(t, fb, &ZLibEncoding{}, common.Rectangle{X: 0, Y: 0, Width: 4, Height: 2},
+		rectData(pixelBytes(pf, red, red, red, red, red, red, red, red)))
+	applyRect(t, fb, &ZLibEncoding{}, common.Rectangle{X: 0, Y: 2, Width: 4, Height: 2},
+		rectData(pixelBytes(pf, blue, blue, blue, blue, red, red, red, red)))
+
+	checkColors(t, fb, image.Rect(0, 0, 4, 2), red)
+	checkColors(t, fb, image.Rect(0, 2, 4, 3), blue)
+	checkColors(t, fb, image.Rect(0, 3, 4, 4), red)
+
+	// a new connection starts a new stream
+	fb.ResetStreams()
+	compressed.Reset()
+	zw.Reset(compressed)
+	applyRect(t, fb, &ZLibEncoding{}, common.Rectangle{X: 0, Y: 0, Width: 1, Height: 1}, rectData(pixelBytes(pf, green)))
+	checkColors(t, fb, image.Rect(0, 0, 1, 1), green)
+}
+
+func TestFramebufferHextile(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := NewFramebuffer(20, 16, *pf)
+
+	data := &bytes.Buffer{}
+	// first tile (16x16): red background, a blue foreground subrect at 1,2 sized 3x4
+	data.WriteByte(HextileBackgroundSpecified | HextileForegroundSpecified | HextileAnySubrects)
+	data.Write(pixelBytes(pf, red))
+	data.Write(pixelBytes(pf, blue))
+	data.Write([]byte{1, 1<<4 | 2, 2<<4 | 3})
+	// second tile (4x16): the same background, a green colored subrect at 0,0 sized 4x1
+	data.WriteByte(HextileAnySubrects | HextileSubrectsColoured)
+	data.Write([]byte{1})
+	data.Write(pixelBytes(pf, green))
+	data.Write([]byte{0, 3<<4 | 0})
+	applyRect(t, fb, &HextileEncoding{}, common.Rectangle{X: 0, Y: 0, Width: 20, Height: 16}, data.Bytes())
+
+	checkColors(t, fb, image.Rect(0, 0, 1, 16), red)
+	checkColors(t, fb, image.Rect(1, 2, 4, 6), blue)
+	checkColors(t, fb, image.Rect(16, 0, 20, 1), green)
+	checkColors(t, fb, image.Rect(16, 1, 20, 16), red)
+}
+
+func TestFramebufferRREAndCopyRect(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := NewFramebuffer(8, 8, *pf)
+
+	data := &bytes.Buffer{}
+	binary.Write(data, binary.BigEndian, uint32(1))
+	data.Write(pixelBytes(pf, red))
+	data.Write(pixelBytes(pf, blue))
+	binary.Write(data, binary.BigEndian, []uint16{1, 1, 2, 2})
+	applyRect(t, fb, &RREEncoding{}, common.Rectangle{X: 2, Y: 2, Width: 4, Height: 4}, data.Bytes())
+
+	checkColors(t, fb, image.Rect(2, 2, 6, 3), red)
+	checkColors(t, fb, image.Rect(3, 3, 5, 5), blue)
+
+	// copy the rre rect to the top left corner, overlapping its source
+	applyRect(t, fb, &CopyRectEncoding{}, common.Rectangle{X: 0, Y: 0, Width: 4, Height: 4}, []byte{0, 2, 0, 2})
+	checkColors(t, fb, image.Rect(0, 0, 4, 1), red)
+	checkColors(t, fb, image.Rect(1, 1, 3, 3), blue)
+}
+
+func TestFramebufferPseudoEncodings(t *testing.T) {
+	fb := NewFramebuffer(4, 4, *common.NewPixelFormat(32))
+
+	rect := &common.Rectangle{Width: 8, Height: 6, Enc: &PseudoEncoding{int32(common.EncDesktopSizePseudo)}}
+	if changed, err := fb.ApplyRect(rect); err != nil || changed != image.Rect(0, 0, 8, 6) {
+		t.Fatalf("unexpected result of a desktop size rect: %v, %v", changed, err)
+	}
+	rect = &common.Rectangle{Width: 1, Height: 1, Enc: &EncCursorPseudo{}}
+	if changed, err := fb.ApplyRect(rect); err != nil || !changed.Empty() {
+		t.Fatalf("unexpected result of a cursor rect: %v, %v", changed, err)
+	}
+	rect = &common.Rectangle{Width: 1, Height: 1, Enc: &PseudoEncoding{int32(common.EncZlibHex)}}
+	if _, err := fb.ApplyRect(rect); err == nil {
+		t.Fatalf("expected an error for an encoding without a decoder")
+	}
+}
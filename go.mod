@@ -1,3 +1,5 @@
 module github.com/amitbet/vncproxy
 
+go 1.21
+
 require golang.org/x/net v0.0.0-20181129055619-fae4c4e3ad76
@@ -47,6 +47,7 @@ func main() {
 		&encodings.RREEncoding{},
 		&encodings.ZLibEncoding{},
 		&encodings.ZRLEEncoding{},
+		&encodings.TRLEEncoding{},
 		&encodings.CopyRectEncoding{},
 		&encodings.CoRREEncoding{},
 		&encodings.HextileEncoding{},
@@ -53,6 +53,7 @@ func NewFbsReader(fbsFile string) (*FbsReader, error) {
 			&encodings.CopyRectEncoding{},
 			&encodings.ZLibEncoding{},
 			&encodings.ZRLEEncoding{},
+			&encodings.TRLEEncoding{},
 			&encodings.CoRREEncoding{},
 			&encodings.HextileEncoding{},
 			&encodings.TightEncoding{},
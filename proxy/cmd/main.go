@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/amitbet/vncproxy/client"
 	"github.com/amitbet/vncproxy/logger"
 	vncproxy "github.com/amitbet/vncproxy/proxy"
 )
@@ -13,12 +21,39 @@ func main() {
 	//create default session if required
 	var tcpPort = flag.String("tcpPort", "", "tcp port")
 	var wsPort = flag.String("wsPort", "", "websocket port")
+	var tlsCert = flag.String("tlsCert", "", "certificate file (PEM) for serving the tcp & websocket ports over TLS (wss), reloaded when it changes")
+	var tlsKey = flag.String("tlsKey", "", "private key file (PEM) for -tlsCert")
 	var vncPass = flag.String("vncPass", "", "password on incoming vnc connections to the proxy, defaults to no password")
 	var recordDir = flag.String("recDir", "", "path to save FBS recordings WILL NOT RECORD if not defined.")
-	var targetVnc = flag.String("target", "", "target vnc server (host:port or /path/to/unix.socket)")
+	var targetVnc = flag.String("target", "", "target vnc server (host:port or /path/to/unix.socket), a comma separated list of servers enables failover")
+	var targetStrategy = flag.String("targetStrategy", "firstHealthy", "how a server is picked from a -target list: firstHealthy / roundRobin / leastConnections")
+	var healthCheck = flag.Duration("healthCheck", 0, "interval for checking the servers in a -target list (e.g. 30s), 0 = no checks")
 	var targetVncPort = flag.String("targPort", "", "target vnc server port (deprecated, use -target)")
 	var targetVncHost = flag.String("targHost", "", "target vnc server host (deprecated, use -target)")
 	var targetVncPass = flag.String("targPass", "", "target vnc password")
+	var targetVncUser = flag.String("targUser", "", "target username, for servers using account logins (VeNCrypt Plain, macOS Screen Sharing, UltraVNC MS-Logon)")
+	var targetCA = flag.String("targCA", "", "CA certificate file (PEM) for verifying targets using VeNCrypt, defaults to the system's roots")
+	var targetCert = flag.String("targCert", "", "client certificate file (PEM) for targets using VeNCrypt")
+	var targetKey = flag.String("targKey", "", "private key file (PEM) for -targCert")
+	var mgmtPort = flag.String("mgmtPort", "", "port for the session management http api, enables multiple sessions (chosen by the ws path)")
+	var mgmtAddr = flag.String("mgmtAddr", "127.0.0.1", "address the management api listens on, it can point the proxy at any host so keep it on an admin network")
+	var mgmtToken = flag.String("mgmtToken", "", "file with the bearer token required by the management api (Authorization: Bearer <token>), needed with -mgmtPort")
+	var sessionTokenKey = flag.String("sessionTokenKey", "", "file with the key for signing session tokens, websocket viewers then connect with a token (from the management api) instead of the session id")
+	var reversePort = flag.String("reversePort", "", "port on which vnc servers behind NAT connect to the proxy (x11vnc -connect host:port, UltraVNC add new client)")
+	var reverseId = flag.String("reverseId", "", "the target is the vnc server connecting to -reversePort with this ID string (e.g. ID:1234) or from this ip address")
+	var reverseSecret = flag.String("reverseSecret", "", "the server connecting to -reversePort must send it after its -reverseId (ID:1234:secret), servers matched by ip address are then rejected")
+	var reverseCA = flag.String("reverseCA", "", "CA certificate file (PEM): -reversePort is served over TLS (with -tlsCert / -tlsKey) and only accepts servers with a client certificate signed by it")
+	var repeaterPort = flag.String("repeaterPort", "", "port on which the proxy acts as an UltraVNC repeater for viewers, the ID they ask for picks the session (see -reverseId)")
+	var repeaterPassthrough = flag.Bool("repeaterPassthrough", false, "pair repeater viewers with the server which connected to -reversePort with the same ID, when no session has it")
+	var repeaterId = flag.String("repeaterId", "", "the -target is an UltraVNC repeater, ask it for the vnc server with this ID (e.g. ID:1234)")
+	var proxyProtocol = flag.Bool("proxyProtocol", false, "expect a PROXY protocol (v1/v2) header from a load balancer on every tcp & ws connection, so viewers are logged with their own address")
+	var shared = flag.Bool("shared", false, "all viewers share a single connection to the target instead of one connection each")
+	var transcode = flag.Bool("transcode", false, "decode the target's updates and encode them again in the encodings each viewer supports, instead of passing the target's encodings through")
+	var viewOnly = flag.Bool("viewOnly", false, "viewers can only watch, keyboard, mouse & clipboard input is not passed to the target")
+	var reconnect = flag.Bool("reconnect", false, "keep viewers connected and redial the target when its connection drops")
+	var idleTimeout = flag.Duration("idleTimeout", 0, "disconnect the viewers after no keyboard / mouse input for this long (e.g. 15m), 0 = never")
+	var maxDuration = flag.Duration("maxDuration", 0, "disconnect the viewers this long after the first one connected (e.g. 8h), 0 = no limit")
+	var limitWarning = flag.Duration("limitWarning", 0, "warn the viewers (bell & clipboard text) this long before -idleTimeout / -maxDuration close the session")
 	var logLevel = flag.String("logLevel", "info", "change logging level")
 
 	flag.Parse()
@@ -30,16 +65,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *targetVnc == "" && *targetVncPort == "" {
+	if *targetVnc == "" && *targetVncPort == "" && *reverseId == "" && *mgmtPort == "" {
 		logger.Error("no target vnc server host/port or socket defined")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if *mgmtPort != "" && *mgmtToken == "" {
+		logger.Error("-mgmtPort needs a -mgmtToken file")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logger.Error("-tlsCert and -tlsKey must be given together")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if *vncPass == "" {
 		logger.Warn("proxy will have no password")
 	}
 
+	targetTLS, err := newTargetTLSConfig(*targetCA, *targetCert, *targetKey)
+	if err != nil {
+		logger.Errorf("error loading the target certificates: %v", err)
+		os.Exit(1)
+	}
+
 	tcpURL := ""
 	if *tcpPort != "" {
 		tcpURL = ":" + string(*tcpPort)
@@ -52,18 +105,52 @@ func main() {
 		WsListeningURL:   wsURL, // empty = not listening on ws
 		TCPListeningURL:  tcpURL,
 		ProxyVncPassword: *vncPass, //empty = no auth
+		TLSCertFile:      *tlsCert,
+		TLSKeyFile:       *tlsKey,
+		TargetTLSConfig:  targetTLS,
+		ProxyProtocol:    *proxyProtocol,
 		SingleSession: &vncproxy.VncSession{
 			Target:         *targetVnc,
 			TargetHostname: *targetVncHost,
 			TargetPort:     *targetVncPort,
 			TargetPassword: *targetVncPass, //"vncPass",
+			TargetUsername: *targetVncUser,
+			ReverseID:      *reverseId,
+			ReverseSecret:  *reverseSecret,
+			RepeaterID:     *repeaterId,
 			ID:             "dummySession",
 			Status:         vncproxy.SessionStatusInit,
 			Type:           vncproxy.SessionTypeProxyPass,
+			Shared:         *shared,
+			Transcode:      *transcode,
+			IdleTimeout:    *idleTimeout,
+			MaxDuration:    *maxDuration,
+			LimitWarning:   *limitWarning,
 		}, // to be used when not using sessions
 		UsingSessions: false, //false = single session - defined in the var above
 	}
 
+	if strings.Contains(*targetVnc, ",") {
+		strategy, err := vncproxy.ParseTargetStrategy(*targetStrategy)
+		if err != nil {
+			logger.Error(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		proxy.SingleSession.Target = ""
+		proxy.SingleSession.Targets = strings.Split(*targetVnc, ",")
+		proxy.SingleSession.TargetStrategy = strategy
+		proxy.SingleSession.HealthCheckInterval = *healthCheck
+	}
+
+	if *reconnect {
+		proxy.SingleSession.Reconnect = &vncproxy.ReconnectPolicy{}
+	}
+
+	if *viewOnly {
+		proxy.SingleSession.InputPolicy = &vncproxy.InputPolicy{Mode: vncproxy.InputModeViewOnly}
+	}
+
 	if *recordDir != "" {
 		fullPath, err := filepath.Abs(*recordDir)
 		if err != nil {
@@ -76,5 +163,89 @@ func main() {
 		logger.Info("FBS recording is turned off")
 	}
 
-	proxy.StartListening()
+	if *reversePort != "" {
+		proxy.ReverseListeningURL = ":" + *reversePort
+		if *reverseId != "" && *reverseSecret == "" && *reverseCA == "" {
+			logger.Warn("any vnc server reaching -reversePort with the -reverseId (or from its ip address) becomes the target, consider -reverseSecret / -reverseCA")
+		}
+	}
+	if *reverseCA != "" {
+		if *tlsCert == "" {
+			logger.Error("-reverseCA needs -tlsCert and -tlsKey")
+			flag.Usage()
+			os.Exit(1)
+		}
+		caTLS, err := client.NewTLSConfig(*reverseCA, "", "")
+		if err != nil {
+			logger.Errorf("error loading the reverse connection CA: %v", err)
+			os.Exit(1)
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.Errorf("error loading the certificate: %v", err)
+			os.Exit(1)
+		}
+		proxy.ReverseTLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    caTLS.RootCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	if *repeaterPort != "" {
+		proxy.RepeaterListeningURL = ":" + *repeaterPort
+		proxy.RepeaterPassthrough = *repeaterPassthrough
+	}
+
+	if *sessionTokenKey != "" {
+		key, err := os.ReadFile(*sessionTokenKey)
+		if err != nil {
+			logger.Errorf("error reading the session token key: %v", err)
+			os.Exit(1)
+		}
+		proxy.SessionTokenKey = []byte(strings.TrimSpace(string(key)))
+	}
+
+	if *mgmtPort != "" {
+		proxy.UsingSessions = true
+		proxy.ManagementURL = net.JoinHostPort(*mgmtAddr, *mgmtPort)
+		token, err := os.ReadFile(*mgmtToken)
+		if err != nil {
+			logger.Errorf("error reading the management api token: %v", err)
+			os.Exit(1)
+		}
+		proxy.ManagementToken = strings.TrimSpace(string(token))
+		if proxy.ManagementToken == "" {
+			logger.Errorf("the management api token file %s is empty", *mgmtToken)
+			os.Exit(1)
+		}
+		//the target from the command line (if any) is registered as the session used by tcp connections
+		if *targetVnc != "" || *targetVncPort != "" || *reverseId != "" {
+			proxy.Sessions().SetSession(proxy.SingleSession.ID, proxy.SingleSession)
+		}
+	}
+
+	// stop cleanly on ctrl-c / kill, so recordings are flushed to disk
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := proxy.Start(ctx); err != nil {
+		logger.Error("error starting proxy: ", err)
+		os.Exit(1)
+	}
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(shutdownCtx); err != nil {
+		logger.Error("error shutting down proxy: ", err)
+	}
+}
+
+// newTargetTLSConfig loads the -targCA / -targCert / -targKey files, it returns nil when none of them is given
+// so targets offering both vnc & VeNCrypt auth are still logged into with -targPass
+func newTargetTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	return client.NewTLSConfig(caFile, certFile, keyFile)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	vncproxy "github.com/amitbet/vncproxy/proxy"
+)
+
+// bothAuthsTarget offers VeNCrypt & vnc auth (like a TigerVNC server with a self signed certificate),
+// it reports the security type each connection picked and completes the handshake for vnc auth
+func bothAuthsTarget(t *testing.T) (string, chan uint8) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	picked := make(chan uint8, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("RFB 003.008\n"))
+			buf := make([]byte, 16)
+			io.ReadFull(c, buf[:12])
+			c.Write([]byte{2, 19, 2})
+			io.ReadFull(c, buf[:1])
+			picked <- buf[0]
+			if buf[0] != 2 {
+				c.Close()
+				continue
+			}
+			c.Write(make([]byte, 16))
+			io.ReadFull(c, buf)
+			binary.Write(c, binary.BigEndian, uint32(0))
+			io.ReadFull(c, buf[:1])
+			binary.Write(c, binary.BigEndian, uint16(640))
+			binary.Write(c, binary.BigEndian, uint16(480))
+			common.NewPixelFormat(32).WriteTo(c)
+			binary.Write(c, binary.BigEndian, uint32(4))
+			c.Write([]byte("test"))
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	return ln.Addr().String(), picked
+}
+
+func TestTargetTLSConfigFlags(t *testing.T) {
+	target, picked := bothAuthsTarget(t)
+
+	// no -targCA / -targCert / -targKey
+	targetTLS, err := newTargetTLSConfig("", "", "")
+	if err != nil {
+		t.Fatalf("error creating the target TLS config: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	vp := &vncproxy.VncProxy{
+		TCPListener:     ln,
+		TargetTLSConfig: targetTLS,
+		SingleSession: &vncproxy.VncSession{
+			Target:         target,
+			TargetPassword: "secret",
+			ID:             "dummySession",
+			Status:         vncproxy.SessionStatusInit,
+			Type:           vncproxy.SessionTypeProxyPass,
+		},
+	}
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	defer nc.Close()
+	cc, err := client.NewClientConn(nc, &client.ClientConfig{})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if err := cc.Connect(); err != nil {
+		t.Fatalf("error in handshake with proxy: %v", err)
+	}
+	if secType := <-picked; secType != 2 {
+		t.Fatalf("the proxy picked security type %d instead of vnc auth", secType)
+	}
+	if cc.FrameBufferWidth != 640 {
+		t.Errorf("unexpected screen width: %d", cc.FrameBufferWidth)
+	}
+}
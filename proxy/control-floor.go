@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrFloorDisabled  = errors.New("control floor is not enabled for this session")
+	ErrNotFloorHolder = errors.New("viewer does not hold the floor")
+)
+
+// FloorInfo is a point in time snapshot of who holds the input floor of a session
+type FloorInfo struct {
+	Holder    string // viewer id, empty if nobody holds the floor
+	HeldSince time.Time
+	LastInput time.Time
+	Requests  []string // viewers waiting for the floor, in request order
+}
+
+// Floor returns the state of the session's input floor
+func (s *VncSession) Floor() FloorInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return FloorInfo{
+		Holder:    s.floorHolder,
+		HeldSince: s.floorHeldSince,
+		LastInput: s.floorLastInput,
+		Requests:  append([]string{}, s.floorRequests...),
+	}
+}
+
+// RequestFloor asks for the input floor on behalf of a viewer, it is granted right away if nobody holds it,
+// otherwise the request is queued until the holder grants it or lets go of the floor
+func (s *VncSession) RequestFloor(viewerId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.checkFloorViewerLocked(viewerId); err != nil {
+		return err
+	}
+	switch {
+	case s.floorHolder == "":
+		s.grantFloorLocked(viewerId, "requested")
+	case s.floorHolder == viewerId:
+	default:
+		for _, id := range s.floorRequests {
+			if id == viewerId {
+				return nil
+			}
+		}
+		s.floorRequests = append(s.floorRequests, viewerId)
+		s.addEventLocked(EventFloorRequested, viewerId, "")
+	}
+	return nil
+}
+
+// GrantFloor passes the floor to a viewer, byViewerId must be the current holder,
+// an empty byViewerId is an admin override which takes the floor from whoever holds it
+func (s *VncSession) GrantFloor(viewerId string, byViewerId string) error {
+	s.mutex.Lock()
+	defer s.sendFloorReleases()
+	defer s.mutex.Unlock()
+
+	if err := s.checkFloorViewerLocked(viewerId); err != nil {
+		return err
+	}
+	detail := "admin override"
+	if byViewerId != "" {
+		if s.floorHolder != byViewerId {
+			return ErrNotFloorHolder
+		}
+		detail = "granted by " + byViewerId
+	}
+	s.grantFloorLocked(viewerId, detail)
+	return nil
+}
+
+// ReleaseFloor lets go of the floor, it passes to the oldest pending request (if any)
+func (s *VncSession) ReleaseFloor(viewerId string) error {
+	s.mutex.Lock()
+	defer s.sendFloorReleases()
+	defer s.mutex.Unlock()
+
+	if !s.ControlFloor {
+		return ErrFloorDisabled
+	}
+	if s.floorHolder != viewerId || viewerId == "" {
+		return ErrNotFloorHolder
+	}
+	s.releaseFloorLocked(EventFloorReleased, "")
+	return nil
+}
+
+// RevokeFloor takes the floor away from its holder (admin action), it passes to the oldest pending request (if any).
+// the viewer it was revoked from doesn't take the floor back by sending input, it has to request it
+func (s *VncSession) RevokeFloor() error {
+	s.mutex.Lock()
+	defer s.sendFloorReleases()
+	defer s.mutex.Unlock()
+
+	if !s.ControlFloor {
+		return ErrFloorDisabled
+	}
+	if s.floorHolder != "" {
+		if s.floorRevoked == nil {
+			s.floorRevoked = make(map[string]bool)
+		}
+		s.floorRevoked[s.floorHolder] = true
+		s.releaseFloorLocked(EventFloorRevoked, "")
+	}
+	return nil
+}
+
+func (s *VncSession) checkFloorViewerLocked(viewerId string) error {
+	if !s.ControlFloor {
+		return ErrFloorDisabled
+	}
+	if _, ok := s.viewers[viewerId]; !ok {
+		return ErrViewerNotFound
+	}
+	return nil
+}
+
+// floorAllowsInput reports if the viewer's keyboard & pointer input may reach the target,
+// when nobody holds the floor the first viewer to send input takes it (unless the floor was revoked from it)
+func (s *VncSession) floorAllowsInput(v *Viewer) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.ControlFloor {
+		return true
+	}
+	switch s.floorHolder {
+	case v.ID:
+		s.floorLastInput = time.Now()
+		return true
+	case "":
+		if s.floorRevoked[v.ID] {
+			return false
+		}
+		s.grantFloorLocked(v.ID, "first input")
+		return true
+	}
+	return false
+}
+
+func (s *VncSession) grantFloorLocked(viewerId string, detail string) {
+	if s.floorHolder != viewerId {
+		s.queueFloorReleaseLocked(s.floorHolder)
+	}
+	now := time.Now()
+	delete(s.floorRevoked, viewerId)
+	s.floorHolder = viewerId
+	s.floorHeldSince = now
+	s.floorLastInput = now
+	s.removeFloorRequestLocked(viewerId)
+	s.addEventLocked(EventFloorGranted, viewerId, detail)
+	s.armFloorTimerLocked(viewerId, s.FloorIdleTimeout)
+}
+
+func (s *VncSession) releaseFloorLocked(eventType string, detail string) {
+	s.addEventLocked(eventType, s.floorHolder, detail)
+	s.queueFloorReleaseLocked(s.floorHolder)
+	s.floorHolder = ""
+	s.floorHeldSince = time.Time{}
+	if s.floorTimer != nil {
+		s.floorTimer.Stop()
+		s.floorTimer = nil
+	}
+	if len(s.floorRequests) > 0 {
+		s.grantFloorLocked(s.floorRequests[0], "next in queue")
+	}
+}
+
+// queueFloorReleaseLocked marks the input of a viewer losing the floor to be released, which is done by
+// sendFloorReleases once the session mutex is unlocked
+func (s *VncSession) queueFloorReleaseLocked(viewerId string) {
+	if v, ok := s.viewers[viewerId]; ok {
+		s.floorReleases = append(s.floorReleases, v)
+	}
+}
+
+// sendFloorReleases releases the keys & buttons previous floor holders left pressed at the target
+func (s *VncSession) sendFloorReleases() {
+	s.mutex.Lock()
+	viewers := s.floorReleases
+	s.floorReleases = nil
+	s.mutex.Unlock()
+
+	for _, v := range viewers {
+		v.releaseInput()
+	}
+}
+
+func (s *VncSession) removeFloorRequestLocked(viewerId string) {
+	for i, id := range s.floorRequests {
+		if id == viewerId {
+			s.floorRequests = append(s.floorRequests[:i:i], s.floorRequests[i+1:]...)
+			return
+		}
+	}
+}
+
+// armFloorTimerLocked schedules a check for the holder's inactivity, the timer isn't reset on every input,
+// instead the check re-arms itself for the remaining time when there was input since
+func (s *VncSession) armFloorTimerLocked(holder string, after time.Duration) {
+	if s.floorTimer != nil {
+		s.floorTimer.Stop()
+		s.floorTimer = nil
+	}
+	if s.FloorIdleTimeout <= 0 {
+		return
+	}
+	s.floorTimer = time.AfterFunc(after, func() { s.checkFloorIdle(holder) })
+}
+
+func (s *VncSession) checkFloorIdle(holder string) {
+	s.mutex.Lock()
+	defer s.sendFloorReleases()
+	defer s.mutex.Unlock()
+
+	if s.floorHolder != holder {
+		return
+	}
+	idle := time.Since(s.floorLastInput)
+	if idle < s.FloorIdleTimeout {
+		s.armFloorTimerLocked(holder, s.FloorIdleTimeout-idle)
+		return
+	}
+	s.releaseFloorLocked(EventFloorTimedOut, "no input for "+idle.Round(time.Second).String())
+}
+
+// dropFloorViewerLocked removes a leaving viewer from the floor, called with the session mutex held
+func (s *VncSession) dropFloorViewerLocked(viewerId string) {
+	s.removeFloorRequestLocked(viewerId)
+	delete(s.floorRevoked, viewerId)
+	if s.floorHolder == viewerId && viewerId != "" {
+		s.releaseFloorLocked(EventFloorReleased, "viewer disconnected")
+	}
+}
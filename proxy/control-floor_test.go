@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/server"
+)
+
+func TestControlFloorHandoff(t *testing.T) {
+	session := &VncSession{ID: "s1", ControlFloor: true}
+	v1 := newTestViewer(t)
+	v2 := newTestViewer(t)
+	v3 := newTestViewer(t)
+	session.addViewer(v1)
+	session.addViewer(v2)
+	session.addViewer(v3)
+
+	// the first viewer to send input takes the free floor
+	if !session.allowClientMessage(v1, keyEvent('a', true)) {
+		t.Fatalf("first input was dropped")
+	}
+	if session.allowClientMessage(v2, keyEvent('b', true)) {
+		t.Fatalf("input from a viewer without the floor passed")
+	}
+
+	session.RequestFloor(v2.ID)
+	session.RequestFloor(v3.ID)
+	if floor := session.Floor(); floor.Holder != v1.ID || len(floor.Requests) != 2 {
+		t.Fatalf("unexpected floor after requests: %+v", floor)
+	}
+
+	if err := session.GrantFloor(v1.ID, v2.ID); err != ErrNotFloorHolder {
+		t.Fatalf("non holder was able to grant the floor: %v", err)
+	}
+	if err := session.GrantFloor(v2.ID, v1.ID); err != nil {
+		t.Fatalf("error granting floor: %v", err)
+	}
+	if session.allowClientMessage(v1, keyEvent('a', false)) || !session.allowClientMessage(v2, keyEvent('b', false)) {
+		t.Fatalf("floor was not passed to the granted viewer")
+	}
+
+	// the holder leaving passes the floor to the next request
+	session.detachViewer(v2, "viewer disconnected", false)
+	if floor := session.Floor(); floor.Holder != v3.ID || len(floor.Requests) != 0 {
+		t.Fatalf("unexpected floor after holder left: %+v", floor)
+	}
+
+	session.RevokeFloor()
+	if floor := session.Floor(); floor.Holder != "" {
+		t.Fatalf("floor was not revoked: %+v", floor)
+	}
+	// the viewer the floor was revoked from doesn't take it back with its next input
+	if session.allowClientMessage(v3, keyEvent('c', true)) || session.Floor().Holder != "" {
+		t.Fatalf("input of a revoked viewer took the floor")
+	}
+	if err := session.RequestFloor(v3.ID); err != nil || session.Floor().Holder != v3.ID {
+		t.Fatalf("revoked viewer couldn't request the floor: %v", err)
+	}
+
+	// admin override
+	if err := session.GrantFloor(v1.ID, ""); err != nil || session.Floor().Holder != v1.ID {
+		t.Fatalf("admin override failed: %v", err)
+	}
+}
+
+func TestControlFloorIdleTimeout(t *testing.T) {
+	session := &VncSession{ID: "s1", ControlFloor: true, FloorIdleTimeout: 20 * time.Millisecond}
+	v1 := newTestViewer(t)
+	session.addViewer(v1)
+
+	if err := session.RequestFloor(v1.ID); err != nil {
+		t.Fatalf("error requesting floor: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for session.Floor().Holder != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("floor was not released after inactivity")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	events := session.Events()
+	if last := events[len(events)-1]; last.Type != EventFloorTimedOut || last.ViewerID != v1.ID {
+		t.Fatalf("unexpected last event: %+v", last)
+	}
+}
+
+func TestControlFloorReleasesInput(t *testing.T) {
+	session := &VncSession{ID: "s1", ControlFloor: true}
+	v1 := newTestViewer(t)
+	v2 := newTestViewer(t)
+	session.addViewer(v1)
+	session.addViewer(v2)
+	sent := []common.ClientMessage{}
+	v1.setTargetSender(func(msg common.ClientMessage) error {
+		sent = append(sent, msg)
+		return nil
+	})
+
+	// v1 holds ctrl & the left button (having released 'a') when the floor passes to v2
+	for _, msg := range []common.ClientMessage{keyEvent(KeysymControlL, true), keyEvent('a', true), keyEvent('a', false), &server.MsgPointerEvent{Mask: 1, X: 10, Y: 20}} {
+		if !session.allowClientMessage(v1, msg) {
+			t.Fatalf("input of the floor holder was dropped")
+		}
+	}
+	if err := session.GrantFloor(v2.ID, v1.ID); err != nil {
+		t.Fatalf("error granting floor: %v", err)
+	}
+
+	if len(sent) != 2 {
+		t.Fatalf("expected a key & a button release, got %+v", sent)
+	}
+	if key, ok := sent[0].(*server.MsgKeyEvent); !ok || key.Key != KeysymControlL || key.Down != 0 {
+		t.Fatalf("unexpected key release: %+v", sent[0])
+	}
+	if pointer, ok := sent[1].(*server.MsgPointerEvent); !ok || pointer.Mask != 0 || pointer.X != 10 || pointer.Y != 20 {
+		t.Fatalf("unexpected button release: %+v", sent[1])
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/logger"
+	listeners "github.com/amitbet/vncproxy/recorder"
+	"github.com/amitbet/vncproxy/server"
+)
+
+// exclusiveLink passes the traffic between a viewer and its own connection to the target,
+// it outlives the target connection so the target can be redialed without the viewer noticing (see ReconnectPolicy)
+type exclusiveLink struct {
+	vp            *VncProxy
+	session       *VncSession
+	viewer        *Viewer
+	serverUpdater *ServerUpdater
+	clientUpdater *ClientUpdater
+	rec           *listeners.Recorder
+	transcoder    *transcoder // set for sessions with Transcode
+}
+
+// exclusiveUpstreamEncs are the encoding readers used to parse the target's updates, a new set is used for every connection
+func exclusiveUpstreamEncs() []common.IEncoding {
+	return []common.IEncoding{
+		&encodings.RawEncoding{},
+		&encodings.TightEncoding{},
+		&encodings.EncCursorPseudo{},
+		&encodings.EncLedStatePseudo{},
+		&encodings.TightPngEncoding{},
+		&encodings.RREEncoding{},
+		&encodings.ZLibEncoding{},
+		&encodings.ZRLEEncoding{},
+		&encodings.TRLEEncoding{},
+		&encodings.CopyRectEncoding{},
+		&encodings.CoRREEncoding{},
+		&encodings.HextileEncoding{},
+	}
+}
+
+// attachExclusiveViewer connects the viewer to its own connection to the target
+func (vp *VncProxy) attachExclusiveViewer(session *VncSession, viewer *Viewer) error {
+	sconn := viewer.sconn
+	link := &exclusiveLink{vp: vp, session: session, viewer: viewer}
+	if session.Transcode {
+		link.transcoder = newTranscoder()
+	}
+
+	if session.Type == SessionTypeRecordingProxy {
+		rec, err := vp.newRecorder(session, viewer)
+		if err != nil {
+			return err
+		}
+		link.rec = rec
+		if link.transcoder == nil {
+			//the recorder follows the viewer's pixel format changes, a transcoded target keeps its own pixel format
+			sconn.Listeners.AddListener(rec)
+		}
+		//the recording ends with the viewer's connection, even if the target was reconnected on the way
+		sconn.Listeners.AddListener(&ConnectionCloseListener{OnClose: func() { vp.closeRecorder(rec) }})
+	}
+
+	//creating cross-listeners between server and client parts to pass messages through the proxy:
+
+	// gets the bytes from the actual vnc server on the env (client part of the proxy)
+	// and writes them through the server socket to the vnc-client
+	// (whole messages are needed both for reconnecting and for injecting warnings between the target's messages)
+	link.serverUpdater = &ServerUpdater{conn: sconn, session: session, viewer: viewer, buffered: session.Reconnect != nil || session.warnsBeforeLimits(), transcoder: link.transcoder}
+
+	// gets the messages from the server part (from vnc-client),
+	// and write through the client to the actual vnc-server
+	link.clientUpdater = &ClientUpdater{session: session, viewer: viewer, transcoder: link.transcoder}
+	sconn.Listeners.AddListener(link.clientUpdater)
+
+	session.setStatus(SessionStatusConnecting, "")
+	cconn, err := link.connect()
+	if err != nil {
+		if link.rec != nil {
+			vp.closeRecorder(link.rec)
+		}
+		return err
+	}
+	link.clientUpdater.setConn(cconn)
+	viewer.setSender(func(msg []byte) error {
+		_, err := link.serverUpdater.write(msg)
+		return err
+	})
+	viewer.setTargetSender(link.clientUpdater.writeMessage)
+	return nil
+}
+
+// connect dials the target & runs the handshake, the target's messages are passed to the viewer once it is done
+func (l *exclusiveLink) connect() (*client.ClientConn, error) {
+	cconn, err := l.vp.createClientConnection(l.session, true, func(cconn *client.ClientConn) {
+		l.viewer.setUpstream(cconn)
+		if l.rec != nil {
+			cconn.Listeners.AddListener(l.rec)
+		}
+		cconn.Listeners.AddListener(l.serverUpdater)
+		cconn.Listeners.AddListener(&ConnectionCloseListener{OnClose: l.targetClosed})
+		cconn.Encs = exclusiveUpstreamEncs()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if l.transcoder != nil {
+		//the target is asked for the encodings the framebuffer can decode, whatever the viewer asks for
+		if err := l.writeToTarget(cconn, &server.MsgSetEncodings{Encodings: sharedUpstreamEncodings}); err != nil {
+			cconn.Close()
+			return nil, err
+		}
+	}
+	return cconn, nil
+}
+
+// targetClosed tears down the viewer when the target goes away, or starts reconnecting when the session allows it
+func (l *exclusiveLink) targetClosed() {
+	logger.Infof("Proxy: target connection closed, session=%s viewer=%s", l.session.ID, l.viewer.ID)
+	if l.session.Reconnect == nil || !l.session.hasViewer(l.viewer.ID) {
+		l.session.detachViewer(l.viewer, "target disconnected", true)
+		return
+	}
+	go l.reconnect()
+}
+
+func (l *exclusiveLink) reconnect() {
+	session := l.session
+	l.clientUpdater.setConn(nil)
+	session.setStatus(SessionStatusReconnecting, "target disconnected")
+	session.addEvent(EventTargetReconnecting, l.viewer.ID, "")
+
+	var cconn *client.ClientConn
+	err := session.Reconnect.retry(session.ID,
+		func() bool { return session.hasViewer(l.viewer.ID) },
+		func() error {
+			var err error
+			session.setStatus(SessionStatusReconnecting, "dialing target")
+			cconn, err = l.connect()
+			return err
+		})
+	if err == nil {
+		err = l.resume(cconn)
+	}
+	if err != nil {
+		if err != errReconnectAborted {
+			logger.Errorf("Proxy: giving up on reconnecting to target, session=%s viewer=%s: %v", session.ID, l.viewer.ID, err)
+		}
+		if cconn != nil {
+			cconn.Close()
+		}
+		session.detachViewer(l.viewer, "reconnect failed: "+err.Error(), true)
+		return
+	}
+
+	logger.Infof("Proxy: target reconnected, session=%s viewer=%s", session.ID, l.viewer.ID)
+	session.addEvent(EventTargetReconnected, l.viewer.ID, "")
+	session.setStatus(SessionStatusActive, "reconnected")
+}
+
+// resume brings the reconnected target in line with what the viewer expects (pixel format, encodings, screen size),
+// then asks for a full screen update & lets the viewer's messages through again
+func (l *exclusiveLink) resume(cconn *client.ClientConn) error {
+	sconn := l.viewer.sconn
+
+	if cconn.FrameBufferWidth != sconn.Width() || cconn.FrameBufferHeight != sconn.Height() {
+		if !viewerSupportsDesktopSize(l.clientUpdater.lastEncodings()) {
+			return errors.New("target desktop size changed and the viewer doesn't support resizing")
+		}
+		logger.Infof("Proxy: reconnected target has a different size %dx%d, session=%s", cconn.FrameBufferWidth, cconn.FrameBufferHeight, l.session.ID)
+		area := image.Rect(0, 0, int(cconn.FrameBufferWidth), int(cconn.FrameBufferHeight))
+		buf := &bytes.Buffer{}
+		writeUpdateHeader(buf, 1)
+		writeRectHeader(buf, area, int32(common.EncDesktopSizePseudo))
+		if _, err := l.serverUpdater.write(buf.Bytes()); err != nil {
+			return err
+		}
+		sconn.SetWidth(cconn.FrameBufferWidth)
+		sconn.SetHeight(cconn.FrameBufferHeight)
+	}
+
+	msgs := []common.ClientMessage{}
+	if l.transcoder == nil {
+		//a transcoded target keeps its own pixel format & encodings
+		cconn.PixelFormat = *sconn.CurrentPixelFormat()
+		msgs = append(msgs, &server.MsgSetPixelFormat{PF: cconn.PixelFormat})
+		if encs := l.clientUpdater.lastEncodings(); encs != nil {
+			msgs = append(msgs, withoutZlibStreams(encs))
+		}
+	}
+	msgs = append(msgs, &server.MsgFramebufferUpdateRequest{Inc: 0, Width: sconn.Width(), Height: sconn.Height()})
+	if err := l.writeToTarget(cconn, msgs...); err != nil {
+		return err
+	}
+
+	l.clientUpdater.resumeWith(cconn)
+	return nil
+}
+
+// writeToTarget sends messages to the target in a single write, outside of the viewer's messages
+func (l *exclusiveLink) writeToTarget(cconn *client.ClientConn, msgs ...common.ClientMessage) error {
+	buf := &bytes.Buffer{}
+	for _, msg := range msgs {
+		if err := msg.Write(buf); err != nil {
+			return err
+		}
+	}
+	n, err := cconn.Write(buf.Bytes())
+	l.session.countToTarget(n)
+	return err
+}
+
+func viewerSupportsDesktopSize(msg *server.MsgSetEncodings) bool {
+	if msg == nil {
+		return false
+	}
+	for _, enc := range msg.Encodings {
+		if enc == common.EncDesktopSizePseudo {
+			return true
+		}
+	}
+	return false
+}
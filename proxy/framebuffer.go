@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"sync"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// framebuffer keeps a copy of the target's screen, so the proxy can answer viewer update requests on its own
+type framebuffer struct {
+	mutex  sync.RWMutex
+	screen *encodings.Framebuffer
+}
+
+func newFramebuffer(width, height uint16, pf common.PixelFormat) *framebuffer {
+	return &framebuffer{screen: encodings.NewFramebuffer(width, height, pf)}
+}
+
+func (fb *framebuffer) Bounds() image.Rectangle {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+	return fb.screen.Bounds()
+}
+
+func (fb *framebuffer) resize(width, height uint16) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.screen.Resize(width, height)
+}
+
+// reset is called for a new connection to the target, which may use another pixel format & starts new zlib streams
+func (fb *framebuffer) reset(pf common.PixelFormat) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.screen.SetPixelFormat(pf)
+	fb.screen.ResetStreams()
+}
+
+func (fb *framebuffer) setColorMapEntries(first uint16, colors []common.Color) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.screen.SetColorMapEntries(first, colors)
+}
+
+// applyRect draws a single rectangle from a FramebufferUpdate into the framebuffer,
+// it returns the area that was changed (empty for pseudo encodings)
+func (fb *framebuffer) applyRect(rect *common.Rectangle) image.Rectangle {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+
+	changed, err := fb.screen.ApplyRect(rect)
+	if err != nil {
+		logger.Errorf("framebuffer.applyRect: %v", err)
+	}
+	return changed
+}
+
+// writeRects writes rectangles (headers + data) encoded with enc for a viewer, the rects are the ones
+// the viewer's encoder state splits an area into. they are encoded into a scratch buffer first, on error nothing
+// is written: the viewer's stream (and its zlib streams) can't be resumed after a partial rect, the caller drops the viewer
+func (fb *framebuffer) writeRects(buf *bytes.Buffer, state *encodings.EncoderState, enc encodings.Encoder, rects []image.Rectangle) error {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+
+	scratch := &bytes.Buffer{}
+	for _, area := range rects {
+		if err := state.WriteRect(scratch, enc, fb.screen, area); err != nil {
+			return fmt.Errorf("framebuffer.writeRects: error encoding %v: %v", area, err)
+		}
+	}
+	buf.Write(scratch.Bytes())
+	return nil
+}
+
+func writeRectHeader(buf *bytes.Buffer, area image.Rectangle, encType int32) {
+	binary.Write(buf, binary.BigEndian, uint16(area.Min.X))
+	binary.Write(buf, binary.BigEndian, uint16(area.Min.Y))
+	binary.Write(buf, binary.BigEndian, uint16(area.Dx()))
+	binary.Write(buf, binary.BigEndian, uint16(area.Dy()))
+	binary.Write(buf, binary.BigEndian, encType)
+}
+
+// maxDirtyRects limits the rects a dirtyRegion keeps, past it they are merged into their bounding box
+const maxDirtyRects = 64
+
+// dirtyRegion is the part of the screen a viewer hasn't been sent yet, as non overlapping rects
+type dirtyRegion []image.Rectangle
+
+// subtractRect returns the parts of r outside of cut: up to 4 strips (above, below, left & right of it)
+func subtractRect(r, cut image.Rectangle) []image.Rectangle {
+	cut = cut.Intersect(r)
+	if cut.Empty() {
+		return []image.Rectangle{r}
+	}
+	var parts []image.Rectangle
+	for _, part := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, cut.Min.Y),
+		image.Rect(r.Min.X, cut.Max.Y, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, cut.Min.Y, cut.Min.X, cut.Max.Y),
+		image.Rect(cut.Max.X, cut.Min.Y, r.Max.X, cut.Max.Y),
+	} {
+		if !part.Empty() {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// add marks area as dirty, only the parts not already in the region are added
+func (d *dirtyRegion) add(area image.Rectangle) {
+	if area.Empty() {
+		return
+	}
+	parts := []image.Rectangle{area}
+	for _, r := range *d {
+		var outside []image.Rectangle
+		for _, part := range parts {
+			outside = append(outside, subtractRect(part, r)...)
+		}
+		parts = outside
+	}
+	*d = append(*d, parts...)
+	if len(*d) > maxDirtyRects {
+		bounds := image.Rectangle{}
+		for _, r := range *d {
+			bounds = bounds.Union(r)
+		}
+		*d = dirtyRegion{bounds}
+	}
+}
+
+// reset marks only area as dirty
+func (d *dirtyRegion) reset(area image.Rectangle) {
+	*d = nil
+	d.add(area)
+}
+
+// take removes the parts inside of area from the region & returns them
+func (d *dirtyRegion) take(area image.Rectangle) []image.Rectangle {
+	var taken []image.Rectangle
+	var left dirtyRegion
+	for _, r := range *d {
+		if in := r.Intersect(area); !in.Empty() {
+			taken = append(taken, in)
+		}
+		left = append(left, subtractRect(r, area)...)
+	}
+	*d = left
+	return taken
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+)
+
+func TestFramebufferRawAndCopyRect(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := newFramebuffer(4, 2, *pf)
+
+	// a 2x1 raw rect at 0,0: red, blue (32bpp little endian, red shift 16)
+	data := []byte{0, 0, 0xFF, 0, 0xFF, 0, 0, 0}
+	rect := &common.Rectangle{X: 0, Y: 0, Width: 2, Height: 1}
+	enc, err := (&encodings.RawEncoding{}).Read(pf, rect, common.NewRfbReadHelper(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("error reading raw rect: %v", err)
+	}
+	rect.Enc = enc
+	if changed := fb.applyRect(rect); changed != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("unexpected changed area: %v", changed)
+	}
+
+	// copy both pixels to the second row
+	copyData := []byte{0, 0, 0, 0}
+	copyRect := &common.Rectangle{X: 2, Y: 1, Width: 2, Height: 1}
+	enc, err = (&encodings.CopyRectEncoding{}).Read(pf, copyRect, common.NewRfbReadHelper(bytes.NewReader(copyData)))
+	if err != nil {
+		t.Fatalf("error reading copyrect: %v", err)
+	}
+	copyRect.Enc = enc
+	fb.applyRect(copyRect)
+
+	if c := fb.screen.RGBA().RGBAAt(2, 1); c.R != 0xFF || c.B != 0 {
+		t.Fatalf("unexpected color after copyrect: %v", c)
+	}
+	if c := fb.screen.RGBA().RGBAAt(3, 1); c.B != 0xFF || c.R != 0 {
+		t.Fatalf("unexpected color after copyrect: %v", c)
+	}
+
+	// re-encode for a viewer using 16bpp
+	viewerPf := common.NewPixelFormat(16)
+	buf := &bytes.Buffer{}
+	if err := fb.writeRects(buf, encodings.NewEncoderState(*viewerPf), &encodings.RawEncoding{}, []image.Rectangle{image.Rect(2, 1, 4, 2)}); err != nil {
+		t.Fatalf("error encoding rects: %v", err)
+	}
+	out := buf.Bytes()
+	if len(out) != 12+2*2 {
+		t.Fatalf("unexpected raw rect length: %d", len(out))
+	}
+	if pixel := viewerPf.ReadPixel(out[12:]); viewerPf.PixelToColor(pixel, nil).R != 0xFF {
+		t.Fatalf("unexpected converted pixel: %x", pixel)
+	}
+}
+
+// failingEncoder writes part of a rect before failing, like an encoder running into an error mid-rect
+type failingEncoder struct{ encodings.RawEncoding }
+
+func (*failingEncoder) Encode(s *encodings.EncoderState, w io.Writer, img image.Image, area image.Rectangle) error {
+	w.Write([]byte{1, 2, 3})
+	return errors.New("encoding failed")
+}
+
+func TestFramebufferWriteRectsError(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	fb := newFramebuffer(4, 4, *pf)
+	buf := bytes.NewBufferString("header")
+	rects := []image.Rectangle{image.Rect(0, 0, 2, 2), image.Rect(2, 2, 4, 4)}
+	if err := fb.writeRects(buf, encodings.NewEncoderState(*pf), &failingEncoder{}, rects); err == nil {
+		t.Fatalf("expected an encoding error")
+	}
+	if buf.String() != "header" {
+		t.Fatalf("a partial rect was written: %q", buf.Bytes())
+	}
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/server"
+)
+
+type InputMode int
+type ClipboardMode int
+
+const (
+	InputModeFull         InputMode = iota // keyboard & pointer are passed to the target
+	InputModeViewOnly                      // no input reaches the target
+	InputModeKeyboardOnly                  // pointer events are dropped
+	InputModePointerOnly                   // key events are dropped
+)
+
+const (
+	ClipboardBoth       ClipboardMode = iota // cut text is passed both ways
+	ClipboardToTarget                        // only viewer -> target
+	ClipboardFromTarget                      // only target -> viewer
+	ClipboardDisabled                        // cut text is dropped in both directions
+)
+
+// commonly used keysyms for blocking keys & key combinations
+const (
+	KeysymBackSpace = 0xff08
+	KeysymTab       = 0xff09
+	KeysymEscape    = 0xff1b
+	KeysymDelete    = 0xffff
+	KeysymKPDelete  = 0xff9f
+	KeysymF4        = 0xffc1
+	KeysymShiftL    = 0xffe1
+	KeysymShiftR    = 0xffe2
+	KeysymControlL  = 0xffe3
+	KeysymControlR  = 0xffe4
+	KeysymMetaL     = 0xffe7
+	KeysymMetaR     = 0xffe8
+	KeysymAltL      = 0xffe9
+	KeysymAltR      = 0xffea
+	KeysymSuperL    = 0xffeb
+	KeysymSuperR    = 0xffec
+)
+
+// KeyComboCtrlAltDel can be added to InputPolicy.BlockedKeyCombos to keep viewers from sending Ctrl+Alt+Del
+var KeyComboCtrlAltDel = []uint32{KeysymControlL, KeysymAltL, KeysymDelete}
+
+func (m InputMode) String() string {
+	switch m {
+	case InputModeFull:
+		return "full"
+	case InputModeViewOnly:
+		return "viewOnly"
+	case InputModeKeyboardOnly:
+		return "keyboardOnly"
+	case InputModePointerOnly:
+		return "pointerOnly"
+	}
+	return ""
+}
+
+// ParseInputMode converts the name of an input mode (as returned by String) back to an InputMode
+func ParseInputMode(name string) (InputMode, error) {
+	for _, m := range []InputMode{InputModeFull, InputModeViewOnly, InputModeKeyboardOnly, InputModePointerOnly} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown input mode: %s", name)
+}
+
+func (m ClipboardMode) String() string {
+	switch m {
+	case ClipboardBoth:
+		return "both"
+	case ClipboardToTarget:
+		return "toTarget"
+	case ClipboardFromTarget:
+		return "fromTarget"
+	case ClipboardDisabled:
+		return "disabled"
+	}
+	return ""
+}
+
+// ParseClipboardMode converts the name of a clipboard mode (as returned by String) back to a ClipboardMode
+func ParseClipboardMode(name string) (ClipboardMode, error) {
+	for _, m := range []ClipboardMode{ClipboardBoth, ClipboardToTarget, ClipboardFromTarget, ClipboardDisabled} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown clipboard mode: %s", name)
+}
+
+// InputPolicy limits what a viewer can send to the target, it can be set on a session (applies to all viewers)
+// and on a single viewer, in which case both policies must allow a message for it to pass.
+// the zero value allows everything.
+type InputPolicy struct {
+	Mode           InputMode
+	Clipboard      ClipboardMode
+	BlockedKeysyms []uint32 // keys which are never sent to the target
+	// key combinations (e.g. KeyComboCtrlAltDel) which are blocked by dropping the last key while the others are held,
+	// left & right modifiers are treated the same, as are the keypad & the main Delete keys
+	BlockedKeyCombos [][]uint32
+}
+
+func (p *InputPolicy) allowsKeyboard() bool {
+	return p == nil || p.Mode == InputModeFull || p.Mode == InputModeKeyboardOnly
+}
+
+func (p *InputPolicy) allowsPointer() bool {
+	return p == nil || p.Mode == InputModeFull || p.Mode == InputModePointerOnly
+}
+
+// allowsClipboardToTarget reports if cut text from the viewer may reach the target
+func (p *InputPolicy) allowsClipboardToTarget() bool {
+	return p == nil || (p.Mode != InputModeViewOnly && (p.Clipboard == ClipboardBoth || p.Clipboard == ClipboardToTarget))
+}
+
+// allowsClipboardFromTarget reports if cut text from the target may reach the viewer
+func (p *InputPolicy) allowsClipboardFromTarget() bool {
+	return p == nil || p.Clipboard == ClipboardBoth || p.Clipboard == ClipboardFromTarget
+}
+
+// blocksKey reports if pressing key while the keys in held are down is blocked by this policy
+func (p *InputPolicy) blocksKey(key uint32, held map[uint32]bool) bool {
+	if p == nil {
+		return false
+	}
+	for _, k := range p.BlockedKeysyms {
+		if k == key {
+			return true
+		}
+	}
+	for _, combo := range p.BlockedKeyCombos {
+		if len(combo) == 0 || normalizeKeysym(combo[len(combo)-1]) != normalizeKeysym(key) {
+			continue
+		}
+		allHeld := true
+		for _, k := range combo[:len(combo)-1] {
+			if !held[normalizeKeysym(k)] {
+				allHeld = false
+				break
+			}
+		}
+		if allHeld {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeKeysym maps right side modifiers to their left side counterparts, and KP_Delete to Delete
+func normalizeKeysym(key uint32) uint32 {
+	switch key {
+	case KeysymShiftR, KeysymControlR, KeysymMetaR, KeysymAltR, KeysymSuperR:
+		return key - 1
+	case KeysymKPDelete:
+		return KeysymDelete
+	}
+	return key
+}
+
+// inputFilter applies input policies to the messages of a single viewer,
+// it keeps track of the keys held down so combinations can be detected & releases of dropped keys are dropped too
+type inputFilter struct {
+	mutex      sync.Mutex
+	held       map[uint32]bool
+	suppressed map[uint32]bool
+}
+
+func newInputFilter() *inputFilter {
+	return &inputFilter{
+		held:       make(map[uint32]bool),
+		suppressed: make(map[uint32]bool),
+	}
+}
+
+// allow reports if a client message should be passed to the target, given all policies that apply to the viewer
+func (f *inputFilter) allow(msg common.ClientMessage, policies ...*InputPolicy) bool {
+	switch m := msg.(type) {
+	case *server.MsgKeyEvent:
+		return f.allowKey(uint32(m.Key), m.Down != 0, policies)
+	case *server.MsgClientQemuExtendedKey:
+		return f.allowKey(m.KeySym, m.IsDown != 0, policies)
+	case *server.MsgPointerEvent:
+		for _, p := range policies {
+			if !p.allowsPointer() {
+				return false
+			}
+		}
+	case *server.MsgClientCutText:
+		for _, p := range policies {
+			if !p.allowsClipboardToTarget() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *inputFilter) allowKey(key uint32, down bool, policies []*InputPolicy) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	norm := normalizeKeysym(key)
+	if !down {
+		delete(f.held, norm)
+		if f.suppressed[key] {
+			delete(f.suppressed, key)
+			return false
+		}
+	}
+
+	allowed := true
+	for _, p := range policies {
+		if !p.allowsKeyboard() {
+			allowed = false
+		}
+	}
+
+	if down {
+		for _, p := range policies {
+			if allowed && p.blocksKey(key, f.held) {
+				allowed = false
+			}
+		}
+		f.held[norm] = true
+		if !allowed {
+			f.suppressed[key] = true
+		}
+	}
+	return allowed
+}
+
+// allowsClipboardFromTarget reports if all given policies let target cut text through to the viewer
+func allowsClipboardFromTarget(policies ...*InputPolicy) bool {
+	for _, p := range policies {
+		if !p.allowsClipboardFromTarget() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/amitbet/vncproxy/server"
+)
+
+func keyEvent(key uint32, down bool) *server.MsgKeyEvent {
+	msg := &server.MsgKeyEvent{Key: server.Key(key)}
+	if down {
+		msg.Down = 1
+	}
+	return msg
+}
+
+func TestInputPolicyModes(t *testing.T) {
+	pointer := &server.MsgPointerEvent{}
+	cutText := &server.MsgClientCutText{Text: []byte("text")}
+	key := keyEvent('a', true)
+
+	tests := []struct {
+		policy                  *InputPolicy
+		key, pointer, clipboard bool
+	}{
+		{nil, true, true, true},
+		{&InputPolicy{Mode: InputModeViewOnly}, false, false, false},
+		{&InputPolicy{Mode: InputModeKeyboardOnly}, true, false, true},
+		{&InputPolicy{Mode: InputModePointerOnly}, false, true, true},
+		{&InputPolicy{Clipboard: ClipboardFromTarget}, true, true, false},
+	}
+	for i, tt := range tests {
+		f := newInputFilter()
+		if f.allow(key, tt.policy) != tt.key || f.allow(pointer, tt.policy) != tt.pointer || f.allow(cutText, tt.policy) != tt.clipboard {
+			t.Errorf("%d: unexpected result for policy %+v", i, tt.policy)
+		}
+	}
+
+	if allowsClipboardFromTarget(nil, &InputPolicy{Clipboard: ClipboardToTarget}) {
+		t.Errorf("target clipboard passed a toTarget policy")
+	}
+}
+
+func TestInputPolicyKeyCombos(t *testing.T) {
+	session := &InputPolicy{BlockedKeyCombos: [][]uint32{KeyComboCtrlAltDel}}
+	viewer := &InputPolicy{BlockedKeysyms: []uint32{KeysymF4}}
+	f := newInputFilter()
+
+	// right ctrl + left alt + del is blocked, including the release of del
+	for _, msg := range []*server.MsgKeyEvent{keyEvent(KeysymControlR, true), keyEvent(KeysymAltL, true)} {
+		if !f.allow(msg, session, viewer) {
+			t.Fatalf("modifier %x was blocked", msg.Key)
+		}
+	}
+	if f.allow(keyEvent(KeysymDelete, true), session, viewer) {
+		t.Fatalf("ctrl+alt+del was not blocked")
+	}
+	if f.allow(keyEvent(KeysymDelete, false), session, viewer) {
+		t.Fatalf("release of a blocked key was not dropped")
+	}
+
+	// del on its own passes once the modifiers are released
+	f.allow(keyEvent(KeysymControlR, false), session, viewer)
+	f.allow(keyEvent(KeysymAltL, false), session, viewer)
+	if !f.allow(keyEvent(KeysymDelete, true), session, viewer) || !f.allow(keyEvent(KeysymDelete, false), session, viewer) {
+		t.Fatalf("del alone was blocked")
+	}
+
+	// the viewer's own policy applies on top of the session's
+	if f.allow(keyEvent(KeysymF4, true), session, viewer) {
+		t.Fatalf("blocked keysym passed")
+	}
+}
+
+func TestInputPolicyKeypadDelete(t *testing.T) {
+	session := &InputPolicy{BlockedKeyCombos: [][]uint32{KeyComboCtrlAltDel}}
+	f := newInputFilter()
+
+	// ctrl + alt + the keypad's delete is the same combination
+	f.allow(keyEvent(KeysymControlL, true), session)
+	f.allow(keyEvent(KeysymAltR, true), session)
+	if f.allow(keyEvent(KeysymKPDelete, true), session) {
+		t.Fatalf("ctrl+alt+KP_Delete was not blocked")
+	}
+	if f.allow(keyEvent(KeysymKPDelete, false), session) {
+		t.Fatalf("release of a blocked key was not dropped")
+	}
+}
@@ -0,0 +1,755 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+)
+
+const managementSessionsPath = "/sessions"
+
+// ManagementApi is an http.Handler exposing the session registry as a small REST api:
+//
+//	GET    /sessions       list all sessions
+//	POST   /sessions       create a session (an id is generated if none is given)
+//	GET    /sessions/{id}  get a single session
+//	PUT    /sessions/{id}  create or replace a session
+//	DELETE /sessions/{id}  remove a session
+//	PUT    /sessions/{id}/inputPolicy                  change the input policy of a (live) session
+//	PUT    /sessions/{id}/viewers/{viewerId}/inputPolicy  change the input policy of a single connected viewer
+//	GET    /sessions/{id}/floor        who holds the input floor & who is waiting for it
+//	POST   /sessions/{id}/floor        request / grant / release / revoke the floor: {"action":"grant","viewerId":"..","by":".."}
+//	GET    /sessions/{id}/events       the session's audit trail
+//	POST   /sessions/{id}/tokens       create a one-time viewer password: {"ttl":"5m"} (optional)
+//	POST   /sessions/{id}/sessionTokens  create a signed ws session token: {"ttl":"1h","viewOnly":true} (both optional)
+//
+// anyone allowed to call it can point the proxy at any host, so it should only be reachable by admins (see Token)
+type ManagementApi struct {
+	Sessions *SessionManager
+	// when set every request needs an "Authorization: Bearer <Token>" header, empty = no check (e.g. the mux mounting it authenticates)
+	Token string
+	// mints session tokens (e.g. VncProxy.NewSessionToken), nil disables the sessionTokens path
+	SessionTokens func(sessionId string, ttl time.Duration, viewOnly bool) (string, error)
+}
+
+// sessionJson is the wire representation of a VncSession, passwords are accepted but never returned
+type sessionJson struct {
+	ID                  string           `json:"id"`
+	Target              string           `json:"target,omitempty"`
+	TargetPassword      string           `json:"targetPassword,omitempty"`
+	TargetUsername      string           `json:"targetUsername,omitempty"`
+	Type                string           `json:"type"`
+	ReplayFilePath      string           `json:"replayFilePath,omitempty"`
+	Shared              bool             `json:"shared,omitempty"`
+	Transcode           bool             `json:"transcode,omitempty"`
+	InputPolicy         *inputPolicyJson `json:"inputPolicy,omitempty"`
+	ControlFloor        bool             `json:"controlFloor,omitempty"`
+	FloorIdleTimeout    string           `json:"floorIdleTimeout,omitempty"` // a duration, e.g. "2m"
+	Reconnect           *reconnectJson   `json:"reconnect,omitempty"`
+	Targets             []string         `json:"targets,omitempty"`
+	TargetStrategy      string           `json:"targetStrategy,omitempty"`
+	HealthCheckInterval string           `json:"healthCheckInterval,omitempty"` // a duration, e.g. "30s"
+	IdleTimeout         string           `json:"idleTimeout,omitempty"`         // a duration, e.g. "15m"
+	MaxDuration         string           `json:"maxDuration,omitempty"`         // a duration, e.g. "8h"
+	LimitWarning        string           `json:"limitWarning,omitempty"`        // a duration, e.g. "1m"
+	ViewerPassword      string           `json:"viewerPassword,omitempty"`
+	TokenOnly           bool             `json:"tokenOnly,omitempty"`
+	ListenAddr          string           `json:"listenAddr,omitempty"`
+	ServerName          string           `json:"serverName,omitempty"`
+	ReverseID           string           `json:"reverseId,omitempty"`
+	ReverseSecret       string           `json:"reverseSecret,omitempty"` // never returned
+	RepeaterID          string           `json:"repeaterId,omitempty"`
+
+	// read only state, ignored when creating sessions
+	Status          string       `json:"status,omitempty"`
+	StatusReason    string       `json:"statusReason,omitempty"`
+	CreatedAt       *time.Time   `json:"createdAt,omitempty"`
+	StatusChangedAt *time.Time   `json:"statusChangedAt,omitempty"`
+	ActiveSince     *time.Time   `json:"activeSince,omitempty"`
+	ClosedAt        *time.Time   `json:"closedAt,omitempty"`
+	LastActivity    *time.Time   `json:"lastActivity,omitempty"`
+	LastInput       *time.Time   `json:"lastInput,omitempty"`
+	Viewers         []viewerJson `json:"viewers,omitempty"`
+	BytesFromTarget uint64       `json:"bytesFromTarget"`
+	BytesToTarget   uint64       `json:"bytesToTarget"`
+	ReverseTargets  int          `json:"reverseTargets,omitempty"` // vnc servers which connected in & wait for viewers
+	Floor           *floorJson   `json:"floor,omitempty"`
+	TargetState     []targetJson `json:"targetState,omitempty"`
+}
+
+type targetJson struct {
+	Address     string     `json:"address"`
+	Healthy     bool       `json:"healthy"`
+	LastCheck   *time.Time `json:"lastCheck,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Connections int        `json:"connections"`
+}
+
+type floorJson struct {
+	Holder    string     `json:"holder,omitempty"`
+	HeldSince *time.Time `json:"heldSince,omitempty"`
+	LastInput *time.Time `json:"lastInput,omitempty"`
+	Requests  []string   `json:"requests"`
+}
+
+// floorActionJson is the body of a floor change, By is the granting viewer (empty for an admin override)
+type floorActionJson struct {
+	Action   string `json:"action"`
+	ViewerID string `json:"viewerId"`
+	By       string `json:"by,omitempty"`
+}
+
+// reconnectJson is the wire representation of a ReconnectPolicy, delays are durations, e.g. "500ms"
+type reconnectJson struct {
+	MaxAttempts  int    `json:"maxAttempts,omitempty"`
+	InitialDelay string `json:"initialDelay,omitempty"`
+	MaxDelay     string `json:"maxDelay,omitempty"`
+}
+
+// tokenJson is both the body of a token request (ttl & viewOnly) & the response
+type tokenJson struct {
+	TTL       string     `json:"ttl,omitempty"` // a duration, e.g. "5m"
+	ViewOnly  bool       `json:"viewOnly,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type eventJson struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	ViewerID string    `json:"viewerId,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+type viewerJson struct {
+	ID            string           `json:"id"`
+	RemoteAddr    string           `json:"remoteAddr"`
+	ConnectedAt   time.Time        `json:"connectedAt"`
+	BytesSent     uint64           `json:"bytesSent"`
+	BytesReceived uint64           `json:"bytesReceived"`
+	InputPolicy   *inputPolicyJson `json:"inputPolicy,omitempty"`
+}
+
+// inputPolicyJson is the wire representation of an InputPolicy, modes are given by name
+type inputPolicyJson struct {
+	Mode             string     `json:"mode,omitempty"`
+	Clipboard        string     `json:"clipboard,omitempty"`
+	BlockedKeysyms   []uint32   `json:"blockedKeysyms,omitempty"`
+	BlockedKeyCombos [][]uint32 `json:"blockedKeyCombos,omitempty"`
+}
+
+// NewManagementApi returns the api for the given sessions, it serves paths under /sessions,
+// http.StripPrefix can be used to mount it under another path of an existing mux
+func NewManagementApi(sessions *SessionManager) *ManagementApi {
+	return &ManagementApi{Sessions: sessions}
+}
+
+// authorized checks the request's bearer token against Token
+func (api *ManagementApi) authorized(r *http.Request) bool {
+	if api.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(api.Token)) == 1
+}
+
+// jsonTime omits unset timestamps from the output
+func jsonTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newSessionJson(session *VncSession) *sessionJson {
+	info := session.Info()
+	sj := &sessionJson{
+		ID:              info.ID,
+		Target:          info.Target,
+		Type:            info.Type.String(),
+		ReplayFilePath:  session.ReplayFilePath,
+		Shared:          session.Shared,
+		Transcode:       session.Transcode,
+		InputPolicy:     newInputPolicyJson(session.getInputPolicy()),
+		ControlFloor:    session.ControlFloor,
+		TokenOnly:       session.TokenOnly,
+		ListenAddr:      session.ListenAddr,
+		ServerName:      session.ServerName,
+		ReverseID:       session.ReverseID,
+		RepeaterID:      session.RepeaterID,
+		Status:          info.Status.String(),
+		StatusReason:    info.StatusReason,
+		CreatedAt:       jsonTime(info.CreatedAt),
+		StatusChangedAt: jsonTime(info.StatusChangedAt),
+		ActiveSince:     jsonTime(info.ActiveSince),
+		ClosedAt:        jsonTime(info.ClosedAt),
+		LastActivity:    jsonTime(info.LastActivity),
+		LastInput:       jsonTime(info.LastInput),
+		BytesFromTarget: info.BytesFromTarget,
+		BytesToTarget:   info.BytesToTarget,
+		ReverseTargets:  info.ReverseTargets,
+	}
+	if session.FloorIdleTimeout > 0 {
+		sj.FloorIdleTimeout = session.FloorIdleTimeout.String()
+	}
+	if session.IdleTimeout > 0 {
+		sj.IdleTimeout = session.IdleTimeout.String()
+	}
+	if session.MaxDuration > 0 {
+		sj.MaxDuration = session.MaxDuration.String()
+	}
+	if session.LimitWarning > 0 {
+		sj.LimitWarning = session.LimitWarning.String()
+	}
+	if session.ControlFloor {
+		sj.Floor = newFloorJson(session.Floor())
+	}
+	if len(session.Targets) > 0 {
+		sj.Targets = session.Targets
+		sj.TargetStrategy = session.TargetStrategy.String()
+		if session.HealthCheckInterval > 0 {
+			sj.HealthCheckInterval = session.HealthCheckInterval.String()
+		}
+	}
+	for _, ti := range info.Targets {
+		sj.TargetState = append(sj.TargetState, targetJson{
+			Address:     ti.Address,
+			Healthy:     ti.Healthy,
+			LastCheck:   jsonTime(ti.LastCheck),
+			LastError:   ti.LastError,
+			Connections: ti.Connections,
+		})
+	}
+	if session.Reconnect != nil {
+		sj.Reconnect = &reconnectJson{MaxAttempts: session.Reconnect.MaxAttempts}
+		if session.Reconnect.InitialDelay > 0 {
+			sj.Reconnect.InitialDelay = session.Reconnect.InitialDelay.String()
+		}
+		if session.Reconnect.MaxDelay > 0 {
+			sj.Reconnect.MaxDelay = session.Reconnect.MaxDelay.String()
+		}
+	}
+	for _, v := range info.Viewers {
+		sj.Viewers = append(sj.Viewers, viewerJson{
+			ID:            v.ID,
+			RemoteAddr:    v.RemoteAddr,
+			ConnectedAt:   v.ConnectedAt,
+			BytesSent:     v.BytesSent,
+			BytesReceived: v.BytesReceived,
+			InputPolicy:   newInputPolicyJson(v.InputPolicy),
+		})
+	}
+	return sj
+}
+
+func (sj *sessionJson) toSession() (*VncSession, error) {
+	if sj.Type == "" {
+		sj.Type = SessionTypeProxyPass.String()
+	}
+	sessionType, err := ParseSessionType(sj.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if sessionType == SessionTypeReplayServer && sj.ReplayFilePath == "" {
+		return nil, errors.New("replayFilePath is required for replay sessions")
+	}
+	if sessionType != SessionTypeReplayServer && sj.Target == "" && len(sj.Targets) == 0 && sj.ReverseID == "" {
+		return nil, errors.New("target (or targets, or reverseId) is required for proxy sessions")
+	}
+	if sj.ReverseSecret != "" && sj.ReverseID == "" {
+		return nil, errors.New("reverseSecret needs a reverseId")
+	}
+
+	inputPolicy, err := sj.InputPolicy.toInputPolicy()
+	if err != nil {
+		return nil, err
+	}
+	var floorIdleTimeout time.Duration
+	if sj.FloorIdleTimeout != "" {
+		if floorIdleTimeout, err = time.ParseDuration(sj.FloorIdleTimeout); err != nil {
+			return nil, err
+		}
+	}
+	reconnect, err := sj.Reconnect.toReconnectPolicy()
+	if err != nil {
+		return nil, err
+	}
+	var targetStrategy TargetStrategy
+	if sj.TargetStrategy != "" {
+		if targetStrategy, err = ParseTargetStrategy(sj.TargetStrategy); err != nil {
+			return nil, err
+		}
+	}
+	var healthCheckInterval time.Duration
+	if sj.HealthCheckInterval != "" {
+		if healthCheckInterval, err = time.ParseDuration(sj.HealthCheckInterval); err != nil {
+			return nil, err
+		}
+	}
+	var idleTimeout, maxDuration, limitWarning time.Duration
+	if sj.IdleTimeout != "" {
+		if idleTimeout, err = time.ParseDuration(sj.IdleTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if sj.MaxDuration != "" {
+		if maxDuration, err = time.ParseDuration(sj.MaxDuration); err != nil {
+			return nil, err
+		}
+	}
+	if sj.LimitWarning != "" {
+		if limitWarning, err = time.ParseDuration(sj.LimitWarning); err != nil {
+			return nil, err
+		}
+	}
+
+	return &VncSession{
+		ID:                  sj.ID,
+		Target:              sj.Target,
+		TargetPassword:      sj.TargetPassword,
+		TargetUsername:      sj.TargetUsername,
+		Type:                sessionType,
+		ReplayFilePath:      sj.ReplayFilePath,
+		Shared:              sj.Shared,
+		Transcode:           sj.Transcode,
+		InputPolicy:         inputPolicy,
+		ControlFloor:        sj.ControlFloor,
+		FloorIdleTimeout:    floorIdleTimeout,
+		Reconnect:           reconnect,
+		Targets:             sj.Targets,
+		TargetStrategy:      targetStrategy,
+		HealthCheckInterval: healthCheckInterval,
+		IdleTimeout:         idleTimeout,
+		MaxDuration:         maxDuration,
+		LimitWarning:        limitWarning,
+		ViewerPassword:      sj.ViewerPassword,
+		TokenOnly:           sj.TokenOnly,
+		ListenAddr:          sj.ListenAddr,
+		ServerName:          sj.ServerName,
+		ReverseID:           sj.ReverseID,
+		ReverseSecret:       sj.ReverseSecret,
+		RepeaterID:          sj.RepeaterID,
+		Status:              SessionStatusInit,
+	}, nil
+}
+
+func (rj *reconnectJson) toReconnectPolicy() (*ReconnectPolicy, error) {
+	if rj == nil {
+		return nil, nil
+	}
+	policy := &ReconnectPolicy{MaxAttempts: rj.MaxAttempts}
+	var err error
+	if rj.InitialDelay != "" {
+		if policy.InitialDelay, err = time.ParseDuration(rj.InitialDelay); err != nil {
+			return nil, err
+		}
+	}
+	if rj.MaxDelay != "" {
+		if policy.MaxDelay, err = time.ParseDuration(rj.MaxDelay); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func newFloorJson(floor FloorInfo) *floorJson {
+	return &floorJson{
+		Holder:    floor.Holder,
+		HeldSince: jsonTime(floor.HeldSince),
+		LastInput: jsonTime(floor.LastInput),
+		Requests:  floor.Requests,
+	}
+}
+
+func newInputPolicyJson(policy *InputPolicy) *inputPolicyJson {
+	if policy == nil {
+		return nil
+	}
+	return &inputPolicyJson{
+		Mode:             policy.Mode.String(),
+		Clipboard:        policy.Clipboard.String(),
+		BlockedKeysyms:   policy.BlockedKeysyms,
+		BlockedKeyCombos: policy.BlockedKeyCombos,
+	}
+}
+
+// toInputPolicy validates & converts the policy, a nil policy (allowing everything) is returned as nil
+func (pj *inputPolicyJson) toInputPolicy() (*InputPolicy, error) {
+	if pj == nil {
+		return nil, nil
+	}
+	policy := &InputPolicy{
+		BlockedKeysyms:   pj.BlockedKeysyms,
+		BlockedKeyCombos: pj.BlockedKeyCombos,
+	}
+	var err error
+	if pj.Mode != "" {
+		if policy.Mode, err = ParseInputMode(pj.Mode); err != nil {
+			return nil, err
+		}
+	}
+	if pj.Clipboard != "" {
+		if policy.Clipboard, err = ParseClipboardMode(pj.Clipboard); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func newRandomId() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (api *ManagementApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vncproxy"`)
+		writeJsonError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	rest := strings.TrimPrefix(path, managementSessionsPath)
+	if rest == path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			api.listSessions(w, r)
+		case http.MethodPost:
+			api.createSession(w, r, "")
+		default:
+			writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	sessionPath := strings.TrimPrefix(rest, "/")
+	if sessionPath == rest {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(sessionPath, "/")
+	sessionId := parts[0]
+
+	switch {
+	case len(parts) == 2 && parts[1] == "inputPolicy":
+		if r.Method != http.MethodPut {
+			writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		api.setInputPolicy(w, r, sessionId, "")
+		return
+	case len(parts) == 4 && parts[1] == "viewers" && parts[3] == "inputPolicy":
+		if r.Method != http.MethodPut {
+			writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		api.setInputPolicy(w, r, sessionId, parts[2])
+		return
+	case len(parts) == 2 && parts[1] == "floor":
+		switch r.Method {
+		case http.MethodGet:
+			api.getFloor(w, r, sessionId)
+		case http.MethodPost:
+			api.changeFloor(w, r, sessionId)
+		default:
+			writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	case len(parts) == 2 && parts[1] == "events":
+		if r.Method != http.MethodGet {
+			writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		api.getEvents(w, r, sessionId)
+		return
+	case len(parts) == 2 && parts[1] == "tokens":
+		if r.Method != http.MethodPost {
+			writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		api.createToken(w, r, sessionId)
+		return
+	case len(parts) == 2 && parts[1] == "sessionTokens":
+		if r.Method != http.MethodPost {
+			writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		api.createSessionToken(w, r, sessionId)
+		return
+	case len(parts) != 1:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		api.getSession(w, r, sessionId)
+	case http.MethodPut:
+		api.createSession(w, r, sessionId)
+	case http.MethodDelete:
+		api.deleteSession(w, r, sessionId)
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (api *ManagementApi) listSessions(w http.ResponseWriter, r *http.Request) {
+	list := []*sessionJson{}
+	for _, session := range api.Sessions.ListSessions() {
+		list = append(list, newSessionJson(session))
+	}
+	writeJson(w, http.StatusOK, list)
+}
+
+func (api *ManagementApi) getSession(w http.ResponseWriter, r *http.Request, sessionId string) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, http.StatusOK, newSessionJson(session))
+}
+
+// createSession handles both POST (pathId is empty, fails on an existing id) and PUT (replaces the session at pathId)
+func (api *ManagementApi) createSession(w http.ResponseWriter, r *http.Request, pathId string) {
+	sj := &sessionJson{}
+	if err := json.NewDecoder(r.Body).Decode(sj); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if pathId != "" {
+		if sj.ID != "" && sj.ID != pathId {
+			writeJsonError(w, http.StatusBadRequest, errors.New("session id in body does not match the url"))
+			return
+		}
+		sj.ID = pathId
+	}
+
+	if sj.ID == "" {
+		id, err := newRandomId()
+		if err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		sj.ID = id
+	}
+
+	session, err := sj.toSession()
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// POST only creates a new session, PUT creates or replaces it
+	replaced, err := api.Sessions.storeSession(sj.ID, session, pathId != "")
+	if err == ErrSessionExists {
+		writeJsonError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	status := http.StatusCreated
+	if replaced {
+		status = http.StatusOK
+	}
+	logger.Infof("ManagementApi: session registered: id=%s type=%s target=%s", session.ID, session.Type, session.TargetAddress())
+	writeJson(w, status, newSessionJson(session))
+}
+
+func (api *ManagementApi) deleteSession(w http.ResponseWriter, r *http.Request, sessionId string) {
+	if err := api.Sessions.DeleteSession(sessionId); err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+	logger.Infof("ManagementApi: session removed: id=%s", sessionId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setInputPolicy replaces the input policy of a session, or of one of its viewers when viewerId is given, a null body removes it
+func (api *ManagementApi) setInputPolicy(w http.ResponseWriter, r *http.Request, sessionId string, viewerId string) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+
+	var pj *inputPolicyJson
+	if err := json.NewDecoder(r.Body).Decode(&pj); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	policy, err := pj.toInputPolicy()
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if viewerId == "" {
+		session.SetInputPolicy(policy)
+	} else if err := session.SetViewerInputPolicy(viewerId, policy); err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+	logger.Infof("ManagementApi: input policy changed: session=%s viewer=%s policy=%+v", sessionId, viewerId, policy)
+	writeJson(w, http.StatusOK, newSessionJson(session))
+}
+
+func (api *ManagementApi) getFloor(w http.ResponseWriter, r *http.Request, sessionId string) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, http.StatusOK, newFloorJson(session.Floor()))
+}
+
+func (api *ManagementApi) changeFloor(w http.ResponseWriter, r *http.Request, sessionId string) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+
+	action := &floorActionJson{}
+	if err := json.NewDecoder(r.Body).Decode(action); err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch action.Action {
+	case "request":
+		err = session.RequestFloor(action.ViewerID)
+	case "grant":
+		err = session.GrantFloor(action.ViewerID, action.By)
+	case "release":
+		err = session.ReleaseFloor(action.ViewerID)
+	case "revoke":
+		err = session.RevokeFloor()
+	default:
+		err = errors.New("unknown floor action: " + action.Action)
+	}
+
+	switch err {
+	case nil:
+		writeJson(w, http.StatusOK, newFloorJson(session.Floor()))
+	case ErrViewerNotFound:
+		writeJsonError(w, http.StatusNotFound, err)
+	case ErrNotFloorHolder:
+		writeJsonError(w, http.StatusConflict, err)
+	default:
+		writeJsonError(w, http.StatusBadRequest, err)
+	}
+}
+
+func (api *ManagementApi) getEvents(w http.ResponseWriter, r *http.Request, sessionId string) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+	list := []eventJson{}
+	for _, e := range session.Events() {
+		list = append(list, eventJson{Time: e.Time, Type: e.Type, ViewerID: e.ViewerID, Detail: e.Detail})
+	}
+	writeJson(w, http.StatusOK, list)
+}
+
+// createToken issues a one-time viewer password for the session, an empty body uses the default expiry
+func (api *ManagementApi) createToken(w http.ResponseWriter, r *http.Request, sessionId string) {
+	session, err := api.Sessions.GetSession(sessionId)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+	tj, ttl, err := readTokenRequest(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if tj.ViewOnly {
+		writeJsonError(w, http.StatusBadRequest, errors.New("viewOnly is only supported by session tokens"))
+		return
+	}
+	token, expires, err := session.NewViewerToken(ttl)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusCreated, &tokenJson{Token: token, ExpiresAt: &expires})
+}
+
+// createSessionToken mints a signed token which websocket viewers use to reach the session, an empty body creates
+// a token which doesn't expire
+func (api *ManagementApi) createSessionToken(w http.ResponseWriter, r *http.Request, sessionId string) {
+	if api.SessionTokens == nil {
+		writeJsonError(w, http.StatusNotFound, errors.New("session tokens are not enabled"))
+		return
+	}
+	if _, err := api.Sessions.GetSession(sessionId); err != nil {
+		writeJsonError(w, http.StatusNotFound, err)
+		return
+	}
+	tj, ttl, err := readTokenRequest(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	token, err := api.SessionTokens(sessionId, ttl, tj.ViewOnly)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := &tokenJson{Token: token, ViewOnly: tj.ViewOnly}
+	if ttl > 0 {
+		resp.ExpiresAt = jsonTime(time.Now().Add(ttl).Truncate(time.Second))
+	}
+	writeJson(w, http.StatusCreated, resp)
+}
+
+// readTokenRequest decodes the (optional) body of a token request
+func readTokenRequest(r *http.Request) (*tokenJson, time.Duration, error) {
+	tj := &tokenJson{}
+	if err := json.NewDecoder(r.Body).Decode(tj); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	var ttl time.Duration
+	if tj.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(tj.TTL); err != nil {
+			return nil, 0, err
+		}
+	}
+	return tj, ttl, nil
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Errorf("ManagementApi: error writing response: %v", err)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
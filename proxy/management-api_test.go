@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func doApiRequest(t *testing.T, api http.Handler, method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestManagementApiSessionLifecycle(t *testing.T) {
+	sessions := NewSessionManager()
+	api := NewManagementApi(sessions)
+
+	rec := doApiRequest(t, api, http.MethodPost, "/sessions", `{"id":"s1","target":"127.0.0.1:5901","targetPassword":"secret","type":"recordingProxy"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Fatalf("create: password leaked in response: %s", rec.Body.String())
+	}
+
+	session, err := sessions.GetSession("s1")
+	if err != nil {
+		t.Fatalf("session not registered: %v", err)
+	}
+	if session.Type != SessionTypeRecordingProxy || session.TargetPassword != "secret" || session.TargetAddress() != "127.0.0.1:5901" {
+		t.Fatalf("unexpected session registered: %+v", session)
+	}
+
+	rec = doApiRequest(t, api, http.MethodPost, "/sessions", `{"id":"s1","target":"127.0.0.1:5901"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate create: expected conflict, got %d", rec.Code)
+	}
+
+	rec = doApiRequest(t, api, http.MethodGet, "/sessions/sessions", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("get /sessions/sessions: expected not found, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = doApiRequest(t, api, http.MethodGet, "/other/sessions", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("get /other/sessions: expected not found, got %d", rec.Code)
+	}
+
+	rec = doApiRequest(t, api, http.MethodPut, "/sessions/s2", `{"type":"replayServer","replayFilePath":"/tmp/rec.fbs"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("put: unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = doApiRequest(t, api, http.MethodGet, "/sessions", "")
+	var list []sessionJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("list: bad response: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != "s1" || list[1].ID != "s2" {
+		t.Fatalf("list: unexpected sessions: %+v", list)
+	}
+
+	rec = doApiRequest(t, api, http.MethodDelete, "/sessions/s1", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: unexpected status %d", rec.Code)
+	}
+	rec = doApiRequest(t, api, http.MethodGet, "/sessions/s1", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("get after delete: expected not found, got %d", rec.Code)
+	}
+}
+
+func TestManagementApiValidation(t *testing.T) {
+	api := NewManagementApi(NewSessionManager())
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"type":"proxyPass"}`, http.StatusBadRequest},                            // no target
+		{`{"type":"replayServer"}`, http.StatusBadRequest},                         // no replay file
+		{`{"type":"bogus","target":"h:1"}`, http.StatusBadRequest},                 // unknown type
+		{`not json`, http.StatusBadRequest},                                        // bad body
+		{`{"target":"h:1","inputPolicy":{"mode":"bogus"}}`, http.StatusBadRequest}, // unknown input mode
+		{`{"target":"/var/run/vnc.sock"}`, http.StatusCreated},                     // default type, generated id
+	}
+
+	for _, tt := range tests {
+		rec := doApiRequest(t, api, http.MethodPost, "/sessions", tt.body)
+		if rec.Code != tt.code {
+			t.Errorf("POST %s: got status %d, want %d", tt.body, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestManagementApiViewerTokens(t *testing.T) {
+	sessions := NewSessionManager()
+	api := NewManagementApi(sessions)
+
+	rec := doApiRequest(t, api, http.MethodPost, "/sessions", `{"id":"s1","target":"127.0.0.1:5901","viewerPassword":"viewpass","tokenOnly":true}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "viewpass") {
+		t.Fatalf("create: viewer password leaked in response: %s", rec.Body.String())
+	}
+	session, _ := sessions.GetSession("s1")
+	if session.ViewerPassword != "viewpass" || !session.TokenOnly {
+		t.Fatalf("unexpected session registered: %+v", session)
+	}
+
+	rec = doApiRequest(t, api, http.MethodPost, "/sessions/s1/tokens", `{"ttl":"2m"}`)
+	var token tokenJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &token); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("token: unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(token.Token) != viewerTokenLength || token.ExpiresAt == nil {
+		t.Fatalf("token: unexpected token: %+v", token)
+	}
+
+	// the default expiry is used without a body
+	if rec = doApiRequest(t, api, http.MethodPost, "/sessions/s1/tokens", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("token without body: unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec = doApiRequest(t, api, http.MethodPost, "/sessions/s1/tokens", `{"ttl":"soon"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("token with a bad ttl: expected bad request, got %d", rec.Code)
+	}
+	if rec = doApiRequest(t, api, http.MethodPost, "/sessions/nope/tokens", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("token for a missing session: expected not found, got %d", rec.Code)
+	}
+}
+
+func TestManagementApiSessionTokens(t *testing.T) {
+	vp := &VncProxy{UsingSessions: true, SessionTokenKey: []byte("secret")}
+	api := NewManagementApi(vp.Sessions())
+	vp.Sessions().SetSession("s1", &VncSession{})
+
+	if rec := doApiRequest(t, api, http.MethodPost, "/sessions/s1/sessionTokens", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("session token without a minter: expected not found, got %d", rec.Code)
+	}
+
+	api.SessionTokens = vp.NewSessionToken
+	rec := doApiRequest(t, api, http.MethodPost, "/sessions/s1/sessionTokens", `{"ttl":"1h","viewOnly":true}`)
+	var token tokenJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &token); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("session token: unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	claims, err := vp.ParseSessionToken(token.Token)
+	if err != nil || claims.SessionID != "s1" || !claims.ViewOnly || token.ExpiresAt == nil {
+		t.Fatalf("session token: unexpected token %+v (%v)", claims, err)
+	}
+	if rec = doApiRequest(t, api, http.MethodPost, "/sessions/nope/sessionTokens", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("session token for a missing session: expected not found, got %d", rec.Code)
+	}
+}
+
+func TestManagementApiToken(t *testing.T) {
+	api := NewManagementApi(NewSessionManager())
+	api.Token = "admin-secret"
+
+	for _, auth := range []string{"", "admin-secret", "Bearer wrong", "Basic admin-secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"id":"s1","target":"10.0.0.1:5900"}`))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("authorization %q: expected unauthorized, got %d", auth, rec.Code)
+		}
+	}
+	if _, err := api.Sessions.GetSession("s1"); err == nil {
+		t.Fatal("a session was created without the token")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"id":"s1","target":"10.0.0.1:5900"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create with the token: unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	vp := &VncProxy{TCPListeningURL: "127.0.0.1:0", ManagementURL: "127.0.0.1:0"}
+	if err := vp.Start(context.Background()); err == nil {
+		vp.Shutdown(context.Background())
+		t.Fatal("the management api was started without a token")
+	}
+}
+
+func TestSessionManagerAddSession(t *testing.T) {
+	sessions := NewSessionManager()
+	first := &VncSession{Target: "127.0.0.1:5901"}
+	if err := sessions.AddSession("s1", first); err != nil {
+		t.Fatalf("error adding a session: %v", err)
+	}
+	if err := sessions.AddSession("s1", &VncSession{Target: "127.0.0.1:5902"}); err != ErrSessionExists {
+		t.Fatalf("expected ErrSessionExists, got %v", err)
+	}
+	if session, _ := sessions.GetSession("s1"); session != first {
+		t.Fatalf("the existing session was replaced")
+	}
+}
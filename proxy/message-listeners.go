@@ -1,6 +1,10 @@
 package proxy
 
 import (
+	"bytes"
+	"io"
+	"sync"
+
 	"github.com/amitbet/vncproxy/client"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
@@ -8,7 +12,77 @@ import (
 )
 
 type ClientUpdater struct {
-	conn *client.ClientConn
+	conn    *client.ClientConn
+	session *VncSession
+	viewer  *Viewer
+
+	mutex     sync.Mutex              // guards conn (which is nil while the target is being reconnected) & encodings
+	encodings *server.MsgSetEncodings // the last encodings the viewer asked for, sent again after a reconnect
+	// set after a reconnect: the viewer's zlib streams belong to the old target connection, so encodings using them are removed
+	noZlibStreams bool
+	// set for sessions with Transcode: the viewer's pixel format & encodings are kept by the transcoder instead of being passed to the target
+	transcoder *transcoder
+}
+
+// setConn replaces the target connection messages are written to, nil drops the viewer's messages
+func (cc *ClientUpdater) setConn(conn *client.ClientConn) {
+	cc.mutex.Lock()
+	cc.conn = conn
+	cc.mutex.Unlock()
+}
+
+// resumeWith switches to a reconnected target connection, from now on encodings using zlib streams are filtered out
+func (cc *ClientUpdater) resumeWith(conn *client.ClientConn) {
+	cc.mutex.Lock()
+	cc.conn = conn
+	cc.noZlibStreams = true
+	cc.mutex.Unlock()
+}
+
+// lastEncodings returns the last SetEncodings message sent by the viewer (nil if there was none)
+func (cc *ClientUpdater) lastEncodings() *server.MsgSetEncodings {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.encodings
+}
+
+// countingWriter reports the number of bytes written through it, used to keep the session & viewer byte counters
+type countingWriter struct {
+	writer io.Writer
+	count  func(int)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.writer.Write(p)
+	cw.count(n)
+	return n, err
+}
+
+func (cc *ClientUpdater) countBytes(n int) {
+	if cc.session != nil {
+		cc.session.countToTarget(n)
+	}
+	if cc.viewer != nil {
+		cc.viewer.countReceived(n)
+	}
+}
+
+// writeMessage sends a client message to the target in a single write, outside of the viewer's messages
+// (it is dropped while the target is being reconnected)
+func (cc *ClientUpdater) writeMessage(msg common.ClientMessage) error {
+	buf := &bytes.Buffer{}
+	if err := msg.Write(buf); err != nil {
+		return err
+	}
+	cc.mutex.Lock()
+	conn := cc.conn
+	cc.mutex.Unlock()
+	if conn == nil {
+		return nil
+	}
+	n, err := conn.Write(buf.Bytes())
+	cc.countBytes(n)
+	return err
 }
 
 // Consume recieves vnc-server-bound messages (Client messages) and updates the server part of the proxy
@@ -19,16 +93,46 @@ func (cc *ClientUpdater) Consume(seg *common.RfbSegment) error {
 	case common.SegmentFullyParsedClientMessage:
 		clientMsg := seg.Message.(common.ClientMessage)
 		logger.Debugf("ClientUpdater.Consume:(vnc-server-bound) got ClientMessage type=%s", clientMsg.Type())
+		cc.mutex.Lock()
+		conn := cc.conn
 		switch clientMsg.Type() {
 
 		case common.SetPixelFormatMsgType:
 			// update pixel format
 			logger.Debugf("ClientUpdater.Consume: updating pixel format")
 			pixFmtMsg := clientMsg.(*server.MsgSetPixelFormat)
-			cc.conn.PixelFormat = pixFmtMsg.PF
+			if cc.transcoder != nil {
+				cc.transcoder.setPixelFormat(pixFmtMsg.PF)
+				cc.mutex.Unlock()
+				return nil
+			}
+			if conn != nil {
+				conn.PixelFormat = pixFmtMsg.PF
+			}
+		case common.SetEncodingsMsgType:
+			cc.encodings = clientMsg.(*server.MsgSetEncodings)
+			if cc.transcoder != nil {
+				cc.transcoder.setEncodings(cc.encodings.Encodings)
+				cc.mutex.Unlock()
+				return nil
+			}
+			if cc.noZlibStreams {
+				clientMsg = withoutZlibStreams(cc.encodings)
+			}
+		}
+		cc.mutex.Unlock()
+
+		if conn == nil {
+			logger.Debugf("ClientUpdater.Consume: target is reconnecting, dropped ClientMessage type=%s", clientMsg.Type())
+			return nil
 		}
 
-		err := clientMsg.Write(cc.conn)
+		if cc.session != nil && cc.viewer != nil && !cc.session.allowClientMessage(cc.viewer, clientMsg) {
+			logger.Debugf("ClientUpdater.Consume: input policy dropped ClientMessage type=%s", clientMsg.Type())
+			return nil
+		}
+
+		err := clientMsg.Write(&countingWriter{conn, cc.countBytes})
 		if err != nil {
 			logger.Errorf("ClientUpdater.Consume (vnc-server-bound, SegmentFullyParsedClientMessage): problem writing to port: %s", err)
 		}
@@ -38,7 +142,63 @@ func (cc *ClientUpdater) Consume(seg *common.RfbSegment) error {
 }
 
 type ServerUpdater struct {
-	conn *server.ServerConn
+	conn    *server.ServerConn
+	session *VncSession
+	viewer  *Viewer
+
+	dropping bool // the bytes of the current message are not passed to the viewer (blocked by the input policy, or transcoded)
+
+	// set for sessions with Transcode: the target's updates are passed to the viewer re-encoded instead of as they are
+	transcoder *transcoder
+
+	// when buffered, each message is passed to the viewer only once it was fully read,
+	// so a target connection dropping mid-message doesn't leave the viewer with a partial message (used for reconnecting)
+	buffered   bool
+	pending    bytes.Buffer
+	initDone   bool
+	writeMutex sync.Mutex
+}
+
+// write sends bytes to the viewer, it is also used to inject messages from outside the target's stream
+func (p *ServerUpdater) write(b []byte) (int, error) {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	n, err := p.conn.Write(b)
+	p.countBytes(n)
+	return n, err
+}
+
+// transcode passes the target's update to the viewer re-encoded, the target's color map is only used for decoding
+func (p *ServerUpdater) transcode(msg interface{}) error {
+	switch msg := msg.(type) {
+	case *client.MsgFramebufferUpdate:
+		update, err := p.transcoder.update(msg, p.conn)
+		if err != nil {
+			//the viewer can't be sent the rest of the update, it is dropped rather than left out of sync
+			p.conn.Close()
+			return err
+		}
+		p.writeMutex.Lock()
+		defer p.writeMutex.Unlock()
+		//the target's bytes were counted as they were read
+		n, err := p.conn.Write(update)
+		if p.viewer != nil {
+			p.viewer.countSent(n)
+		}
+		return err
+	case *client.MsgSetColorMapEntries:
+		p.transcoder.setColorMapEntries(msg)
+	}
+	return nil
+}
+
+func (p *ServerUpdater) countBytes(n int) {
+	if p.session != nil {
+		p.session.countFromTarget(n)
+	}
+	if p.viewer != nil {
+		p.viewer.countSent(n)
+	}
 }
 
 func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
@@ -46,8 +206,26 @@ func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
 	logger.Debugf("WriteTo.Consume (ServerUpdater): got segment type=%s, object type:%d", seg.SegmentType, seg.UpcomingObjectType)
 	switch seg.SegmentType {
 	case common.SegmentMessageStart:
+		p.pending.Reset()
+		p.dropping = seg.UpcomingObjectType == int(common.ServerCutText) &&
+			p.session != nil && p.viewer != nil && !p.session.allowClipboardFromTarget(p.viewer)
+		if p.dropping {
+			logger.Debugf("WriteTo.Consume (ServerUpdater): input policy dropped ServerCutText")
+		}
+		if p.transcoder != nil {
+			msgType := common.ServerMessageType(seg.UpcomingObjectType)
+			p.dropping = p.dropping || msgType == common.FramebufferUpdate || msgType == common.SetColourMapEntries
+		}
 	case common.SegmentRectSeparator:
 	case common.SegmentServerInitMessage:
+		if p.transcoder != nil {
+			p.transcoder.targetInit(seg.Message.(*common.ServerInit))
+		}
+		if p.initDone {
+			//a reconnected target, the viewer keeps the pixel format it is using, size changes are handled by the reconnect
+			return nil
+		}
+		p.initDone = true
 		serverInitMessage := seg.Message.(*common.ServerInit)
 		p.conn.SetHeight(serverInitMessage.FBHeight)
 		p.conn.SetWidth(serverInitMessage.FBWidth)
@@ -56,11 +234,38 @@ func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
 
 	case common.SegmentBytes:
 		logger.Debugf("WriteTo.Consume (ServerUpdater SegmentBytes): got bytes len=%d", len(seg.Bytes))
-		_, err := p.conn.Write(seg.Bytes)
+		if p.dropping {
+			p.session.countFromTarget(len(seg.Bytes))
+			return nil
+		}
+		if p.buffered {
+			p.pending.Write(seg.Bytes)
+			return nil
+		}
+		_, err := p.write(seg.Bytes)
 		if err != nil {
 			logger.Errorf("WriteTo.Consume (ServerUpdater SegmentBytes): problem writing to port: %s", err)
 		}
 		return err
+	case common.SegmentFullyParsedServerMessage:
+		if p.transcoder != nil {
+			if err := p.transcode(seg.Message); err != nil {
+				logger.Errorf("WriteTo.Consume (ServerUpdater SegmentFullyParsedServerMessage): problem writing transcoded update to port: %s", err)
+				return err
+			}
+		}
+		if !p.buffered || p.pending.Len() == 0 {
+			return nil
+		}
+		_, err := p.write(p.pending.Bytes())
+		p.pending.Reset()
+		if err != nil {
+			logger.Errorf("WriteTo.Consume (ServerUpdater SegmentFullyParsedServerMessage): problem writing to port: %s", err)
+		}
+		return err
+	case common.SegmentConnectionClosed:
+		//anything left is a partial message
+		p.pending.Reset()
 	case common.SegmentFullyParsedClientMessage:
 
 		clientMsg := seg.Message.(common.ClientMessage)
@@ -75,3 +280,15 @@ func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
 	}
 	return nil
 }
+
+// ConnectionCloseListener calls OnClose when the connection it is listening to is closed
+type ConnectionCloseListener struct {
+	OnClose func()
+}
+
+func (l *ConnectionCloseListener) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentConnectionClosed {
+		l.OnClose()
+	}
+	return nil
+}
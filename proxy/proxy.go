@@ -1,9 +1,17 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/amitbet/vncproxy/client"
@@ -16,39 +24,135 @@ import (
 )
 
 type VncProxy struct {
-	TCPListeningURL  string      // empty = not listening on tcp
-	WsListeningURL   string      // empty = not listening on ws
-	RecordingDir     string      // empty = no recording
-	ProxyVncPassword string      //empty = no auth
-	SingleSession    *VncSession // to be used when not using sessions
-	UsingSessions    bool        //false = single session - defined in the var above
-	sessionManager   *SessionManager
+	TCPListeningURL  string       // empty = not listening on tcp
+	WsListeningURL   string       // empty = not listening on ws
+	TCPListener      net.Listener // accepts raw RFB connections instead of listening on TCPListeningURL (e.g. a unix socket)
+	WsListener       net.Listener // accepts websocket connections instead of listening on the host of WsListeningURL (its path is still used)
+	RecordingDir     string       // empty = no recording
+	ProxyVncPassword string       //empty = no auth
+	SingleSession    *VncSession  // to be used when not using sessions
+	UsingSessions    bool         //false = single session - defined in the var above
+	ManagementURL    string       // empty = no management api (host:port to serve the session registry http api on)
+	// bearer token required on every management api request (see ManagementApi.Token), Start refuses a ManagementURL without it
+	ManagementToken string
+	// certificate & key (PEM files) for serving the tcp & ws listeners over TLS (wss://),
+	// the files are loaded again when they change on disk. empty = no TLS
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSConfig   *tls.Config // used instead of TLSCertFile / TLSKeyFile when set
+	// security types offered to viewers (e.g. a server.ServerAuthVeNCrypt), used instead of ProxyVncPassword when set
+	SecurityHandlers []server.SecurityHandler
+	// CA & client certificate used when a target asks for VeNCrypt (see client.NewTLSConfig), nil = the system's roots,
+	// the target's host name is verified unless ServerName is set. when set VeNCrypt is preferred over the vnc password
+	TargetTLSConfig *tls.Config
+	// checks viewers of sessions without their own ViewerPassword / tokens (e.g. calling a local verifier),
+	// instead of ProxyVncPassword or the SecurityHandlers' own settings
+	Authenticator server.ViewerAuthenticator
+	// HMAC key for session tokens (see NewSessionToken), when set websocket viewers must connect with a token
+	// instead of the session id. empty = session ids are used in the ws url
+	SessionTokenKey []byte
+	// the proxy is behind a load balancer sending the PROXY protocol header (v1 or v2) on each tcp & ws connection,
+	// viewers are then known by their own address instead of the balancer's. connections without a header are closed
+	ProxyProtocol bool
+	// host:port on which vnc servers behind NAT connect to the proxy (x11vnc -connect host:port), they are the target
+	// of the session with their ReverseID. empty = not listening for reverse connections
+	ReverseListeningURL string
+	ReverseListener     net.Listener // accepts reverse connections instead of listening on ReverseListeningURL
+	// serves the reverse listener over TLS (e.g. vnc servers connecting through stunnel), with ClientAuth set to
+	// tls.RequireAndVerifyClientCert only servers with a certificate signed by ClientCAs are accepted. nil = no TLS
+	ReverseTLSConfig *tls.Config
+	// host:port on which the proxy acts as an UltraVNC repeater for viewers: the ID a viewer asks for picks the session
+	// with that ReverseID. empty = no repeater
+	RepeaterListeningURL string
+	RepeaterListener     net.Listener // accepts repeater viewers instead of listening on RepeaterListeningURL
+	// repeater viewers asking for an ID no session has are paired with the server which connected to the reverse
+	// listener with that ID, their traffic is passed on as it is (the server authenticates the viewer, nothing is recorded)
+	RepeaterPassthrough bool
+
+	sessionManager *SessionManager
+	sessionsInit   sync.Once
+
+	mutex      sync.Mutex // guards the running state below
+	started    bool
+	stopping   bool
+	done       chan struct{} // closed once the proxy was shut down
+	tcpServer  *server.TcpServer
+	wsServer   *server.WsServer
+	mgmtServer *http.Server
+	reverseLn  net.Listener
+	repeaterLn net.Listener
+	repeater   *repeaterPairs
+	recorders  map[*listeners.Recorder]struct{}
+	// the listeners opened for sessions with a ListenAddr, by session id
+	sessionListeners map[string]*sessionListener
+	listenerTLS      *tls.Config
 }
 
-func (vp *VncProxy) createClientConnection(target string, vncPass string) (*client.ClientConn, error) {
-	var (
-		nc  net.Conn
-		err error
-	)
+// shutdownTimeout bounds the shutdown triggered by the context given to Start
+const shutdownTimeout = 10 * time.Second
 
-	if target[0] == '/' {
-		nc, err = net.Dial("unix", target)
-	} else {
-		nc, err = net.Dial("tcp", target)
-	}
+// Sessions returns the session registry used when UsingSessions is true, sessions can be added before or while the proxy is listening
+func (vp *VncProxy) Sessions() *SessionManager {
+	vp.sessionsInit.Do(func() {
+		if vp.sessionManager == nil {
+			vp.sessionManager = NewSessionManager()
+		}
+	})
+	return vp.sessionManager
+}
 
+// createClientConnection dials the session's target (picking one of its candidate targets if it has several) & runs the
+// RFB handshake. prepare is called with the connection before the handshake (e.g. to add listeners), if a candidate target
+// fails the handshake it is called again with the connection to the next candidate
+func (vp *VncProxy) createClientConnection(session *VncSession, exclusive bool, prepare func(cconn *client.ClientConn)) (*client.ClientConn, error) {
+	var clientConn *client.ClientConn
+	_, _, err := session.dialTarget(func(nc net.Conn, target string) error {
+		logger.Debugf("Proxy: connected to target %s, session=%s", target, session.ID)
+		cconn, err := vp.handshakeTarget(session, exclusive, nc, target, prepare)
+		clientConn = cconn
+		return err
+	})
 	if err != nil {
 		logger.Errorf("error connecting to vnc server: %s", err)
 		return nil, err
 	}
+	return clientConn, nil
+}
+
+// handshakeTarget runs the repeater & RFB handshakes on a connection to one of the session's targets
+func (vp *VncProxy) handshakeTarget(session *VncSession, exclusive bool, nc net.Conn, target string, prepare func(cconn *client.ClientConn)) (*client.ClientConn, error) {
+	if session.RepeaterID != "" {
+		if err := client.ConnectRepeater(nc, session.RepeaterID); err != nil {
+			logger.Errorf("error asking repeater %s for %s: %s", target, session.RepeaterID, err)
+			return nil, err
+		}
+	}
 
 	var noauth client.ClientAuthNone
-	authArr := []client.ClientAuth{&client.PasswordAuth{Password: vncPass}, &noauth}
+	vencrypt := &client.VeNCryptAuth{TLSConfig: vp.targetTLSConfig(target), Username: session.TargetUsername, Password: session.TargetPassword}
+	authArr := []client.ClientAuth{}
+	// VeNCrypt is preferred only when it was configured for (certificates or an account login), otherwise a server
+	// offering both keeps using the vnc password instead of TLS with a certificate that may not verify
+	preferVeNCrypt := vp.TargetTLSConfig != nil || session.TargetUsername != ""
+	if preferVeNCrypt {
+		authArr = append(authArr, vencrypt)
+	}
+	if session.TargetUsername != "" {
+		// account logins are preferred over the vnc password when the server offers both
+		authArr = append(authArr,
+			&client.ARDAuth{Username: session.TargetUsername, Password: session.TargetPassword},
+			&client.MSLogonIIAuth{Username: session.TargetUsername, Password: session.TargetPassword})
+	}
+	authArr = append(authArr, &client.PasswordAuth{Password: session.TargetPassword})
+	if !preferVeNCrypt {
+		authArr = append(authArr, vencrypt)
+	}
+	authArr = append(authArr, &noauth)
 
 	clientConn, err := client.NewClientConn(nc,
 		&client.ClientConfig{
 			Auth:      authArr,
-			Exclusive: true,
+			Exclusive: exclusive,
 		})
 
 	if err != nil {
@@ -56,6 +160,11 @@ func (vp *VncProxy) createClientConnection(target string, vncPass string) (*clie
 		return nil, err
 	}
 
+	prepare(clientConn)
+	session.setStatus(SessionStatusHandshaking, "")
+	if err := clientConn.Connect(); err != nil {
+		return nil, err
+	}
 	return clientConn, nil
 }
 
@@ -68,111 +177,208 @@ func (vp *VncProxy) getProxySession(sessionId string) (*VncSession, error) {
 		}
 		return vp.SingleSession, nil
 	}
-	return vp.sessionManager.GetSession(sessionId)
+	return vp.Sessions().GetSession(sessionId)
+}
+
+// recordingMetadata is written next to each recording (<recording>.json), to tell whose connection was recorded
+type recordingMetadata struct {
+	SessionID  string    `json:"sessionId"`
+	ViewerID   string    `json:"viewerId"`
+	ClientAddr string    `json:"clientAddr"` // the viewer's own address, also behind a load balancer (see ProxyProtocol)
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+// newRecorder opens a recording of the viewer's connection (for shared sessions, the viewer which connected the target)
+func (vp *VncProxy) newRecorder(session *VncSession, viewer *Viewer) (*listeners.Recorder, error) {
+	recFile := "recording" + strconv.FormatInt(time.Now().Unix(), 10) + ".rbs"
+	recPath := path.Join(vp.RecordingDir, recFile)
+	rec, err := listeners.NewRecorder(recPath)
+	if err != nil {
+		logger.Errorf("Proxy.newRecorder can't open recorder save path: %s", recPath)
+		return nil, err
+	}
+	meta, _ := json.Marshal(&recordingMetadata{SessionID: session.ID, ViewerID: viewer.ID, ClientAddr: viewer.RemoteAddr, StartedAt: time.Now()})
+	if err := ioutil.WriteFile(recPath+".json", meta, 0644); err != nil {
+		logger.Errorf("Proxy.newRecorder can't write the recording's metadata: %v", err)
+	}
+
+	vp.mutex.Lock()
+	if vp.recorders == nil {
+		vp.recorders = make(map[*listeners.Recorder]struct{})
+	}
+	vp.recorders[rec] = struct{}{}
+	vp.mutex.Unlock()
+	return rec, nil
+}
+
+// closeRecorder flushes & closes a recording once its connections are gone
+func (vp *VncProxy) closeRecorder(rec *listeners.Recorder) {
+	rec.Close()
+	vp.mutex.Lock()
+	delete(vp.recorders, rec)
+	vp.mutex.Unlock()
 }
 
 func (vp *VncProxy) newServerConnHandler(cfg *server.ServerConfig, sconn *server.ServerConn) error {
 	var err error
 	session, err := vp.getProxySession(sconn.SessionId)
 	if err != nil {
-		logger.Errorf("Proxy.newServerConnHandler can't get session: %d", sconn.SessionId)
+		logger.Errorf("Proxy.newServerConnHandler can't get session: %s", sconn.SessionId)
 		return err
 	}
+	if session == nil {
+		return errors.New("Proxy.newServerConnHandler: no session defined")
+	}
 
-	var rec *listeners.Recorder
+	session.markCreated()
+	viewer := newViewer(sconn)
+	logger.Infof("Proxy: viewer connected from %s, session=%s viewer=%s", viewer.RemoteAddr, session.ID, viewer.ID)
+	if claims, ok := sconn.SessionClaims.(*SessionTokenClaims); ok && claims.ViewOnly {
+		viewer.SetInputPolicy(&InputPolicy{Mode: InputModeViewOnly})
+	}
+	session.addViewer(viewer)
+
+	switch {
+	case session.Type == SessionTypeReplayServer:
+		fbs, err := player.ConnectFbsFile(session.ReplayFilePath, sconn)
 
-	if session.Type == SessionTypeRecordingProxy {
-		recFile := "recording" + strconv.FormatInt(time.Now().Unix(), 10) + ".rbs"
-		recPath := path.Join(vp.RecordingDir, recFile)
-		rec, err = listeners.NewRecorder(recPath)
 		if err != nil {
-			logger.Errorf("Proxy.newServerConnHandler can't open recorder save path: %s", recPath)
+			session.failViewer(viewer, err)
+			logger.Error("TestServer.NewConnHandler: Error in loading FBS: ", err)
 			return err
 		}
+		sconn.Listeners.AddListener(player.NewFBSPlayListener(sconn, fbs))
 
-		sconn.Listeners.AddListener(rec)
-	}
-
-	session.Status = SessionStatusInit
-	if session.Type == SessionTypeProxyPass || session.Type == SessionTypeRecordingProxy {
-		target := session.Target
-		if session.TargetHostname != "" && session.TargetPort != "" {
-			target = session.TargetHostname + ":" + session.TargetPort
-		}
-
-		cconn, err := vp.createClientConnection(target, session.TargetPassword)
+	case session.Shared:
+		err = vp.attachSharedViewer(session, viewer)
 		if err != nil {
-			session.Status = SessionStatusError
-			logger.Errorf("Proxy.newServerConnHandler error creating connection: %s", err)
+			session.failViewer(viewer, err)
+			logger.Errorf("Proxy.newServerConnHandler error attaching to shared session: %s", err)
 			return err
 		}
-		if session.Type == SessionTypeRecordingProxy {
-			cconn.Listeners.AddListener(rec)
-		}
-
-		//creating cross-listeners between server and client parts to pass messages through the proxy:
-
-		// gets the bytes from the actual vnc server on the env (client part of the proxy)
-		// and writes them through the server socket to the vnc-client
-		serverUpdater := &ServerUpdater{sconn}
-		cconn.Listeners.AddListener(serverUpdater)
 
-		// gets the messages from the server part (from vnc-client),
-		// and write through the client to the actual vnc-server
-		clientUpdater := &ClientUpdater{cconn}
-		sconn.Listeners.AddListener(clientUpdater)
-
-		err = cconn.Connect()
+	default:
+		err = vp.attachExclusiveViewer(session, viewer)
 		if err != nil {
-			session.Status = SessionStatusError
-			logger.Errorf("Proxy.newServerConnHandler error connecting to client: %s", err)
+			session.failViewer(viewer, err)
+			logger.Errorf("Proxy.newServerConnHandler error connecting to target: %s", err)
 			return err
 		}
+	}
 
-		encs := []common.IEncoding{
-			&encodings.RawEncoding{},
-			&encodings.TightEncoding{},
-			&encodings.EncCursorPseudo{},
-			&encodings.EncLedStatePseudo{},
-			&encodings.TightPngEncoding{},
-			&encodings.RREEncoding{},
-			&encodings.ZLibEncoding{},
-			&encodings.ZRLEEncoding{},
-			&encodings.CopyRectEncoding{},
-			&encodings.CoRREEncoding{},
-			&encodings.HextileEncoding{},
+	// tear down the upstream connection when the viewer goes away
+	sconn.Listeners.AddListener(&ConnectionCloseListener{OnClose: func() {
+		logger.Infof("Proxy: viewer connection closed, session=%s viewer=%s addr=%s", session.ID, viewer.ID, viewer.RemoteAddr)
+		vp.mutex.Lock()
+		stopping := vp.stopping
+		vp.mutex.Unlock()
+		if stopping {
+			//closed by the shutdown, the session is closed rather than left idle
+			session.detachViewer(viewer, "proxy shutting down", true)
+			return
 		}
-		cconn.Encs = encs
+		session.detachViewer(viewer, "viewer disconnected", false)
+	}})
 
+	session.setStatus(SessionStatusActive, "")
+	return nil
+}
+
+// attachSharedViewer joins the viewer to the session's shared connection to the target, connecting it if needed
+func (vp *VncProxy) attachSharedViewer(session *VncSession, viewer *Viewer) error {
+	var sv *sharedViewer
+	var upstream *sharedUpstream
+	var err error
+
+	// the upstream may close (last viewer leaving) between getting it and joining it, in that case a new one is connected
+	for attempt := 0; attempt < 2; attempt++ {
+		upstream, err = session.sharedUpstreamFor(func() (*sharedUpstream, error) {
+			return vp.connectSharedUpstream(session, viewer)
+		})
 		if err != nil {
-			session.Status = SessionStatusError
-			logger.Errorf("Proxy.newServerConnHandler error connecting to client: %s", err)
 			return err
 		}
+		sv, err = upstream.addViewer(viewer)
+		if err != errUpstreamClosed {
+			break
+		}
+	}
+	if err != nil {
+		return err
 	}
 
-	if session.Type == SessionTypeReplayServer {
-		fbs, err := player.ConnectFbsFile(session.ReplayFilePath, sconn)
+	// the viewer gets the target's screen size & name in its ServerInit, pixels are converted to whatever format it asks for
+	bounds := upstream.fb.Bounds()
+	viewer.sconn.SetWidth(uint16(bounds.Dx()))
+	viewer.sconn.SetHeight(uint16(bounds.Dy()))
+	viewer.sconn.SetDesktopName(upstream.getDesktopName())
 
-		if err != nil {
-			logger.Error("TestServer.NewConnHandler: Error in loading FBS: ", err)
-			return err
-		}
-		sconn.Listeners.AddListener(player.NewFBSPlayListener(sconn, fbs))
+	viewer.setSender(func(msg []byte) error {
+		sv.queue(msg)
 		return nil
+	})
+	viewer.setTargetSender(upstream.writeMessage)
+	viewer.sconn.Listeners.AddListener(sv)
+	viewer.sconn.Listeners.AddListener(&ConnectionCloseListener{OnClose: func() {
+		upstream.removeViewer(sv)
+	}})
+	return nil
+}
+
+// connectSharedUpstream opens the single target connection used by all viewers of a shared session
+func (vp *VncProxy) connectSharedUpstream(session *VncSession, viewer *Viewer) (*sharedUpstream, error) {
+	session.setStatus(SessionStatusConnecting, "")
+	upstream := newSharedUpstream(vp, session)
 
+	if session.Type == SessionTypeRecordingProxy {
+		rec, err := vp.newRecorder(session, viewer)
+		if err != nil {
+			return nil, err
+		}
+		upstream.rec = rec
 	}
 
-	session.Status = SessionStatusActive
-	return nil
+	if err := upstream.connect(); err != nil {
+		if upstream.rec != nil {
+			vp.closeRecorder(upstream.rec)
+		}
+		return nil, err
+	}
+	return upstream, nil
 }
 
-func (vp *VncProxy) StartListening() {
+// GetSessionInfo returns a snapshot of the state of a session: its status, connected viewers & traffic counters
+func (vp *VncProxy) GetSessionInfo(sessionId string) (*SessionInfo, error) {
+	session, err := vp.getProxySession(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrSessionNotFound
+	}
+	return session.Info(), nil
+}
 
-	secHandlers := []server.SecurityHandler{&server.ServerAuthNone{}}
+// ListSessionInfo returns a snapshot of the state of all sessions known to the proxy
+func (vp *VncProxy) ListSessionInfo() []*SessionInfo {
+	list := []*SessionInfo{}
+	if !vp.UsingSessions {
+		if vp.SingleSession != nil {
+			list = append(list, vp.SingleSession.Info())
+		}
+		return list
+	}
+	for _, session := range vp.Sessions().ListSessions() {
+		list = append(list, session.Info())
+	}
+	return list
+}
 
-	if vp.ProxyVncPassword != "" {
-		secHandlers = []server.SecurityHandler{&server.ServerAuthVNC{vp.ProxyVncPassword}}
+func (vp *VncProxy) newServerConfig() *server.ServerConfig {
+	// sessions which need no credentials are offered "none" instead, see sessionAuthenticator
+	secHandlers := []server.SecurityHandler{&server.ServerAuthVNC{Pass: vp.ProxyVncPassword}}
+	if len(vp.SecurityHandlers) > 0 {
+		secHandlers = vp.SecurityHandlers
 	}
 	cfg := &server.ServerConfig{
 		SecurityHandlers: secHandlers,
@@ -184,21 +390,299 @@ func (vp *VncProxy) StartListening() {
 		Width:            uint16(1024),
 		NewConnHandler:   vp.newServerConnHandler,
 		UseDummySession:  !vp.UsingSessions,
+		Authenticator:    &sessionAuthenticator{vp: vp},
 	}
+	if len(vp.SessionTokenKey) > 0 {
+		cfg.ResolveSession = vp.resolveSession
+	}
+	if vp.UsingSessions {
+		cfg.SelectTcpSession = vp.selectTcpSession
+	}
+	return cfg
+}
 
-	if vp.TCPListeningURL != "" && vp.WsListeningURL != "" {
-		logger.Infof("running two listeners: tcp port: %s, ws url: %s", vp.TCPListeningURL, vp.WsListeningURL)
+// Start opens the proxy's listeners (tcp, ws & management api, as configured) and serves them in the background,
+// it returns an error if any of them can't be opened. the proxy runs until ctx is done or Shutdown is called.
+func (vp *VncProxy) Start(ctx context.Context) error {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+	if vp.started {
+		return errors.New("Proxy.Start: proxy was already started")
+	}
+	if vp.stopping {
+		return errors.New("Proxy.Start: proxy was shut down")
+	}
+	if vp.TCPListeningURL == "" && vp.TCPListener == nil && vp.WsListeningURL == "" && vp.WsListener == nil && vp.wsServer == nil {
+		return errors.New("Proxy.Start: no tcp or ws listener configured")
+	}
+	if vp.ManagementURL != "" && vp.ManagementToken == "" {
+		return errors.New("Proxy.Start: the management api needs a ManagementToken")
+	}
 
-		go server.WsServe(vp.WsListeningURL, cfg)
-		server.TcpServe(vp.TCPListeningURL, cfg)
+	tlsConfig, err := vp.tlsConfig()
+	if err != nil {
+		return err
 	}
 
+	// listeners opened here are closed if a later one fails, caller-provided listeners are left to the caller
+	tcpLn, wsLn := vp.TCPListener, vp.WsListener
+	var mgmtLn net.Listener
+	var opened []net.Listener
+	closeAll := func() {
+		for _, ln := range opened {
+			ln.Close()
+		}
+	}
+	if tcpLn == nil && vp.TCPListeningURL != "" {
+		if tcpLn, err = net.Listen("tcp", vp.TCPListeningURL); err != nil {
+			return err
+		}
+		opened = append(opened, tcpLn)
+	}
+	wsPath := "/"
 	if vp.WsListeningURL != "" {
-		logger.Infof("running ws listener url: %s", vp.WsListeningURL)
-		server.WsServe(vp.WsListeningURL, cfg)
+		wsUrl, err := url.Parse(vp.WsListeningURL)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		wsPath = wsUrl.Path
+		if wsLn == nil {
+			if wsLn, err = net.Listen("tcp", wsUrl.Host); err != nil {
+				closeAll()
+				return err
+			}
+			opened = append(opened, wsLn)
+		}
+	}
+	if vp.ManagementURL != "" {
+		if mgmtLn, err = net.Listen("tcp", vp.ManagementURL); err != nil {
+			closeAll()
+			return err
+		}
+		opened = append(opened, mgmtLn)
+	}
+	reverseLn := vp.ReverseListener
+	if reverseLn == nil && vp.ReverseListeningURL != "" {
+		if reverseLn, err = net.Listen("tcp", vp.ReverseListeningURL); err != nil {
+			closeAll()
+			return err
+		}
+		opened = append(opened, reverseLn)
+	}
+	if reverseLn != nil && vp.ReverseTLSConfig != nil {
+		reverseLn = tls.NewListener(reverseLn, vp.ReverseTLSConfig)
+	}
+	repeaterLn := vp.RepeaterListener
+	if repeaterLn == nil && vp.RepeaterListeningURL != "" {
+		if repeaterLn, err = net.Listen("tcp", vp.RepeaterListeningURL); err != nil {
+			closeAll()
+			return err
+		}
+		opened = append(opened, repeaterLn)
+	}
+
+	vp.started = true
+	vp.listenerTLS = tlsConfig
+	cfg := vp.newServerConfig()
+	// the PROXY protocol header comes before the TLS handshake
+	if vp.ProxyProtocol {
+		if tcpLn != nil {
+			tcpLn = server.NewProxyProtocolListener(tcpLn)
+		}
+		if wsLn != nil {
+			wsLn = server.NewProxyProtocolListener(wsLn)
+		}
+	}
+	scheme := "ws"
+	if tlsConfig != nil {
+		scheme = "wss"
+		if tcpLn != nil {
+			tcpLn = tls.NewListener(tcpLn, tlsConfig)
+		}
+		if wsLn != nil {
+			wsLn = tls.NewListener(wsLn, tlsConfig)
+		}
+	}
+
+	if tcpLn != nil || vp.UsingSessions || repeaterLn != nil {
+		vp.tcpServer = server.NewTcpServer(cfg)
 	}
-	if vp.TCPListeningURL != "" {
-		logger.Infof("running tcp listener on port: %s", vp.TCPListeningURL)
-		server.TcpServe(vp.TCPListeningURL, cfg)
+	if tcpLn != nil {
+		logger.Infof("running tcp listener on: %s (tls: %v)", tcpLn.Addr(), tlsConfig != nil)
+		go vp.serve("tcp listener", func() error { return vp.tcpServer.Serve(tcpLn) })
+	}
+	if vp.UsingSessions {
+		// sessions with their own port can be added & removed while the proxy is running
+		vp.Sessions().setOnChange(vp.syncSessionListeners)
+		vp.syncSessionListenersLocked()
+	}
+	if wsLn != nil {
+		logger.Infof("running ws listener on: %s://%s%s", scheme, wsLn.Addr(), wsPath)
+		wsServer := vp.wsServerLocked()
+		go vp.serve("ws listener", func() error {
+			return wsServer.Serve(wsLn, wsPath)
+		})
+	}
+	if mgmtLn != nil {
+		logger.Infof("running management api on: %s", mgmtLn.Addr())
+		mux := http.NewServeMux()
+		api := NewManagementApi(vp.Sessions())
+		api.Token = vp.ManagementToken
+		if len(vp.SessionTokenKey) > 0 {
+			api.SessionTokens = vp.NewSessionToken
+		}
+		mux.Handle(managementSessionsPath, api)
+		mux.Handle(managementSessionsPath+"/", api)
+		vp.mgmtServer = &http.Server{Handler: mux}
+		go vp.serve("management api", func() error { return vp.mgmtServer.Serve(mgmtLn) })
+	}
+
+	if reverseLn != nil {
+		logger.Infof("running reverse connection listener on: %s", reverseLn.Addr())
+		vp.reverseLn = reverseLn
+		go vp.serve("reverse connection listener", func() error { return vp.serveReverse(reverseLn) })
+	}
+	if repeaterLn != nil {
+		logger.Infof("running repeater listener on: %s", repeaterLn.Addr())
+		vp.repeaterLn = repeaterLn
+		go vp.serve("repeater listener", func() error { return vp.serveRepeater(repeaterLn) })
+	}
+
+	done := vp.doneLocked()
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := vp.Shutdown(shutdownCtx); err != nil {
+				logger.Errorf("Proxy: error shutting down: %v", err)
+			}
+		case <-done:
+		}
+	}()
+	return nil
+}
+
+// WsHandler returns an http.Handler accepting websocket viewers, for embedding the proxy in an existing web server.
+// mount it at prefix on your mux without stripping the prefix (e.g. mux.Handle("/vnc/", proxy.WsHandler("/vnc/"))),
+// viewers connect to prefix followed by the session id.
+// the connections it accepts are closed by Shutdown, the management api can be mounted the same way (see NewManagementApi)
+func (vp *VncProxy) WsHandler(prefix string) http.Handler {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+	return vp.wsServerLocked().Handler(prefix)
+}
+
+func (vp *VncProxy) wsServerLocked() *server.WsServer {
+	if vp.wsServer == nil {
+		vp.wsServer = server.NewWsServer(vp.newServerConfig())
+	}
+	return vp.wsServer
+}
+
+// doneLocked returns the channel which is closed once the proxy was shut down
+func (vp *VncProxy) doneLocked() chan struct{} {
+	if vp.done == nil {
+		vp.done = make(chan struct{})
+	}
+	return vp.done
+}
+
+// serve runs one of the proxy's servers, errors other than the server being shut down are logged
+func (vp *VncProxy) serve(name string, serveFunc func() error) {
+	err := serveFunc()
+	if err != nil && err != server.ErrServerClosed && err != http.ErrServerClosed {
+		logger.Errorf("Proxy: %s stopped: %v", name, err)
+	}
+}
+
+// sessions returns all sessions the proxy serves
+func (vp *VncProxy) sessions() []*VncSession {
+	if !vp.UsingSessions {
+		if vp.SingleSession == nil {
+			return nil
+		}
+		return []*VncSession{vp.SingleSession}
+	}
+	return vp.Sessions().ListSessions()
+}
+
+// Shutdown stops the proxy: the listeners are closed, all viewers are disconnected (closing their target connections),
+// and all recordings are flushed & closed. it waits for the connections to be torn down until ctx is done.
+func (vp *VncProxy) Shutdown(ctx context.Context) error {
+	vp.mutex.Lock()
+	done := vp.doneLocked()
+	if vp.stopping {
+		//already shutting down, wait for it to finish
+		vp.mutex.Unlock()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	vp.stopping = true
+	tcpServer, wsServer, mgmtServer, reverseLn, repeaterLn := vp.tcpServer, vp.wsServer, vp.mgmtServer, vp.reverseLn, vp.repeaterLn
+	vp.mutex.Unlock()
+
+	logger.Infof("Proxy: shutting down")
+	var firstErr error
+	keepErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	//stop accepting first, so no viewer or target connects while the viewers are being closed
+	if reverseLn != nil {
+		reverseLn.Close()
+	}
+	if repeaterLn != nil {
+		repeaterLn.Close()
+	}
+	if tcpServer != nil {
+		keepErr(tcpServer.Shutdown(ctx))
+	}
+	if wsServer != nil {
+		keepErr(wsServer.Shutdown(ctx))
+	}
+	if mgmtServer != nil {
+		keepErr(mgmtServer.Shutdown(ctx))
+	}
+	for _, session := range vp.sessions() {
+		session.closeViewers("proxy shutting down")
+	}
+	vp.closeRepeaterConns()
+
+	vp.mutex.Lock()
+	recorders := make([]*listeners.Recorder, 0, len(vp.recorders))
+	for rec := range vp.recorders {
+		recorders = append(recorders, rec)
+	}
+	vp.mutex.Unlock()
+	for _, rec := range recorders {
+		vp.closeRecorder(rec)
+	}
+
+	for _, session := range vp.sessions() {
+		session.stopHealthChecks()
+		session.closeReverseConns()
+	}
+
+	close(done)
+	return firstErr
+}
+
+// StartListening runs the proxy until it is shut down, use Start to run it in the background
+func (vp *VncProxy) StartListening() {
+	if err := vp.Start(context.Background()); err != nil {
+		logger.Errorf("Proxy.StartListening: %v", err)
+		return
 	}
+	vp.mutex.Lock()
+	done := vp.doneLocked()
+	vp.mutex.Unlock()
+	<-done
 }
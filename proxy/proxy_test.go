@@ -1,6 +1,23 @@
 package proxy
 
-import "testing"
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"golang.org/x/net/websocket"
+)
 
 func TestProxy(t *testing.T) {
 	//create default session if required
@@ -25,3 +42,212 @@ func TestProxy(t *testing.T) {
 
 	proxy.StartListening()
 }
+
+// fakeTarget accepts rfb connections, runs a 3.8 handshake without auth, rings the bell and reports each connection
+func fakeTarget(t *testing.T, width, height uint16) (string, chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fakeTargetHandshake(c, width, height)
+			conns <- c
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+// fakeTargetHandshake runs the server side of a 3.8 handshake without auth & rings the bell
+func fakeTargetHandshake(c net.Conn, width, height uint16) {
+	c.Write([]byte("RFB 003.008\n"))
+	buf := make([]byte, 12)
+	io.ReadFull(c, buf)
+	c.Write([]byte{1, 1})
+	io.ReadFull(c, buf[:1])
+	binary.Write(c, binary.BigEndian, uint32(0))
+	io.ReadFull(c, buf[:1])
+	binary.Write(c, binary.BigEndian, width)
+	binary.Write(c, binary.BigEndian, height)
+	common.NewPixelFormat(32).WriteTo(c)
+	binary.Write(c, binary.BigEndian, uint32(4))
+	c.Write([]byte("test"))
+	c.Write([]byte{byte(common.Bell)})
+}
+
+// connectViewer connects a vnc-client to the proxy & runs the handshake
+func connectViewer(t *testing.T, addr string) *client.ClientConn {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	return handshakeViewer(t, nc)
+}
+
+func handshakeViewer(t *testing.T, nc net.Conn) *client.ClientConn {
+	cc, err := client.NewClientConn(nc, &client.ClientConfig{})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if err := cc.Connect(); err != nil {
+		t.Fatalf("error in handshake with proxy: %v", err)
+	}
+	return cc
+}
+
+func TestProxyShutdown(t *testing.T) {
+	target, targetConns := fakeTarget(t, 640, 480)
+	recDir := t.TempDir()
+	proxyAddr := deadAddress(t)
+	vp := &VncProxy{
+		TCPListeningURL: proxyAddr,
+		RecordingDir:    recDir,
+		SingleSession:   &VncSession{ID: "dummySession", Target: target, Type: SessionTypeRecordingProxy},
+	}
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	// a second proxy can run in the same process
+	other := &VncProxy{WsListeningURL: "http://" + deadAddress(t) + "/", SingleSession: &VncSession{Target: target}}
+	if err := other.Start(context.Background()); err != nil {
+		t.Fatalf("error starting second proxy: %v", err)
+	}
+	defer other.Shutdown(context.Background())
+
+	cc := connectViewer(t, proxyAddr)
+	if cc.FrameBufferWidth != 640 || cc.FrameBufferHeight != 480 {
+		t.Fatalf("unexpected screen size: %dx%d", cc.FrameBufferWidth, cc.FrameBufferHeight)
+	}
+	targetConn := <-targetConns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := vp.Shutdown(ctx); err != nil {
+		t.Fatalf("error shutting down: %v", err)
+	}
+
+	// both sides of the proxied connection are closed
+	targetConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(ioutil.Discard, targetConn); err != nil {
+		t.Errorf("target connection was not closed: %v", err)
+	}
+	if info := vp.SingleSession.Info(); info.Status != SessionStatusClosed || len(info.Viewers) != 0 {
+		t.Errorf("unexpected session state after shutdown: %+v", info)
+	}
+
+	// the recording was flushed
+	files, _ := filepath.Glob(filepath.Join(recDir, "*.rbs"))
+	if len(files) != 1 {
+		t.Fatalf("unexpected recordings: %v", files)
+	}
+	if data, _ := ioutil.ReadFile(files[0]); len(data) == 0 {
+		t.Errorf("recording is empty")
+	}
+
+	// the listener was released
+	ln, err := net.Listen("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("proxy port is still in use: %v", err)
+	}
+	ln.Close()
+}
+
+func TestProxyEmbedded(t *testing.T) {
+	target, _ := fakeTarget(t, 800, 600)
+	vp := &VncProxy{UsingSessions: true}
+	sessions := vp.Sessions()
+	// tcp connections carry no session id, they use the dummy session
+	sessions.SetSession("dummySession", &VncSession{Target: target, Type: SessionTypeProxyPass})
+	sessions.SetSession("s1", &VncSession{Target: target, Type: SessionTypeProxyPass})
+
+	// raw RFB connections over a unix socket
+	socketPath := filepath.Join(t.TempDir(), "vnc.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("error listening on unix socket: %v", err)
+	}
+	vp.TCPListener = ln
+
+	// websocket viewers & the management api served from the application's own mux
+	mux := http.NewServeMux()
+	mux.Handle("/vnc/", vp.WsHandler("/vnc/"))
+	mux.Handle("/admin/", http.StripPrefix("/admin", NewManagementApi(vp.Sessions())))
+	web := httptest.NewServer(mux)
+	defer web.Close()
+
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+
+	if cc := connectViewer(t, socketPath); cc.FrameBufferWidth != 800 {
+		t.Errorf("unexpected screen width over unix socket: %d", cc.FrameBufferWidth)
+	}
+
+	wsUrl := "ws" + strings.TrimPrefix(web.URL, "http") + "/vnc/s1"
+	ws, err := websocket.Dial(wsUrl, "", web.URL)
+	if err != nil {
+		t.Fatalf("error connecting over websocket: %v", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	if cc := handshakeViewer(t, ws); cc.FrameBufferWidth != 800 {
+		t.Errorf("unexpected screen width over websocket: %d", cc.FrameBufferWidth)
+	}
+
+	resp, err := http.Get(web.URL + "/admin/sessions/s1")
+	if err != nil {
+		t.Fatalf("error calling management api: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected management api status: %d", resp.StatusCode)
+	}
+	if info, _ := vp.GetSessionInfo("s1"); len(info.Viewers) != 1 {
+		t.Errorf("unexpected viewers: %+v", info.Viewers)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	target, _ := fakeTarget(t, 800, 600)
+	vp := &VncProxy{
+		TCPListeningURL: deadAddress(t),
+		ProxyProtocol:   true,
+		RecordingDir:    t.TempDir(),
+		SingleSession:   &VncSession{ID: "dummySession", Target: target, Type: SessionTypeRecordingProxy},
+	}
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+
+	nc, err := net.Dial("tcp", vp.TCPListeningURL)
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	nc.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 4242 5900\r\n"))
+	handshakeViewer(t, nc)
+
+	info, _ := vp.GetSessionInfo("dummySession")
+	if len(info.Viewers) != 1 || info.Viewers[0].RemoteAddr != "203.0.113.7:4242" {
+		t.Fatalf("the viewer's own address wasn't used: %+v", info.Viewers)
+	}
+	metaFiles, _ := filepath.Glob(filepath.Join(vp.RecordingDir, "*.rbs.json"))
+	if len(metaFiles) != 1 {
+		t.Fatalf("unexpected recording metadata files: %v", metaFiles)
+	}
+	var meta recordingMetadata
+	data, _ := ioutil.ReadFile(metaFiles[0])
+	if err := json.Unmarshal(data, &meta); err != nil || meta.ClientAddr != "203.0.113.7:4242" {
+		t.Errorf("unexpected recording metadata: %s", data)
+	}
+}
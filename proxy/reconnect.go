@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+)
+
+var errReconnectAborted = errors.New("reconnect aborted, no viewers left")
+
+const (
+	defaultReconnectInitialDelay = 500 * time.Millisecond
+	defaultReconnectMaxDelay     = 30 * time.Second
+)
+
+// ReconnectPolicy makes the proxy keep viewers connected when the target connection drops (vm reboot, network errors),
+// the target is redialed with exponential backoff and the viewers get a full screen update once it is back
+type ReconnectPolicy struct {
+	MaxAttempts  int           // 0 = keep trying as long as viewers are connected
+	InitialDelay time.Duration // delay before the first attempt, doubled after each failure (default 500ms)
+	MaxDelay     time.Duration // upper limit for the delay between attempts (default 30s)
+}
+
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	initial := p.InitialDelay
+	if initial <= 0 {
+		initial = defaultReconnectInitialDelay
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = defaultReconnectMaxDelay
+	}
+
+	d := initial
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// retry calls connect until it succeeds, the attempts run out or alive reports there is no one left to reconnect for
+func (p *ReconnectPolicy) retry(sessionId string, alive func() bool, connect func() error) error {
+	var err error
+	for attempt := 0; p.MaxAttempts == 0 || attempt < p.MaxAttempts; attempt++ {
+		time.Sleep(p.delay(attempt))
+		if !alive() {
+			return errReconnectAborted
+		}
+
+		err = connect()
+		if err == nil {
+			return nil
+		}
+		logger.Warnf("ReconnectPolicy.retry: reconnect attempt %d failed, session=%s: %v", attempt+1, sessionId, err)
+	}
+	return err
+}
+
+// usesZlibStream reports if an encoding keeps compression state across rectangles for the whole connection,
+// a viewer can't continue such a stream from a reconnected target (which starts it over)
+func usesZlibStream(enc common.EncodingType) bool {
+	switch enc {
+	case common.EncZlib, common.EncZlibHex, common.EncTight, common.EncTightPng, common.EncZRLE, common.EncTRLE:
+		return true
+	}
+	return false
+}
+
+// withoutZlibStreams returns a copy of the SetEncodings message without the encodings that use zlib streams
+func withoutZlibStreams(msg *server.MsgSetEncodings) *server.MsgSetEncodings {
+	filtered := []common.EncodingType{}
+	for _, enc := range msg.Encodings {
+		if !usesZlibStream(enc) {
+			filtered = append(filtered, enc)
+		}
+	}
+	return &server.MsgSetEncodings{EncNum: uint16(len(filtered)), Encodings: filtered}
+}
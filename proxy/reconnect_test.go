@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/server"
+)
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	p := &ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for attempt, d := range expected {
+		if p.delay(attempt) != d {
+			t.Errorf("attempt %d: expected delay %v, got %v", attempt, d, p.delay(attempt))
+		}
+	}
+}
+
+func TestReconnectPolicyRetry(t *testing.T) {
+	p := &ReconnectPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	alive := func() bool { return true }
+
+	calls := 0
+	err := p.retry("s1", alive, func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("expected success on the second attempt, got calls=%d err=%v", calls, err)
+	}
+
+	calls = 0
+	err = p.retry("s1", alive, func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("expected failure after 3 attempts, got calls=%d err=%v", calls, err)
+	}
+
+	err = p.retry("s1", func() bool { return false }, func() error {
+		t.Fatalf("connect called with no viewers left")
+		return nil
+	})
+	if err != errReconnectAborted {
+		t.Fatalf("expected abort, got %v", err)
+	}
+}
+
+func TestWithoutZlibStreams(t *testing.T) {
+	msg := &server.MsgSetEncodings{Encodings: []common.EncodingType{common.EncTight, common.EncZRLE, common.EncHextile, common.EncCopyRect, common.EncDesktopSizePseudo}}
+	filtered := withoutZlibStreams(msg)
+	if filtered.EncNum != 3 || filtered.Encodings[0] != common.EncHextile {
+		t.Fatalf("unexpected filtered encodings: %+v", filtered)
+	}
+	if !viewerSupportsDesktopSize(filtered) {
+		t.Fatalf("desktop size support was lost")
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+)
+
+var errRepeaterViewerWaiting = errors.New("another viewer is already waiting for this id")
+
+// repeaterPairs holds the vnc servers which connected in with an ID no session knows (see RepeaterPassthrough),
+// and the viewers waiting for such a server
+type repeaterPairs struct {
+	parked  map[string]net.Conn
+	waiting map[string]chan net.Conn
+	relayed map[net.Conn]struct{} // both ends of the paired connections, closed on shutdown
+}
+
+// serveRepeater accepts viewers using the UltraVNC repeater handshake on ln, until the proxy is shut down
+func (vp *VncProxy) serveRepeater(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			vp.mutex.Lock()
+			stopping := vp.stopping
+			vp.mutex.Unlock()
+			if stopping {
+				return server.ErrServerClosed
+			}
+			return err
+		}
+		go vp.acceptRepeaterViewer(c)
+	}
+}
+
+// acceptRepeaterViewer reads the ID a viewer asks for: viewers of a session with that ReverseID join the session
+// through the proxy, otherwise (with RepeaterPassthrough) the viewer is paired with the server which connected in with the ID
+func (vp *VncProxy) acceptRepeaterViewer(c net.Conn) {
+	c.SetDeadline(time.Now().Add(reverseHandshakeTimeout))
+	id, err := server.ReadRepeaterViewerID(c)
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		logger.Warnf("Proxy: rejected repeater viewer from %s: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+
+	if session := vp.reverseSession(id, ""); id != "" && session != nil {
+		logger.Infof("Proxy: repeater viewer %s asked for id %q, joining session %s", c.RemoteAddr(), id, session.ID)
+		vp.mutex.Lock()
+		tcpServer := vp.tcpServer
+		vp.mutex.Unlock()
+		tcpServer.ServeConn(c, session.ID)
+		return
+	}
+	if !vp.RepeaterPassthrough {
+		logger.Warnf("Proxy: rejected repeater viewer from %s: no session for id %q", c.RemoteAddr(), id)
+		c.Close()
+		return
+	}
+
+	target, err := vp.takeRepeaterServer(id, reverseConnectTimeout)
+	if err != nil {
+		logger.Warnf("Proxy: repeater viewer %s asked for id %q: %v", c.RemoteAddr(), id, err)
+		c.Close()
+		return
+	}
+	logger.Infof("Proxy: paired repeater viewer %s with server %s, id %q", c.RemoteAddr(), target.RemoteAddr(), id)
+	vp.relay(c, target)
+}
+
+// parkRepeaterServer keeps a server's connection until a viewer asks for its id, a newer connection with the same id replaces it
+func (vp *VncProxy) parkRepeaterServer(id string, c net.Conn) {
+	vp.mutex.Lock()
+	pairs := vp.repeaterPairsLocked()
+	if waiting, ok := pairs.waiting[id]; ok {
+		delete(pairs.waiting, id)
+		vp.mutex.Unlock()
+		waiting <- c
+		return
+	}
+	old := pairs.parked[id]
+	pairs.parked[id] = c
+	vp.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// takeRepeaterServer returns the server which connected in with id, waiting for it to connect if needed
+func (vp *VncProxy) takeRepeaterServer(id string, timeout time.Duration) (net.Conn, error) {
+	vp.mutex.Lock()
+	pairs := vp.repeaterPairsLocked()
+	if c, ok := pairs.parked[id]; ok {
+		delete(pairs.parked, id)
+		vp.mutex.Unlock()
+		return c, nil
+	}
+	if _, ok := pairs.waiting[id]; ok {
+		vp.mutex.Unlock()
+		return nil, errRepeaterViewerWaiting
+	}
+	waiting := make(chan net.Conn, 1)
+	pairs.waiting[id] = waiting
+	vp.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c := <-waiting:
+		return c, nil
+	case <-timer.C:
+	}
+
+	vp.mutex.Lock()
+	if pairs.waiting[id] == waiting {
+		delete(pairs.waiting, id)
+	}
+	vp.mutex.Unlock()
+	// the server may have connected right before the wait was given up
+	select {
+	case c := <-waiting:
+		return c, nil
+	default:
+		return nil, errNoReverseTarget
+	}
+}
+
+// relay passes the bytes between a viewer & a server as they are, until one of them disconnects
+func (vp *VncProxy) relay(viewer net.Conn, target net.Conn) {
+	vp.mutex.Lock()
+	if vp.stopping {
+		vp.mutex.Unlock()
+		viewer.Close()
+		target.Close()
+		return
+	}
+	pairs := vp.repeaterPairsLocked()
+	pairs.relayed[viewer] = struct{}{}
+	pairs.relayed[target] = struct{}{}
+	vp.mutex.Unlock()
+
+	done := make(chan struct{}, 2)
+	copyConn := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyConn(viewer, target)
+	go copyConn(target, viewer)
+	<-done
+	viewer.Close()
+	target.Close()
+	<-done
+
+	vp.mutex.Lock()
+	delete(pairs.relayed, viewer)
+	delete(pairs.relayed, target)
+	vp.mutex.Unlock()
+}
+
+func (vp *VncProxy) repeaterPairsLocked() *repeaterPairs {
+	if vp.repeater == nil {
+		vp.repeater = &repeaterPairs{
+			parked:  make(map[string]net.Conn),
+			waiting: make(map[string]chan net.Conn),
+			relayed: make(map[net.Conn]struct{}),
+		}
+	}
+	return vp.repeater
+}
+
+// closeRepeaterConns closes the parked servers & the paired connections when the proxy shuts down
+func (vp *VncProxy) closeRepeaterConns() {
+	vp.mutex.Lock()
+	pairs := vp.repeaterPairsLocked()
+	conns := make([]net.Conn, 0, len(pairs.parked)+len(pairs.relayed))
+	for id, c := range pairs.parked {
+		conns = append(conns, c)
+		delete(pairs.parked, id)
+	}
+	for c := range pairs.relayed {
+		conns = append(conns, c)
+	}
+	vp.mutex.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
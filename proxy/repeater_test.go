@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/amitbet/vncproxy/client"
+)
+
+func startRepeaterProxy(t *testing.T, vp *VncProxy) {
+	vp.TCPListeningURL = deadAddress(t)
+	vp.ReverseListeningURL = deadAddress(t)
+	vp.RepeaterListeningURL = deadAddress(t)
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	t.Cleanup(func() { vp.Shutdown(context.Background()) })
+}
+
+// connectThroughRepeater connects a viewer to the repeater, asking for id
+func connectThroughRepeater(addr string, id string) (*client.ClientConn, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.ConnectRepeater(nc, id); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	cc, err := client.NewClientConn(nc, &client.ClientConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return cc, cc.Connect()
+}
+
+func repeaterScreenWidth(t *testing.T, addr string, id string) uint16 {
+	cc, err := connectThroughRepeater(addr, id)
+	if err != nil {
+		t.Fatalf("error connecting through the repeater: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc.FrameBufferWidth
+}
+
+func TestRepeaterPassthrough(t *testing.T) {
+	vp := &VncProxy{RepeaterPassthrough: true, SingleSession: &VncSession{}}
+	startRepeaterProxy(t, vp)
+
+	// the server connects first
+	connectReverse(t, vp.ReverseListeningURL, "ID:77", 800, 600)
+	if width := repeaterScreenWidth(t, vp.RepeaterListeningURL, "ID:77"); width != 800 {
+		t.Errorf("unexpected screen width: %d", width)
+	}
+
+	// the viewer waits for the server
+	errs := make(chan error)
+	var cc *client.ClientConn
+	go func() {
+		var err error
+		cc, err = connectThroughRepeater(vp.RepeaterListeningURL, "ID:78")
+		errs <- err
+	}()
+	connectReverse(t, vp.ReverseListeningURL, "ID:78", 640, 480)
+	if err := <-errs; err != nil {
+		t.Fatalf("error connecting a waiting viewer: %v", err)
+	}
+	defer cc.Close()
+	if cc.FrameBufferWidth != 640 {
+		t.Errorf("unexpected screen width: %d", cc.FrameBufferWidth)
+	}
+}
+
+func TestRepeaterSessions(t *testing.T) {
+	session := &VncSession{Type: SessionTypeProxyPass, ReverseID: "ID:5"}
+	vp := &VncProxy{UsingSessions: true, RepeaterPassthrough: true}
+	vp.Sessions().SetSession("s1", session)
+	startRepeaterProxy(t, vp)
+
+	// viewers asking for a session's id join it through the proxy
+	connectReverse(t, vp.ReverseListeningURL, "ID:5", 800, 600)
+	waitReverseTargets(t, session, 1)
+	if width := repeaterScreenWidth(t, vp.RepeaterListeningURL, "ID:5"); width != 800 {
+		t.Errorf("unexpected screen width: %d", width)
+	}
+	if info := session.Info(); len(info.Viewers) != 1 {
+		t.Errorf("the repeater viewer didn't join the session: %+v", info.Viewers)
+	}
+
+	// sessions can use a repeater as their target
+	connectReverse(t, vp.ReverseListeningURL, "ID:6", 640, 480)
+	through := &VncSession{ID: "s2", Target: vp.RepeaterListeningURL, RepeaterID: "ID:6"}
+	cc, err := vp.createClientConnection(through, false, func(*client.ClientConn) {})
+	if err != nil {
+		t.Fatalf("error connecting through the repeater: %v", err)
+	}
+	defer cc.Close()
+	if cc.FrameBufferWidth != 640 {
+		t.Errorf("unexpected screen width through the repeater: %d", cc.FrameBufferWidth)
+	}
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+)
+
+const (
+	// how long a viewer of a reverse session waits for its vnc server to connect
+	reverseConnectTimeout = 30 * time.Second
+	// a vnc server connecting in must send its ID / RFB version within this time
+	reverseHandshakeTimeout = 10 * time.Second
+	// connections kept per session until viewers use them, a new one replaces the oldest
+	maxParkedReverseConns = 4
+)
+
+var errNoReverseTarget = errors.New("the session's vnc server didn't connect")
+
+// bufferedConn is a connection whose first bytes were already read into r, they are read again from there
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// serveReverse accepts reverse connections from vnc servers on ln, until the proxy is shut down
+func (vp *VncProxy) serveReverse(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			vp.mutex.Lock()
+			stopping := vp.stopping
+			vp.mutex.Unlock()
+			if stopping {
+				return server.ErrServerClosed
+			}
+			return err
+		}
+		go vp.acceptReverse(c)
+	}
+}
+
+// acceptReverse identifies a vnc server which connected in, and keeps its connection for the viewers of its session.
+// the server is only identified by what it sends (or its ip address), see VncSession.ReverseID for the risks
+func (vp *VncProxy) acceptReverse(c net.Conn) {
+	//a TLS handshake (see ReverseTLSConfig) is done on the first read, it writes too
+	c.SetDeadline(time.Now().Add(reverseHandshakeTimeout))
+	br := bufio.NewReader(c)
+	id, err := readReverseId(br)
+	if err == nil {
+		var version []byte
+		if version, err = br.Peek(4); err == nil && string(version) != "RFB " {
+			err = errors.New("not a vnc server")
+		}
+	}
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		logger.Warnf("Proxy: rejected reverse connection from %s: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	session := vp.reverseSession(id, host)
+	if session == nil && id != "" && vp.RepeaterPassthrough {
+		logger.Infof("Proxy: vnc server %s connected in with id %q, waiting for a repeater viewer", c.RemoteAddr(), id)
+		vp.parkRepeaterServer(id, &bufferedConn{Conn: c, r: br})
+		return
+	}
+	if session == nil {
+		logger.Warnf("Proxy: rejected reverse connection from %s: no session for its id", c.RemoteAddr())
+		c.Close()
+		return
+	}
+	logger.Infof("Proxy: vnc server %s connected in for session %s (id %q)", c.RemoteAddr(), session.ID, session.ReverseID)
+	session.addEvent(EventReverseTargetConnected, "", c.RemoteAddr().String())
+	session.parkReverseConn(&bufferedConn{Conn: c, r: br})
+}
+
+// readReverseId reads the ID string some servers send before the RFB version (x11vnc -connect repeater=ID:1234+host:port,
+// UltraVNC's "ID:1234", see common.ReadRepeaterID), empty if there is none
+func readReverseId(br *bufio.Reader) (string, error) {
+	start, err := br.Peek(3)
+	if err != nil {
+		return "", err
+	}
+	if string(start) != "ID:" {
+		return "", nil
+	}
+	return common.ReadRepeaterID(br)
+}
+
+// reverseSession returns the session accepting the server: the one whose ReverseID is the server's ID string,
+// or its ip address for servers which send no ID
+func (vp *VncProxy) reverseSession(id string, host string) *VncSession {
+	for _, session := range vp.sessions() {
+		if session.acceptsReverse(id, host) {
+			return session
+		}
+	}
+	return nil
+}
+
+// acceptsReverse reports if a vnc server which connected in with id (empty if it sent none) from host is the session's,
+// sessions with a ReverseSecret only accept servers sending "<ReverseID>:<ReverseSecret>"
+func (s *VncSession) acceptsReverse(id string, host string) bool {
+	if s.ReverseID == "" {
+		return false
+	}
+	if s.ReverseSecret == "" {
+		key := id
+		if key == "" {
+			key = host
+		}
+		return strings.EqualFold(s.ReverseID, key)
+	}
+	prefix := s.ReverseID + ":"
+	if len(id) <= len(prefix) || !strings.EqualFold(id[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(id[len(prefix):]), []byte(s.ReverseSecret)) == 1
+}
+
+// reverseQueue returns the connections of the session's vnc server waiting for viewers
+func (s *VncSession) reverseQueue() chan net.Conn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.reverseConns == nil {
+		s.reverseConns = make(chan net.Conn, maxParkedReverseConns)
+	}
+	return s.reverseConns
+}
+
+func (s *VncSession) parkReverseConn(nc net.Conn) {
+	queue := s.reverseQueue()
+	for {
+		select {
+		case queue <- nc:
+			return
+		default:
+		}
+		// the queue is full, the oldest connection makes room
+		select {
+		case old := <-queue:
+			old.Close()
+		default:
+		}
+	}
+}
+
+// takeReverseConn returns a connection of the session's vnc server, waiting for the server to connect if needed
+func (s *VncSession) takeReverseConn(timeout time.Duration) (net.Conn, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case nc := <-s.reverseQueue():
+		return nc, nil
+	case <-timer.C:
+		return nil, errNoReverseTarget
+	}
+}
+
+// closeReverseConns closes the connections no viewer used, when the session is removed or the proxy shuts down
+func (s *VncSession) closeReverseConns() {
+	queue := s.reverseQueue()
+	for {
+		select {
+		case nc := <-queue:
+			nc.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+)
+
+// connectReverse connects a fake vnc server to the proxy's reverse listener, sending id first (if set)
+func connectReverse(t *testing.T, addr string, id string, width, height uint16) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to the reverse listener: %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	if id != "" {
+		common.WriteRepeaterID(nc, id)
+	}
+	go fakeTargetHandshake(nc, width, height)
+}
+
+// waitReverseTargets waits until the session has n vnc servers waiting for viewers
+func waitReverseTargets(t *testing.T, session *VncSession, n int) {
+	for i := 0; i < 100; i++ {
+		if session.Info().ReverseTargets == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d waiting reverse connections, got %d", n, session.Info().ReverseTargets)
+}
+
+func TestReverseConnections(t *testing.T) {
+	byId := &VncSession{Type: SessionTypeProxyPass, ReverseID: "ID:1234"}
+	byAddr := &VncSession{Type: SessionTypeProxyPass, ReverseID: "127.0.0.1"}
+	vp := &VncProxy{UsingSessions: true, WsListeningURL: "http://" + deadAddress(t) + "/", ReverseListeningURL: deadAddress(t)}
+	vp.Sessions().SetSession("byId", byId)
+	vp.Sessions().SetSession("byAddr", byAddr)
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+
+	connectReverse(t, vp.ReverseListeningURL, "ID:1234", 800, 600)
+	connectReverse(t, vp.ReverseListeningURL, "", 640, 480)
+	connectReverse(t, vp.ReverseListeningURL, "ID:9999", 320, 200)
+	waitReverseTargets(t, byId, 1)
+	waitReverseTargets(t, byAddr, 1)
+
+	for session, width := range map[*VncSession]uint16{byId: 800, byAddr: 640} {
+		cc, err := vp.createClientConnection(session, false, func(*client.ClientConn) {})
+		if err != nil {
+			t.Fatalf("error connecting to the reverse target of %s: %v", session.ID, err)
+		}
+		if cc.FrameBufferWidth != width {
+			t.Errorf("session %s got a screen of width %d", session.ID, cc.FrameBufferWidth)
+		}
+		cc.Close()
+	}
+	waitReverseTargets(t, byId, 0)
+
+	if events := byId.Events(); len(events) == 0 || events[len(events)-1].Type != EventReverseTargetConnected {
+		t.Errorf("the reverse connection wasn't recorded: %+v", events)
+	}
+}
+
+func TestReverseSecret(t *testing.T) {
+	byId := &VncSession{ReverseID: "ID:42", ReverseSecret: "s3cret"}
+	byAddr := &VncSession{ReverseID: "127.0.0.1", ReverseSecret: "s3cret"}
+	for id, accepted := range map[string]bool{"ID:42": false, "ID:42:": false, "ID:42:wrong": false, "ID:42:s3cret": true, "id:42:s3cret": true, "": false} {
+		if byId.acceptsReverse(id, "127.0.0.1") != accepted {
+			t.Errorf("unexpected result for id %q", id)
+		}
+	}
+	// a server can't send a secret without an ID string, so ip addresses aren't enough
+	if byAddr.acceptsReverse("", "127.0.0.1") {
+		t.Errorf("a session with a secret accepted a server by its ip address")
+	}
+}
+
+func TestReverseTLSClientAuth(t *testing.T) {
+	proxyCertFile, proxyKeyFile := writeTestCert(t, t.TempDir(), "proxy")
+	serverCertFile, serverKeyFile := writeTestCert(t, t.TempDir(), "vncserver")
+	proxyCert, _ := tls.LoadX509KeyPair(proxyCertFile, proxyKeyFile)
+	serverCert, _ := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	parsed, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	trusted := x509.NewCertPool()
+	trusted.AddCert(parsed)
+
+	session := &VncSession{Type: SessionTypeProxyPass, ReverseID: "ID:42"}
+	vp := &VncProxy{
+		UsingSessions:       true,
+		WsListeningURL:      "http://" + deadAddress(t) + "/",
+		ReverseListeningURL: deadAddress(t),
+		ReverseTLSConfig:    &tls.Config{Certificates: []tls.Certificate{proxyCert}, ClientCAs: trusted, ClientAuth: tls.RequireAndVerifyClientCert},
+	}
+	vp.Sessions().SetSession("s1", session)
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+
+	dial := func(certs []tls.Certificate) *tls.Conn {
+		nc, err := tls.Dial("tcp", vp.ReverseListeningURL, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err != nil {
+			t.Fatalf("error connecting to the reverse listener: %v", err)
+		}
+		t.Cleanup(func() { nc.Close() })
+		common.WriteRepeaterID(nc, "ID:42")
+		return nc
+	}
+
+	// a server without a client certificate is rejected
+	rejected := dial(nil)
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("a server without a client certificate was accepted")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("a server without a client certificate wasn't rejected")
+	}
+
+	go fakeTargetHandshake(dial([]tls.Certificate{serverCert}), 800, 600)
+	waitReverseTargets(t, session, 1)
+	cc, err := vp.createClientConnection(session, false, func(*client.ClientConn) {})
+	if err != nil {
+		t.Fatalf("error connecting to the reverse target: %v", err)
+	}
+	defer cc.Close()
+	if cc.FrameBufferWidth != 800 {
+		t.Errorf("unexpected screen width: %d", cc.FrameBufferWidth)
+	}
+}
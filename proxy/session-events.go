@@ -0,0 +1,53 @@
+package proxy
+
+import "time"
+
+// maxSessionEvents is the number of events kept per session, older events are dropped
+const maxSessionEvents = 1000
+
+const (
+	EventViewerConnected    = "viewerConnected"
+	EventViewerDisconnected = "viewerDisconnected"
+	EventFloorRequested     = "floorRequested"
+	EventFloorGranted       = "floorGranted"
+	EventFloorReleased      = "floorReleased"
+	EventFloorRevoked       = "floorRevoked"
+	EventFloorTimedOut      = "floorTimedOut"
+	EventTargetReconnecting = "targetReconnecting"
+	EventTargetReconnected  = "targetReconnected"
+	EventLimitWarning       = "limitWarning"
+	EventLimitReached       = "limitReached"
+	EventViewerAuthFailed   = "viewerAuthFailed"
+	EventViewerTokenIssued  = "viewerTokenIssued"
+	EventViewerTokenUsed    = "viewerTokenUsed"
+
+	EventReverseTargetConnected = "reverseTargetConnected"
+)
+
+// SessionEvent is a single entry in a session's audit trail
+type SessionEvent struct {
+	Time     time.Time
+	Type     string
+	ViewerID string
+	Detail   string
+}
+
+// addEventLocked appends an event to the audit trail, called with the session mutex held
+func (s *VncSession) addEventLocked(eventType string, viewerId string, detail string) {
+	s.events = append(s.events, SessionEvent{
+		Time:     time.Now(),
+		Type:     eventType,
+		ViewerID: viewerId,
+		Detail:   detail,
+	})
+	if len(s.events) > maxSessionEvents {
+		s.events = s.events[len(s.events)-maxSessionEvents:]
+	}
+}
+
+// Events returns a copy of the session's audit trail, oldest first
+func (s *VncSession) Events() []SessionEvent {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]SessionEvent{}, s.events...)
+}
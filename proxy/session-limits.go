@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+)
+
+const (
+	limitReasonIdle        = "idle timeout"
+	limitReasonMaxDuration = "maximum session duration reached"
+)
+
+// hasLimits reports if the session's viewers are disconnected after some time (see IdleTimeout / MaxDuration)
+func (s *VncSession) hasLimits() bool {
+	return s.IdleTimeout > 0 || s.MaxDuration > 0
+}
+
+// warnsBeforeLimits reports if messages are injected into the viewers' streams to warn them before the session is closed
+func (s *VncSession) warnsBeforeLimits() bool {
+	return s.hasLimits() && s.LimitWarning > 0
+}
+
+// markInput records keyboard & pointer input from a viewer, it keeps the session from reaching its idle timeout
+func (s *VncSession) markInput() {
+	s.mutex.Lock()
+	s.lastInput = time.Now()
+	s.mutex.Unlock()
+}
+
+// startLimitsLocked starts counting the session's time when its first viewer joins, called with the session mutex held
+func (s *VncSession) startLimitsLocked() {
+	if !s.hasLimits() {
+		return
+	}
+	now := time.Now()
+	s.limitsSince = now
+	s.lastInput = now
+	s.limitWarnedFor = time.Time{}
+	s.armLimitsTimerLocked(now)
+}
+
+// stopLimitsLocked is called with the session mutex held, once the last viewer is gone
+func (s *VncSession) stopLimitsLocked() {
+	if s.limitsTimer != nil {
+		s.limitsTimer.Stop()
+		s.limitsTimer = nil
+	}
+	s.limitsSince = time.Time{}
+}
+
+// limitDeadlineLocked returns the time at which the session should be closed & why, a zero time if it has no limits
+func (s *VncSession) limitDeadlineLocked() (time.Time, string) {
+	var deadline time.Time
+	reason := ""
+	if s.MaxDuration > 0 {
+		deadline = s.limitsSince.Add(s.MaxDuration)
+		reason = limitReasonMaxDuration
+	}
+	if s.IdleTimeout > 0 {
+		idleDeadline := s.lastInput.Add(s.IdleTimeout)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+			reason = limitReasonIdle
+		}
+	}
+	return deadline, reason
+}
+
+// armLimitsTimerLocked schedules the next check, either when the viewers should be warned or when the session should be closed,
+// like the floor timer it isn't reset on every input, instead the check re-arms itself
+func (s *VncSession) armLimitsTimerLocked(now time.Time) {
+	if s.limitsTimer != nil {
+		s.limitsTimer.Stop()
+	}
+	deadline, _ := s.limitDeadlineLocked()
+	next := deadline
+	if warnAt := deadline.Add(-s.LimitWarning); s.LimitWarning > 0 && now.Before(warnAt) {
+		next = warnAt
+	}
+	since := s.limitsSince
+	s.limitsTimer = time.AfterFunc(next.Sub(now), func() { s.checkLimits(since) })
+}
+
+// checkLimits warns the viewers or closes the session once it reached its idle timeout or maximum duration,
+// since identifies the run of the session the check was scheduled for
+func (s *VncSession) checkLimits(since time.Time) {
+	s.mutex.Lock()
+	if s.limitsSince.IsZero() || !s.limitsSince.Equal(since) {
+		s.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	deadline, reason := s.limitDeadlineLocked()
+
+	if !now.Before(deadline) {
+		s.stopLimitsLocked()
+		s.addEventLocked(EventLimitReached, "", reason)
+		viewers := s.currentViewersLocked()
+		s.mutex.Unlock()
+
+		logger.Infof("VncSession: closing session=%s: %s", s.ID, reason)
+		s.detachViewers(viewers, reason)
+		return
+	}
+
+	var warnViewers []*Viewer
+	if s.LimitWarning > 0 && !now.Before(deadline.Add(-s.LimitWarning)) && !s.limitWarnedFor.Equal(deadline) {
+		s.limitWarnedFor = deadline
+		s.addEventLocked(EventLimitWarning, "", reason)
+		warnViewers = s.currentViewersLocked()
+	}
+	s.armLimitsTimerLocked(now)
+	s.mutex.Unlock()
+
+	if len(warnViewers) > 0 {
+		text := fmt.Sprintf("This session will be closed in %s (%s)", deadline.Sub(now).Round(time.Second), reason)
+		logger.Infof("VncSession: warning viewers of session=%s: %s", s.ID, text)
+		for _, v := range warnViewers {
+			v.warn(text, s.allowClipboardFromTarget(v))
+		}
+	}
+}
+
+func (s *VncSession) currentViewersLocked() []*Viewer {
+	list := make([]*Viewer, 0, len(s.viewers))
+	for _, v := range s.viewers {
+		list = append(list, v)
+	}
+	return list
+}
+
+// serverCutTextMsg builds a ServerCutText message carrying text
+func serverCutTextMsg(text string) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{byte(common.ServerCutText), 0, 0, 0})
+	binary.Write(buf, binary.BigEndian, uint32(len(text)))
+	buf.WriteString(text)
+	return buf.Bytes()
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionIdleTimeout(t *testing.T) {
+	session := &VncSession{ID: "s1", IdleTimeout: 150 * time.Millisecond, LimitWarning: 100 * time.Millisecond}
+	v := newTestViewer(t)
+	warnings := make(chan []byte, 10)
+	v.setSender(func(msg []byte) error {
+		warnings <- msg
+		return nil
+	})
+	session.addViewer(v)
+	session.setStatus(SessionStatusActive, "")
+
+	// input keeps the session open past the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		session.allowClientMessage(v, keyEvent('a', i%2 == 0))
+	}
+	if !session.hasViewer(v.ID) {
+		t.Fatalf("viewer was disconnected while sending input")
+	}
+
+	select {
+	case msg := <-warnings:
+		if len(msg) < 9 || msg[0] != 2 || msg[1] != 3 {
+			t.Fatalf("unexpected warning message: %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no warning was sent")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for session.hasViewer(v.ID) {
+		if time.Now().After(deadline) {
+			t.Fatalf("viewer was not disconnected after the idle timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := session.Info()
+	if info.Status != SessionStatusClosed || info.StatusReason != limitReasonIdle {
+		t.Fatalf("unexpected state after idle timeout: %+v", info)
+	}
+	events := session.Events()
+	if last := events[len(events)-1]; last.Type != EventViewerDisconnected || last.Detail != limitReasonIdle {
+		t.Fatalf("unexpected last event: %+v", last)
+	}
+}
+
+func TestSessionMaxDuration(t *testing.T) {
+	session := &VncSession{
+		ID:           "s1",
+		MaxDuration:  100 * time.Millisecond,
+		LimitWarning: 50 * time.Millisecond,
+		InputPolicy:  &InputPolicy{Clipboard: ClipboardDisabled},
+	}
+	v := newTestViewer(t)
+	warnings := make(chan []byte, 10)
+	v.setSender(func(msg []byte) error {
+		warnings <- msg
+		return nil
+	})
+	session.addViewer(v)
+
+	// input doesn't extend the maximum duration
+	stop := time.After(300 * time.Millisecond)
+	for session.hasViewer(v.ID) {
+		select {
+		case <-stop:
+			t.Fatalf("viewer was not disconnected after the maximum duration")
+		case <-time.After(10 * time.Millisecond):
+		}
+		session.allowClientMessage(v, keyEvent('a', true))
+	}
+	if info := session.Info(); info.StatusReason != limitReasonMaxDuration {
+		t.Fatalf("unexpected state after maximum duration: %+v", info)
+	}
+
+	// with the clipboard disabled the warning is only a bell
+	select {
+	case msg := <-warnings:
+		if len(msg) != 1 || msg[0] != 2 {
+			t.Fatalf("unexpected warning message: %v", msg)
+		}
+	default:
+		t.Fatalf("no warning was sent")
+	}
+}
@@ -1,19 +1,124 @@
 package proxy
 
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+var ErrSessionExists = errors.New("session already exists")
+
+// SessionManager holds the sessions known to the proxy, it is safe for concurrent use
+// so sessions can be added & removed while the proxy is serving connections
 type SessionManager struct {
 	sessions map[string]*VncSession
+	mutex    sync.RWMutex
+	onChange func() // called after sessions were added or removed (outside of mutex), see setOnChange
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{sessions: make(map[string]*VncSession)}
 }
 
 func (s *SessionManager) GetSession(sessionId string) (*VncSession, error) {
-	return s.sessions[sessionId], nil
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
 }
 
+// SetSession registers a session, replacing the session with the same id if there is one
 func (s *SessionManager) SetSession(sessionId string, session *VncSession) error {
+	_, err := s.storeSession(sessionId, session, true)
+	return err
+}
+
+// AddSession registers a session only if no session has its id yet (ErrSessionExists otherwise),
+// the check & the change are done atomically
+func (s *SessionManager) AddSession(sessionId string, session *VncSession) error {
+	_, err := s.storeSession(sessionId, session, false)
+	return err
+}
+
+// storeSession registers a session, an existing session with the same id is replaced only if replace is set.
+// it reports if a session was replaced
+func (s *SessionManager) storeSession(sessionId string, session *VncSession, replace bool) (bool, error) {
+	if sessionId == "" {
+		return false, errors.New("SessionManager.SetSession: empty session id")
+	}
+	if session == nil {
+		return false, errors.New("SessionManager.SetSession: nil session")
+	}
+
+	s.mutex.Lock()
+	old, exists := s.sessions[sessionId]
+	if exists && !replace {
+		s.mutex.Unlock()
+		return false, ErrSessionExists
+	}
+	defer s.changed()
+	defer s.mutex.Unlock()
+
+	session.ID = sessionId
+	session.markCreated()
+	if exists && old != session {
+		old.stopHealthChecks()
+		old.closeReverseConns()
+	}
 	s.sessions[sessionId] = session
-	return nil
+	if len(session.Targets) > 0 {
+		//start checking the targets right away, so the first viewer already connects to a healthy one
+		session.getTargetPool()
+	}
+	return exists, nil
 }
 
 func (s *SessionManager) DeleteSession(sessionId string) error {
+	s.mutex.Lock()
+	defer s.changed()
+	defer s.mutex.Unlock()
+
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	session.stopHealthChecks()
+	session.closeReverseConns()
 	delete(s.sessions, sessionId)
 	return nil
 }
+
+// setOnChange registers the function called whenever sessions are added, replaced or removed
+func (s *SessionManager) setOnChange(onChange func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onChange = onChange
+}
+
+// changed calls onChange, it is deferred before unlocking the mutex so it runs once the mutex was released
+func (s *SessionManager) changed() {
+	s.mutex.RLock()
+	onChange := s.onChange
+	s.mutex.RUnlock()
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// ListSessions returns all registered sessions ordered by id
+func (s *SessionManager) ListSessions() []*VncSession {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]*VncSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, session)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// session tokens are JWTs signed with HS256, this is their (only accepted) header
+var sessionTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var errInvalidSessionToken = errors.New("invalid session token")
+
+// SessionTokenClaims are the claims of a session token, which lets a websocket viewer connect to a session
+// without knowing its id (see VncProxy.SessionTokenKey)
+type SessionTokenClaims struct {
+	SessionID string `json:"sid"`
+	ViewOnly  bool   `json:"viewOnly,omitempty"` // the viewer's input is not passed to the target
+	ExpiresAt int64  `json:"exp,omitempty"`      // unix time, 0 = the token doesn't expire
+}
+
+// NewSessionToken mints a token for a session, viewers connect with it as their ws url path (instead of the
+// session id) or as the "token" query parameter. ttl = 0 creates a token which doesn't expire
+func (vp *VncProxy) NewSessionToken(sessionId string, ttl time.Duration, viewOnly bool) (string, error) {
+	if len(vp.SessionTokenKey) == 0 {
+		return "", errors.New("Proxy.NewSessionToken: no SessionTokenKey configured")
+	}
+	if _, err := vp.getProxySession(sessionId); err != nil {
+		return "", err
+	}
+	claims := &SessionTokenClaims{SessionID: sessionId, ViewOnly: viewOnly}
+	if ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := sessionTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + vp.signSessionToken(signed), nil
+}
+
+// ParseSessionToken checks a token's signature & expiry, returning its claims
+func (vp *VncProxy) ParseSessionToken(token string) (*SessionTokenClaims, error) {
+	if len(vp.SessionTokenKey) == 0 {
+		return nil, errors.New("Proxy.ParseSessionToken: no SessionTokenKey configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != sessionTokenHeader {
+		return nil, errInvalidSessionToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(vp.signSessionToken(parts[0]+"."+parts[1]))) {
+		return nil, errInvalidSessionToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidSessionToken
+	}
+	claims := &SessionTokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil || claims.SessionID == "" {
+		return nil, errInvalidSessionToken
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("session token expired")
+	}
+	return claims, nil
+}
+
+func (vp *VncProxy) signSessionToken(signed string) string {
+	mac := hmac.New(sha256.New, vp.SessionTokenKey)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// resolveSession is the websocket server's SessionResolver when session tokens are used, plain session ids are rejected
+func (vp *VncProxy) resolveSession(requested string) (string, interface{}, error) {
+	claims, err := vp.ParseSessionToken(requested)
+	if err != nil {
+		return "", nil, err
+	}
+	return claims.SessionID, claims, nil
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestSessionTokens(t *testing.T) {
+	vp := &VncProxy{UsingSessions: true, SessionTokenKey: []byte("secret")}
+	vp.Sessions().SetSession("s1", &VncSession{})
+
+	token, err := vp.NewSessionToken("s1", time.Minute, true)
+	if err != nil {
+		t.Fatalf("error creating token: %v", err)
+	}
+	claims, err := vp.ParseSessionToken(token)
+	if err != nil {
+		t.Fatalf("error parsing token: %v", err)
+	}
+	if claims.SessionID != "s1" || !claims.ViewOnly || claims.ExpiresAt == 0 {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := vp.NewSessionToken("missing", 0, false); err == nil {
+		t.Errorf("a token was created for a missing session")
+	}
+
+	other := &VncProxy{SessionTokenKey: []byte("other")}
+	if _, err := other.ParseSessionToken(token); err == nil {
+		t.Errorf("a token signed with another key was accepted")
+	}
+
+	parts := strings.Split(token, ".")
+	forged, _ := vp.NewSessionToken("s1", 0, false)
+	if _, err := vp.ParseSessionToken(parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]); err == nil {
+		t.Errorf("a token with a modified payload was accepted")
+	}
+
+	expired, _ := vp.NewSessionToken("s1", time.Nanosecond, false)
+	time.Sleep(time.Second)
+	if _, err := vp.ParseSessionToken(expired); err == nil {
+		t.Errorf("an expired token was accepted")
+	}
+}
+
+func TestSessionTokenWsRouting(t *testing.T) {
+	target, _ := fakeTarget(t, 800, 600)
+	vp := &VncProxy{UsingSessions: true, SessionTokenKey: []byte("secret")}
+	session := &VncSession{Target: target, Type: SessionTypeProxyPass}
+	vp.Sessions().SetSession("s1", session)
+
+	mux := http.NewServeMux()
+	mux.Handle("/vnc/", vp.WsHandler("/vnc/"))
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+	wsUrl := "ws" + strings.TrimPrefix(web.URL, "http") + "/vnc/"
+
+	if _, err := websocket.Dial(wsUrl+"s1", "", web.URL); err == nil {
+		t.Errorf("a plain session id was accepted")
+	}
+
+	token, err := vp.NewSessionToken("s1", time.Minute, true)
+	if err != nil {
+		t.Fatalf("error creating token: %v", err)
+	}
+	ws, err := websocket.Dial(wsUrl+"?token="+token, "", web.URL)
+	if err != nil {
+		t.Fatalf("error connecting with a session token: %v", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	if cc := handshakeViewer(t, ws); cc.FrameBufferWidth != 800 {
+		t.Errorf("unexpected screen width: %d", cc.FrameBufferWidth)
+	}
+
+	info, _ := vp.GetSessionInfo("s1")
+	if len(info.Viewers) != 1 {
+		t.Fatalf("unexpected viewers: %+v", info.Viewers)
+	}
+	if policy := info.Viewers[0].InputPolicy; policy == nil || policy.Mode != InputModeViewOnly {
+		t.Errorf("the view only claim wasn't applied: %+v", policy)
+	}
+}
@@ -0,0 +1,548 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"sync"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/logger"
+	listeners "github.com/amitbet/vncproxy/recorder"
+	"github.com/amitbet/vncproxy/server"
+)
+
+var errUpstreamClosed = errors.New("shared upstream connection is closed")
+
+// sharedUpstreamEncodings are the encodings requested from the target in shared mode (and by transcoding exclusive sessions),
+// the proxy keeps its own framebuffer so it can only ask for encodings it knows how to apply
+var sharedUpstreamEncodings = []common.EncodingType{
+	common.EncCopyRect,
+	common.EncTight,
+	common.EncZRLE,
+	common.EncZlib,
+	common.EncHextile,
+	common.EncRaw,
+	common.EncDesktopSizePseudo,
+}
+
+// sharedUpstream is a single connection to the target vnc server which is fanned out to all viewers of a shared session.
+// the proxy requests updates from the target on its own, keeps the screen in a framebuffer
+// and answers every viewer's update requests independently from it.
+type sharedUpstream struct {
+	vp      *VncProxy
+	session *VncSession
+	fb      *framebuffer
+	rec     *listeners.Recorder // kept across reconnects, so the recording continues in the same file
+
+	writeMutex sync.Mutex         // serializes writes to the target, which come from all viewers
+	conn       *client.ClientConn // guarded by writeMutex, nil while the target is being reconnected
+
+	mutex       sync.Mutex
+	viewers     map[string]*sharedViewer
+	closed      bool
+	desktopName string
+}
+
+func newSharedUpstream(vp *VncProxy, session *VncSession) *sharedUpstream {
+	return &sharedUpstream{
+		vp:      vp,
+		session: session,
+		viewers: make(map[string]*sharedViewer),
+	}
+}
+
+// connect dials the target, runs the handshake & starts requesting updates
+func (u *sharedUpstream) connect() error {
+	cconn, err := u.vp.createClientConnection(u.session, false, func(cconn *client.ClientConn) {
+		if u.rec != nil {
+			cconn.Listeners.AddListener(u.rec)
+		}
+		cconn.Listeners.AddListener(u)
+		cconn.Listeners.AddListener(&ConnectionCloseListener{OnClose: func() {
+			logger.Infof("Proxy: shared target connection closed, session=%s", u.session.ID)
+			u.targetClosed()
+		}})
+		cconn.Encs = sharedUpstreamEncs()
+	})
+	if err != nil {
+		return err
+	}
+
+	if u.isClosed() {
+		//the last viewer left while connecting
+		cconn.Close()
+		return errUpstreamClosed
+	}
+	u.setConn(cconn)
+	if err := u.start(); err != nil {
+		cconn.Close()
+		return err
+	}
+	return nil
+}
+
+func (u *sharedUpstream) setConn(conn *client.ClientConn) {
+	u.writeMutex.Lock()
+	u.conn = conn
+	u.writeMutex.Unlock()
+}
+
+func (u *sharedUpstream) closeConn() {
+	u.writeMutex.Lock()
+	conn := u.conn
+	u.conn = nil
+	u.writeMutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (u *sharedUpstream) getDesktopName() string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.desktopName
+}
+
+// start is called once the handshake with the target is done, it asks for the encodings the framebuffer supports & a full update
+func (u *sharedUpstream) start() error {
+	setEncodings := &server.MsgSetEncodings{Encodings: sharedUpstreamEncodings}
+	if err := u.writeMessage(setEncodings); err != nil {
+		return err
+	}
+	return u.requestUpdate(false)
+}
+
+func (u *sharedUpstream) requestUpdate(incremental bool) error {
+	bounds := u.fb.Bounds()
+	var inc uint8
+	if incremental {
+		inc = 1
+	}
+	return u.writeMessage(&server.MsgFramebufferUpdateRequest{
+		Inc:    inc,
+		Width:  uint16(bounds.Dx()),
+		Height: uint16(bounds.Dy()),
+	})
+}
+
+// writeMessage sends a whole client message to the target in a single write, so messages from several viewers don't interleave
+func (u *sharedUpstream) writeMessage(msg common.ClientMessage) error {
+	buf := &bytes.Buffer{}
+	if err := msg.Write(buf); err != nil {
+		return err
+	}
+
+	u.writeMutex.Lock()
+	if u.conn == nil {
+		//the target is being reconnected, input is dropped & the updates are requested again once it is back
+		u.writeMutex.Unlock()
+		return nil
+	}
+	n, err := u.conn.Write(buf.Bytes())
+	u.writeMutex.Unlock()
+
+	u.session.countToTarget(n)
+	return err
+}
+
+// Consume receives the messages sent by the target, keeps the framebuffer up to date and notifies the viewers
+func (u *sharedUpstream) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentServerInitMessage:
+		initMsg := seg.Message.(*common.ServerInit)
+		u.mutex.Lock()
+		u.desktopName = string(initMsg.NameText)
+		u.mutex.Unlock()
+		if u.fb == nil {
+			u.fb = newFramebuffer(initMsg.FBWidth, initMsg.FBHeight, initMsg.PixelFormat)
+			return nil
+		}
+
+		//a reconnected target, its pixel format or size may have changed
+		u.fb.reset(initMsg.PixelFormat)
+		bounds := u.fb.Bounds()
+		if bounds.Dx() != int(initMsg.FBWidth) || bounds.Dy() != int(initMsg.FBHeight) {
+			logger.Infof("sharedUpstream: reconnected target has a different size %dx%d, session=%s", initMsg.FBWidth, initMsg.FBHeight, u.session.ID)
+			u.fb.resize(initMsg.FBWidth, initMsg.FBHeight)
+			u.markDirty(u.fb.Bounds(), true)
+		}
+	case common.SegmentBytes:
+		u.session.countFromTarget(len(seg.Bytes))
+	case common.SegmentFullyParsedServerMessage:
+		switch msg := seg.Message.(type) {
+		case *client.MsgFramebufferUpdate:
+			return u.applyUpdate(msg)
+		case *client.MsgSetColorMapEntries:
+			u.fb.setColorMapEntries(msg.FirstColor, msg.Colors)
+			u.markDirty(u.fb.Bounds(), false)
+		case *client.MsgServerCutText:
+			cutText := serverCutTextMsg(msg.Text)
+			for _, sv := range u.currentViewers() {
+				if u.session.allowClipboardFromTarget(sv.viewer) {
+					sv.queue(cutText)
+				}
+			}
+		case *client.MsgBell:
+			u.broadcast([]byte{byte(common.Bell)})
+		}
+	}
+	return nil
+}
+
+func (u *sharedUpstream) applyUpdate(msg *client.MsgFramebufferUpdate) error {
+	dirty := image.Rectangle{}
+	resized := false
+	for i := range msg.Rectangles {
+		rect := &msg.Rectangles[i]
+		if rect.Enc == nil || rect.Enc.Type() == int32(common.EncLastRectPseudo) {
+			break
+		}
+		if rect.Enc.Type() == int32(common.EncDesktopSizePseudo) {
+			logger.Infof("sharedUpstream: target desktop resized to %dx%d, session=%s", rect.Width, rect.Height, u.session.ID)
+			u.fb.resize(rect.Width, rect.Height)
+			resized = true
+			continue
+		}
+		dirty = dirty.Union(u.fb.applyRect(rect))
+	}
+
+	if resized {
+		dirty = u.fb.Bounds()
+	}
+	u.markDirty(dirty, resized)
+
+	return u.requestUpdate(!resized)
+}
+
+func (u *sharedUpstream) currentViewers() []*sharedViewer {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	list := make([]*sharedViewer, 0, len(u.viewers))
+	for _, sv := range u.viewers {
+		list = append(list, sv)
+	}
+	return list
+}
+
+func (u *sharedUpstream) markDirty(area image.Rectangle, resized bool) {
+	if area.Empty() && !resized {
+		return
+	}
+	for _, sv := range u.currentViewers() {
+		sv.markDirty(area, resized)
+	}
+}
+
+func (u *sharedUpstream) broadcast(msg []byte) {
+	for _, sv := range u.currentViewers() {
+		sv.queue(msg)
+	}
+}
+
+// addViewer attaches a viewer to the upstream, it fails if the upstream was already closed
+func (u *sharedUpstream) addViewer(viewer *Viewer) (*sharedViewer, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.closed {
+		return nil, errUpstreamClosed
+	}
+
+	sv := newSharedViewer(u, viewer)
+	u.viewers[viewer.ID] = sv
+	go sv.run()
+	return sv, nil
+}
+
+// removeViewer detaches a viewer, the target connection is closed when the last viewer leaves
+func (u *sharedUpstream) removeViewer(sv *sharedViewer) {
+	u.mutex.Lock()
+	if _, ok := u.viewers[sv.viewer.ID]; !ok {
+		u.mutex.Unlock()
+		return
+	}
+	delete(u.viewers, sv.viewer.ID)
+	sv.stop()
+	last := len(u.viewers) == 0
+	if last {
+		u.closed = true
+	}
+	u.mutex.Unlock()
+
+	if last {
+		logger.Infof("sharedUpstream: last viewer left, closing target connection, session=%s", u.session.ID)
+		u.closeConn()
+		u.closeRecording()
+	}
+}
+
+// targetClosed is called when the target connection goes away,
+// the target is redialed if the session allows it, otherwise all viewers are disconnected
+func (u *sharedUpstream) targetClosed() {
+	u.mutex.Lock()
+	if u.session.Reconnect != nil && !u.closed && len(u.viewers) > 0 {
+		u.mutex.Unlock()
+		go u.reconnect()
+		return
+	}
+	u.mutex.Unlock()
+	u.disconnectViewers("target disconnected")
+}
+
+func (u *sharedUpstream) alive() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return !u.closed && len(u.viewers) > 0
+}
+
+func (u *sharedUpstream) reconnect() {
+	u.setConn(nil)
+	u.session.setStatus(SessionStatusReconnecting, "target disconnected")
+	u.session.addEvent(EventTargetReconnecting, "", "")
+
+	err := u.session.Reconnect.retry(u.session.ID, u.alive, func() error {
+		u.session.setStatus(SessionStatusReconnecting, "dialing target")
+		return u.connect()
+	})
+	if err != nil {
+		if err != errReconnectAborted && err != errUpstreamClosed {
+			logger.Errorf("sharedUpstream: giving up on reconnecting to target, session=%s: %v", u.session.ID, err)
+		}
+		u.disconnectViewers("reconnect failed: " + err.Error())
+		return
+	}
+
+	logger.Infof("sharedUpstream: target reconnected, session=%s", u.session.ID)
+	u.session.addEvent(EventTargetReconnected, "", "")
+	u.session.setStatus(SessionStatusActive, "reconnected")
+}
+
+// disconnectViewers closes the upstream for good & disconnects all of its viewers
+func (u *sharedUpstream) disconnectViewers(reason string) {
+	u.mutex.Lock()
+	u.closed = true
+	viewers := u.viewers
+	u.viewers = make(map[string]*sharedViewer)
+	u.mutex.Unlock()
+
+	for _, sv := range viewers {
+		sv.stop()
+		u.session.detachViewer(sv.viewer, reason, true)
+	}
+	u.closeRecording()
+}
+
+func (u *sharedUpstream) closeRecording() {
+	if u.rec != nil {
+		u.vp.closeRecorder(u.rec)
+	}
+}
+
+func (u *sharedUpstream) isClosed() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.closed
+}
+
+// sharedViewer is the per-viewer side of a shared session: it tracks which parts of the screen the viewer hasn't seen yet
+// and answers the viewer's update requests from the framebuffer, writes to the viewer are done on the viewer's own goroutine
+// so a slow viewer doesn't hold up the others.
+type sharedViewer struct {
+	viewer   *Viewer
+	upstream *sharedUpstream
+
+	mutex                sync.Mutex
+	encoder              *encodings.EncoderState
+	dirty                dirtyRegion
+	pending              *server.MsgFramebufferUpdateRequest
+	resized              bool
+	desktopSizeSupported bool
+	ready                bool
+	outbox               [][]byte
+
+	notify   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newSharedViewer(upstream *sharedUpstream, viewer *Viewer) *sharedViewer {
+	return &sharedViewer{
+		viewer:   viewer,
+		upstream: upstream,
+		encoder:  encodings.NewEncoderState(*viewer.sconn.CurrentPixelFormat()),
+		dirty:    dirtyRegion{upstream.fb.Bounds()},
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (sv *sharedViewer) signal() {
+	select {
+	case sv.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (sv *sharedViewer) stop() {
+	sv.stopOnce.Do(func() { close(sv.done) })
+}
+
+func (sv *sharedViewer) markDirty(area image.Rectangle, resized bool) {
+	sv.mutex.Lock()
+	sv.dirty.add(area)
+	sv.resized = sv.resized || resized
+	sv.mutex.Unlock()
+	sv.signal()
+}
+
+func (sv *sharedViewer) queue(msg []byte) {
+	sv.mutex.Lock()
+	if !sv.ready {
+		//the viewer is still in the handshake, it can't receive server messages yet
+		sv.mutex.Unlock()
+		return
+	}
+	sv.outbox = append(sv.outbox, msg)
+	sv.mutex.Unlock()
+	sv.signal()
+}
+
+// Consume receives the viewer's messages: update requests are answered locally, input is forwarded to the target
+func (sv *sharedViewer) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType != common.SegmentFullyParsedClientMessage {
+		return nil
+	}
+
+	switch msg := seg.Message.(type) {
+	case *server.MsgSetPixelFormat:
+		sv.mutex.Lock()
+		sv.encoder.SetPixelFormat(msg.PF)
+		sv.dirty.reset(sv.upstream.fb.Bounds())
+		sv.mutex.Unlock()
+	case *server.MsgSetEncodings:
+		sv.mutex.Lock()
+		sv.encoder.SetEncodings(msg.Encodings)
+		sv.desktopSizeSupported = sv.encoder.Supports(common.EncDesktopSizePseudo)
+		sv.mutex.Unlock()
+	case *server.MsgFramebufferUpdateRequest:
+		sv.mutex.Lock()
+		sv.ready = true
+		if msg.Inc == 0 {
+			sv.dirty.add(requestArea(msg))
+		}
+		sv.pending = msg
+		sv.mutex.Unlock()
+		sv.signal()
+	default:
+		if !sv.upstream.session.allowClientMessage(sv.viewer, msg.(common.ClientMessage)) {
+			logger.Debugf("sharedViewer.Consume: input policy dropped %s from viewer %s", msg.(common.ClientMessage).Type(), sv.viewer.ID)
+			return nil
+		}
+		err := sv.upstream.writeMessage(msg.(common.ClientMessage))
+		if err != nil {
+			logger.Errorf("sharedViewer.Consume: error forwarding %s to target: %v", msg.(common.ClientMessage).Type(), err)
+		}
+	}
+	return nil
+}
+
+func requestArea(req *server.MsgFramebufferUpdateRequest) image.Rectangle {
+	return image.Rect(int(req.X), int(req.Y), int(req.X)+int(req.Width), int(req.Y)+int(req.Height))
+}
+
+func (sv *sharedViewer) run() {
+	for {
+		select {
+		case <-sv.done:
+			return
+		case <-sv.notify:
+			if err := sv.flush(); err != nil {
+				logger.Errorf("sharedViewer.run: error writing to viewer %s: %v", sv.viewer.ID, err)
+				sv.viewer.sconn.Close()
+				return
+			}
+		}
+	}
+}
+
+// flush writes any queued server messages, followed by a framebuffer update if the viewer has a pending request
+func (sv *sharedViewer) flush() error {
+	buf := &bytes.Buffer{}
+
+	sv.mutex.Lock()
+	for _, msg := range sv.outbox {
+		buf.Write(msg)
+	}
+	sv.outbox = nil
+	err := sv.buildUpdate(buf)
+	sv.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+	n, err := sv.viewer.sconn.Write(buf.Bytes())
+	sv.viewer.countSent(n)
+	return err
+}
+
+// buildUpdate writes a FramebufferUpdate answering the pending request (if there is anything to send), called with the mutex held
+func (sv *sharedViewer) buildUpdate(buf *bytes.Buffer) error {
+	if sv.pending == nil {
+		return nil
+	}
+	bounds := sv.upstream.fb.Bounds()
+
+	if sv.resized {
+		sv.resized = false
+		sv.dirty.reset(bounds)
+		sv.viewer.sconn.SetWidth(uint16(bounds.Dx()))
+		sv.viewer.sconn.SetHeight(uint16(bounds.Dy()))
+		if sv.desktopSizeSupported {
+			//the viewer will ask for a full update after resizing
+			writeUpdateHeader(buf, 1)
+			writeRectHeader(buf, bounds, int32(common.EncDesktopSizePseudo))
+			sv.pending = nil
+			return nil
+		}
+	}
+
+	// only the dirty parts inside the request are sent, the rest stays dirty for later requests
+	areas := sv.dirty.take(requestArea(sv.pending).Intersect(bounds))
+	if len(areas) == 0 {
+		//nothing new for this viewer, the request stays pending until the target sends something
+		return nil
+	}
+	sv.pending = nil
+
+	enc := sv.encoder.Encoder()
+	var rects []image.Rectangle
+	for _, area := range areas {
+		rects = append(rects, sv.encoder.SplitRect(enc, area)...)
+	}
+	writeUpdateHeader(buf, uint16(len(rects)))
+	return sv.upstream.fb.writeRects(buf, sv.encoder, enc, rects)
+}
+
+func writeUpdateHeader(buf *bytes.Buffer, numRects uint16) {
+	buf.Write([]byte{byte(common.FramebufferUpdate), 0})
+	binary.Write(buf, binary.BigEndian, numRects)
+}
+
+// sharedUpstreamEncs are the encoding readers used to parse the target's updates in shared mode
+func sharedUpstreamEncs() []common.IEncoding {
+	return []common.IEncoding{
+		&encodings.RawEncoding{},
+		&encodings.CopyRectEncoding{},
+		&encodings.TightEncoding{},
+		&encodings.ZRLEEncoding{},
+		&encodings.ZLibEncoding{},
+		&encodings.HextileEncoding{},
+	}
+}
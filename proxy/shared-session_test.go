@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/server"
+)
+
+// updateRects reads the rect areas of a FramebufferUpdate with raw 32bpp rects
+func updateRects(t *testing.T, data []byte) []image.Rectangle {
+	r := bytes.NewReader(data)
+	var header struct {
+		Type, Pad uint8
+		NumRects  uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		t.Fatalf("error reading the update header: %v", err)
+	}
+	rects := []image.Rectangle{}
+	for i := 0; i < int(header.NumRects); i++ {
+		var rect struct {
+			X, Y, Width, Height uint16
+			Enc                 int32
+		}
+		if err := binary.Read(r, binary.BigEndian, &rect); err != nil {
+			t.Fatalf("error reading rect %d: %v", i, err)
+		}
+		r.Seek(int64(rect.Width)*int64(rect.Height)*4, 1)
+		rects = append(rects, image.Rect(int(rect.X), int(rect.Y), int(rect.X+rect.Width), int(rect.Y+rect.Height)))
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes left after the update", r.Len())
+	}
+	return rects
+}
+
+func TestSharedViewerPartialRequests(t *testing.T) {
+	pf := common.NewPixelFormat(32)
+	upstream := &sharedUpstream{fb: newFramebuffer(8, 4, *pf)}
+	sv := &sharedViewer{
+		upstream: upstream,
+		encoder:  encodings.NewEncoderState(*pf),
+		dirty:    dirtyRegion{upstream.fb.Bounds()},
+	}
+
+	request := func(x, y, w, h uint16) []image.Rectangle {
+		sv.pending = &server.MsgFramebufferUpdateRequest{Inc: 1, X: x, Y: y, Width: w, Height: h}
+		buf := &bytes.Buffer{}
+		if err := sv.buildUpdate(buf); err != nil {
+			t.Fatalf("error building the update: %v", err)
+		}
+		if buf.Len() == 0 {
+			return nil
+		}
+		return updateRects(t, buf.Bytes())
+	}
+
+	if rects := request(0, 0, 4, 4); len(rects) != 1 || rects[0] != image.Rect(0, 0, 4, 4) {
+		t.Fatalf("first request: unexpected rects %v", rects)
+	}
+	// the left half was sent, only the right half is left for a full screen request
+	if rects := request(0, 0, 8, 4); len(rects) != 1 || rects[0] != image.Rect(4, 0, 8, 4) {
+		t.Fatalf("second request: unexpected rects %v", rects)
+	}
+	if rects := request(0, 0, 8, 4); rects != nil {
+		t.Fatalf("nothing is dirty, but %v was sent", rects)
+	}
+
+	// changes inside & outside of a partial request
+	sv.markDirty(image.Rect(1, 1, 3, 2), false)
+	sv.markDirty(image.Rect(6, 2, 8, 4), false)
+	if rects := request(0, 0, 4, 4); len(rects) != 1 || rects[0] != image.Rect(1, 1, 3, 2) {
+		t.Fatalf("third request: unexpected rects %v", rects)
+	}
+	if rects := request(0, 0, 8, 4); len(rects) != 1 || rects[0] != image.Rect(6, 2, 8, 4) {
+		t.Fatalf("fourth request: unexpected rects %v", rects)
+	}
+}
+
+func TestDirtyRegion(t *testing.T) {
+	d := dirtyRegion{}
+	d.add(image.Rect(0, 0, 4, 4))
+	d.add(image.Rect(2, 2, 6, 6))
+	area := 0
+	for _, r := range d {
+		area += r.Dx() * r.Dy()
+	}
+	if area != 16+16-4 {
+		t.Fatalf("overlapping rects were kept: %v", d)
+	}
+	taken := d.take(image.Rect(0, 0, 6, 3))
+	left := d.take(image.Rect(0, 0, 6, 6))
+	for _, r := range taken {
+		for _, l := range left {
+			if r.Overlaps(l) {
+				t.Fatalf("%v was taken twice", r.Intersect(l))
+			}
+		}
+	}
+	if len(d) != 0 {
+		t.Fatalf("rects left after taking everything: %v", d)
+	}
+}
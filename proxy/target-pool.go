@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+)
+
+type TargetStrategy int
+
+const (
+	TargetStrategyFirstHealthy     TargetStrategy = iota // the first healthy target in the list, the rest are fallbacks
+	TargetStrategyRoundRobin                             // healthy targets take turns
+	TargetStrategyLeastConnections                       // the healthy target with the fewest open connections
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// targetConnectTimeout bounds dialing a candidate target & its RFB handshake, so a hanging target is failed over too
+const targetConnectTimeout = healthCheckTimeout
+
+func (ts TargetStrategy) String() string {
+	switch ts {
+	case TargetStrategyFirstHealthy:
+		return "firstHealthy"
+	case TargetStrategyRoundRobin:
+		return "roundRobin"
+	case TargetStrategyLeastConnections:
+		return "leastConnections"
+	}
+	return ""
+}
+
+// ParseTargetStrategy converts the name of a strategy (as returned by String) back to a TargetStrategy
+func ParseTargetStrategy(name string) (TargetStrategy, error) {
+	for _, ts := range []TargetStrategy{TargetStrategyFirstHealthy, TargetStrategyRoundRobin, TargetStrategyLeastConnections} {
+		if ts.String() == name {
+			return ts, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown target strategy: %s", name)
+}
+
+// TargetInfo is a point in time snapshot of the state of one of a session's candidate targets
+type TargetInfo struct {
+	Address     string
+	Healthy     bool
+	LastCheck   time.Time
+	LastError   string
+	Connections int
+}
+
+type backend struct {
+	address     string
+	healthy     bool // targets are considered healthy until a check or a connection fails
+	lastCheck   time.Time
+	lastError   string
+	connections int
+}
+
+// targetPool keeps the health & load of a session's candidate targets and picks the one to connect to
+type targetPool struct {
+	mutex    sync.Mutex
+	strategy TargetStrategy
+	backends []*backend
+	next     int // round robin position
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newTargetPool(targets []string, strategy TargetStrategy) *targetPool {
+	pool := &targetPool{strategy: strategy, stop: make(chan struct{})}
+	for _, address := range targets {
+		pool.backends = append(pool.backends, &backend{address: address, healthy: true})
+	}
+	return pool
+}
+
+func (p *targetPool) Info() []TargetInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	list := []TargetInfo{}
+	for _, b := range p.backends {
+		list = append(list, TargetInfo{
+			Address:     b.address,
+			Healthy:     b.healthy,
+			LastCheck:   b.lastCheck,
+			LastError:   b.lastError,
+			Connections: b.connections,
+		})
+	}
+	return list
+}
+
+// candidates returns the targets in the order they should be tried, according to the strategy,
+// unhealthy targets are kept at the end as a last resort since their state may be outdated
+func (p *targetPool) candidates() []*backend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	healthy := []*backend{}
+	unhealthy := []*backend{}
+	for _, b := range p.backends {
+		if b.healthy {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+
+	switch p.strategy {
+	case TargetStrategyRoundRobin:
+		if len(healthy) > 0 {
+			start := p.next % len(healthy)
+			p.next++
+			rotated := append([]*backend{}, healthy[start:]...)
+			healthy = append(rotated, healthy[:start]...)
+		}
+	case TargetStrategyLeastConnections:
+		sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].connections < healthy[j].connections })
+	}
+	return append(healthy, unhealthy...)
+}
+
+// dial connects to the best available target & runs handshake on the connection,
+// failing over to the next candidate when a target can't be reached or its handshake fails
+func (p *targetPool) dial(handshake func(nc net.Conn, target string) error) (net.Conn, string, error) {
+	var lastErr error
+	for _, b := range p.candidates() {
+		nc, err := dialTarget(b.address, targetConnectTimeout)
+		if err != nil {
+			logger.Warnf("targetPool.dial: target %s is unreachable: %v", b.address, err)
+			p.setHealth(b, err)
+			lastErr = err
+			continue
+		}
+
+		p.mutex.Lock()
+		b.connections++
+		p.mutex.Unlock()
+		pc := &pooledConn{Conn: nc, release: func() { p.release(b) }}
+
+		nc.SetDeadline(time.Now().Add(targetConnectTimeout))
+		err = handshake(pc, b.address)
+		nc.SetDeadline(time.Time{})
+		if err != nil {
+			logger.Warnf("targetPool.dial: handshake with target %s failed: %v", b.address, err)
+			pc.Close()
+			p.setHealth(b, err)
+			lastErr = err
+			continue
+		}
+
+		p.mutex.Lock()
+		b.healthy = true
+		p.mutex.Unlock()
+		return pc, b.address, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no target defined for session")
+	}
+	return nil, "", lastErr
+}
+
+func (p *targetPool) release(b *backend) {
+	p.mutex.Lock()
+	b.connections--
+	p.mutex.Unlock()
+}
+
+func (p *targetPool) setHealth(b *backend, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b.lastCheck = time.Now()
+	b.healthy = err == nil
+	b.lastError = ""
+	if err != nil {
+		b.lastError = err.Error()
+	}
+}
+
+// runHealthChecks probes all targets every interval until the pool is stopped
+func (p *targetPool) runHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.mutex.Lock()
+		backends := append([]*backend{}, p.backends...)
+		p.mutex.Unlock()
+
+		for _, b := range backends {
+			err := probeTarget(b.address, healthCheckTimeout)
+			if err != nil {
+				logger.Warnf("targetPool: health check failed for %s: %v", b.address, err)
+			}
+			p.setHealth(b, err)
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *targetPool) close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// pooledConn releases its target's connection count once closed
+type pooledConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+// dialTarget connects to a target given as host:port or as a unix socket path, timeout 0 means no timeout
+func dialTarget(target string, timeout time.Duration) (net.Conn, error) {
+	if target == "" {
+		return nil, errors.New("no target defined for session")
+	}
+	network := "tcp"
+	if target[0] == '/' {
+		network = "unix"
+	}
+	return net.DialTimeout(network, target, timeout)
+}
+
+// probeTarget checks that a target is a responsive vnc server: it runs the RFB version handshake
+// and reads the offered security types, the connection is closed before authenticating
+func probeTarget(target string, timeout time.Duration) error {
+	nc, err := dialTarget(target, timeout)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(timeout))
+
+	var version [12]byte
+	if _, err := io.ReadFull(nc, version[:]); err != nil {
+		return err
+	}
+	var major, minor uint
+	if _, err := fmt.Sscanf(string(version[:]), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		return fmt.Errorf("bad protocol version %q", version)
+	}
+
+	switch {
+	case major > 3 || minor >= 8:
+		minor = 8
+	case minor >= 7:
+		minor = 7
+	default:
+		minor = 3
+	}
+	if _, err := fmt.Fprintf(nc, "RFB 003.%03d\n", minor); err != nil {
+		return err
+	}
+
+	// 3.3 servers choose the security type, later versions send a list, in both cases 0 means the connection was refused
+	var count uint32
+	if minor == 3 {
+		err = binary.Read(nc, binary.BigEndian, &count)
+	} else {
+		var count8 uint8
+		err = binary.Read(nc, binary.BigEndian, &count8)
+		count = uint32(count8)
+	}
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		var reasonLen uint32
+		if err := binary.Read(nc, binary.BigEndian, &reasonLen); err != nil || reasonLen > 1024 {
+			return errors.New("target refused the connection")
+		}
+		reason := make([]byte, reasonLen)
+		io.ReadFull(nc, reason)
+		return fmt.Errorf("target refused the connection: %s", reason)
+	}
+	return nil
+}
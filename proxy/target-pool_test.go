@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenRfb starts a listener which answers the version handshake with the given greeting & a "none" security type
+func listenRfb(t *testing.T, greeting string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte(greeting))
+				buf := make([]byte, 12)
+				if _, err := io.ReadFull(c, buf); err != nil {
+					return
+				}
+				c.Write([]byte{1, 1})
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// deadAddress returns an address nothing is listening on
+func deadAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func noHandshake(net.Conn, string) error { return nil }
+
+// readGreeting is a handshake which only checks the target's version greeting
+func readGreeting(nc net.Conn, target string) error {
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(nc, buf); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(buf), "RFB ") {
+		return fmt.Errorf("bad greeting from %s: %q", target, buf)
+	}
+	return nil
+}
+
+func TestProbeTarget(t *testing.T) {
+	if err := probeTarget(listenRfb(t, "RFB 003.008\n"), healthCheckTimeout); err != nil {
+		t.Errorf("healthy target failed the check: %v", err)
+	}
+	if err := probeTarget(listenRfb(t, "HTTP/1.1 400\n"), healthCheckTimeout); err == nil {
+		t.Errorf("non vnc target passed the check")
+	}
+	if err := probeTarget(deadAddress(t), healthCheckTimeout); err == nil {
+		t.Errorf("dead target passed the check")
+	}
+}
+
+func TestTargetPoolStrategies(t *testing.T) {
+	dead := deadAddress(t)
+	t1 := listenRfb(t, "RFB 003.008\n")
+	t2 := listenRfb(t, "RFB 003.008\n")
+
+	// first healthy fails over past the dead target & remembers it is down
+	pool := newTargetPool([]string{dead, t1, t2}, TargetStrategyFirstHealthy)
+	nc, target, err := pool.dial(noHandshake)
+	if err != nil || target != t1 {
+		t.Fatalf("expected failover to %s, got %s (%v)", t1, target, err)
+	}
+	nc.Close()
+	if info := pool.Info(); info[0].Healthy || info[0].LastError == "" {
+		t.Fatalf("dead target still marked healthy: %+v", info[0])
+	}
+
+	// a target failing the handshake is failed over too, as is one which doesn't answer at all
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer silent.Close()
+	pool = newTargetPool([]string{listenRfb(t, "HTTP/1.1 400\n"), silent.Addr().String(), t2}, TargetStrategyFirstHealthy)
+	start := time.Now()
+	nc, target, err = pool.dial(readGreeting)
+	if err != nil || target != t2 {
+		t.Fatalf("expected failover to %s, got %s (%v)", t2, target, err)
+	}
+	if time.Since(start) > 2*targetConnectTimeout {
+		t.Fatalf("failover took %v", time.Since(start))
+	}
+	nc.Close()
+	if info := pool.Info(); info[0].Healthy || info[1].Healthy || info[0].Connections != 0 || info[1].Connections != 0 {
+		t.Fatalf("targets failing the handshake not marked down: %+v", info)
+	}
+
+	// round robin alternates between the healthy targets
+	pool = newTargetPool([]string{t1, t2}, TargetStrategyRoundRobin)
+	var picked []string
+	for i := 0; i < 3; i++ {
+		nc, target, err := pool.dial(noHandshake)
+		if err != nil {
+			t.Fatalf("error dialing: %v", err)
+		}
+		nc.Close()
+		picked = append(picked, target)
+	}
+	if picked[0] != t1 || picked[1] != t2 || picked[2] != t1 {
+		t.Fatalf("unexpected round robin order: %v", picked)
+	}
+
+	// least connections picks the target with fewer open connections, closing releases them
+	pool = newTargetPool([]string{t1, t2}, TargetStrategyLeastConnections)
+	c1, first, _ := pool.dial(noHandshake)
+	c2, second, _ := pool.dial(noHandshake)
+	if first != t1 || second != t2 {
+		t.Fatalf("unexpected least connections order: %s, %s", first, second)
+	}
+	c1.Close()
+	c1.Close()
+	c3, third, _ := pool.dial(noHandshake)
+	if third != t1 {
+		t.Fatalf("expected the released target, got %s", third)
+	}
+	c2.Close()
+	c3.Close()
+	for _, info := range pool.Info() {
+		if info.Connections != 0 {
+			t.Fatalf("connections not released: %+v", info)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+)
+
+// tcp viewers picking their session by the TLS server name must finish the TLS handshake within this time
+const tlsHandshakeTimeout = 10 * time.Second
+
+// sessionListener is a tcp listener opened for a session's ListenAddr
+type sessionListener struct {
+	addr    string
+	ln      net.Listener
+	closing chan struct{} // closed when the listener is closed because its session was removed or changed
+}
+
+// selectTcpSession picks the session of a viewer on the main tcp listener (see server.TcpSessionSelector):
+// the session whose ServerName the viewer asked for (the authority in a PROXY protocol header, or the TLS server name),
+// otherwise it is picked by the viewer's password (see sessionAuthenticator.SelectSession)
+func (vp *VncProxy) selectTcpSession(c net.Conn) (string, error) {
+	tlsConn, isTLS := c.(*tls.Conn)
+	if isTLS {
+		c = tlsConn.NetConn()
+	}
+	if ppConn, ok := c.(*server.ProxyProtocolConn); ok {
+		if sessionId := vp.sessionByServerName(ppConn.Authority()); sessionId != "" {
+			return sessionId, nil
+		}
+	}
+	if !isTLS {
+		return "", nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return "", err
+	}
+	return vp.sessionByServerName(tlsConn.ConnectionState().ServerName), nil
+}
+
+func (vp *VncProxy) sessionByServerName(serverName string) string {
+	if serverName == "" {
+		return ""
+	}
+	for _, session := range vp.Sessions().ListSessions() {
+		if strings.EqualFold(session.ServerName, serverName) {
+			return session.ID
+		}
+	}
+	return ""
+}
+
+// SelectSession picks the session of a tcp viewer without a hint by its password: the first session (by id) for which
+// it is a one-time token or the ViewerPassword. other viewers connect to the default session, as before
+func (a *sessionAuthenticator) SelectSession(creds *server.ViewerCredentials) (string, error) {
+	if creds.HasCredentials() {
+		for _, session := range a.vp.Sessions().ListSessions() {
+			if session.useViewerToken(creds) {
+				return session.ID, nil
+			}
+			if !session.TokenOnly && session.ViewerPassword != "" && creds.MatchesPassword(session.ViewerPassword) {
+				return session.ID, nil
+			}
+		}
+	}
+	if err := a.AuthenticateViewer(server.DefaultSessionId, creds); err != nil {
+		return "", err
+	}
+	return server.DefaultSessionId, nil
+}
+
+// anySessionRequiresViewerAuth reports if tcp viewers may need a password to pick their session
+func (vp *VncProxy) anySessionRequiresViewerAuth() bool {
+	for _, session := range vp.Sessions().ListSessions() {
+		if session.requiresViewerAuth() {
+			return true
+		}
+	}
+	return false
+}
+
+// syncSessionListeners opens a listener for each session with a ListenAddr, and closes the listeners of sessions
+// which were removed or moved to another address. a listener which can't be opened is logged, the other sessions are still served
+func (vp *VncProxy) syncSessionListeners() {
+	vp.mutex.Lock()
+	defer vp.mutex.Unlock()
+	vp.syncSessionListenersLocked()
+}
+
+func (vp *VncProxy) syncSessionListenersLocked() {
+	if !vp.started || vp.stopping || !vp.UsingSessions {
+		return
+	}
+	wanted := make(map[string]string)
+	for _, session := range vp.Sessions().ListSessions() {
+		if session.ListenAddr != "" {
+			wanted[session.ID] = session.ListenAddr
+		}
+	}
+
+	for sessionId, sl := range vp.sessionListeners {
+		if wanted[sessionId] != sl.addr {
+			close(sl.closing)
+			sl.ln.Close()
+			delete(vp.sessionListeners, sessionId)
+			logger.Infof("closed tcp listener of session %s on: %s", sessionId, sl.addr)
+		}
+	}
+
+	for sessionId, addr := range wanted {
+		if _, ok := vp.sessionListeners[sessionId]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger.Errorf("Proxy: can't open the tcp listener of session %s on %s: %v", sessionId, addr, err)
+			continue
+		}
+		if vp.ProxyProtocol {
+			ln = server.NewProxyProtocolListener(ln)
+		}
+		if vp.listenerTLS != nil {
+			ln = tls.NewListener(ln, vp.listenerTLS)
+		}
+		if vp.sessionListeners == nil {
+			vp.sessionListeners = make(map[string]*sessionListener)
+		}
+		sl := &sessionListener{addr: addr, ln: ln, closing: make(chan struct{})}
+		vp.sessionListeners[sessionId] = sl
+		logger.Infof("running tcp listener of session %s on: %s (tls: %v)", sessionId, ln.Addr(), vp.listenerTLS != nil)
+
+		id, tcpServer := sessionId, vp.tcpServer
+		go vp.serve("tcp listener of session "+id, func() error {
+			err := tcpServer.ServeSession(ln, id)
+			select {
+			case <-sl.closing:
+				return nil
+			default:
+				return err
+			}
+		})
+	}
+}
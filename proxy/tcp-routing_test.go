@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/amitbet/vncproxy/client"
+)
+
+// handshakeWithPassword runs the viewer handshake on nc using vnc authentication
+func handshakeWithPassword(t *testing.T, nc net.Conn, password string) (*client.ClientConn, error) {
+	cc, err := client.NewClientConn(nc, &client.ClientConfig{Auth: []client.ClientAuth{&client.PasswordAuth{Password: password}}})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if err := cc.Connect(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// startRoutingProxy runs a proxy with two sessions, s1 showing an 800x600 screen & s2 a 640x480 one
+func startRoutingProxy(t *testing.T, vp *VncProxy, s1, s2 *VncSession) {
+	s1.Target, _ = fakeTarget(t, 800, 600)
+	s2.Target, _ = fakeTarget(t, 640, 480)
+	vp.UsingSessions = true
+	vp.TCPListeningURL = deadAddress(t)
+	vp.Sessions().SetSession("s1", s1)
+	vp.Sessions().SetSession("s2", s2)
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	t.Cleanup(func() { vp.Shutdown(context.Background()) })
+}
+
+func TestTcpSessionListenAddr(t *testing.T) {
+	vp := &VncProxy{}
+	s1 := &VncSession{Type: SessionTypeProxyPass, ListenAddr: deadAddress(t)}
+	s2 := &VncSession{Type: SessionTypeProxyPass}
+	startRoutingProxy(t, vp, s1, s2)
+
+	if cc := connectViewer(t, s1.ListenAddr); cc.FrameBufferWidth != 800 {
+		t.Errorf("unexpected screen width on the session's port: %d", cc.FrameBufferWidth)
+	}
+
+	// sessions added later get their listener right away, & lose it when removed
+	s3 := &VncSession{Target: s2.Target, Type: SessionTypeProxyPass, ListenAddr: deadAddress(t)}
+	vp.Sessions().SetSession("s3", s3)
+	if cc := connectViewer(t, s3.ListenAddr); cc.FrameBufferWidth != 640 {
+		t.Errorf("unexpected screen width on the added session's port: %d", cc.FrameBufferWidth)
+	}
+	vp.Sessions().DeleteSession("s3")
+	if nc, err := net.Dial("tcp", s3.ListenAddr); err == nil {
+		nc.Close()
+		t.Errorf("the listener of a removed session is still open")
+	}
+}
+
+func TestTcpSessionByPassword(t *testing.T) {
+	vp := &VncProxy{}
+	startRoutingProxy(t, vp, &VncSession{Type: SessionTypeProxyPass, ViewerPassword: "first"},
+		&VncSession{Type: SessionTypeProxyPass, ViewerPassword: "second"})
+
+	for password, width := range map[string]uint16{"first": 800, "second": 640} {
+		nc, err := net.Dial("tcp", vp.TCPListeningURL)
+		if err != nil {
+			t.Fatalf("error connecting to proxy: %v", err)
+		}
+		cc, err := handshakeWithPassword(t, nc, password)
+		if err != nil {
+			t.Errorf("password %q was rejected: %v", password, err)
+			continue
+		}
+		if cc.FrameBufferWidth != width {
+			t.Errorf("password %q reached a screen of width %d", password, cc.FrameBufferWidth)
+		}
+		cc.Close()
+	}
+
+	if err := connectWithPassword(t, vp.TCPListeningURL, "other"); err == nil {
+		t.Errorf("a password of no session was accepted")
+	}
+}
+
+func TestTcpSessionByServerName(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "vnc.example.com")
+	vp := &VncProxy{TLSCertFile: certFile, TLSKeyFile: keyFile}
+	startRoutingProxy(t, vp, &VncSession{Type: SessionTypeProxyPass},
+		&VncSession{Type: SessionTypeProxyPass, ServerName: "s2.vnc.example.com"})
+
+	nc, err := tls.Dial("tcp", vp.TCPListeningURL, &tls.Config{ServerName: "s2.vnc.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	if cc := handshakeViewer(t, nc); cc.FrameBufferWidth != 640 {
+		t.Errorf("unexpected screen width for the server name: %d", cc.FrameBufferWidth)
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// certReloader serves a certificate & key pair from disk, the files are checked on every handshake
+// and loaded again when they change, so certificates can be renewed without restarting the proxy
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reloadIfChanged loads the files if their modification time changed since the last load,
+// on failure the previous certificate (if any) is kept, the files may be in the middle of being replaced
+func (r *certReloader) reloadIfChanged() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		logger.Infof("certReloader: loaded new certificate from %s", r.certFile)
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := r.reloadIfChanged(); err != nil {
+		logger.Errorf("certReloader: error reloading certificate %s, keeping the current one: %v", r.certFile, err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cert, nil
+}
+
+// tlsConfig returns the TLS configuration for the proxy's listeners, nil if they are not using TLS
+func (vp *VncProxy) tlsConfig() (*tls.Config, error) {
+	if vp.TLSConfig != nil {
+		return vp.TLSConfig, nil
+	}
+	if vp.TLSCertFile == "" && vp.TLSKeyFile == "" {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(vp.TLSCertFile, vp.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// targetTLSConfig returns the TLS configuration for connecting to target when it uses VeNCrypt
+func (vp *VncProxy) targetTLSConfig(target string) *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if vp.TargetTLSConfig != nil {
+		cfg = vp.TargetTLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate for the given common name & its key to dir
+func writeTestCert(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error encoding key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func certCommonName(t *testing.T, cert *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("error parsing certificate: %v", err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+	cert, _ := reloader.GetCertificate(nil)
+	if name := certCommonName(t, cert); name != "first" {
+		t.Fatalf("unexpected certificate: %s", name)
+	}
+
+	// a renewed certificate is picked up on the next handshake
+	writeTestCert(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	cert, _ = reloader.GetCertificate(nil)
+	if name := certCommonName(t, cert); name != "second" {
+		t.Fatalf("certificate was not reloaded: %s", name)
+	}
+
+	// a broken file keeps the current certificate
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cert, _ = reloader.GetCertificate(nil)
+	if name := certCommonName(t, cert); name != "second" {
+		t.Fatalf("unexpected certificate after a failed reload: %s", name)
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	target, _ := fakeTarget(t, 640, 480)
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy")
+	proxyAddr := deadAddress(t)
+	vp := &VncProxy{
+		TCPListeningURL: proxyAddr,
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		SingleSession:   &VncSession{ID: "dummySession", Target: target, Type: SessionTypeProxyPass},
+	}
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+
+	nc, err := tls.Dial("tcp", proxyAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("error connecting over tls: %v", err)
+	}
+	if cc := handshakeViewer(t, nc); cc.FrameBufferWidth != 640 {
+		t.Errorf("unexpected screen width over tls: %d", cc.FrameBufferWidth)
+	}
+
+	if err := (&VncProxy{TCPListeningURL: deadAddress(t), TLSCertFile: "missing.pem", TLSKeyFile: "missing.key"}).Start(context.Background()); err == nil {
+		t.Errorf("proxy started with a missing certificate")
+	}
+}
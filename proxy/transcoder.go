@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"image"
+	"sync"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+)
+
+// transcoder is used by the exclusive links of sessions with Transcode set: the proxy negotiates the encodings with the target
+// & the viewer on its own, the target's updates are decoded into a framebuffer and encoded again in the pixel format &
+// encodings the viewer asked for (e.g. a viewer without Tight support gets ZRLE or Raw from a target sending Tight)
+type transcoder struct {
+	mutex                sync.Mutex // guards the viewer's side (encoder & desktopSizeSupported)
+	fb                   *framebuffer
+	encoder              *encodings.EncoderState
+	desktopSizeSupported bool
+}
+
+func newTranscoder() *transcoder {
+	return &transcoder{encoder: encodings.NewEncoderState(common.PixelFormat{})}
+}
+
+// targetInit is called with the ServerInit of each connection to the target, the first one is also the viewer's ServerInit.
+// a reconnected target may use another pixel format & starts new zlib streams, the viewer's side isn't changed
+func (t *transcoder) targetInit(initMsg *common.ServerInit) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.fb == nil {
+		t.fb = newFramebuffer(initMsg.FBWidth, initMsg.FBHeight, initMsg.PixelFormat)
+		t.encoder.SetPixelFormat(initMsg.PixelFormat)
+		return
+	}
+	t.fb.reset(initMsg.PixelFormat)
+	t.fb.resize(initMsg.FBWidth, initMsg.FBHeight)
+}
+
+// setPixelFormat & setEncodings take the viewer's messages, which are not passed on to the target
+func (t *transcoder) setPixelFormat(pf common.PixelFormat) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.encoder.SetPixelFormat(pf)
+}
+
+func (t *transcoder) setEncodings(encs []common.EncodingType) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.encoder.SetEncodings(encs)
+	t.desktopSizeSupported = t.encoder.Supports(common.EncDesktopSizePseudo)
+}
+
+func (t *transcoder) setColorMapEntries(msg *client.MsgSetColorMapEntries) {
+	t.fb.setColorMapEntries(msg.FirstColor, msg.Colors)
+}
+
+// update draws an update of the target into the framebuffer, and returns the update for the viewer: the changed areas
+// encoded for the viewer. a desktop size change is passed on to viewers supporting it (sconn gets the new size),
+// other viewers keep getting their original part of the screen
+func (t *transcoder) update(msg *client.MsgFramebufferUpdate, sconn *server.ServerConn) ([]byte, error) {
+	changed := []image.Rectangle{}
+	resized := false
+	for i := range msg.Rectangles {
+		rect := &msg.Rectangles[i]
+		if rect.Enc == nil || rect.Enc.Type() == int32(common.EncLastRectPseudo) {
+			break
+		}
+		if rect.Enc.Type() == int32(common.EncDesktopSizePseudo) {
+			t.fb.resize(rect.Width, rect.Height)
+			resized = true
+			continue
+		}
+		if area := t.fb.applyRect(rect); !area.Empty() {
+			changed = append(changed, area)
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	bounds := t.fb.Bounds()
+	viewerBounds := image.Rect(0, 0, int(sconn.Width()), int(sconn.Height()))
+	header := &bytes.Buffer{}
+	numRects := 0
+	if resized {
+		changed = []image.Rectangle{bounds}
+		if t.desktopSizeSupported {
+			sconn.SetWidth(uint16(bounds.Dx()))
+			sconn.SetHeight(uint16(bounds.Dy()))
+			viewerBounds = bounds
+			writeRectHeader(header, bounds, int32(common.EncDesktopSizePseudo))
+			numRects++
+		} else {
+			logger.Warnf("transcoder: target desktop resized to %dx%d, the viewer doesn't support resizing", bounds.Dx(), bounds.Dy())
+		}
+	}
+
+	enc := t.encoder.Encoder()
+	rects := []image.Rectangle{}
+	for _, area := range changed {
+		if area = area.Intersect(viewerBounds); !area.Empty() {
+			rects = append(rects, t.encoder.SplitRect(enc, area)...)
+		}
+	}
+	numRects += len(rects)
+
+	buf := &bytes.Buffer{}
+	writeUpdateHeader(buf, uint16(numRects))
+	buf.Write(header.Bytes())
+	if err := t.fb.writeRects(buf, t.encoder, enc, rects); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
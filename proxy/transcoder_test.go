@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/encodings"
+)
+
+// updateCollector passes on the updates a viewer receives
+type updateCollector struct {
+	updates chan *client.MsgFramebufferUpdate
+}
+
+func (u *updateCollector) Consume(seg *common.RfbSegment) error {
+	if msg, ok := seg.Message.(*client.MsgFramebufferUpdate); ok && seg.SegmentType == common.SegmentFullyParsedServerMessage {
+		u.updates <- msg
+	}
+	return nil
+}
+
+func TestTranscodingSession(t *testing.T) {
+	target, targetConns := fakeTarget(t, 16, 8)
+	vp := &VncProxy{
+		TCPListeningURL: deadAddress(t),
+		SingleSession:   &VncSession{ID: "dummySession", Target: target, Type: SessionTypeProxyPass, Transcode: true},
+	}
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	defer vp.Shutdown(context.Background())
+
+	// a viewer which only supports ZRLE, using rgb565
+	nc, err := net.Dial("tcp", vp.TCPListeningURL)
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	cc := handshakeViewer(t, nc)
+	collector := &updateCollector{updates: make(chan *client.MsgFramebufferUpdate, 1)}
+	cc.Listeners.AddListener(collector)
+	rgb565 := &common.PixelFormat{BPP: 16, Depth: 16, TrueColor: 1, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+	if err := cc.SetPixelFormat(rgb565); err != nil {
+		t.Fatalf("error setting pixel format: %v", err)
+	}
+	if err := cc.SetEncodings([]common.IEncoding{&encodings.ZRLEEncoding{}}); err != nil {
+		t.Fatalf("error setting encodings: %v", err)
+	}
+	cc.FramebufferUpdateRequest(false, 0, 0, 16, 8)
+
+	// the target is asked for the proxy's encodings, the viewer's pixel format & encodings are not passed on
+	tc := <-targetConns
+	tc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(tc, header); err != nil || header[0] != byte(common.SetEncodingsMsgType) {
+		t.Fatalf("expected a SetEncodings message from the proxy: %v, %v", header, err)
+	}
+	encs := make([]int32, binary.BigEndian.Uint16(header[2:]))
+	binary.Read(tc, binary.BigEndian, encs)
+	hasTight := false
+	for _, enc := range encs {
+		hasTight = hasTight || enc == int32(common.EncTight)
+	}
+	if !hasTight {
+		t.Fatalf("the proxy didn't ask the target for tight: %v", encs)
+	}
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(tc, request); err != nil || request[0] != byte(common.FramebufferUpdateRequestMsgType) {
+		t.Fatalf("expected the viewer's update request: %v, %v", request, err)
+	}
+
+	// a tight fill rect of the whole screen
+	tc.Write([]byte{byte(common.FramebufferUpdate), 0, 0, 1})
+	binary.Write(tc, binary.BigEndian, []uint16{0, 0, 16, 8})
+	binary.Write(tc, binary.BigEndian, int32(common.EncTight))
+	tc.Write([]byte{encodings.TightFill << 4, 0, 0xFF, 0})
+
+	var update *client.MsgFramebufferUpdate
+	select {
+	case update = <-collector.updates:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the viewer got no update")
+	}
+	fb := encodings.NewFramebuffer(16, 8, *rgb565)
+	for i := range update.Rectangles {
+		rect := &update.Rectangles[i]
+		if rect.Enc.Type() != int32(common.EncZRLE) {
+			t.Fatalf("unexpected encoding for the viewer: %d", rect.Enc.Type())
+		}
+		if _, err := fb.ApplyRect(rect); err != nil {
+			t.Fatalf("error applying the viewer's rect: %v", err)
+		}
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			if c := fb.RGBA().RGBAAt(x, y); c != (color.RGBA{0, 0xFF, 0, 0xFF}) {
+				t.Fatalf("unexpected color at %v: %v", image.Pt(x, y), c)
+			}
+		}
+	}
+}
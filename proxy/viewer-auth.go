@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/amitbet/vncproxy/server"
+)
+
+// vnc authentication only uses the first 8 characters of a password, so tokens are exactly that long
+const (
+	viewerTokenLength     = 8
+	viewerTokenAlphabet   = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	defaultViewerTokenTTL = 5 * time.Minute
+)
+
+var errViewerAuthFailed = errors.New(server.AUTH_FAIL)
+
+// NewViewerToken creates a one-time password for the session, it is used as the vnc password of a single viewer
+// and expires after ttl (defaults to 5 minutes) if it wasn't used
+func (s *VncSession) NewViewerToken(ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 {
+		ttl = defaultViewerTokenTTL
+	}
+	token := make([]byte, viewerTokenLength)
+	for i := range token {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(viewerTokenAlphabet))))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		token[i] = viewerTokenAlphabet[n.Int64()]
+	}
+	expires := time.Now().Add(ttl)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.viewerTokens == nil {
+		s.viewerTokens = make(map[string]time.Time)
+	}
+	s.viewerTokens[string(token)] = expires
+	s.addEventLocked(EventViewerTokenIssued, "", "expires "+expires.Format(time.RFC3339))
+	return string(token), expires, nil
+}
+
+// useViewerToken reports if the viewer authenticated with one of the session's tokens, which can't be used again
+func (s *VncSession) useViewerToken(creds *server.ViewerCredentials) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for token, expires := range s.viewerTokens {
+		if now.After(expires) {
+			delete(s.viewerTokens, token)
+			continue
+		}
+		if creds.MatchesPassword(token) {
+			delete(s.viewerTokens, token)
+			s.addEventLocked(EventViewerTokenUsed, "", "")
+			return true
+		}
+	}
+	return false
+}
+
+// requiresViewerAuth reports if the viewers need credentials of the session itself
+func (s *VncSession) requiresViewerAuth() bool {
+	return s.ViewerPassword != "" || s.TokenOnly
+}
+
+// sessionAuthenticator checks the viewers of each session, in order: the session's one-time tokens,
+// the session's ViewerPassword, the proxy's Authenticator and the security types themselves (e.g. ProxyVncPassword)
+type sessionAuthenticator struct {
+	vp *VncProxy
+}
+
+func (a *sessionAuthenticator) RequiresCredentials(sessionId string) bool {
+	vp := a.vp
+	if vp.ProxyVncPassword != "" || len(vp.SecurityHandlers) > 0 {
+		return true
+	}
+	if oa, ok := vp.Authenticator.(server.OptionalAuthenticator); ok {
+		if oa.RequiresCredentials(sessionId) {
+			return true
+		}
+	} else if vp.Authenticator != nil {
+		return true
+	}
+	if sessionId == "" {
+		// a tcp viewer which picks its session by password, see SelectSession
+		if vp.UsingSessions && vp.anySessionRequiresViewerAuth() {
+			return true
+		}
+		sessionId = server.DefaultSessionId
+	}
+	session, err := vp.getProxySession(sessionId)
+	if err != nil || session == nil {
+		return false
+	}
+	return session.requiresViewerAuth()
+}
+
+func (a *sessionAuthenticator) AuthenticateViewer(sessionId string, creds *server.ViewerCredentials) error {
+	vp := a.vp
+	session, err := vp.getProxySession(sessionId)
+	if err != nil || session == nil {
+		// the connection fails later on, but unknown session ids shouldn't be told apart from wrong passwords
+		return errViewerAuthFailed
+	}
+
+	err = a.authenticate(session, creds)
+	if err != nil {
+		session.addEvent(EventViewerAuthFailed, "", err.Error()+" (from "+creds.RemoteAddr+")")
+	}
+	return err
+}
+
+func (a *sessionAuthenticator) authenticate(session *VncSession, creds *server.ViewerCredentials) error {
+	vp := a.vp
+	if creds.HasCredentials() && session.useViewerToken(creds) {
+		return nil
+	}
+	switch {
+	case session.TokenOnly:
+		return errViewerAuthFailed
+	case session.ViewerPassword != "":
+		if !creds.MatchesPassword(session.ViewerPassword) {
+			return errViewerAuthFailed
+		}
+		return nil
+	case vp.Authenticator != nil:
+		return vp.Authenticator.AuthenticateViewer(session.ID, creds)
+	}
+	return creds.Check()
+}
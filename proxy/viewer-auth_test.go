@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/server"
+)
+
+// connectWithPassword runs the viewer handshake using vnc authentication, returning the handshake's error
+func connectWithPassword(t *testing.T, addr string, password string) error {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to proxy: %v", err)
+	}
+	cc, err := client.NewClientConn(nc, &client.ClientConfig{Auth: []client.ClientAuth{&client.PasswordAuth{Password: password}}})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	if err := cc.Connect(); err != nil {
+		return err
+	}
+	cc.Close()
+	return nil
+}
+
+func startAuthProxy(t *testing.T, vp *VncProxy) string {
+	target, _ := fakeTarget(t, 640, 480)
+	vp.TCPListeningURL = deadAddress(t)
+	vp.SingleSession.ID = "dummySession"
+	vp.SingleSession.Target = target
+	vp.SingleSession.Type = SessionTypeProxyPass
+	if err := vp.Start(context.Background()); err != nil {
+		t.Fatalf("error starting proxy: %v", err)
+	}
+	t.Cleanup(func() { vp.Shutdown(context.Background()) })
+	return vp.TCPListeningURL
+}
+
+func TestViewerPassword(t *testing.T) {
+	session := &VncSession{ViewerPassword: "session"}
+	addr := startAuthProxy(t, &VncProxy{ProxyVncPassword: "global", SingleSession: session})
+
+	if err := connectWithPassword(t, addr, "global"); err == nil {
+		t.Errorf("the proxy's password was accepted for a session with its own password")
+	}
+	if err := connectWithPassword(t, addr, "session"); err != nil {
+		t.Errorf("the session's password was rejected: %v", err)
+	}
+
+	failed := 0
+	for _, e := range session.Events() {
+		if e.Type == EventViewerAuthFailed {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected a single failed authentication event, got %d", failed)
+	}
+}
+
+func TestViewerTokens(t *testing.T) {
+	session := &VncSession{ViewerPassword: "session", TokenOnly: true}
+	addr := startAuthProxy(t, &VncProxy{SingleSession: session})
+
+	if err := connectWithPassword(t, addr, "session"); err == nil {
+		t.Errorf("a password was accepted by a token only session")
+	}
+
+	token, _, err := session.NewViewerToken(time.Minute)
+	if err != nil {
+		t.Fatalf("error creating token: %v", err)
+	}
+	if err := connectWithPassword(t, addr, token); err != nil {
+		t.Errorf("the token was rejected: %v", err)
+	}
+	if err := connectWithPassword(t, addr, token); err == nil {
+		t.Errorf("the token was accepted twice")
+	}
+
+	expired, _, _ := session.NewViewerToken(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if err := connectWithPassword(t, addr, expired); err == nil {
+		t.Errorf("an expired token was accepted")
+	}
+}
+
+func TestViewerAuthenticator(t *testing.T) {
+	var calledFor string
+	authenticator := server.ViewerAuthenticatorFunc(func(sessionId string, creds *server.ViewerCredentials) error {
+		calledFor = sessionId
+		if !creds.MatchesPassword("verified") {
+			return errors.New("unknown viewer")
+		}
+		return nil
+	})
+	addr := startAuthProxy(t, &VncProxy{Authenticator: authenticator, SingleSession: &VncSession{}})
+
+	if err := connectWithPassword(t, addr, "verified"); err != nil {
+		t.Errorf("the verified password was rejected: %v", err)
+	}
+	if calledFor != "dummySession" {
+		t.Errorf("the authenticator was called for session %q", calledFor)
+	}
+	if err := connectWithPassword(t, addr, "other"); err == nil {
+		t.Errorf("a password rejected by the authenticator was accepted")
+	}
+}
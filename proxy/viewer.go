@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/client"
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
+	"github.com/amitbet/vncproxy/server"
+)
+
+// Viewer is a single vnc-client connected to a session through the proxy,
+// together with the upstream connection serving it (nil for replay sessions)
+type Viewer struct {
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	sconn *server.ServerConn
+	cconn *client.ClientConn // guarded by mutex, replaced when the target is reconnected
+
+	mutex         sync.Mutex
+	bytesSent     uint64 // to the viewer
+	bytesReceived uint64 // from the viewer
+	closeOnce     sync.Once
+	closed        bool
+
+	inputPolicy *InputPolicy // applied on top of the session's policy, guarded by mutex
+	input       *inputFilter
+	send        func(msg []byte) error // injects a server message into the viewer's stream, guarded by mutex, nil if not supported
+	// sends a client message to the target on behalf of the viewer, guarded by mutex, nil if not supported
+	sendToTarget func(msg common.ClientMessage) error
+
+	// input passed to the target which is still pressed (releases by keysym & the button mask), guarded by mutex
+	pressedKeys map[uint32]common.ClientMessage
+	pointer     server.MsgPointerEvent
+}
+
+// ViewerInfo is a point in time snapshot of a viewer's state
+type ViewerInfo struct {
+	ID            string
+	RemoteAddr    string
+	ConnectedAt   time.Time
+	BytesSent     uint64
+	BytesReceived uint64
+	InputPolicy   *InputPolicy
+}
+
+func newViewer(sconn *server.ServerConn) *Viewer {
+	id, err := newRandomId()
+	if err != nil {
+		id = sconn.RemoteAddr()
+	}
+	return &Viewer{
+		ID:          id,
+		RemoteAddr:  sconn.RemoteAddr(),
+		ConnectedAt: time.Now(),
+		sconn:       sconn,
+		input:       newInputFilter(),
+	}
+}
+
+func (v *Viewer) Info() ViewerInfo {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return ViewerInfo{
+		ID:            v.ID,
+		RemoteAddr:    v.RemoteAddr,
+		ConnectedAt:   v.ConnectedAt,
+		BytesSent:     v.bytesSent,
+		BytesReceived: v.bytesReceived,
+		InputPolicy:   v.inputPolicy,
+	}
+}
+
+// SetInputPolicy limits the input this viewer can send, on top of the session's policy (nil removes the viewer's limits)
+func (v *Viewer) SetInputPolicy(policy *InputPolicy) {
+	v.mutex.Lock()
+	v.inputPolicy = policy
+	v.mutex.Unlock()
+}
+
+func (v *Viewer) getInputPolicy() *InputPolicy {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.inputPolicy
+}
+
+func (v *Viewer) countSent(n int) {
+	v.mutex.Lock()
+	v.bytesSent += uint64(n)
+	v.mutex.Unlock()
+}
+
+func (v *Viewer) countReceived(n int) {
+	v.mutex.Lock()
+	v.bytesReceived += uint64(n)
+	v.mutex.Unlock()
+}
+
+// close shuts down both the viewer connection and the upstream connection (if any)
+func (v *Viewer) close() {
+	v.closeOnce.Do(func() {
+		v.mutex.Lock()
+		cconn := v.cconn
+		v.closed = true
+		v.mutex.Unlock()
+
+		if cconn != nil {
+			cconn.Close()
+		}
+		v.sconn.Close()
+	})
+}
+
+// setUpstream replaces the viewer's connection to the target (after a reconnect),
+// if the viewer was already closed the new connection is closed right away
+func (v *Viewer) setUpstream(cconn *client.ClientConn) {
+	v.mutex.Lock()
+	v.cconn = cconn
+	closed := v.closed
+	v.mutex.Unlock()
+
+	if closed && cconn != nil {
+		cconn.Close()
+	}
+}
+
+// setSender sets the function used to inject server messages (e.g. warnings) into the stream to the viewer
+func (v *Viewer) setSender(send func(msg []byte) error) {
+	v.mutex.Lock()
+	v.send = send
+	v.mutex.Unlock()
+}
+
+// setTargetSender sets the function used to send client messages to the target outside of the viewer's own messages
+func (v *Viewer) setTargetSender(send func(msg common.ClientMessage) error) {
+	v.mutex.Lock()
+	v.sendToTarget = send
+	v.mutex.Unlock()
+}
+
+// trackInput keeps track of the keys & buttons the viewer holds down at the target, called for input passed to the target
+func (v *Viewer) trackInput(msg common.ClientMessage) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	switch m := msg.(type) {
+	case *server.MsgKeyEvent:
+		if m.Down == 0 {
+			delete(v.pressedKeys, uint32(m.Key))
+			return
+		}
+		if v.pressedKeys == nil {
+			v.pressedKeys = make(map[uint32]common.ClientMessage)
+		}
+		v.pressedKeys[uint32(m.Key)] = &server.MsgKeyEvent{Key: m.Key}
+	case *server.MsgClientQemuExtendedKey:
+		if m.IsDown == 0 {
+			delete(v.pressedKeys, m.KeySym)
+			return
+		}
+		if v.pressedKeys == nil {
+			v.pressedKeys = make(map[uint32]common.ClientMessage)
+		}
+		v.pressedKeys[m.KeySym] = &server.MsgClientQemuExtendedKey{SubType: m.SubType, KeySym: m.KeySym, KeyCode: m.KeyCode}
+	case *server.MsgPointerEvent:
+		v.pointer = *m
+	}
+}
+
+// releaseInput sends the target releases for all keys & buttons the viewer still holds down
+// (e.g. when it loses the floor in the middle of a key combination or a drag)
+func (v *Viewer) releaseInput() {
+	v.mutex.Lock()
+	send := v.sendToTarget
+	msgs := []common.ClientMessage{}
+	for _, msg := range v.pressedKeys {
+		msgs = append(msgs, msg)
+	}
+	if v.pointer.Mask != 0 {
+		msgs = append(msgs, &server.MsgPointerEvent{X: v.pointer.X, Y: v.pointer.Y})
+	}
+	v.pressedKeys = nil
+	v.pointer.Mask = 0
+	v.mutex.Unlock()
+
+	if send == nil {
+		return
+	}
+	for _, msg := range msgs {
+		if err := send(msg); err != nil {
+			logger.Errorf("Viewer.releaseInput: error writing to the target of viewer %s: %v", v.ID, err)
+			return
+		}
+	}
+}
+
+// warn rings the viewer's bell and, if withCutText is set, sends text as server cut text
+func (v *Viewer) warn(text string, withCutText bool) {
+	v.mutex.Lock()
+	send := v.send
+	v.mutex.Unlock()
+	if send == nil {
+		return
+	}
+
+	msg := []byte{byte(common.Bell)}
+	if withCutText {
+		msg = append(msg, serverCutTextMsg(text)...)
+	}
+	if err := send(msg); err != nil {
+		logger.Errorf("Viewer.warn: error writing to viewer %s: %v", v.ID, err)
+	}
+}
+
+func sortViewerInfo(list []ViewerInfo) {
+	sort.Slice(list, func(i, j int) bool { return list[i].ConnectedAt.Before(list[j].ConnectedAt) })
+}
@@ -1,27 +1,466 @@
 package proxy
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/server"
+)
+
+var ErrViewerNotFound = errors.New("viewer not found")
+
 type SessionStatus int
 type SessionType int
 
 const (
-	SessionStatusInit SessionStatus = iota
-	SessionStatusActive
-	SessionStatusError
+	SessionStatusInit         SessionStatus = iota // registered, no viewer has connected yet
+	SessionStatusConnecting                        // dialing the target vnc server
+	SessionStatusHandshaking                       // running the RFB handshake with the target
+	SessionStatusActive                            // at least one viewer is connected & proxied
+	SessionStatusIdle                              // all viewers have left, the session can be joined again
+	SessionStatusClosing                           // the target went away, connections are being torn down
+	SessionStatusClosed                            // all connections were closed after the target went away (or a time limit was reached)
+	SessionStatusFailed                            // connecting to the target failed, see StatusReason
+	SessionStatusReconnecting                      // the target connection dropped, viewers are kept while it is redialed
 )
 
+// SessionStatusError is kept for compatibility, it is the same as SessionStatusFailed
+const SessionStatusError = SessionStatusFailed
+
 const (
 	SessionTypeRecordingProxy SessionType = iota
 	SessionTypeReplayServer
 	SessionTypeProxyPass
 )
 
+func (st SessionStatus) String() string {
+	switch st {
+	case SessionStatusInit:
+		return "init"
+	case SessionStatusConnecting:
+		return "connecting"
+	case SessionStatusHandshaking:
+		return "handshaking"
+	case SessionStatusActive:
+		return "active"
+	case SessionStatusIdle:
+		return "idle"
+	case SessionStatusClosing:
+		return "closing"
+	case SessionStatusClosed:
+		return "closed"
+	case SessionStatusFailed:
+		return "failed"
+	case SessionStatusReconnecting:
+		return "reconnecting"
+	}
+	return ""
+}
+
+func (st SessionType) String() string {
+	switch st {
+	case SessionTypeRecordingProxy:
+		return "recordingProxy"
+	case SessionTypeReplayServer:
+		return "replayServer"
+	case SessionTypeProxyPass:
+		return "proxyPass"
+	}
+	return ""
+}
+
+// ParseSessionType converts the name of a session type (as returned by String) back to a SessionType
+func ParseSessionType(name string) (SessionType, error) {
+	for _, st := range []SessionType{SessionTypeRecordingProxy, SessionTypeReplayServer, SessionTypeProxyPass} {
+		if st.String() == name {
+			return st, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown session type: %s", name)
+}
+
 type VncSession struct {
 	Target         string
 	TargetHostname string
 	TargetPort     string
 	TargetPassword string
+	TargetUsername string // for targets logging in with an account: VeNCrypt Plain, Apple Remote Desktop, UltraVNC MS-Logon
 	ID             string
 	Status         SessionStatus
 	Type           SessionType
 	ReplayFilePath string
+	Shared         bool         // all viewers share a single connection to the target (otherwise each viewer gets its own)
+	Transcode      bool         // encodings are negotiated with the target & the viewer separately, the target's updates are decoded & encoded again for the viewer (shared sessions always do)
+	InputPolicy    *InputPolicy // limits the input all viewers can send to the target, nil allows everything (use SetInputPolicy on live sessions)
+	// only the viewer holding the floor can send keyboard & pointer input, see RequestFloor / GrantFloor
+	ControlFloor     bool
+	FloorIdleTimeout time.Duration    // the floor is released when its holder sends no input for this long, 0 = never
+	Reconnect        *ReconnectPolicy // redial the target when its connection drops instead of disconnecting the viewers, nil = disabled
+	// candidate targets (used instead of Target when set), one is picked by TargetStrategy and the others are fallbacks
+	Targets             []string
+	TargetStrategy      TargetStrategy
+	HealthCheckInterval time.Duration // how often Targets are probed with an RFB handshake, 0 = no periodic checks
+	IdleTimeout         time.Duration // the viewers are disconnected when none of them sent keyboard / pointer input for this long, 0 = never
+	MaxDuration         time.Duration // the viewers are disconnected this long after the first of them joined, 0 = no limit
+	LimitWarning        time.Duration // how long before IdleTimeout / MaxDuration the viewers are warned (bell & cut text), 0 = no warning
+	ViewerPassword      string        // the viewers' vnc password for this session (instead of the proxy's ProxyVncPassword), empty = not set
+	TokenOnly           bool          // viewers can only connect with a one-time password from NewViewerToken
+	ListenAddr          string        // a tcp address (e.g. ":5901") on which raw RFB viewers connect to this session only, empty = none
+	ServerName          string        // tcp viewers asking for this TLS server name (SNI) connect to this session
+	// the vnc server connects to the proxy's reverse listener instead of being dialed (x11vnc -connect): its ID string
+	// (e.g. "ID:1234") or, for servers sending none, its ip address. used when the session has no Target.
+	// anyone who can reach the reverse listener & knows (or guesses) the ID, or connects from that ip address, becomes
+	// the session's target & sees the viewers' input: set ReverseSecret and/or VncProxy.ReverseTLSConfig when the
+	// listener is reachable from untrusted networks
+	ReverseID string
+	// when set, the vnc server must send it after its ID string: "<ReverseID>:<ReverseSecret>" (e.g. x11vnc
+	// -connect repeater=ID:1234:secret+host:port), servers matched by their ip address are not accepted
+	ReverseSecret string
+	// Target is an UltraVNC repeater, which is asked for the vnc server with this ID ("ID:1234", or "host:port"
+	// for repeaters in mode I). empty = Target is the vnc server itself
+	RepeaterID string
+
+	// runtime state, guarded by mutex (use Info() to read it)
+	mutex           sync.RWMutex
+	statusReason    string
+	createdAt       time.Time
+	statusChangedAt time.Time
+	activeSince     time.Time
+	closedAt        time.Time
+	lastActivity    time.Time
+	viewers         map[string]*Viewer
+	reverseConns    chan net.Conn // connections from the vnc server waiting for viewers, see ReverseID
+	bytesFromTarget uint64
+	bytesToTarget   uint64
+	events          []SessionEvent
+	floorHolder     string
+	floorHeldSince  time.Time
+	floorLastInput  time.Time
+	floorRequests   []string
+	floorTimer      *time.Timer
+	floorRevoked    map[string]bool // viewers the floor was revoked from, they don't take a free floor until they request it
+	floorReleases   []*Viewer       // previous floor holders whose pressed input has to be released at the target
+	targetPool      *targetPool
+	lastInput       time.Time
+	limitsSince     time.Time
+	limitsTimer     *time.Timer
+	limitWarnedFor  time.Time
+	viewerTokens    map[string]time.Time // unused one-time passwords & their expiry
+
+	upstreamMutex sync.Mutex // held while the shared upstream is being connected
+	upstream      *sharedUpstream
+}
+
+// SessionInfo is a point in time snapshot of a session's state
+type SessionInfo struct {
+	ID              string
+	Type            SessionType
+	Target          string
+	Status          SessionStatus
+	StatusReason    string
+	CreatedAt       time.Time
+	StatusChangedAt time.Time
+	ActiveSince     time.Time
+	ClosedAt        time.Time
+	LastActivity    time.Time
+	LastInput       time.Time // last keyboard / pointer input from any viewer, only tracked when the session has limits
+	Viewers         []ViewerInfo
+	BytesFromTarget uint64
+	BytesToTarget   uint64
+	Targets         []TargetInfo // state of the candidate targets, empty when the session has a single target
+	ReverseTargets  int          // connections from the vnc server waiting for viewers (ReverseID sessions only)
+}
+
+// TargetAddress returns the address of the vnc server behind this session (host:port or a unix socket path)
+func (s *VncSession) TargetAddress() string {
+	if s.TargetHostname != "" && s.TargetPort != "" {
+		return s.TargetHostname + ":" + s.TargetPort
+	}
+	return s.Target
+}
+
+// Info returns a snapshot of the session state, including the connected viewers and byte counters
+func (s *VncSession) Info() *SessionInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	info := &SessionInfo{
+		ID:              s.ID,
+		Type:            s.Type,
+		Target:          s.TargetAddress(),
+		Status:          s.Status,
+		StatusReason:    s.statusReason,
+		CreatedAt:       s.createdAt,
+		StatusChangedAt: s.statusChangedAt,
+		ActiveSince:     s.activeSince,
+		ClosedAt:        s.closedAt,
+		LastActivity:    s.lastActivity,
+		LastInput:       s.lastInput,
+		Viewers:         []ViewerInfo{},
+		BytesFromTarget: s.bytesFromTarget,
+		BytesToTarget:   s.bytesToTarget,
+		ReverseTargets:  len(s.reverseConns),
+	}
+	for _, v := range s.viewers {
+		info.Viewers = append(info.Viewers, v.Info())
+	}
+	sortViewerInfo(info.Viewers)
+	if s.targetPool != nil {
+		info.Targets = s.targetPool.Info()
+	}
+	return info
+}
+
+// markCreated stamps the creation time once, sessions may be created as literals so this is done lazily
+func (s *VncSession) markCreated() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.createdAt.IsZero() {
+		s.createdAt = time.Now()
+		s.statusChangedAt = s.createdAt
+	}
+}
+
+func (s *VncSession) setStatus(status SessionStatus, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setStatusLocked(status, reason)
+}
+
+func (s *VncSession) setStatusLocked(status SessionStatus, reason string) {
+	now := time.Now()
+	if s.createdAt.IsZero() {
+		s.createdAt = now
+	}
+	switch status {
+	case SessionStatusActive:
+		if s.Status != SessionStatusActive {
+			s.activeSince = now
+		}
+		s.closedAt = time.Time{}
+	case SessionStatusClosed, SessionStatusFailed:
+		s.closedAt = now
+	}
+	s.Status = status
+	s.statusReason = reason
+	s.statusChangedAt = now
+}
+
+// addViewer registers a viewer connection, it is done before connecting upstream so a disconnect on either side is never missed
+func (s *VncSession) addViewer(v *Viewer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.viewers == nil {
+		s.viewers = make(map[string]*Viewer)
+	}
+	s.viewers[v.ID] = v
+	s.lastActivity = time.Now()
+	s.addEventLocked(EventViewerConnected, v.ID, v.RemoteAddr)
+	if len(s.viewers) == 1 {
+		s.startLimitsLocked()
+	}
+}
+
+func (s *VncSession) hasViewer(viewerId string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.viewers[viewerId]
+	return ok
+}
+
+func (s *VncSession) addEvent(eventType string, viewerId string, detail string) {
+	s.mutex.Lock()
+	s.addEventLocked(eventType, viewerId, detail)
+	s.mutex.Unlock()
+}
+
+// failViewer drops a viewer whose setup failed and marks the session as failed
+func (s *VncSession) failViewer(v *Viewer, err error) {
+	s.detachViewer(v, err.Error(), false)
+	s.setStatus(SessionStatusFailed, err.Error())
+}
+
+// detachViewer removes a viewer and closes both sides of its connection,
+// it is called when either the viewer or the target disconnects and is safe to call more than once
+func (s *VncSession) detachViewer(v *Viewer, reason string, byTarget bool) {
+	s.mutex.Lock()
+	if _, ok := s.viewers[v.ID]; !ok {
+		s.mutex.Unlock()
+		return
+	}
+	s.dropFloorViewerLocked(v.ID)
+	delete(s.viewers, v.ID)
+	s.addEventLocked(EventViewerDisconnected, v.ID, reason)
+	if byTarget {
+		s.setStatusLocked(SessionStatusClosing, reason)
+	}
+	s.mutex.Unlock()
+
+	//a shared target stays connected, so a leaving floor holder's keys are released first
+	s.sendFloorReleases()
+	v.close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.viewers) > 0 {
+		return
+	}
+	s.stopLimitsLocked()
+	if byTarget {
+		s.setStatusLocked(SessionStatusClosed, reason)
+	} else {
+		s.setStatusLocked(SessionStatusIdle, reason)
+	}
+}
+
+// closeViewers disconnects all viewers (and their target connections), leaving the session closed
+func (s *VncSession) closeViewers(reason string) {
+	s.mutex.Lock()
+	viewers := s.currentViewersLocked()
+	s.mutex.Unlock()
+	s.detachViewers(viewers, reason)
+}
+
+func (s *VncSession) detachViewers(viewers []*Viewer, reason string) {
+	for _, v := range viewers {
+		s.detachViewer(v, reason, true)
+	}
+}
+
+func (s *VncSession) countFromTarget(n int) {
+	s.mutex.Lock()
+	s.bytesFromTarget += uint64(n)
+	s.lastActivity = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *VncSession) countToTarget(n int) {
+	s.mutex.Lock()
+	s.bytesToTarget += uint64(n)
+	s.lastActivity = time.Now()
+	s.mutex.Unlock()
+}
+
+// sharedUpstreamFor returns the session's shared upstream connection, connecting a new one (using connect) if there is none
+func (s *VncSession) sharedUpstreamFor(connect func() (*sharedUpstream, error)) (*sharedUpstream, error) {
+	s.upstreamMutex.Lock()
+	defer s.upstreamMutex.Unlock()
+
+	if s.upstream != nil && !s.upstream.isClosed() {
+		return s.upstream, nil
+	}
+	upstream, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	s.upstream = upstream
+	return upstream, nil
+}
+
+// SetInputPolicy changes the input policy of all viewers of the session, it takes effect on live connections
+func (s *VncSession) SetInputPolicy(policy *InputPolicy) {
+	s.mutex.Lock()
+	s.InputPolicy = policy
+	s.mutex.Unlock()
+}
+
+func (s *VncSession) getInputPolicy() *InputPolicy {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.InputPolicy
+}
+
+// SetViewerInputPolicy limits the input of a single connected viewer, on top of the session's policy
+func (s *VncSession) SetViewerInputPolicy(viewerId string, policy *InputPolicy) error {
+	s.mutex.RLock()
+	v, ok := s.viewers[viewerId]
+	s.mutex.RUnlock()
+	if !ok {
+		return ErrViewerNotFound
+	}
+	v.SetInputPolicy(policy)
+	return nil
+}
+
+// allowClientMessage reports if a message sent by the viewer may be passed on to the target
+// (input counts as activity for the idle timeout even if the viewer isn't allowed to send it)
+func (s *VncSession) allowClientMessage(v *Viewer, msg common.ClientMessage) bool {
+	isInput := false
+	switch msg.(type) {
+	case *server.MsgKeyEvent, *server.MsgClientQemuExtendedKey, *server.MsgPointerEvent:
+		isInput = true
+		if s.hasLimits() {
+			s.markInput()
+		}
+	}
+	if !v.input.allow(msg, s.getInputPolicy(), v.getInputPolicy()) {
+		return false
+	}
+	if isInput {
+		if !s.floorAllowsInput(v) {
+			return false
+		}
+		v.trackInput(msg)
+	}
+	return true
+}
+
+// allowClipboardFromTarget reports if the target's cut text may be passed on to the viewer
+func (s *VncSession) allowClipboardFromTarget(v *Viewer) bool {
+	return allowsClipboardFromTarget(s.getInputPolicy(), v.getInputPolicy())
+}
+
+// getTargetPool returns the pool of candidate targets, creating it (and starting the health checks) on first use
+func (s *VncSession) getTargetPool() *targetPool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.targetPool == nil {
+		s.targetPool = newTargetPool(s.Targets, s.TargetStrategy)
+		if s.HealthCheckInterval > 0 {
+			go s.targetPool.runHealthChecks(s.HealthCheckInterval)
+		}
+	}
+	return s.targetPool
+}
+
+// stopHealthChecks is called when the session is removed from the registry
+func (s *VncSession) stopHealthChecks() {
+	s.mutex.Lock()
+	pool := s.targetPool
+	s.mutex.Unlock()
+	if pool != nil {
+		pool.close()
+	}
+}
+
+// dialTarget connects to the session's target & runs handshake on the connection,
+// picking one of the candidate targets when there are several (the next one is tried if the handshake fails)
+func (s *VncSession) dialTarget(handshake func(nc net.Conn, target string) error) (net.Conn, string, error) {
+	if len(s.Targets) > 0 {
+		return s.getTargetPool().dial(handshake)
+	}
+
+	var nc net.Conn
+	var err error
+	target := s.TargetAddress()
+	if s.ReverseID != "" && target == "" {
+		nc, err = s.takeReverseConn(reverseConnectTimeout)
+		if err == nil {
+			target = nc.RemoteAddr().String()
+		}
+	} else {
+		nc, err = dialTarget(target, 0)
+	}
+	if err != nil {
+		return nil, target, err
+	}
+	if err := handshake(nc, target); err != nil {
+		nc.Close()
+		return nil, target, err
+	}
+	return nc, target, nil
 }
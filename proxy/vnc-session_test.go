@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/amitbet/vncproxy/server"
+)
+
+func newTestViewer(t *testing.T) *Viewer {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c2.Close() })
+
+	sconn, err := server.NewServerConn(c1, &server.ServerConfig{ClientMessages: server.DefaultClientMessages})
+	if err != nil {
+		t.Fatalf("error creating server conn: %v", err)
+	}
+	return newViewer(sconn)
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	session := &VncSession{ID: "s1", Target: "127.0.0.1:5901"}
+	session.markCreated()
+
+	if info := session.Info(); info.Status != SessionStatusInit || info.CreatedAt.IsZero() {
+		t.Fatalf("unexpected initial state: %+v", info)
+	}
+
+	v1 := newTestViewer(t)
+	v2 := newTestViewer(t)
+	session.addViewer(v1)
+	session.addViewer(v2)
+	session.setStatus(SessionStatusActive, "")
+	session.countFromTarget(100)
+	session.countToTarget(10)
+
+	info := session.Info()
+	if info.Status != SessionStatusActive || len(info.Viewers) != 2 || info.ActiveSince.IsZero() {
+		t.Fatalf("unexpected active state: %+v", info)
+	}
+	if info.BytesFromTarget != 100 || info.BytesToTarget != 10 {
+		t.Fatalf("unexpected byte counters: %+v", info)
+	}
+
+	// one viewer leaving keeps the session active
+	session.detachViewer(v1, "viewer disconnected", false)
+	session.detachViewer(v1, "viewer disconnected", false)
+	if info := session.Info(); info.Status != SessionStatusActive || len(info.Viewers) != 1 {
+		t.Fatalf("unexpected state after first viewer left: %+v", info)
+	}
+
+	// last viewer leaving makes it idle
+	session.detachViewer(v2, "viewer disconnected", false)
+	if info := session.Info(); info.Status != SessionStatusIdle || len(info.Viewers) != 0 {
+		t.Fatalf("unexpected state after all viewers left: %+v", info)
+	}
+
+	// the target going away closes the session
+	v3 := newTestViewer(t)
+	session.addViewer(v3)
+	session.setStatus(SessionStatusActive, "")
+	session.detachViewer(v3, "target disconnected", true)
+	info = session.Info()
+	if info.Status != SessionStatusClosed || info.StatusReason != "target disconnected" || info.ClosedAt.IsZero() {
+		t.Fatalf("unexpected state after target left: %+v", info)
+	}
+}
@@ -20,6 +20,10 @@ func main() {
 	var targetVncPort = flag.String("targPort", "", "target vnc server port")
 	var targetVncPass = flag.String("targPass", "", "target vnc password")
 	var targetVncHost = flag.String("targHost", "localhost", "target vnc hostname")
+	var targetVncUser = flag.String("targUser", "", "target username, for servers using account logins (VeNCrypt Plain, macOS Screen Sharing, UltraVNC MS-Logon)")
+	var targetCA = flag.String("targCA", "", "CA certificate file (PEM) for verifying a target using VeNCrypt, defaults to the system's roots")
+	var targetCert = flag.String("targCert", "", "client certificate file (PEM) for a target using VeNCrypt")
+	var targetKey = flag.String("targKey", "", "private key file (PEM) for -targCert")
 	var logLevel = flag.String("logLevel", "info", "change logging level")
 
 	flag.Parse()
@@ -52,8 +56,31 @@ func main() {
 	if err != nil {
 		logger.Errorf("error connecting to vnc server: %s", err)
 	}
+	targetTLS, err := client.NewTLSConfig(*targetCA, *targetCert, *targetKey)
+	if err != nil {
+		logger.Errorf("error loading the target certificates: %s", err)
+		return
+	}
+	targetTLS.ServerName = *targetVncHost
+
 	var noauth client.ClientAuthNone
-	authArr := []client.ClientAuth{&client.PasswordAuth{Password: *targetVncPass}, &noauth}
+	vencrypt := &client.VeNCryptAuth{TLSConfig: targetTLS, Username: *targetVncUser, Password: *targetVncPass}
+	authArr := []client.ClientAuth{}
+	// VeNCrypt goes first only when certificates or an account login were given, otherwise the vnc password is preferred
+	preferVeNCrypt := *targetCA != "" || *targetCert != "" || *targetVncUser != ""
+	if preferVeNCrypt {
+		authArr = append(authArr, vencrypt)
+	}
+	if *targetVncUser != "" {
+		authArr = append(authArr,
+			&client.ARDAuth{Username: *targetVncUser, Password: *targetVncPass},
+			&client.MSLogonIIAuth{Username: *targetVncUser, Password: *targetVncPass})
+	}
+	authArr = append(authArr, &client.PasswordAuth{Password: *targetVncPass})
+	if !preferVeNCrypt {
+		authArr = append(authArr, vencrypt)
+	}
+	authArr = append(authArr, &noauth)
 
 	//vncSrvMessagesChan := make(chan common.ServerMessage)
 
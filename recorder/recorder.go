@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
@@ -21,6 +23,9 @@ type Recorder struct {
 	sessionStartWritten bool
 	segmentChan         chan *common.RfbSegment
 	maxWriteSize        int
+	closing             chan struct{}
+	closed              chan struct{}
+	closeOnce           sync.Once
 }
 
 func getNowMillisec() int {
@@ -46,10 +51,17 @@ func NewRecorder(saveFilePath string) (*Recorder, error) {
 
 	//buffer the channel so we don't halt the proxying flow for slow writes when under pressure
 	rec.segmentChan = make(chan *common.RfbSegment, 100)
+	rec.closing = make(chan struct{})
+	rec.closed = make(chan struct{})
 	go func() {
 		for {
-			data := <-rec.segmentChan
-			rec.HandleRfbSegment(data)
+			select {
+			case data := <-rec.segmentChan:
+				rec.HandleRfbSegment(data)
+			case <-rec.closing:
+				rec.finish()
+				return
+			}
 		}
 	}()
 
@@ -114,6 +126,8 @@ func (r *Recorder) Consume(data *common.RfbSegment) error {
 	//using async writes so if chan buffer overflows, proxy will not be affected
 	select {
 	case r.segmentChan <- data:
+	case <-r.closing:
+		//the recording is done, later segments are dropped
 		// default:
 		// 	logger.Error("error: recorder queue is full")
 	}
@@ -143,7 +157,7 @@ func (r *Recorder) HandleRfbSegment(data *common.RfbSegment) error {
 		case common.Bell:
 		case common.ServerCutText:
 		default:
-			logger.Warn("Recorder.HandleRfbSegment: unknown message type:" + string(data.UpcomingObjectType))
+			logger.Warn("Recorder.HandleRfbSegment: unknown message type:" + strconv.Itoa(data.UpcomingObjectType))
 		}
 	case common.SegmentConnectionClosed:
 		r.writeToDisk()
@@ -209,6 +223,24 @@ func (r *Recorder) writeToDisk() error {
 // 	return r.Write(buf)
 // }
 
+// Close ends the recording: segments already queued are written, the file is flushed & closed,
+// it waits for the file to be closed and is safe to call more than once
 func (r *Recorder) Close() {
-	r.writer.Close()
+	r.closeOnce.Do(func() { close(r.closing) })
+	<-r.closed
+}
+
+// finish runs on the writing goroutine, after Close was called
+func (r *Recorder) finish() {
+	for {
+		select {
+		case data := <-r.segmentChan:
+			r.HandleRfbSegment(data)
+		default:
+			r.writeToDisk()
+			r.writer.Close()
+			close(r.closed)
+			return
+		}
+	}
 }
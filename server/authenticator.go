@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// ViewerCredentials is what a viewer sent during the security handshake. vnc authentication only proves that
+// the viewer knows a password (a DES challenge response), VeNCrypt Plain sends the username & password themselves
+type ViewerCredentials struct {
+	Type       SecurityType
+	SubType    SecuritySubType
+	Username   string
+	RemoteAddr string // the viewer's address, see ServerConn.RemoteAddr
+
+	password    string
+	hasPassword bool
+	challenge   []byte
+	response    []byte
+	check       func(*ViewerCredentials) error // the security type's own check
+}
+
+// MatchesPassword reports if the viewer proved knowing password, always false for the "none" security types
+func (vc *ViewerCredentials) MatchesPassword(password string) bool {
+	if vc.hasPassword {
+		return subtle.ConstantTimeCompare([]byte(vc.password), []byte(password)) == 1
+	}
+	if vc.challenge == nil {
+		return false
+	}
+	bk, err := des.NewCipher([]byte(fixDesKey(password)))
+	if err != nil {
+		return false
+	}
+	expected := make([]byte, 16)
+	bk.Encrypt(expected, vc.challenge)
+	bk.Encrypt(expected[8:], vc.challenge[8:])
+	return subtle.ConstantTimeCompare(expected, vc.response) == 1
+}
+
+// Password returns the password if the viewer sent it in clear text (VeNCrypt Plain), for passing it on to another verifier
+func (vc *ViewerCredentials) Password() (string, bool) {
+	return vc.password, vc.hasPassword
+}
+
+// Check verifies the credentials with the security type's own settings (e.g. ServerAuthVNC.Pass) as if there was no
+// Authenticator, so an Authenticator can leave viewers it has no rules for to the configured security types
+func (vc *ViewerCredentials) Check() error {
+	if vc.check == nil {
+		return nil
+	}
+	return vc.check(vc)
+}
+
+// HasCredentials reports if the viewer sent a password (or answered a challenge)
+func (vc *ViewerCredentials) HasCredentials() bool {
+	return vc.hasPassword || vc.challenge != nil
+}
+
+// A ViewerAuthenticator decides which viewers may connect to which session, when ServerConfig.Authenticator is set
+// ServerSecurityHandler calls it with the credentials read by the chosen security type instead of letting the security
+// type check them (e.g. against ServerAuthVNC.Pass). a nil error accepts the viewer, the error text is sent to it otherwise
+type ViewerAuthenticator interface {
+	AuthenticateViewer(sessionId string, creds *ViewerCredentials) error
+}
+
+// ViewerAuthenticatorFunc allows using a function as a ViewerAuthenticator
+type ViewerAuthenticatorFunc func(sessionId string, creds *ViewerCredentials) error
+
+func (f ViewerAuthenticatorFunc) AuthenticateViewer(sessionId string, creds *ViewerCredentials) error {
+	return f(sessionId, creds)
+}
+
+// An OptionalAuthenticator is a ViewerAuthenticator for which some sessions are open to everyone,
+// the viewers of those sessions are offered the "none" security type only
+type OptionalAuthenticator interface {
+	ViewerAuthenticator
+	RequiresCredentials(sessionId string) bool
+}
+
+// A SessionSelector is a ViewerAuthenticator which also picks the session of viewers which didn't ask for one
+// (raw tcp viewers without a hint, see TcpSessionSelector) by their credentials, e.g. mapping passwords to sessions.
+// SelectSession must authenticate the viewer for the session it returns
+type SessionSelector interface {
+	ViewerAuthenticator
+	SelectSession(creds *ViewerCredentials) (sessionId string, err error)
+}
+
+// A CredentialsReader is a SecurityHandler which can hand the viewer's credentials to a ViewerAuthenticator
+// instead of checking them itself
+type CredentialsReader interface {
+	ReadCredentials(common.IServerConn) (*ViewerCredentials, error)
+}
+
+// securityHandlersFor returns the security types offered to a viewer of sessionId
+func securityHandlersFor(cfg *ServerConfig, sessionId string) []SecurityHandler {
+	if oa, ok := cfg.Authenticator.(OptionalAuthenticator); ok && !oa.RequiresCredentials(sessionId) {
+		return []SecurityHandler{&ServerAuthNone{}}
+	}
+	return cfg.SecurityHandlers
+}
+
+// authenticate runs the chosen security type, the credentials are checked by cfg.Authenticator when one is set
+func authenticate(cfg *ServerConfig, c *ServerConn, sType SecurityHandler) error {
+	reader, ok := sType.(CredentialsReader)
+	if cfg.Authenticator == nil || !ok {
+		return sType.Auth(c)
+	}
+	creds, err := reader.ReadCredentials(c)
+	if err != nil {
+		return err
+	}
+	creds.RemoteAddr = c.RemoteAddr()
+	if selector, ok := cfg.Authenticator.(SessionSelector); ok && c.SessionId == "" {
+		sessionId, err := selector.SelectSession(creds)
+		if err != nil {
+			return err
+		}
+		c.SessionId = sessionId
+		return nil
+	}
+	return cfg.Authenticator.AuthenticateViewer(c.SessionId, creds)
+}
+
+// readChallengeResponse runs the vnc authentication challenge, see 7.2.2
+func readChallengeResponse(c common.IServerConn) (*ViewerCredentials, error) {
+	creds := &ViewerCredentials{Type: SecTypeVNC, challenge: make([]byte, 16), response: make([]byte, 16)}
+	if _, err := rand.Read(creds.challenge); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(creds.challenge); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, creds.response); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
@@ -69,11 +69,12 @@ func ServerVersionHandler(cfg *ServerConfig, c *ServerConn) error {
 }
 
 func ServerSecurityHandler(cfg *ServerConfig, c *ServerConn) error {
-	if err := binary.Write(c, binary.BigEndian, uint8(len(cfg.SecurityHandlers))); err != nil {
+	secHandlers := securityHandlersFor(cfg, c.SessionId)
+	if err := binary.Write(c, binary.BigEndian, uint8(len(secHandlers))); err != nil {
 		return err
 	}
 
-	for _, sectype := range cfg.SecurityHandlers {
+	for _, sectype := range secHandlers {
 		if err := binary.Write(c, binary.BigEndian, sectype.Type()); err != nil {
 			return err
 		}
@@ -89,7 +90,7 @@ func ServerSecurityHandler(cfg *ServerConfig, c *ServerConn) error {
 	}
 
 	secTypes := make(map[SecurityType]SecurityHandler)
-	for _, sType := range cfg.SecurityHandlers {
+	for _, sType := range secHandlers {
 		secTypes[sType.Type()] = sType
 	}
 
@@ -99,7 +100,7 @@ func ServerSecurityHandler(cfg *ServerConfig, c *ServerConn) error {
 	}
 
 	var authCode uint32
-	authErr := sType.Auth(c)
+	authErr := authenticate(cfg, c, sType)
 	if authErr != nil {
 		authCode = uint32(1)
 	}
@@ -112,7 +113,7 @@ func ServerSecurityHandler(cfg *ServerConfig, c *ServerConn) error {
 	// }
 
 	if authErr != nil {
-		if err := binary.Write(c, binary.BigEndian, len(authErr.Error())); err != nil {
+		if err := binary.Write(c, binary.BigEndian, uint32(len(authErr.Error()))); err != nil {
 			return err
 		}
 		if err := binary.Write(c, binary.BigEndian, []byte(authErr.Error())); err != nil {
@@ -128,12 +129,17 @@ func ServerSecurityHandler(cfg *ServerConfig, c *ServerConn) error {
 }
 
 func ServerServerInitHandler(cfg *ServerConfig, c *ServerConn) error {
+	// a name set on the connection (e.g. the target's name in a shared session) overrides the configured one
+	desktopName := cfg.DesktopName
+	if c.DesktopName() != "" {
+		desktopName = []byte(c.DesktopName())
+	}
 	srvInit := &common.ServerInit{
 		FBWidth:     c.Width(),
 		FBHeight:    c.Height(),
 		PixelFormat: *c.CurrentPixelFormat(),
-		NameLength:  uint32(len(cfg.DesktopName)),
-		NameText:    []byte(cfg.DesktopName),
+		NameLength:  uint32(len(desktopName)),
+		NameText:    desktopName,
 	}
 	logger.Debugf("Server.ServerServerInitHandler initMessage: %v", srvInit)
 	if err := binary.Write(c, binary.BigEndian, srvInit.FBWidth); err != nil {
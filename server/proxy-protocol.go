@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amitbet/vncproxy/logger"
+)
+
+// DefaultProxyHeaderTimeout bounds the wait for a connection's PROXY protocol header
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolV1MaxLength = 107
+	pp2TypeAuthority         = 0x02
+)
+
+// ProxyProtocolListener accepts connections from a load balancer which sends the PROXY protocol (v1 or v2) header
+// (see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt) before the client's data.
+// the header is read on the first Read / Write / RemoteAddr call, so a slow client doesn't hold up Accept.
+// connections without a valid header are closed, the listener must only be reachable through the load balancer
+type ProxyProtocolListener struct {
+	net.Listener
+	HeaderTimeout time.Duration // how long to wait for the header, 0 = DefaultProxyHeaderTimeout
+}
+
+func NewProxyProtocolListener(ln net.Listener) *ProxyProtocolListener {
+	return &ProxyProtocolListener{Listener: ln}
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	return &ProxyProtocolConn{Conn: c, r: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+// ProxyProtocolConn is a connection accepted by a ProxyProtocolListener, its RemoteAddr & LocalAddr are the addresses
+// the load balancer received the connection on
+type ProxyProtocolConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once      sync.Once
+	err       error
+	src       net.Addr
+	dst       net.Addr
+	authority string
+}
+
+// readHeader parses the header once, a connection with a bad header is closed
+func (c *ProxyProtocolConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.err = c.parseHeader()
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			logger.Warnf("ProxyProtocolConn: bad PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *ProxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// Write waits for the header too, nothing is sent to connections which turn out not to come from the load balancer
+func (c *ProxyProtocolConn) Write(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// RemoteAddr returns the client's address from the header, or the load balancer's address
+// if the header carries none (e.g. the balancer's own health checks)
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to (on the load balancer) when the header carries it
+func (c *ProxyProtocolConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// BalancerAddr returns the address of the load balancer itself
+func (c *ProxyProtocolConn) BalancerAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// Authority returns the host name the client asked for (a v2 header's authority, usually the TLS server name),
+// empty if the header didn't carry one
+func (c *ProxyProtocolConn) Authority() string {
+	if c.readHeader() != nil {
+		return ""
+	}
+	return c.authority
+}
+
+func (c *ProxyProtocolConn) parseHeader() error {
+	start, err := c.r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return c.parseV2()
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return c.parseV1()
+	}
+	return errors.New("no PROXY protocol header")
+}
+
+// parseV1 reads the text header: "PROXY TCP4 <src ip> <dst ip> <src port> <dst port>\r\n" (or "PROXY UNKNOWN ...\r\n")
+func (c *ProxyProtocolConn) parseV1() error {
+	line := make([]byte, 0, proxyProtocolV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return errors.New("v1 header too long")
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("bad v1 header: %q", strings.TrimSpace(string(line)))
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.src, c.dst = src, dst
+	return nil
+}
+
+func parseV1Addr(host string, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("bad v1 address: %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad v1 port: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseV2 reads the binary header: the signature, version & command, address family, the length of the rest,
+// the addresses and a list of TLVs
+func (c *ProxyProtocolConn) parseV2() error {
+	var header struct {
+		Signature  [12]byte
+		VersionCmd uint8
+		Family     uint8
+		Length     uint16
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.VersionCmd>>4 != 2 {
+		return fmt.Errorf("unsupported v2 version: %d", header.VersionCmd>>4)
+	}
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch header.VersionCmd & 0xf {
+	case 0:
+		// LOCAL: the balancer's own connection, the addresses are ignored
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("unsupported v2 command: %d", header.VersionCmd&0xf)
+	}
+
+	var addrLen int
+	switch header.Family >> 4 {
+	case 1: // AF_INET
+		addrLen = 2*net.IPv4len + 4
+	case 2: // AF_INET6
+		addrLen = 2*net.IPv6len + 4
+	default:
+		// AF_UNSPEC & AF_UNIX carry no client address we could use
+		return nil
+	}
+	if len(payload) < addrLen {
+		return errors.New("v2 header too short for its addresses")
+	}
+	ipLen := (addrLen - 4) / 2
+	c.src = &net.TCPAddr{IP: net.IP(payload[:ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen:]))}
+	c.dst = &net.TCPAddr{IP: net.IP(payload[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))}
+
+	tlvs := payload[addrLen:]
+	for len(tlvs) >= 3 {
+		tlvType, tlvLen := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+tlvLen {
+			return errors.New("v2 header has a truncated TLV")
+		}
+		if tlvType == pp2TypeAuthority {
+			c.authority = string(tlvs[3 : 3+tlvLen])
+		}
+		tlvs = tlvs[3+tlvLen:]
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptProxied sends header & data through a ProxyProtocolListener, returning the accepted connection
+func acceptProxied(t *testing.T, header []byte, data string) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	pln := &ProxyProtocolListener{Listener: ln, HeaderTimeout: time.Second}
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	nc.Write(append(header, data...))
+
+	c, err := pln.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func proxyV2Header(family byte, addrs []byte, tlvs []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)+len(tlvs)))
+	return append(append(header, addrs...), tlvs...)
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	c := acceptProxied(t, []byte("PROXY TCP4 203.0.113.7 192.0.2.1 4242 5900\r\n"), "RFB 003.008\n")
+	if addr := c.RemoteAddr().String(); addr != "203.0.113.7:4242" {
+		t.Errorf("unexpected remote address: %s", addr)
+	}
+	if addr := c.LocalAddr().String(); addr != "192.0.2.1:5900" {
+		t.Errorf("unexpected local address: %s", addr)
+	}
+	data := make([]byte, 12)
+	if _, err := io.ReadFull(c, data); err != nil || string(data) != "RFB 003.008\n" {
+		t.Errorf("unexpected data after the header: %q (%v)", data, err)
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	addrs := []byte{198, 51, 100, 9, 192, 0, 2, 1, 0x10, 0x92, 0x17, 0x0c}
+	authority := []byte{pp2TypeAuthority, 0, 6}
+	authority = append(authority, "s1.vnc"...)
+	c := acceptProxied(t, proxyV2Header(0x11, addrs, authority), "data")
+	if addr := c.RemoteAddr().String(); addr != "198.51.100.9:4242" {
+		t.Errorf("unexpected remote address: %s", addr)
+	}
+	if authority := c.(*ProxyProtocolConn).Authority(); authority != "s1.vnc" {
+		t.Errorf("unexpected authority: %q", authority)
+	}
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(c, data); err != nil || string(data) != "data" {
+		t.Errorf("unexpected data after the header: %q (%v)", data, err)
+	}
+
+	// the balancer's health checks use LOCAL, their address is the balancer's own
+	local := proxyV2Header(0x00, nil, nil)
+	local[12] = 0x20
+	c = acceptProxied(t, local, "")
+	if addr := c.RemoteAddr().String(); addr != c.(*ProxyProtocolConn).BalancerAddr().String() {
+		t.Errorf("unexpected remote address for a LOCAL header: %s", addr)
+	}
+}
+
+func TestProxyProtocolWithoutHeader(t *testing.T) {
+	c := acceptProxied(t, nil, "GET / HTTP/1.1\r\n\r\n")
+	if _, err := c.Write([]byte(ProtoVersion38)); err == nil {
+		t.Errorf("data was sent to a connection without a PROXY protocol header")
+	}
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("a connection without a PROXY protocol header was read")
+	}
+	if c.RemoteAddr().String() != c.(*ProxyProtocolConn).BalancerAddr().String() {
+		t.Errorf("unexpected remote address: %s", c.RemoteAddr())
+	}
+}
@@ -0,0 +1,16 @@
+package server
+
+import (
+	"io"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// ReadRepeaterViewerID runs the repeater side of the UltraVNC repeater handshake with a viewer,
+// returning the ID of the server it asks for
+func ReadRepeaterViewerID(c io.ReadWriter) (string, error) {
+	if _, err := io.WriteString(c, common.RepeaterGreeting); err != nil {
+		return "", err
+	}
+	return common.ReadRepeaterID(c)
+}
@@ -1,9 +1,6 @@
 package server
 
 import (
-	"bytes"
-	"crypto/des"
-	"crypto/rand"
 	"errors"
 	"log"
 	"github.com/amitbet/vncproxy/common"
@@ -77,6 +74,10 @@ func (*ServerAuthNone) Auth(c common.IServerConn) error {
 	return nil
 }
 
+func (*ServerAuthNone) ReadCredentials(c common.IServerConn) (*ViewerCredentials, error) {
+	return &ViewerCredentials{Type: SecTypeNone}, nil
+}
+
 func (*ServerAuthNone) SubType() SecuritySubType {
 	return SecSubTypeUnknown
 }
@@ -184,6 +185,7 @@ func (*ServerAuthNone) SubType() SecuritySubType {
 // }
 
 // ServerAuthVNC is the standard password authentication. See 7.2.2.
+// Pass is not used when the ServerConfig has an Authenticator.
 type ServerAuthVNC struct {
 	Pass string
 }
@@ -199,42 +201,30 @@ func (*ServerAuthVNC) SubType() SecuritySubType {
 const AUTH_FAIL = "Authentication Failure"
 
 func (auth *ServerAuthVNC) Auth(c common.IServerConn) error {
-	buf := make([]byte, 8+len([]byte(AUTH_FAIL)))
-	rand.Read(buf[:16]) // Random 16 bytes in buf
-	sndsz, err := c.Write(buf[:16])
+	creds, err := auth.ReadCredentials(c)
 	if err != nil {
-		log.Printf("Error sending challenge to client: %s\n", err.Error())
-		return errors.New("Error sending challenge to client:" + err.Error())
-	}
-	if sndsz != 16 {
-		log.Printf("The full 16 byte challenge was not sent!\n")
-		return errors.New("The full 16 byte challenge was not sent")
+		return err
 	}
-	//c.Flush()
-	buf2 := make([]byte, 16)
-	_, err = c.Read(buf2)
-	if err != nil {
-		log.Printf("The authentication result was not read: %s\n", err.Error())
-		return errors.New("The authentication result was not read" + err.Error())
+	// the failure result & reason are sent by ServerSecurityHandler
+	return creds.Check()
+}
+
+func (auth *ServerAuthVNC) check(creds *ViewerCredentials) error {
+	if !creds.MatchesPassword(auth.Pass) {
+		return errors.New(AUTH_FAIL)
 	}
-	AuthText := auth.Pass
-	bk, err := des.NewCipher([]byte(fixDesKey(AuthText)))
+	return nil
+}
+
+// ReadCredentials sends the challenge & reads the viewer's response, it is checked by ViewerCredentials.MatchesPassword
+func (auth *ServerAuthVNC) ReadCredentials(c common.IServerConn) (*ViewerCredentials, error) {
+	creds, err := readChallengeResponse(c)
 	if err != nil {
-		log.Printf("Error generating authentication cipher: %s\n", err.Error())
-		return errors.New("Error generating authentication cipher")
+		log.Printf("Error running the authentication challenge: %s\n", err.Error())
+		return nil, errors.New("Error running the authentication challenge: " + err.Error())
 	}
-	buf3 := make([]byte, 16)
-	bk.Encrypt(buf3, buf)               //Encrypt first 8 bytes
-	bk.Encrypt(buf3[8:], buf[8:])       // Encrypt second 8 bytes
-	if bytes.Compare(buf2, buf3) != 0 { // If the result does not decrypt correctly to what we sent then a problem
-		SetUint32(buf, 0, 1)
-		SetUint32(buf, 4, uint32(len([]byte(AUTH_FAIL))))
-		copy(buf[8:], []byte(AUTH_FAIL))
-		c.Write(buf)
-		//c.Flush()
-		return errors.New("Authentication failed")
-	}
-	return nil
+	creds.check = auth.check
+	return creds, nil
 }
 
 // SetUint32 set 4 bytes at pos in buf to the val (in big endian format)
@@ -4,9 +4,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 	"github.com/amitbet/vncproxy/common"
 	"github.com/amitbet/vncproxy/logger"
+
+	"golang.org/x/net/websocket"
 )
 
 type ServerConn struct {
@@ -42,6 +45,8 @@ type ServerConn struct {
 	Listeners *common.MultiListener
 
 	SessionId string
+	// whatever ServerConfig.ResolveSession returned with the session id (e.g. a token's claims), nil without a resolver
+	SessionClaims interface{}
 
 	quit chan struct{}
 }
@@ -77,6 +82,18 @@ func (c *ServerConn) Conn() io.ReadWriter {
 	return c.c
 }
 
+// RemoteAddr returns the address of the connected vnc-client, or an empty string if it is unknown.
+// behind a load balancer this is the client's address from the PROXY protocol header, see ProxyProtocolListener
+func (c *ServerConn) RemoteAddr() string {
+	switch conn := c.c.(type) {
+	case *websocket.Conn:
+		return conn.Request().RemoteAddr
+	case net.Conn:
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
+
 func (c *ServerConn) SetEncodings(encs []common.EncodingType) error {
 	encodings := make(map[int32]common.IEncoding)
 	for _, enc := range c.cfg.Encodings {
@@ -147,13 +164,16 @@ func (c *ServerConn) SetHeight(h uint16) {
 	c.fbHeight = h
 }
 
+// notifyClosed lets the listeners know this connection is gone (so they can release whatever is attached to it)
+func (c *ServerConn) notifyClosed() {
+	c.Listeners.Consume(&common.RfbSegment{
+		SegmentType: common.SegmentConnectionClosed,
+	})
+}
+
 func (c *ServerConn) handle() error {
 
-	defer func() {
-		c.Listeners.Consume(&common.RfbSegment{
-			SegmentType: common.SegmentConnectionClosed,
-		})
-	}()
+	defer c.notifyClosed()
 
 	//create a map of all message types
 	clientMessages := make(map[common.ClientMessageType]common.ClientMessage)
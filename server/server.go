@@ -1,11 +1,13 @@
 package server
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"github.com/amitbet/vncproxy/common"
+	"github.com/amitbet/vncproxy/logger"
 )
 
 var DefaultClientMessages = []common.ClientMessage{
@@ -27,6 +29,14 @@ type FramebufferUpdate struct {
 
 type ServerHandler func(*ServerConfig, *ServerConn) error
 
+// DefaultSessionId is the session of raw tcp viewers, unless ServerConfig.SelectTcpSession picks another one
+const DefaultSessionId = "dummySession"
+
+// A TcpSessionSelector picks the session of a raw tcp viewer from its connection (e.g. the TLS server name it asked for),
+// before the RFB handshake. an empty id leaves the choice to the viewer's credentials (see SessionSelector),
+// an error rejects the viewer
+type TcpSessionSelector func(c net.Conn) (sessionId string, err error)
+
 type ServerConfig struct {
 	SecurityHandlers []SecurityHandler
 	Encodings        []common.IEncoding
@@ -37,6 +47,12 @@ type ServerConfig struct {
 	Height           uint16
 	Width            uint16
 	UseDummySession  bool
+	// checks the viewers' credentials (with the session id they connect to) instead of the security handlers, see ViewerAuthenticator
+	Authenticator ViewerAuthenticator
+	// maps the session websocket viewers ask for to a session id (e.g. validating a signed token), see SessionResolver
+	ResolveSession SessionResolver
+	// picks the session of raw tcp viewers, nil = they all use DefaultSessionId
+	SelectTcpSession TcpSessionSelector
 
 	//handler to allow for registering for messages, this can't be a channel
 	//because of the websockets handler function which will kill the connection on exit if conn.handle() is run on another thread
@@ -46,29 +62,175 @@ type ServerConfig struct {
 func wsHandlerFunc(ws io.ReadWriter, cfg *ServerConfig, sessionId string) {
 	err := attachNewServerConn(ws, cfg, sessionId)
 	if err != nil {
-		log.Fatalf("Error attaching new connection. %v", err)
+		logger.Errorf("Error attaching new connection. %v", err)
 	}
 }
 
+// ErrServerClosed is returned by the Serve & Listen methods after the server was shut down
+var ErrServerClosed = errors.New("server closed")
+
 func WsServe(url string, cfg *ServerConfig) error {
-	server := WsServer{cfg}
-	server.Listen(url, WsHandler(wsHandlerFunc))
-	return nil
+	return NewWsServer(cfg).Listen(url, WsHandler(wsHandlerFunc))
 }
 
 func TcpServe(url string, cfg *ServerConfig) error {
 	ln, err := net.Listen("tcp", url)
 	if err != nil {
-		log.Fatalf("Error listen. %v", err)
+		return err
+	}
+	return NewTcpServer(cfg).Serve(ln)
+}
+
+// TcpServer accepts vnc-clients on raw RFB listeners, unlike TcpServe it can be shut down
+type TcpServer struct {
+	cfg       *ServerConfig
+	conns     connSet
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+func NewTcpServer(cfg *ServerConfig) *TcpServer {
+	return &TcpServer{cfg: cfg, listeners: make(map[net.Listener]struct{})}
+}
+
+// Serve accepts connections on ln until the server is shut down (ErrServerClosed is returned) or ln fails
+func (s *TcpServer) Serve(ln net.Listener) error {
+	return s.ServeSession(ln, "")
+}
+
+// ServeSession is Serve for a listener dedicated to a single session, its viewers connect to sessionId
+// (an empty sessionId selects the session of each viewer, see ServerConfig.SelectTcpSession)
+func (s *TcpServer) ServeSession(ln net.Listener, sessionId string) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		ln.Close()
+		return ErrServerClosed
 	}
+	s.listeners[ln] = struct{}{}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, ln)
+		s.mutex.Unlock()
+	}()
+
 	for {
 		c, err := ln.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		go attachNewServerConn(c, cfg, "dummySession")
+		go s.ServeConn(c, sessionId)
+	}
+}
+
+// ServeConn handles a single viewer connection which was accepted elsewhere (e.g. after a repeater handshake),
+// it returns once the viewer is gone. the connection is closed by Shutdown like the ones accepted by Serve
+func (s *TcpServer) ServeConn(c net.Conn, sessionId string) error {
+	if !s.conns.add(c) {
+		c.Close()
+		return ErrServerClosed
+	}
+	defer s.conns.done(c)
+	if sessionId == "" {
+		var err error
+		if sessionId, err = s.selectSession(c); err != nil {
+			logger.Warnf("TcpServer: rejected viewer from %s: %v", c.RemoteAddr(), err)
+			return err
+		}
+	}
+	return attachNewServerConn(c, s.cfg, sessionId)
+}
+
+func (s *TcpServer) selectSession(c net.Conn) (string, error) {
+	if s.cfg.SelectTcpSession == nil {
+		return DefaultSessionId, nil
+	}
+	return s.cfg.SelectTcpSession(c)
+}
+
+func (s *TcpServer) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// Shutdown stops accepting, closes all open connections & waits for their handlers to return (or for ctx to be done)
+func (s *TcpServer) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mutex.Unlock()
+
+	s.conns.closeAll()
+	return s.conns.wait(ctx)
+}
+
+// connSet keeps track of the connections a server is handling, so they can be closed when it shuts down
+type connSet struct {
+	mutex  sync.Mutex
+	conns  map[io.Closer]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// add registers a connection, it returns false if the server is already shutting down
+func (s *connSet) add(c io.Closer) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[io.Closer]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// done is called once the connection's handler returned
+func (s *connSet) done(c io.Closer) {
+	s.mutex.Lock()
+	delete(s.conns, c)
+	s.mutex.Unlock()
+	c.Close()
+	s.wg.Done()
+}
+
+func (s *connSet) closeAll() {
+	s.mutex.Lock()
+	s.closed = true
+	conns := make([]io.Closer, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mutex.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (s *connSet) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nil
 }
 
 func attachNewServerConn(c io.ReadWriter, cfg *ServerConfig, sessionId string) error {
@@ -78,8 +240,15 @@ func attachNewServerConn(c io.ReadWriter, cfg *ServerConfig, sessionId string) e
 		return err
 	}
 
+	//the session id must be known before the conn handler is called, since it is used to select the session
+	conn.SessionId = sessionId
+	if cfg.UseDummySession {
+		conn.SessionId = DefaultSessionId
+	}
+	conn.SessionClaims = wsSessionClaims(c)
+
 	if err := ServerVersionHandler(cfg, conn); err != nil {
-		fmt.Errorf("err: %v\n", err)
+		logger.Errorf("attachNewServerConn: error in the version handshake: %v", err)
 		conn.Close()
 		return err
 	}
@@ -99,19 +268,16 @@ func attachNewServerConn(c io.ReadWriter, cfg *ServerConfig, sessionId string) e
 
 	if err := ServerClientInitHandler(cfg, conn); err != nil {
 		conn.Close()
+		conn.notifyClosed()
 		return err
 	}
 
 	if err := ServerServerInitHandler(cfg, conn); err != nil {
 		conn.Close()
+		conn.notifyClosed()
 		return err
 	}
 
-	conn.SessionId = sessionId
-	if cfg.UseDummySession {
-		conn.SessionId = "dummySession"
-	}
-
 	//go here will kill ws connections
 	conn.handle()
 
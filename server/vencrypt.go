@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/amitbet/vncproxy/common"
+)
+
+// maxPlainCredentialLength limits the username & password lengths a viewer can announce (VeNCrypt Plain)
+const maxPlainCredentialLength = 1024
+
+// CredentialsVerifier checks the username & password sent by a viewer using one of the VeNCrypt Plain sub types,
+// a nil error accepts the viewer, the error text is sent to the viewer otherwise
+type CredentialsVerifier func(username string, password string) error
+
+// StaticCredentials returns a CredentialsVerifier accepting a single username & password
+func StaticCredentials(username string, password string) CredentialsVerifier {
+	return func(u string, p string) error {
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !userOk || !passOk {
+			return errors.New("invalid username or password")
+		}
+		return nil
+	}
+}
+
+// ServerAuthVeNCrypt is the VeNCrypt security type (version 0.2), see https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#vencrypt
+// the TLS* & X509* sub types move the connection to TLS before authenticating, everything after that
+// (including the rest of the session) is encrypted.
+// Go has no anonymous TLS cipher suites, so the TLS* sub types are served with TLSConfig's certificate as well,
+// they differ from the X509* sub types only in the client not verifying it.
+// Password & Verify are not used when the ServerConfig has an Authenticator.
+type ServerAuthVeNCrypt struct {
+	SubTypes  []SecuritySubType // the SecSubTypeVeNCrypt02* sub types offered to the viewer, in order of preference
+	TLSConfig *tls.Config       // required by the TLS* & X509* sub types
+	Password  string            // checked by the *VNC sub types (standard vnc authentication inside TLS)
+	Verify    CredentialsVerifier
+}
+
+func (*ServerAuthVeNCrypt) Type() SecurityType {
+	return SecTypeVeNCrypt
+}
+
+// SubType returns the preferred sub type
+func (auth *ServerAuthVeNCrypt) SubType() SecuritySubType {
+	if len(auth.SubTypes) == 0 {
+		return SecSubTypeVeNCrypt02Unknown
+	}
+	return auth.SubTypes[0]
+}
+
+func (auth *ServerAuthVeNCrypt) Auth(c common.IServerConn) error {
+	creds, err := auth.ReadCredentials(c)
+	if err != nil {
+		return err
+	}
+	return creds.Check()
+}
+
+func (auth *ServerAuthVeNCrypt) check(creds *ViewerCredentials) error {
+	switch creds.SubType {
+	case SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02X509VNC:
+		if !creds.MatchesPassword(auth.Password) {
+			return errors.New(AUTH_FAIL)
+		}
+	case SecSubTypeVeNCrypt02Plain, SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509Plain:
+		if auth.Verify == nil {
+			return errors.New("VeNCrypt: no credentials verifier configured")
+		}
+		return auth.Verify(creds.Username, creds.password)
+	}
+	return nil
+}
+
+// ReadCredentials negotiates the sub type (moving the connection to TLS if needed) & reads the viewer's credentials
+func (auth *ServerAuthVeNCrypt) ReadCredentials(c common.IServerConn) (*ViewerCredentials, error) {
+	if len(auth.SubTypes) == 0 {
+		return nil, errors.New("VeNCrypt: no sub types configured")
+	}
+
+	// version: the server sends 0.2, the client answers with the version it wants to use
+	if err := binary.Write(c, binary.BigEndian, []uint8{0, 2}); err != nil {
+		return nil, err
+	}
+	var version [2]uint8
+	if err := binary.Read(c, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != [2]uint8{0, 2} {
+		binary.Write(c, binary.BigEndian, uint8(1))
+		return nil, fmt.Errorf("VeNCrypt: unsupported version %d.%d", version[0], version[1])
+	}
+	if err := binary.Write(c, binary.BigEndian, uint8(0)); err != nil {
+		return nil, err
+	}
+
+	// sub type negotiation
+	if err := binary.Write(c, binary.BigEndian, uint8(len(auth.SubTypes))); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(c, binary.BigEndian, auth.SubTypes); err != nil {
+		return nil, err
+	}
+	var subType SecuritySubType
+	if err := binary.Read(c, binary.BigEndian, &subType); err != nil {
+		return nil, err
+	}
+	offered := false
+	for _, st := range auth.SubTypes {
+		offered = offered || st == subType
+	}
+
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSNone, SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02TLSPlain,
+		SecSubTypeVeNCrypt02X509None, SecSubTypeVeNCrypt02X509VNC, SecSubTypeVeNCrypt02X509Plain:
+		if !offered || auth.TLSConfig == nil {
+			binary.Write(c, binary.BigEndian, uint8(0))
+			return nil, fmt.Errorf("VeNCrypt: sub type %d not available", subType)
+		}
+		// the viewer waits for an ack before starting the TLS handshake
+		if err := binary.Write(c, binary.BigEndian, uint8(1)); err != nil {
+			return nil, err
+		}
+		if err := auth.startTLS(c); err != nil {
+			return nil, err
+		}
+	case SecSubTypeVeNCrypt02Plain:
+		if !offered {
+			return nil, fmt.Errorf("VeNCrypt: sub type %d not available", subType)
+		}
+	default:
+		return nil, fmt.Errorf("VeNCrypt: unsupported sub type %d", subType)
+	}
+
+	creds := &ViewerCredentials{Type: SecTypeVeNCrypt}
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02X509VNC:
+		var err error
+		if creds, err = readChallengeResponse(c); err != nil {
+			return nil, err
+		}
+		creds.Type = SecTypeVeNCrypt
+	case SecSubTypeVeNCrypt02Plain, SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509Plain:
+		if err := readPlain(c, creds); err != nil {
+			return nil, err
+		}
+	}
+	creds.SubType = subType
+	creds.check = auth.check
+	return creds, nil
+}
+
+// startTLS runs the TLS handshake on the viewer's connection & replaces it with the encrypted one
+func (auth *ServerAuthVeNCrypt) startTLS(c common.IServerConn) error {
+	sconn, ok := c.(*ServerConn)
+	if !ok {
+		return errors.New("VeNCrypt: TLS sub types need a *ServerConn")
+	}
+	nc, ok := sconn.c.(net.Conn)
+	if !ok {
+		return errors.New("VeNCrypt: the viewer connection doesn't support TLS")
+	}
+	tlsConn := tls.Server(nc, auth.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("VeNCrypt: TLS handshake failed: %v", err)
+	}
+	sconn.c = tlsConn
+	return nil
+}
+
+// readPlain reads the viewer's username & password
+func readPlain(c common.IServerConn, creds *ViewerCredentials) error {
+	var lengths [2]uint32
+	if err := binary.Read(c, binary.BigEndian, &lengths); err != nil {
+		return err
+	}
+	if lengths[0] > maxPlainCredentialLength || lengths[1] > maxPlainCredentialLength {
+		return errors.New("VeNCrypt: username or password too long")
+	}
+	username := make([]byte, lengths[0])
+	password := make([]byte, lengths[1])
+	if err := binary.Read(c, binary.BigEndian, username); err != nil {
+		return err
+	}
+	if err := binary.Read(c, binary.BigEndian, password); err != nil {
+		return err
+	}
+	creds.Username = string(username)
+	creds.password = string(password)
+	creds.hasPassword = true
+	return nil
+}
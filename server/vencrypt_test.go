@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vncproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// tcpPair returns both ends of a loopback tcp connection, unlike net.Pipe it buffers writes
+// which TLS needs (both sides can write at the same time during the handshake)
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	return c2, c1
+}
+
+// runSecurityHandshake runs the server side of the security handshake on one end of a connection, the other end is returned
+func runSecurityHandshake(t *testing.T, handler SecurityHandler) (net.Conn, chan error) {
+	c1, c2 := tcpPair(t)
+	cfg := &ServerConfig{SecurityHandlers: []SecurityHandler{handler}, ClientMessages: DefaultClientMessages}
+	sconn, err := NewServerConn(c1, cfg)
+	if err != nil {
+		t.Fatalf("error creating server conn: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() { result <- ServerSecurityHandler(cfg, sconn) }()
+	return c2, result
+}
+
+// negotiateVeNCrypt plays the viewer's part up to choosing a sub type, it returns the offered sub types
+func negotiateVeNCrypt(t *testing.T, c net.Conn, subType SecuritySubType) []SecuritySubType {
+	var secTypes [2]uint8
+	io.ReadFull(c, secTypes[:])
+	if secTypes != [2]uint8{1, uint8(SecTypeVeNCrypt)} {
+		t.Fatalf("unexpected security types: %v", secTypes)
+	}
+	c.Write([]byte{uint8(SecTypeVeNCrypt)})
+
+	var version [2]uint8
+	io.ReadFull(c, version[:])
+	c.Write([]byte{0, 2})
+	var status, count uint8
+	binary.Read(c, binary.BigEndian, &status)
+	binary.Read(c, binary.BigEndian, &count)
+	if version != [2]uint8{0, 2} || status != 0 {
+		t.Fatalf("unexpected version negotiation: %v %d", version, status)
+	}
+	offered := make([]SecuritySubType, count)
+	binary.Read(c, binary.BigEndian, offered)
+	binary.Write(c, binary.BigEndian, subType)
+	return offered
+}
+
+func writePlain(c net.Conn, username string, password string) {
+	binary.Write(c, binary.BigEndian, []uint32{uint32(len(username)), uint32(len(password))})
+	c.Write([]byte(username + password))
+}
+
+func TestVeNCryptPlain(t *testing.T) {
+	for _, tc := range []struct {
+		password string
+		result   uint32
+	}{
+		{"secret", 0},
+		{"wrong", 1},
+	} {
+		handler := &ServerAuthVeNCrypt{
+			SubTypes: []SecuritySubType{SecSubTypeVeNCrypt02Plain},
+			Verify:   StaticCredentials("user", "secret"),
+		}
+		c, errs := runSecurityHandshake(t, handler)
+		if offered := negotiateVeNCrypt(t, c, SecSubTypeVeNCrypt02Plain); len(offered) != 1 || offered[0] != SecSubTypeVeNCrypt02Plain {
+			t.Fatalf("unexpected sub types: %v", offered)
+		}
+		writePlain(c, "user", tc.password)
+
+		var result uint32
+		binary.Read(c, binary.BigEndian, &result)
+		if result != tc.result {
+			t.Errorf("password %q: unexpected security result %d", tc.password, result)
+		}
+		if result != 0 {
+			var reasonLen uint32
+			binary.Read(c, binary.BigEndian, &reasonLen)
+			io.ReadFull(c, make([]byte, reasonLen))
+		}
+		if err := <-errs; (err == nil) != (tc.result == 0) {
+			t.Errorf("password %q: unexpected handshake error: %v", tc.password, err)
+		}
+	}
+}
+
+func TestVeNCryptX509Plain(t *testing.T) {
+	handler := &ServerAuthVeNCrypt{
+		SubTypes:  []SecuritySubType{SecSubTypeVeNCrypt02X509Plain, SecSubTypeVeNCrypt02TLSNone},
+		TLSConfig: testTLSConfig(t),
+		Verify:    StaticCredentials("user", "secret"),
+	}
+	c, errs := runSecurityHandshake(t, handler)
+	negotiateVeNCrypt(t, c, SecSubTypeVeNCrypt02X509Plain)
+
+	var ack uint8
+	binary.Read(c, binary.BigEndian, &ack)
+	if ack != 1 {
+		t.Fatalf("sub type was not accepted: %d", ack)
+	}
+	tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("tls handshake failed: %v", err)
+	}
+	writePlain(tlsConn, "user", "secret")
+
+	// the security result already comes over TLS
+	var result uint32
+	binary.Read(tlsConn, binary.BigEndian, &result)
+	if result != 0 {
+		t.Fatalf("unexpected security result %d", result)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected handshake error: %v", err)
+	}
+}
+
+func TestVeNCryptRejectsUnofferedSubType(t *testing.T) {
+	handler := &ServerAuthVeNCrypt{
+		SubTypes:  []SecuritySubType{SecSubTypeVeNCrypt02X509VNC},
+		TLSConfig: testTLSConfig(t),
+	}
+	c, errs := runSecurityHandshake(t, handler)
+	negotiateVeNCrypt(t, c, SecSubTypeVeNCrypt02TLSNone)
+
+	var ack uint8
+	binary.Read(c, binary.BigEndian, &ack)
+	if ack != 0 {
+		t.Fatalf("sub type which wasn't offered was accepted")
+	}
+	go io.Copy(io.Discard, c)
+	if err := <-errs; err == nil {
+		t.Fatalf("handshake succeeded with a sub type which wasn't offered")
+	}
+}
@@ -1,45 +1,170 @@
 package server
 
 import (
+	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
+
 	"github.com/amitbet/vncproxy/logger"
 
 	"golang.org/x/net/websocket"
 )
 
 type WsServer struct {
-	cfg *ServerConfig
+	cfg   *ServerConfig
+	conns connSet
+
+	mutex       sync.Mutex
+	httpServers []*http.Server
+	closed      bool
 }
 
 type WsHandler func(io.ReadWriter, *ServerConfig, string)
 
+// SessionResolver maps the session a websocket viewer asked for (its "token" query parameter, or the url path after
+// the server's path) to the id of the session it connects to, the claims are kept in ServerConn.SessionClaims.
+// an error rejects the viewer before the websocket & RFB handshakes
+type SessionResolver func(requested string) (sessionId string, claims interface{}, err error)
 
-func (wsServer *WsServer) Listen(urlStr string, handlerFunc WsHandler) {
+// resolvedSession is passed from the http request to the websocket connection in the request's context
+type resolvedSession struct {
+	id     string
+	claims interface{}
+}
 
-	if urlStr == "" {
-		urlStr = "/"
+type resolvedSessionKey struct{}
+
+// wsSessionClaims returns the claims resolved for a websocket connection, nil for other connections
+func wsSessionClaims(c io.ReadWriter) interface{} {
+	ws, ok := c.(*websocket.Conn)
+	if !ok {
+		return nil
 	}
-	url, err := url.Parse(urlStr)
-	if err != nil {
-		logger.Errorf("error while parsing url: ", err)
+	if resolved, ok := ws.Request().Context().Value(resolvedSessionKey{}).(*resolvedSession); ok {
+		return resolved.claims
 	}
+	return nil
+}
 
-	http.Handle(url.Path, websocket.Handler(
+func NewWsServer(cfg *ServerConfig) *WsServer {
+	return &WsServer{cfg: cfg}
+}
+
+// handler accepts websocket vnc-clients, the session id is the part of the url path following urlPath
+// (or what the config's ResolveSession makes of it)
+func (wsServer *WsServer) handler(urlPath string, handlerFunc WsHandler) http.Handler {
+	wsHandler := websocket.Handler(
 		func(ws *websocket.Conn) {
-			path := ws.Request().URL.Path
-			var sessionId string
-			if path != "" {
-				sessionId = path[1:]
+			if !wsServer.conns.add(ws) {
+				ws.Close()
+				return
 			}
+			defer wsServer.conns.done(ws)
 
+			resolved := ws.Request().Context().Value(resolvedSessionKey{}).(*resolvedSession)
 			ws.PayloadType = websocket.BinaryFrame
-			handlerFunc(ws, wsServer.cfg, sessionId)
-		}))
+			handlerFunc(ws, wsServer.cfg, resolved.id)
+		})
 
-	err = http.ListenAndServe(url.Host, nil)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolved, err := wsServer.resolveSession(r, urlPath)
+		if err != nil {
+			logger.Warnf("WsServer: rejected viewer from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		wsHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), resolvedSessionKey{}, resolved)))
+	})
+}
+
+func (wsServer *WsServer) resolveSession(r *http.Request, urlPath string) (*resolvedSession, error) {
+	var requested string
+	if len(r.URL.Path) > len(urlPath) {
+		requested = r.URL.Path[len(urlPath):]
+	}
+	if wsServer.cfg.ResolveSession == nil {
+		return &resolvedSession{id: requested}, nil
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		requested = token
+	}
+	id, claims, err := wsServer.cfg.ResolveSession(requested)
 	if err != nil {
-		panic("ListenAndServe: " + err.Error())
+		return nil, err
+	}
+	return &resolvedSession{id: id, claims: claims}, nil
+}
+
+// Handler returns an http.Handler which accepts websocket vnc-clients, so they can be served from the caller's own mux.
+// it must be mounted at prefix (without stripping it), clients connect to prefix followed by the session id.
+// connections accepted through it are closed by Shutdown.
+func (wsServer *WsServer) Handler(prefix string) http.Handler {
+	return wsServer.handler(prefix, wsHandlerFunc)
+}
+
+// Listen serves websocket vnc-clients on the host & path of urlStr until the server is shut down
+func (wsServer *WsServer) Listen(urlStr string, handlerFunc WsHandler) error {
+	url, err := url.Parse(urlStr)
+	if err != nil {
+		logger.Errorf("error while parsing url: %v", err)
+		return err
+	}
+	ln, err := net.Listen("tcp", url.Host)
+	if err != nil {
+		return err
+	}
+	return wsServer.serve(ln, url.Path, handlerFunc)
+}
+
+// Serve accepts websocket vnc-clients on ln, which connect to urlPath followed by the session id
+func (wsServer *WsServer) Serve(ln net.Listener, urlPath string) error {
+	return wsServer.serve(ln, urlPath, wsHandlerFunc)
+}
+
+func (wsServer *WsServer) serve(ln net.Listener, urlPath string, handlerFunc WsHandler) error {
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(urlPath, wsServer.handler(urlPath, handlerFunc))
+	httpServer := &http.Server{Handler: mux}
+
+	wsServer.mutex.Lock()
+	if wsServer.closed {
+		wsServer.mutex.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	wsServer.httpServers = append(wsServer.httpServers, httpServer)
+	wsServer.mutex.Unlock()
+
+	err := httpServer.Serve(ln)
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting, closes all open connections & waits for their handlers to return (or for ctx to be done)
+func (wsServer *WsServer) Shutdown(ctx context.Context) error {
+	wsServer.mutex.Lock()
+	wsServer.closed = true
+	httpServers := wsServer.httpServers
+	wsServer.mutex.Unlock()
+
+	//websocket connections are hijacked, so the http servers only close their listeners & idle connections
+	var firstErr error
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	wsServer.conns.closeAll()
+	if err := wsServer.conns.wait(ctx); err != nil && firstErr == nil {
+		firstErr = err
 	}
+	return firstErr
 }